@@ -0,0 +1,53 @@
+package dockerdiscovery
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const acmeChallengePrefix = "_acme-challenge."
+
+// acmeChallengeTTL is short so that the validation servers never see an outdated token
+const acmeChallengeTTL = 10
+
+// SetACMEChallenge publishes the DNS-01 challenge values of the domain (without the _acme-challenge label),
+// e.g. for a certificate automation running outside of the containers. No values remove the challenge.
+func (dd *DockerDiscovery) SetACMEChallenge(domain string, values []string) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if len(values) == 0 {
+		delete(dd.acmeChallenges, domain)
+		return
+	}
+	dd.acmeChallenges[domain] = values
+}
+
+// acmeChallengeRecords answers TXT queries for _acme-challenge.<domain> with the values published for the
+// domain and the values of the coredns.dockerdiscovery.acme_challenge label of the container owning it.
+func (dd *DockerDiscovery) acmeChallengeRecords(qname string, qtype uint16) []dns.RR {
+	if qtype != dns.TypeTXT {
+		return nil
+	}
+
+	target := qname[len(acmeChallengePrefix):]
+	values := append([]string{}, dd.acmeChallenges[strings.ToLower(strings.TrimSuffix(target, "."))]...)
+	if containerInfo, _ := dd.containerInfoByDomain(target); containerInfo != nil {
+		for _, value := range strings.Split(containerInfo.container.Config.Labels["coredns.dockerdiscovery.acme_challenge"], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+
+	var answers []dns.RR
+	for _, value := range values {
+		answers = append(answers, &dns.TXT{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: acmeChallengeTTL},
+			Txt: []string{value},
+		})
+	}
+	return answers
+}
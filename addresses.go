@@ -0,0 +1,99 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// preferredAddress returns the address of the container in the first network of the preference list it has an
+// address of the family in, nil if none.
+func preferredAddress(container *dockerapi.Container, networks []string, ipv6 bool) net.IP {
+	for _, name := range networks {
+		network, ok := container.NetworkSettings.Networks[name]
+		address := network.IPAddress
+		if ipv6 {
+			address = network.GlobalIPv6Address
+		}
+		if ok && address != "" {
+			return net.ParseIP(address)
+		}
+	}
+	return nil
+}
+
+// containerAddress6 returns the IPv6 address of the container, taken from the ipv6_networks independently of the
+// network of its IPv4 address (e.g. IPv4 from a macvlan network and IPv6 from the default bridge). Otherwise it's
+// the fallback, the IPv6 address in the network of the IPv4 address.
+func (dd *DockerDiscovery) containerAddress6(container *dockerapi.Container, fallback string) net.IP {
+	if address := preferredAddress(container, dd.ipv6Networks, true); address != nil {
+		return address
+	}
+	return net.ParseIP(fallback) // nil when the network has no IPv6
+}
+
+// filterFamily drops the address of the family excluded by only_ipv4 or only_ipv6
+func (dd *DockerDiscovery) filterFamily(address, address6 net.IP) (net.IP, net.IP) {
+	switch dd.addressFamily {
+	case 4:
+		return address, nil
+	case 6:
+		return nil, address6
+	}
+	return address, address6
+}
+
+// filterFamilyRecords drops the A or AAAA records of the family excluded by only_ipv6 or only_ipv4, whatever
+// produced them (e.g. dns64, internal names or overrides)
+func (dd *DockerDiscovery) filterFamilyRecords(records []dns.RR) []dns.RR {
+	if dd.addressFamily == 0 {
+		return records
+	}
+	excluded := dns.TypeAAAA
+	if dd.addressFamily == 6 {
+		excluded = dns.TypeA
+	}
+	var filtered []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype != excluded {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// addresses returns the addresses of the container, the IPv4 one first
+func (containerInfo *ContainerInfo) addresses() []net.IP {
+	var addresses []net.IP
+	for _, address := range []net.IP{containerInfo.address, containerInfo.address6} {
+		if address != nil {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// joinAddresses formats the addresses for the logs, skipping the nil ones
+func joinAddresses(addresses ...net.IP) string {
+	var formatted []string
+	for _, address := range addresses {
+		if address != nil {
+			formatted = append(formatted, address.String())
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// containerGlue returns the A and AAAA records of the container addresses for the target name
+func containerGlue(target string, containerInfo *ContainerInfo) []dns.RR {
+	var records []dns.RR
+	if containerInfo.address != nil {
+		records = append(records, a(target, []net.IP{containerInfo.address})...)
+	}
+	if containerInfo.address6 != nil {
+		records = append(records, aaaa(target, []net.IP{containerInfo.address6})...)
+	}
+	return records
+}
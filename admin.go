@@ -0,0 +1,49 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/admin"
+)
+
+// adminHandler serves the admin API of the instance, the claims with approve_conflicts and the faults in the fault
+// injection mode
+func (dd *DockerDiscovery) adminHandler() http.Handler {
+	config := admin.Config{Overrides: dd, Rcodes: dd, Resolvers: dd, Table: dd, Backends: dd, Connection: dd, Subnets: dd,
+		ACME: dd}
+	if dd.approveConflicts {
+		config.Claims = dd
+	}
+	if dd.faultInjection {
+		config.Faults = faultsAPI{dd}
+	}
+	return admin.Handler(config)
+}
+
+// startAdmin starts listening for the admin API, if enabled.
+func (dd *DockerDiscovery) startAdmin() error {
+	if dd.adminAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", dd.adminAddress)
+	if err != nil {
+		return err
+	}
+	dd.admin = &http.Server{Handler: dd.adminHandler()}
+	go dd.admin.Serve(listener)
+	log.Printf("[docker] Admin API listening on %s", listener.Addr())
+	return nil
+}
+
+// stopAdmin stops the admin API, on reload it's closed before the new instance listens on the same address.
+func (dd *DockerDiscovery) stopAdmin() error {
+	if dd.admin == nil {
+		return nil
+	}
+	err := dd.admin.Shutdown(context.Background())
+	dd.admin = nil
+	return err
+}
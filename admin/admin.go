@@ -0,0 +1,421 @@
+// Package admin is the HTTP admin API of a docker discovery engine: its overrides, response codes, resolvers,
+// claims and record table, and the health of its backends. The CoreDNS plugin serves it on the admin address, with
+// its *dockerdiscovery.DockerDiscovery implementing every part of the API.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+)
+
+const (
+	overridesPath = "/overrides"
+	rcodesPath    = "/rcodes"
+	resolversPath = "/resolvers"
+	claimsPath    = "/claims"
+	faultsPath    = "/faults"
+	acmePath      = "/acme"
+)
+
+// Config is the parts of the engine served by the admin API, the endpoints of the parts left nil are not served
+type Config struct {
+	Overrides  Overrides
+	Rcodes     Rcodes
+	Resolvers  Resolvers
+	Claims     Claims // the containers held for approval, with approve_conflicts
+	Faults     Faults // the faults injected, in the fault injection mode
+	Table      Table
+	Backends   Backends
+	Connection Connection
+	Subnets    Subnets
+	ACME       ACME
+}
+
+// Overrides are the names answered with an address set by hand instead of the containers' ones
+type Overrides interface {
+	Overrides() map[string]net.IP
+	// SetOverride overrides the name with the address, nil removes the override
+	SetOverride(name string, address net.IP) error
+}
+
+// Rcodes are the names answered with a forced response code
+type Rcodes interface {
+	Rcodes() map[string]string
+	// SetRcode forces the response code of the name (e.g. SERVFAIL), empty answers the name again
+	SetRcode(name, rcode string) error
+}
+
+// Resolvers are the resolvers enabled, changing them resolves the names of the containers again
+type Resolvers interface {
+	Resolvers() []discovery.ResolverConfig
+	// SetResolver fails with discovery.ErrInvalidResolver for an invalid configuration
+	SetResolver(ctx context.Context, config discovery.ResolverConfig) error
+	// RemoveResolver fails with discovery.ErrNoResolver for a resolver not enabled
+	RemoveResolver(ctx context.Context, name string) error
+}
+
+// Claims are the containers held out of the answers until approved, the approval and the rejection failing with
+// discovery.ErrNoClaim for a container not held
+type Claims interface {
+	PendingClaims() []discovery.PendingClaim
+	ApproveClaim(ctx context.Context, id string) error
+	RejectClaim(id string) error
+}
+
+// Faults are the failures injected in the engine to validate its monitoring
+type Faults interface {
+	// Faults returns the faults injected, e.g. "event_delay=1s,drop_etcd_writes"
+	Faults() string
+	// SetFaults replaces the faults injected
+	SetFaults(spec string) error
+}
+
+// ACME is the DNS-01 challenges published as _acme-challenge.<domain> TXT records
+type ACME interface {
+	// SetACMEChallenge publishes the challenge values of the domain, no values remove the challenge
+	SetACMEChallenge(domain string, values []string)
+}
+
+// Table is the record table: the names and their addresses, the overrides and the rcodes
+type Table interface {
+	ExportTable() discovery.RecordTable
+	// ImportTable merges the record table into the current one, or replaces the imported names, the overrides and
+	// the rcodes with it
+	ImportTable(table discovery.RecordTable, replace bool) error
+}
+
+// Backends is the health of the backends the record table is published to
+type Backends interface {
+	Backends() []discovery.BackendStatus
+}
+
+// Connection is the state of the connection to docker
+type Connection interface {
+	Connection() discovery.ConnectionStatus
+}
+
+// Subnets are the subnets of the docker networks hosting discovered containers
+type Subnets interface {
+	Subnets() []discovery.NetworkSubnets
+}
+
+// overrideRequest is the body of PUT /overrides/<name>
+type overrideRequest struct {
+	Address string `json:"address"`
+}
+
+// rcodeRequest is the body of PUT /rcodes/<name>
+type rcodeRequest struct {
+	Rcode string `json:"rcode"`
+}
+
+// acmeRequest is the body of PUT /acme/<domain>
+type acmeRequest struct {
+	Values []string `json:"values"`
+}
+
+// api serves the admin API of the engine
+type api struct {
+	config Config
+}
+
+// Handler serves the parts of the admin API set in the config:
+//
+//	GET    /overrides         the overridden names and their address
+//	PUT    /overrides/<name>  override the name with {"address": "<ip>"}
+//	DELETE /overrides/<name>  remove the override of the name
+//	GET    /rcodes            the names whose response code is forced, and the code
+//	PUT    /rcodes/<name>     force the response code of the name with {"rcode": "SERVFAIL"}
+//	DELETE /rcodes/<name>     answer the name again
+//	GET    /backends          the health of the backends
+//	GET    /connection        the state of the connection to docker
+//	GET    /subnets           the subnets of the networks hosting discovered containers
+//	GET    /resolvers         the resolvers enabled, in order of precedence
+//	PUT    /resolvers/<name>  enable or change the resolver with {"domain": "<suffix>"}, the names are resolved again
+//	DELETE /resolvers/<name>  disable the resolver, the names are resolved again
+//	GET    /claims            the containers held by approve_conflicts
+//	POST   /claims/<id>       approve the names claimed by the container
+//	DELETE /claims/<id>       reject them, the container is not answered
+//	GET    /faults            the faults injected, in the fault injection mode
+//	PUT    /faults            inject the faults {"faults": "<fault>,..."} instead
+//	PUT    /acme/<domain>     publish the DNS-01 challenge values of the domain with {"values": ["<token>", ...]}
+//	DELETE /acme/<domain>     remove the challenge of the domain
+//	GET    /table             the record table: the names and their addresses, the overrides and the rcodes
+//	POST   /table             merge the record table of the body into the current one
+//	PUT    /table             replace the imported names, the overrides and the rcodes with the record table
+func Handler(config Config) http.Handler {
+	api := &api{config: config}
+	mux := http.NewServeMux()
+	if overrides := config.Overrides; overrides != nil {
+		mux.HandleFunc(overridesPath, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			addresses := make(map[string]string)
+			for name, address := range overrides.Overrides() {
+				addresses[name] = address.String()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(addresses)
+		})
+		mux.HandleFunc(overridesPath+"/", func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(r.URL.Path, overridesPath+"/")
+			var address net.IP
+			switch r.Method {
+			case http.MethodPut:
+				var body overrideRequest
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if address = net.ParseIP(body.Address); address == nil {
+					http.Error(w, "invalid address: "+body.Address, http.StatusBadRequest)
+					return
+				}
+			case http.MethodDelete:
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := overrides.SetOverride(name, address); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("[docker] Override of %s set to %v through the admin API", name, address)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	if rcodes := config.Rcodes; rcodes != nil {
+		mux.HandleFunc(rcodesPath, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rcodes.Rcodes())
+		})
+		mux.HandleFunc(rcodesPath+"/", func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(r.URL.Path, rcodesPath+"/")
+			var rcode string
+			switch r.Method {
+			case http.MethodPut:
+				var body rcodeRequest
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if rcode = body.Rcode; rcode == "" {
+					http.Error(w, "missing rcode", http.StatusBadRequest)
+					return
+				}
+			case http.MethodDelete:
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := rcodes.SetRcode(name, rcode); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("[docker] Rcode of %s set to %q through the admin API", name, rcode)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	if backends := config.Backends; backends != nil {
+		mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(backends.Backends())
+		})
+	}
+	if connection := config.Connection; connection != nil {
+		mux.HandleFunc("/connection", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(connection.Connection())
+		})
+	}
+	if subnets := config.Subnets; subnets != nil {
+		mux.HandleFunc("/subnets", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(subnets.Subnets())
+		})
+	}
+	if table := config.Table; table != nil {
+		mux.HandleFunc("/table", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(table.ExportTable())
+				return
+			case http.MethodPost, http.MethodPut:
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var imported discovery.RecordTable
+			if err := json.NewDecoder(r.Body).Decode(&imported); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := table.ImportTable(imported, r.Method == http.MethodPut); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	if acme := config.ACME; acme != nil {
+		mux.HandleFunc(acmePath+"/", func(w http.ResponseWriter, r *http.Request) {
+			domain := strings.TrimPrefix(r.URL.Path, acmePath+"/")
+			if domain == "" {
+				http.Error(w, "missing domain", http.StatusBadRequest)
+				return
+			}
+			var values []string
+			switch r.Method {
+			case http.MethodPut:
+				var body acmeRequest
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if values = body.Values; len(values) == 0 {
+					http.Error(w, "missing values", http.StatusBadRequest)
+					return
+				}
+			case http.MethodDelete:
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			acme.SetACMEChallenge(domain, values)
+			log.Printf("[docker] ACME challenge of %s set to %d values through the admin API", domain, len(values))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	if config.Resolvers != nil {
+		mux.HandleFunc(resolversPath, api.resolvers)
+		mux.HandleFunc(resolversPath+"/", api.resolvers)
+	}
+	if config.Claims != nil {
+		mux.HandleFunc(claimsPath, api.claims)
+		mux.HandleFunc(claimsPath+"/", api.claims)
+	}
+	if config.Faults != nil {
+		mux.HandleFunc(faultsPath, api.injectedFaults)
+	}
+	return mux
+}
+
+// resolvers serves the resolvers on GET /resolvers, enables or changes one on PUT /resolvers/<name> with its
+// configuration and disables it on DELETE /resolvers/<name>
+func (api *api) resolvers(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, resolversPath), "/")
+	var err error
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.config.Resolvers.Resolvers())
+		return
+	case name != "" && r.Method == http.MethodPut:
+		var config discovery.ResolverConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config.Name = name
+		err = api.config.Resolvers.SetResolver(r.Context(), config)
+	case name != "" && r.Method == http.MethodDelete:
+		err = api.config.Resolvers.RemoveResolver(r.Context(), name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, discovery.ErrInvalidResolver) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, discovery.ErrNoResolver) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// claims serves the pending claims on GET /claims, approves one on POST /claims/<id> and rejects it on
+// DELETE /claims/<id>
+func (api *api) claims(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, claimsPath), "/")
+	var err error
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.config.Claims.PendingClaims())
+		return
+	case id != "" && r.Method == http.MethodPost:
+		err = api.config.Claims.ApproveClaim(r.Context(), id)
+	case id != "" && r.Method == http.MethodDelete:
+		err = api.config.Claims.RejectClaim(id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, discovery.ErrNoClaim) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// faultsRequest is the body of GET and PUT /faults
+type faultsRequest struct {
+	Faults string `json:"faults"`
+}
+
+// injectedFaults serves the faults injected, and changes them on PUT
+func (api *api) injectedFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body faultsRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := api.config.Faults.SetFaults(body.Faults); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(faultsRequest{Faults: api.config.Faults.Faults()})
+}
@@ -0,0 +1,106 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEngine is an engine with the resolvers, the claims and the ACME challenges only
+type fakeEngine struct {
+	resolvers map[string]discovery.ResolverConfig
+	claims    map[string]bool
+	acme      map[string][]string
+}
+
+func (engine *fakeEngine) Resolvers() []discovery.ResolverConfig {
+	var configs []discovery.ResolverConfig
+	for _, config := range engine.resolvers {
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+func (engine *fakeEngine) SetResolver(_ context.Context, config discovery.ResolverConfig) error {
+	if config.Name != "label" {
+		return fmt.Errorf("%w: unknown resolver %s", discovery.ErrInvalidResolver, config.Name)
+	}
+	engine.resolvers[config.Name] = config
+	return nil
+}
+
+func (engine *fakeEngine) RemoveResolver(_ context.Context, name string) error {
+	if _, ok := engine.resolvers[name]; !ok {
+		return discovery.ErrNoResolver
+	}
+	delete(engine.resolvers, name)
+	return nil
+}
+
+func (engine *fakeEngine) PendingClaims() []discovery.PendingClaim {
+	var claims []discovery.PendingClaim
+	for id := range engine.claims {
+		claims = append(claims, discovery.PendingClaim{ID: id})
+	}
+	return claims
+}
+
+func (engine *fakeEngine) ApproveClaim(_ context.Context, id string) error {
+	if !engine.claims[id] {
+		return discovery.ErrNoClaim
+	}
+	delete(engine.claims, id)
+	return nil
+}
+
+func (engine *fakeEngine) RejectClaim(id string) error {
+	if !engine.claims[id] {
+		return discovery.ErrNoClaim
+	}
+	return nil
+}
+
+func (engine *fakeEngine) SetACMEChallenge(domain string, values []string) {
+	if len(values) == 0 {
+		delete(engine.acme, domain)
+		return
+	}
+	engine.acme[domain] = values
+}
+
+func TestHandler(t *testing.T) {
+	engine := &fakeEngine{resolvers: make(map[string]discovery.ResolverConfig), claims: map[string]bool{"fa155d6fd141": true},
+		acme: make(map[string][]string)}
+	handler := Handler(Config{Resolvers: engine, Claims: engine, ACME: engine})
+	request := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	// the errors of the engine are told apart by their status
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/resolvers/unknown", ""))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/resolvers/label", `{"labels":["coredns.dockerdiscovery.host"]}`))
+	assert.Contains(t, engine.resolvers, "label")
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/resolvers/label", ""))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/resolvers/label", ""))
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPost, "/claims/fa155d6fd141", ""))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/claims/fa155d6fd141", ""))
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPut, "/acme/app.lab.example.com", `{"values": ["gfj9Xq...Rg85nM"]}`))
+	assert.Equal(t, map[string][]string{"app.lab.example.com": {"gfj9Xq...Rg85nM"}}, engine.acme)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/acme/app.lab.example.com", `{"values": []}`))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/acme/app.lab.example.com", ""))
+	assert.Empty(t, engine.acme)
+
+	// the parts left out of the config are not served
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/faults", ""))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/overrides", ""))
+}
@@ -0,0 +1,74 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// aliasLabel gives a container stable external names, comma separated, answered with a CNAME to its first domain
+const aliasLabel = "coredns.dockerdiscovery.alias"
+
+// labelAliases returns the alias names of the container label (lower case, with trailing dot)
+func (dd *DockerDiscovery) labelAliases(container *dockerapi.Container) []string {
+	var aliases []string
+	for _, alias := range strings.Split(container.Config.Labels[aliasLabel], ",") {
+		alias = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(alias), "."))
+		if alias == "" {
+			continue
+		}
+		if !validDomain(alias, dd.strictNames) {
+			log.Printf("[docker] Ignoring invalid alias %q of container %s", alias, container.ID[:12])
+			continue
+		}
+		aliases = append(aliases, alias+".")
+	}
+	return aliases
+}
+
+// aliasTarget returns the name the alias points to: the target of the alias directive, otherwise the first domain
+// of the container with the alias label, the lowest container ID first. Empty when the name is no alias. The caller
+// must hold the lock.
+func (dd *DockerDiscovery) aliasTarget(name string) string {
+	if target, ok := dd.aliases[name]; ok {
+		return target
+	}
+	var owner *ContainerInfo
+	for _, containerInfo := range dd.containerInfoMap {
+		if len(containerInfo.domains) == 0 || !containsDomain(containerInfo.aliases, name) {
+			continue
+		}
+		if owner == nil || containerInfo.container.ID < owner.container.ID {
+			owner = containerInfo
+		}
+	}
+	if owner == nil {
+		return ""
+	}
+	return strings.ToLower(dns.Fqdn(owner.domains[0]))
+}
+
+// aliasRecords answers the queries of an alias with the CNAME record to its target, followed by the A or AAAA
+// records of the containers of the target. The CNAME queries get these addresses in the additional section. The
+// caller must hold the lock.
+func (dd *DockerDiscovery) aliasRecords(name, target string, qtype uint16, client net.IP) (answers, extras []dns.RR) {
+	answers = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dd.ttl},
+		Target: target,
+	}}
+	for _, containerInfo := range dd.containersByDomain(target) {
+		switch qtype {
+		case dns.TypeCNAME:
+			extras = append(extras, containerGlue(target, containerInfo)...)
+		case dns.TypeA, dns.TypeAAAA:
+			answers = append(answers, dd.addressRecords(target, qtype, containerInfo, client, dd.containerTTL(containerInfo))...)
+		}
+	}
+	for _, rr := range extras {
+		rr.Header().Ttl = dd.ttl
+	}
+	return answers, extras
+}
@@ -0,0 +1,99 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// imageReference returns the image of the container with its tag, ":latest" when it has none
+func imageReference(container *dockerapi.Container) string {
+	image := container.Config.Image
+	name := image[strings.LastIndex(image, "/")+1:]
+	if !strings.ContainsAny(name, ":@") {
+		image += ":latest"
+	}
+	return image
+}
+
+// matchAny reports whether the value matches one of the shell patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enableLabel opts a container in or out of the registration, whatever expose_by_default
+const enableLabel = "coredns.dockerdiscovery.enable"
+
+// containerFilter is a term of the filter directive, in the syntax of the docker filters: name=PATTERN matches the
+// container name, label=KEY the containers with the label, label=KEY=PATTERN its value, negated by a leading !
+type containerFilter struct {
+	negated bool
+	label   string // empty for the name term
+	pattern string // empty for the label presence
+}
+
+// parseContainerFilter parses a term of the filter directive
+func parseContainerFilter(term string) (containerFilter, error) {
+	filter := containerFilter{negated: strings.HasPrefix(term, "!")}
+	kind, value, ok := strings.Cut(strings.TrimPrefix(term, "!"), "=")
+	switch {
+	case !ok || value == "":
+		return filter, fmt.Errorf("invalid filter: '%s'", term)
+	case kind == "name":
+		filter.pattern = value
+	case kind == "label":
+		filter.label, filter.pattern, _ = strings.Cut(value, "=")
+	default:
+		return filter, fmt.Errorf("unknown filter: '%s'", kind)
+	}
+	if _, err := path.Match(filter.pattern, ""); err != nil {
+		return filter, fmt.Errorf("invalid filter pattern: '%s'", filter.pattern)
+	}
+	return filter, nil
+}
+
+// matches reports whether the container matches the term
+func (filter containerFilter) matches(container *dockerapi.Container) bool {
+	var matched bool
+	if filter.label == "" {
+		matched, _ = path.Match(filter.pattern, normalizeContainerName(container))
+	} else if value, ok := container.Config.Labels[filter.label]; ok {
+		matched = filter.pattern == ""
+		if !matched {
+			matched, _ = path.Match(filter.pattern, value)
+		}
+	}
+	return matched != filter.negated
+}
+
+// allowed reports whether the container is registered: the container of CoreDNS by the self directive, the others
+// by the only_images and only_projects whitelists and the terms of the filter directives, then by their enable
+// label, otherwise by expose_by_default
+func (dd *DockerDiscovery) allowed(container *dockerapi.Container) bool {
+	if dd.selfPolicy != "" && dd.isSelf(container) {
+		return dd.selfPolicy == "register"
+	}
+	if len(dd.onlyImages) > 0 && !matchAny(dd.onlyImages, imageReference(container)) {
+		return false
+	}
+	if len(dd.onlyProjects) > 0 && !matchAny(dd.onlyProjects, container.Config.Labels["com.docker.compose.project"]) {
+		return false
+	}
+	for _, filter := range dd.filters {
+		if !filter.matches(container) {
+			return false
+		}
+	}
+	if enabled, err := strconv.ParseBool(strings.TrimSpace(container.Config.Labels[enableLabel])); err == nil {
+		return enabled
+	}
+	return !dd.hideByDefault
+}
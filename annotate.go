@@ -0,0 +1,42 @@
+package dockerdiscovery
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// annotationOptionCode is the EDNS0 local option code of the container annotations, the first of the local range
+const annotationOptionCode = dns.EDNS0LOCALSTART
+
+// annotated reports whether the answers to the client carry the container annotations, with annotate_answers
+func (dd *DockerDiscovery) annotated(client net.IP) bool {
+	if client == nil {
+		return false
+	}
+	for _, subnet := range dd.annotateClients {
+		if subnet.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// annotate adds an EDNS0 local option per container owning the question name to the answer, with its short ID and
+// name, e.g. "78c2a0b4c1d2 my-nginx", so the resolvers of annotate_answers can correlate the answers with the
+// containers. The answers to clients without EDNS0 are left as they are, they can't carry options.
+func (dd *DockerDiscovery) annotate(state request.Request, m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil || !dd.annotated(net.ParseIP(state.IP())) {
+		return
+	}
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	for _, containerInfo := range dd.containersByDomain(state.Name()) {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+			Code: annotationOptionCode,
+			Data: []byte(containerInfo.container.ID[:12] + " " + dd.containerName(containerInfo.container)),
+		})
+	}
+}
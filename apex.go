@@ -0,0 +1,58 @@
+package dockerdiscovery
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// soaConfig is the SOA record synthesized at the apex of the zones, set by the soa directive
+type soaConfig struct {
+	mname, rname                   string
+	refresh, retry, expire, minttl uint32
+}
+
+// defaultSOATimers are the refresh, retry, expire and minimum TTL of the SOA records when not configured
+var defaultSOATimers = [4]uint32{7200, 1800, 86400, 30}
+
+// isApex reports whether the name is the apex of one of the server block zones, the root zone excepted. The name
+// must be in lower case.
+func (dd *DockerDiscovery) isApex(name string) bool {
+	for _, zone := range dd.zones {
+		if zone != "." && strings.ToLower(zone) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// apexRecords answers the SOA and NS queries at the apex of the zones, as configured by the soa and ns
+// directives, so the zones can be delegated from their parent. The serial is the version of the record table (see
+// zoneSerial).
+func (dd *DockerDiscovery) apexRecords(name string, qtype uint16) []dns.RR {
+	if !dd.isApex(name) {
+		return nil
+	}
+	var answers []dns.RR
+	switch {
+	case qtype == dns.TypeSOA && dd.soa != nil:
+		answers = append(answers, &dns.SOA{
+			Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: dd.ttl},
+			Ns:      dd.soa.mname,
+			Mbox:    dd.soa.rname,
+			Serial:  dd.zoneSerial(),
+			Refresh: dd.soa.refresh,
+			Retry:   dd.soa.retry,
+			Expire:  dd.soa.expire,
+			Minttl:  dd.soa.minttl,
+		})
+	case qtype == dns.TypeNS:
+		for _, ns := range dd.nameServers {
+			answers = append(answers, &dns.NS{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: dd.ttl},
+				Ns:  ns,
+			})
+		}
+	}
+	return answers
+}
@@ -0,0 +1,74 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+	"github.com/miekg/dns"
+)
+
+// The types of the Go API, defined by the discovery package
+type (
+	ContainerRecord    = discovery.ContainerRecord
+	RecordTable        = discovery.RecordTable
+	PendingClaim       = discovery.PendingClaim
+	ResolverConfig     = discovery.ResolverConfig
+	Status             = discovery.Status
+	ConnectionStatus   = discovery.ConnectionStatus
+	BackendStatus      = discovery.BackendStatus
+	ZoneStatus         = discovery.ZoneStatus
+	EtcdEndpointStatus = discovery.EtcdEndpointStatus
+	NetworkSubnets     = discovery.NetworkSubnets
+)
+
+// Lookup returns the records answered for the name and type, for use by other plugins or programs embedding
+// CoreDNS. Records depending on the client address (e.g. the internal names) are not returned.
+func (dd *DockerDiscovery) Lookup(qname string, qtype uint16) []dns.RR {
+	answers, _ := dd.records(dns.Fqdn(qname), qtype, nil)
+	return answers
+}
+
+// Containers returns a snapshot of the discovered containers, sorted by name
+func (dd *DockerDiscovery) Containers() []ContainerRecord {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	containers := make([]ContainerRecord, 0, len(dd.containerInfoMap))
+	for _, containerInfo := range dd.containerInfoMap {
+		containers = append(containers, dd.containerRecord(containerInfo))
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	return containers
+}
+
+func (dd *DockerDiscovery) containerRecord(containerInfo *ContainerInfo) ContainerRecord {
+	record := ContainerRecord{
+		ID:       containerInfo.container.ID,
+		Name:     dd.containerName(containerInfo.container),
+		Image:    containerInfo.container.Config.Image,
+		Network:  containerInfo.network,
+		Address:  append(net.IP{}, containerInfo.address...),
+		Address6: append(net.IP(nil), containerInfo.address6...),
+		Domains:  append([]string{}, containerInfo.domains...),
+	}
+	if !containerInfo.exited.IsZero() {
+		exitCode, exited := containerInfo.exitCode, containerInfo.exited
+		record.ExitCode, record.Exited = &exitCode, &exited
+	}
+	return record
+}
+
+// Version returns the version of the record table, increased by every change of the records (e.g. for zone
+// serials). It only increases over the life of the process, reloads included.
+func (dd *DockerDiscovery) Version() uint64 {
+	return atomic.LoadUint64(&dd.version)
+}
+
+// bumpVersion increases the version of the record table
+func (dd *DockerDiscovery) bumpVersion() {
+	version := atomic.AddUint64(&dd.version, 1)
+	recordTableVersion.WithLabelValues(dd.dockerEndpoint).Set(float64(version))
+	dd.notifyBackends()
+}
@@ -0,0 +1,250 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/backends"
+)
+
+// backendRetryInterval is how long a failing backend waits before publishing the record table again
+const backendRetryInterval = 5 * time.Second
+
+// backendTimeout bounds each publication of the record table to a backend
+const backendTimeout = 5 * time.Second
+
+// backend publishes the record table outside of the DNS answers, e.g. to etcd
+type backend interface {
+	name() string
+	// sync publishes the containers, replacing what was published before. It gives up when the context is done.
+	sync(ctx context.Context, containers []*ContainerInfo) error
+}
+
+// backendQueue feeds a backend with the record table in the background, so a degraded backend never blocks
+// the answers served from memory. Changes made while a backend is busy or failing are coalesced: it always
+// publishes the latest record table.
+type backendQueue struct {
+	backend backend
+	wake    chan struct{}
+	busy    sync.Mutex // held while publishing
+
+	mu        sync.Mutex
+	healthy   bool
+	synced    uint64 // version of the record table published last
+	published bool   // whether the record table was published once
+	lastError error
+	reload    bool // whether the backend reloads what it holds before the next publication
+	paused    bool // the record table is no longer published, e.g. during the lame duck period
+}
+
+// reloader is a backend publishing only the changes, which reloads what it really holds on the periodic resyncs,
+// so the records changed behind its back are published again.
+type reloader interface {
+	// reload forgets what the backend published, it's called by the goroutine publishing to it.
+	reload()
+}
+
+// recordBackend feeds a backend of the backends package, which publishes the records of the containers, e.g. the
+// zone file. The backend is set once the configuration is parsed, before the backends are started.
+type recordBackend struct {
+	dd      *DockerDiscovery
+	backend backends.Backend
+}
+
+func (backend *recordBackend) name() string {
+	return backend.backend.Name()
+}
+
+func (backend *recordBackend) sync(ctx context.Context, containers []*ContainerInfo) error {
+	records := make([]ContainerRecord, 0, len(containers))
+	for _, containerInfo := range containers {
+		records = append(records, backend.dd.containerRecord(containerInfo))
+	}
+	return backend.backend.Sync(ctx, records)
+}
+
+func (backend *recordBackend) reload() {
+	if reloader, ok := backend.backend.(backends.Reloader); ok {
+		reloader.Reload()
+	}
+}
+
+func (dd *DockerDiscovery) addBackend(backend backend) {
+	dd.backends = append(dd.backends, &backendQueue{backend: backend, wake: make(chan struct{}, 1), healthy: true})
+}
+
+// startBackends starts publishing the record table to the backends
+func (dd *DockerDiscovery) startBackends() {
+	for _, queue := range dd.backends {
+		queue := queue
+		dd.spawn("backend", func() { queue.run(dd) })
+	}
+	dd.notifyBackends()
+}
+
+// notifyBackends wakes the backends up after a change of the record table, it never blocks.
+func (dd *DockerDiscovery) notifyBackends() {
+	for _, queue := range dd.backends {
+		select {
+		case queue.wake <- struct{}{}:
+		default: // already woken up, the change is published with the pending ones
+		}
+		queue.updateMetrics(dd.Version())
+	}
+}
+
+// reloadBackends has the backends reload what they hold and publish the record table again
+func (dd *DockerDiscovery) reloadBackends() {
+	for _, queue := range dd.backends {
+		queue.mu.Lock()
+		queue.reload = true
+		queue.mu.Unlock()
+	}
+	dd.notifyBackends()
+}
+
+// sync publishes the record table to the backend, labelled with the backend for the profiles
+func (queue *backendQueue) sync(dd *DockerDiscovery) error {
+	var err error
+	pprof.Do(dd.ctx, dd.stageLabels("backend", "docker_backend", queue.backend.name()), func(ctx context.Context) {
+		defer stageRegion(ctx, "backend").End()
+		err = queue.backend.sync(ctx, dd.backendSnapshot())
+	})
+	return err
+}
+
+// run publishes the record table when woken up, until the final shutdown
+func (queue *backendQueue) run(dd *DockerDiscovery) {
+	for {
+		select {
+		case <-queue.wake:
+		case <-dd.ctx.Done():
+			return
+		}
+		queue.mu.Lock()
+		reload := queue.reload
+		queue.reload = false
+		queue.mu.Unlock()
+		if backend, ok := queue.backend.(reloader); ok && reload {
+			backend.reload()
+		}
+		for {
+			err := queue.publish(dd)
+			if err == nil {
+				break
+			}
+			if dd.ctx.Err() != nil {
+				return
+			}
+			log.Printf("[docker] Error publishing the records to backend %s, retrying in %s: %s", queue.backend.name(), backendRetryInterval, err)
+			if !sleepContext(dd.ctx, backendRetryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// publish publishes the record table to the backend, unless paused
+func (queue *backendQueue) publish(dd *DockerDiscovery) error {
+	queue.busy.Lock()
+	defer queue.busy.Unlock()
+	queue.mu.Lock()
+	paused := queue.paused
+	queue.mu.Unlock()
+	if paused {
+		return nil
+	}
+
+	version := dd.Version()
+	err := queue.sync(dd)
+	if err != nil {
+		err = &BackendError{Backend: queue.backend.name(), Err: err}
+	}
+
+	queue.mu.Lock()
+	queue.healthy = err == nil
+	queue.lastError = err
+	if err == nil {
+		queue.synced = version
+		queue.published = true
+	}
+	queue.mu.Unlock()
+	queue.updateMetrics(dd.Version())
+
+	if err != nil {
+		backendErrorCount.WithLabelValues(queue.backend.name()).Inc()
+		countError(err)
+	}
+	return err
+}
+
+// drain stops publishing the record table to the backend, once the publication in progress is done, then
+// publishes an empty one, deleting the records it holds. Nothing is deleted from a backend never published to.
+func (queue *backendQueue) drain(dd *DockerDiscovery) {
+	queue.mu.Lock()
+	queue.paused = true
+	queue.mu.Unlock()
+	queue.busy.Lock()
+	defer queue.busy.Unlock()
+
+	queue.mu.Lock()
+	published := queue.published
+	queue.mu.Unlock()
+	if !published {
+		return
+	}
+	ctx, cancel := context.WithTimeout(dd.ctx, backendTimeout)
+	defer cancel()
+	if err := queue.backend.sync(ctx, nil); err != nil {
+		log.Printf("[docker] Error deleting the records of backend %s: %s", queue.backend.name(), err)
+	}
+}
+
+func (queue *backendQueue) status(version uint64) BackendStatus {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	status := BackendStatus{Name: queue.backend.name(), Healthy: queue.healthy, Pending: version - queue.synced}
+	if queue.lastError != nil {
+		status.LastError = queue.lastError.Error()
+		status.Err = queue.lastError
+	}
+	return status
+}
+
+func (queue *backendQueue) updateMetrics(version uint64) {
+	status := queue.status(version)
+	healthy := 0.0
+	if status.Healthy {
+		healthy = 1
+	}
+	backendHealthy.WithLabelValues(status.Name).Set(healthy)
+	backendPending.WithLabelValues(status.Name).Set(float64(status.Pending))
+}
+
+// Backends returns the health of the backends the record table is published to
+func (dd *DockerDiscovery) Backends() []BackendStatus {
+	version := dd.Version()
+	var statuses []BackendStatus
+	for _, queue := range dd.backends {
+		statuses = append(statuses, queue.status(version))
+	}
+	return statuses
+}
+
+// backendSnapshot returns the containers to publish, sorted by ID
+func (dd *DockerDiscovery) backendSnapshot() []*ContainerInfo {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	containers := make([]*ContainerInfo, 0, len(dd.containerInfoMap))
+	for _, containerInfo := range dd.containerInfoMap {
+		containers = append(containers, containerInfo)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].container.ID < containers[j].container.ID })
+	return containers
+}
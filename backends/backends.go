@@ -0,0 +1,47 @@
+// Package backends publishes the record table of a docker discovery engine outside of the DNS answers: to a zone
+// file, a hosts file or a webhook. The backends are fed with the snapshots of the discovered containers, e.g. the
+// ones of (*dockerdiscovery.DockerDiscovery).Containers, and publish them whole.
+package backends
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+)
+
+// Backend publishes the records of the containers
+type Backend interface {
+	// Name returns the name of the backend in the logs and the status, e.g. zone_file
+	Name() string
+	// Sync publishes the records of the containers, replacing what was published before. It gives up when the
+	// context is done.
+	Sync(ctx context.Context, records []discovery.ContainerRecord) error
+}
+
+// Reloader is a backend publishing only the changes, which forgets what it published on Reload so the next Sync
+// publishes everything again, e.g. the files deleted by hand
+type Reloader interface {
+	Reload()
+}
+
+// WriteFileAtomic writes the data to a temporary file and renames it, so that readers never see a partial file.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimPrefix(filepath.Base(path), ".")+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		tmp.Close()
+	}
+	return err
+}
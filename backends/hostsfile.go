@@ -0,0 +1,101 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+)
+
+// hostsReloadInterval is the reload interval of the hosts plugin in the Corefile snippet
+const hostsReloadInterval = "5s"
+
+// HostsFile writes the addresses of the containers to a file in the hosts format, e.g. for the hosts plugin of a
+// CoreDNS of another stack, or as /etc/hosts of machines without this DNS server. With a snippet, it also writes
+// the Corefile snippet of the hosts plugin serving the file, to be imported by the other CoreDNS servers sharing
+// the volume. The files are only written when their content changes, so the hosts plugin reloads them then.
+type HostsFile struct {
+	path    string
+	snippet *Snippet
+	written map[string]string // content last written, by path
+}
+
+// Snippet is the Corefile snippet of the hosts plugin serving the hosts file
+type Snippet struct {
+	Path   string
+	Zones  []string // zones of the hosts plugin, the root zone is left out
+	Source string   // where the containers come from, e.g. the docker endpoint, in the comment of the snippet
+	TTL    uint32   // TTL of the answers
+}
+
+// NewHostsFile returns the backend writing the addresses to the file, and the snippet if not nil
+func NewHostsFile(path string, snippet *Snippet) *HostsFile {
+	return &HostsFile{path: path, snippet: snippet, written: make(map[string]string)}
+}
+
+func (backend *HostsFile) Name() string {
+	return "hosts_file"
+}
+
+func (backend *HostsFile) Sync(_ context.Context, records []discovery.ContainerRecord) error {
+	var lines []string
+	for _, record := range records {
+		var names []string
+		for _, domain := range record.Domains {
+			names = append(names, strings.TrimSuffix(strings.ToLower(domain), "."))
+		}
+		if len(names) == 0 {
+			continue
+		}
+		for _, address := range []net.IP{record.Address, record.Address6} {
+			if len(address) > 0 {
+				lines = append(lines, address.String()+"\t"+strings.Join(names, " "))
+			}
+		}
+	}
+	sort.Strings(lines)
+
+	data := fmt.Sprintf("# docker containers, %d addresses\n%s", len(lines), strings.Join(lines, "\n"))
+	if len(lines) > 0 {
+		data += "\n"
+	}
+	if err := backend.write(backend.path, data); err != nil {
+		return err
+	}
+	if backend.snippet == nil {
+		return nil
+	}
+	return backend.write(backend.snippet.Path, backend.corefileSnippet())
+}
+
+// corefileSnippet returns the hosts plugin block serving the hosts file for the zones, with the TTL of the answers,
+// reloading the file as it changes and passing the other names of the zones to the next plugin
+func (backend *HostsFile) corefileSnippet() string {
+	zones := ""
+	for _, zone := range backend.snippet.Zones {
+		if zone != "." {
+			zones += " " + zone
+		}
+	}
+	return fmt.Sprintf("# docker containers, from %s\nhosts %s%s {\n\tttl %d\n\treload %s\n\tfallthrough\n}\n",
+		backend.snippet.Source, backend.path, zones, backend.snippet.TTL, hostsReloadInterval)
+}
+
+// Reload forgets the content written, the files are written again by the next sync, e.g. once deleted by hand
+func (backend *HostsFile) Reload() {
+	backend.written = make(map[string]string)
+}
+
+func (backend *HostsFile) write(path, data string) error {
+	if previous, ok := backend.written[path]; ok && previous == data {
+		return nil
+	}
+	if err := WriteFileAtomic(path, []byte(data)); err != nil {
+		return err
+	}
+	backend.written[path] = data
+	return nil
+}
@@ -0,0 +1,62 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+)
+
+// Webhook posts the whole record table (a JSON list of discovery.ContainerRecord) to a URL after every change
+type Webhook struct {
+	url       string
+	client    *http.Client
+	published map[string]discovery.ContainerRecord // records of the last post by container name
+}
+
+// NewWebhook returns the backend posting the records to the URL with the client
+func NewWebhook(url string, client *http.Client) *Webhook {
+	return &Webhook{url: url, client: client}
+}
+
+func (backend *Webhook) Name() string {
+	return "webhook"
+}
+
+func (backend *Webhook) Sync(ctx context.Context, records []discovery.ContainerRecord) error {
+	posted := make([]discovery.ContainerRecord, 0, len(records))
+	for _, record := range records {
+		// by name, the containers recreated by compose keep it
+		if previous, ok := backend.published[record.Name]; ok && (!previous.Address.Equal(record.Address) || !previous.Address6.Equal(record.Address6)) {
+			record.PreviousAddress, record.PreviousAddress6 = previous.Address, previous.Address6
+		}
+		posted = append(posted, record)
+	}
+	body, err := json.Marshal(posted)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, backend.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := backend.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	backend.published = make(map[string]discovery.ContainerRecord, len(posted))
+	for _, record := range posted {
+		backend.published[record.Name] = record
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+	"github.com/miekg/dns"
+)
+
+// ZoneFile writes the A and AAAA records of the containers to a file in the zone file format, e.g. to be included
+// ($INCLUDE) in the zone of another DNS server.
+type ZoneFile struct {
+	path string
+	ttl  uint32
+}
+
+// NewZoneFile returns the backend writing the records to the file, with the TTL
+func NewZoneFile(path string, ttl uint32) *ZoneFile {
+	return &ZoneFile{path: path, ttl: ttl}
+}
+
+func (backend *ZoneFile) Name() string {
+	return "zone_file"
+}
+
+func (backend *ZoneFile) Sync(_ context.Context, records []discovery.ContainerRecord) error {
+	var lines []string
+	for _, record := range records {
+		for _, domain := range record.Domains {
+			for _, rr := range backend.addressRecords(dns.Fqdn(strings.ToLower(domain)), record) {
+				lines = append(lines, rr.String())
+			}
+		}
+	}
+	sort.Strings(lines)
+
+	data := fmt.Sprintf("; docker containers, %d records\n%s", len(lines), strings.Join(lines, "\n"))
+	if len(lines) > 0 {
+		data += "\n"
+	}
+	return WriteFileAtomic(backend.path, []byte(data))
+}
+
+// addressRecords returns the A and AAAA records of the name with the addresses of the container
+func (backend *ZoneFile) addressRecords(name string, record discovery.ContainerRecord) []dns.RR {
+	var rrs []dns.RR
+	for _, address := range []net.IP{record.Address, record.Address6} {
+		header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: backend.ttl}
+		switch {
+		case len(address) == 0:
+		case address.To4() != nil:
+			header.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: header, A: address})
+		default:
+			header.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: header, AAAA: address})
+		}
+	}
+	return rrs
+}
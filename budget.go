@@ -0,0 +1,34 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+// queryBudgetMin is the lowest query_budget, below the scheduling delays
+const queryBudgetMin = time.Millisecond
+
+// withBudget returns the context of the lookups of a query, bounded by the query_budget. The cancel function must
+// be called once the query is handled.
+func (dd *DockerDiscovery) withBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dd.queryBudget == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, dd.queryBudget)
+}
+
+// overBudget reports whether the query_budget of the query ran out, and not the query itself
+func overBudget(ctx, budget context.Context) bool {
+	return budget.Err() != nil && ctx.Err() == nil
+}
+
+// passOverBudget passes the query whose budget ran out to the next plugin, instead of delaying the client with
+// a late or negative answer
+func (dd *DockerDiscovery) passOverBudget(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	queryCount.WithLabelValues(metrics.WithServer(ctx), "budget").Inc()
+	return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+}
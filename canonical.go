@@ -0,0 +1,74 @@
+package dockerdiscovery
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rrsetKey identifies the RR set of a record
+type rrsetKey struct {
+	name   string
+	class  uint16
+	rrtype uint16
+}
+
+func rrsetOf(rr dns.RR) rrsetKey {
+	return rrsetKey{name: strings.ToLower(rr.Header().Name), class: rr.Header().Class, rrtype: rr.Header().Rrtype}
+}
+
+// canonicalize makes the RR sets of the records canonical, so the answers are the same for the same records and
+// can be signed or cached as they are: the duplicates are dropped, the records of an RR set share its lowest TTL
+// (RFC 2181 5.2) and, unless shuffled by round_robin, they are sorted by their RDATA in wire format, the canonical
+// order of RFC 4034 6.3. The RR sets keep the order they first appear in.
+func canonicalize(records []dns.RR, shuffled bool) []dns.RR {
+	if len(records) < 2 {
+		return records
+	}
+	records = dns.Dedup(records, nil)
+
+	var keys []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range records {
+		key := rrsetOf(rr)
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	canonical := make([]dns.RR, 0, len(records))
+	for _, key := range keys {
+		set := sets[key]
+		ttl := set[0].Header().Ttl
+		for _, rr := range set[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		for _, rr := range set {
+			rr.Header().Ttl = ttl
+		}
+		if !shuffled {
+			rdatas := make(map[dns.RR][]byte, len(set))
+			for _, rr := range set {
+				rdatas[rr] = rdata(rr)
+			}
+			sort.SliceStable(set, func(i, j int) bool { return bytes.Compare(rdatas[set[i]], rdatas[set[j]]) < 0 })
+		}
+		canonical = append(canonical, set...)
+	}
+	return canonical
+}
+
+// rdata returns the RDATA of the record in uncompressed wire format, nil when it can't be packed
+func rdata(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr))
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	return buf[off-int(rr.Header().Rdlength) : off]
+}
@@ -0,0 +1,190 @@
+package dockerdiscovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// claimsPath is the admin API path of the containers held for approval by approve_conflicts
+const claimsPath = "/claims"
+
+// recordOwner is the owner of the names of the record directives in the conflicts
+const recordOwner = "record"
+
+// claimConflicts returns the domains of the container already owned by other containers or record directives, and
+// their owners. The names the container had already, and the containers replaced by the change or of the same
+// compose service (its replicas) are no conflict. The caller must hold the lock.
+func (dd *DockerDiscovery) claimConflicts(change *containerChange, container *dockerapi.Container, previous *ContainerInfo, domains []string) (names, owners []string) {
+	owned := make(map[string]bool)
+	if previous != nil {
+		for _, domain := range previous.domains {
+			owned[dns.Fqdn(strings.ToLower(domain))] = true
+		}
+	}
+	service := serviceIdentity(container)
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		name := dns.Fqdn(strings.ToLower(domain))
+		if owned[name] {
+			continue
+		}
+		var nameOwners []string
+		for _, owner := range dd.domainIndex[name] {
+			if owner.container.ID == container.ID || change.removes(owner.container.ID) || (service != "" && serviceIdentity(owner.container) == service) {
+				continue
+			}
+			nameOwners = append(nameOwners, normalizeContainerName(owner.container))
+		}
+		for _, rr := range dd.staticRecords {
+			if strings.EqualFold(rr.Header().Name, name) {
+				nameOwners = append(nameOwners, recordOwner)
+				break
+			}
+		}
+		if len(nameOwners) == 0 {
+			continue
+		}
+		names = append(names, name)
+		for _, owner := range nameOwners {
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+	}
+	sort.Strings(owners)
+	return names, owners
+}
+
+// serviceIdentity returns the compose project and service of the container, empty without compose
+func serviceIdentity(container *dockerapi.Container) string {
+	labels := container.Config.Labels
+	project, service := labels["com.docker.compose.project"], labels["com.docker.compose.service"]
+	if project == "" || service == "" {
+		return ""
+	}
+	return project + "/" + service
+}
+
+// holdConflicting reports whether the registration of the container is held: rejected, or claiming names already
+// owned and not approved, then it's pending and the approval webhook is notified once. The caller must hold the lock.
+func (dd *DockerDiscovery) holdConflicting(change *containerChange, container *dockerapi.Container, previous *ContainerInfo, domains []string) bool {
+	if approved, ok := dd.claimDecisions[container.ID]; ok {
+		if !approved {
+			log.Printf("[docker] Ignoring container %s (%s), its claim was rejected", normalizeContainerName(container), container.ID[:12])
+		}
+		return !approved
+	}
+	names, owners := dd.claimConflicts(change, container, previous, domains)
+	if len(names) == 0 {
+		delete(dd.pendingClaims, container.ID)
+		return false
+	}
+	if claim, ok := dd.pendingClaims[container.ID]; ok {
+		claim.Names, claim.Owners = names, owners
+		return true
+	}
+
+	claim := &PendingClaim{ID: container.ID, Container: normalizeContainerName(container), Names: names, Owners: owners, Since: time.Now()}
+	dd.pendingClaims[container.ID] = claim
+	log.Printf("[docker] Holding container %s (%s) claiming %s owned by %s, until approved", claim.Container, container.ID[:12],
+		strings.Join(names, " "), strings.Join(owners, " "))
+	if dd.approvalWebhook != "" {
+		go dd.notifyClaim(*claim)
+	}
+	return true
+}
+
+// notifyClaim posts the pending claim to the approval webhook
+func (dd *DockerDiscovery) notifyClaim(claim PendingClaim) {
+	body, err := json.Marshal(claim)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(dd.ctx, backendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dd.approvalWebhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[docker] Error notifying the claim of container %s: %s", claim.ID[:12], err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("[docker] Error notifying the claim of container %s: %s", claim.ID[:12], err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[docker] Error notifying the claim of container %s: unexpected status %s", claim.ID[:12], resp.Status)
+	}
+}
+
+// PendingClaims returns the containers held for approval, the oldest first
+func (dd *DockerDiscovery) PendingClaims() []PendingClaim {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	claims := make([]PendingClaim, 0, len(dd.pendingClaims))
+	for _, claim := range dd.pendingClaims {
+		claims = append(claims, *claim)
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Since.Before(claims[j].Since) })
+	return claims
+}
+
+// ApproveClaim registers the container held for approval, by ID or short ID, answered along with the owners of its
+// names. The container is inspected again, it may have changed while held.
+func (dd *DockerDiscovery) ApproveClaim(ctx context.Context, id string) error {
+	claim, err := dd.decideClaim(id, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("[docker] Claim of container %s (%s) approved", claim.Container, claim.ID[:12])
+	container, err := dd.inspectContainer(ctx, claim.ID)
+	if err != nil {
+		return err
+	}
+	return dd.updateContainerInfo(container)
+}
+
+// RejectClaim keeps the container held for approval, by ID or short ID, out of the answers until it's removed
+func (dd *DockerDiscovery) RejectClaim(id string) error {
+	claim, err := dd.decideClaim(id, false)
+	if err != nil {
+		return err
+	}
+	log.Printf("[docker] Claim of container %s (%s) rejected", claim.Container, claim.ID[:12])
+	return nil
+}
+
+func (dd *DockerDiscovery) decideClaim(id string, approved bool) (*PendingClaim, error) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	for containerID, claim := range dd.pendingClaims {
+		if len(id) >= 12 && strings.HasPrefix(containerID, id) {
+			delete(dd.pendingClaims, containerID)
+			dd.claimDecisions[containerID] = approved
+			return claim, nil
+		}
+	}
+	return nil, fmt.Errorf("%w of container %s", discovery.ErrNoClaim, id)
+}
+
+// forgetClaim forgets the claim and the decision about the removed container. The caller must hold the lock.
+func (dd *DockerDiscovery) forgetClaim(containerID string) {
+	delete(dd.pendingClaims, containerID)
+	delete(dd.claimDecisions, containerID)
+}
@@ -0,0 +1,156 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// composePlaceholderTTL is the TTL of the pre-registered compose names, short as they point to a placeholder until
+// the containers start
+const composePlaceholderTTL = 5
+
+// composeFile is the part of a compose file naming the containers of its services
+type composeFile struct {
+	Name     string                    `yaml:"name"`
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	ContainerName string        `yaml:"container_name"`
+	Hostname      string        `yaml:"hostname"`
+	Image         string        `yaml:"image"`
+	Labels        composeLabels `yaml:"labels"`
+}
+
+// composeLabels are the labels of a compose service, in the map or the list (KEY=VALUE) syntax
+type composeLabels map[string]string
+
+func (labels *composeLabels) UnmarshalYAML(node *yaml.Node) error {
+	*labels = make(composeLabels)
+	if node.Kind == yaml.MappingNode {
+		return node.Decode((*map[string]string)(labels))
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	for _, label := range list {
+		key, value, _ := strings.Cut(label, "=")
+		(*labels)[key] = value
+	}
+	return nil
+}
+
+// composeProjectRegexp matches the characters compose drops from the directory name of the default project name
+var composeProjectRegexp = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// composeContainers returns the containers the compose file would create, one per service, with the names and
+// labels set by compose. The project is the name of the file, or the name of its directory like compose does.
+func composeContainers(file string, data []byte) ([]*dockerapi.Container, error) {
+	var compose composeFile
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, err
+	}
+	project := compose.Name
+	if project == "" {
+		dir, err := filepath.Abs(filepath.Dir(file))
+		if err != nil {
+			return nil, err
+		}
+		project = composeProjectRegexp.ReplaceAllString(strings.ToLower(filepath.Base(dir)), "")
+	}
+
+	var services []string
+	for service := range compose.Services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	var containers []*dockerapi.Container
+	for i, service := range services {
+		definition := compose.Services[service]
+		name := definition.ContainerName
+		if name == "" {
+			name = fmt.Sprintf("%s-%s-1", project, service)
+		}
+		labels := map[string]string{
+			"com.docker.compose.project":          project,
+			"com.docker.compose.service":          service,
+			"com.docker.compose.container-number": "1",
+		}
+		for key, value := range definition.Labels {
+			labels[key] = value
+		}
+		containers = append(containers, &dockerapi.Container{
+			ID:              fmt.Sprintf("%064x", i),
+			Name:            "/" + name,
+			Config:          &dockerapi.Config{Hostname: definition.Hostname, Image: definition.Image, Labels: labels},
+			HostConfig:      &dockerapi.HostConfig{},
+			NetworkSettings: &dockerapi.NetworkSettings{},
+		})
+	}
+	return containers, nil
+}
+
+// loadComposeFile pre-registers the names the containers of the services of the compose file will have, answered
+// with the placeholder address until the containers start. The names are resolved like the names of the
+// containers, so the resolvers must be configured.
+func (dd *DockerDiscovery) loadComposeFile(file string, placeholder net.IP) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	containers, err := composeContainers(file, data)
+	if err != nil {
+		return err
+	}
+	if placeholder == nil {
+		if len(dd.hostIPs) > 0 {
+			placeholder = dd.hostIPs[0]
+		} else if placeholder, err = detectHostIP(); err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	for _, container := range containers {
+		if !dd.allowed(container) {
+			continue
+		}
+		domains, _ := dd.resolveDomainsByContainer(container)
+		for _, domain := range domains {
+			dd.composeNames[strings.ToLower(dns.Fqdn(domain))] = placeholder
+			count++
+		}
+	}
+	log.Printf("[docker] Pre-registered %d names of the %d services of %s, answered with %s until they start", count, len(containers), file, placeholder)
+	return nil
+}
+
+// composeRecords answers the A and AAAA queries of the pre-registered compose names with their placeholder address.
+// The caller must hold the lock.
+func (dd *DockerDiscovery) composeRecords(name string, qtype uint16) []dns.RR {
+	placeholder, ok := dd.composeNames[name]
+	if !ok {
+		return nil
+	}
+	var answers []dns.RR
+	if qtype == dns.TypeA && placeholder.To4() != nil {
+		answers = a(name, []net.IP{placeholder})
+	} else if qtype == dns.TypeAAAA && placeholder.To4() == nil {
+		answers = aaaa(name, []net.IP{placeholder})
+	}
+	for _, rr := range answers {
+		rr.Header().Ttl = composePlaceholderTTL
+	}
+	return answers
+}
@@ -0,0 +1,134 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// watchRetryInterval is how long to wait before connecting to docker again after the first failure, the wait
+// doubles with every failed attempt up to watchRetryMaxInterval
+const watchRetryInterval = 5 * time.Second
+
+// watchRetryMaxInterval bounds the wait between the attempts to connect to docker
+const watchRetryMaxInterval = time.Minute
+
+// defaultUnhealthyAfter is how long docker can be unreachable before the health check of the status page fails
+const defaultUnhealthyAfter = time.Minute
+
+// connectionLogInterval is how often the errors of a docker daemon staying unreachable are logged
+const connectionLogInterval = time.Minute
+
+// connectionState tracks the failed attempts to watch docker since the last successful sync, so a daemon down is
+// logged once per connectionLogInterval rather than on every retry. It's guarded by connectionMu.
+type connectionState struct {
+	connected bool      // synced with docker and watching its events
+	failures  int       // failed attempts since the last successful sync
+	since     time.Time // first failed attempt
+	logged    time.Time // last failure logged
+	lastError error
+}
+
+// fail records a failed attempt, it reports whether it should be logged.
+func (connection *connectionState) fail(now time.Time) bool {
+	connection.connected = false
+	connection.failures++
+	if connection.failures == 1 {
+		connection.since = now
+	}
+	if connection.failures > 1 && now.Sub(connection.logged) < connectionLogInterval {
+		return false
+	}
+	connection.logged = now
+	return true
+}
+
+// retryIn returns the wait before the next attempt: watchRetryInterval after the first failure, doubling with every
+// other one up to watchRetryMaxInterval.
+func (connection *connectionState) retryIn() time.Duration {
+	wait := watchRetryInterval
+	for i := 1; i < connection.failures && wait < watchRetryMaxInterval; i++ {
+		wait *= 2
+	}
+	if wait > watchRetryMaxInterval {
+		wait = watchRetryMaxInterval
+	}
+	return wait
+}
+
+// disconnected records the loss of the connection to docker, or a failed attempt to connect again. It returns the
+// wait before the next attempt.
+func (dd *DockerDiscovery) disconnected(err error) time.Duration {
+	dockerConnected.WithLabelValues(dd.dockerEndpoint).Set(0)
+	dd.connectionMu.Lock()
+	defer dd.connectionMu.Unlock()
+	dd.connection.lastError = err
+	logged := dd.connection.fail(time.Now())
+	wait := dd.connection.retryIn()
+	if !logged {
+		return wait
+	}
+	if dd.connection.failures == 1 {
+		log.Printf("[docker] Error watching docker, reconnecting in %s: %s", wait, err)
+		return wait
+	}
+	log.Printf("[docker] Docker still unreachable after %d attempts in %s, reconnecting in %s: %s",
+		dd.connection.failures, time.Since(dd.connection.since).Round(time.Second), wait, err)
+	return wait
+}
+
+// connected records the successful sync with docker after connecting to it.
+func (dd *DockerDiscovery) connected() {
+	dockerConnected.WithLabelValues(dd.dockerEndpoint).Set(1)
+	dd.connectionMu.Lock()
+	defer dd.connectionMu.Unlock()
+	if dd.connection.failures > 1 {
+		log.Printf("[docker] Connected to docker again after %d attempts in %s", dd.connection.failures, time.Since(dd.connection.since).Round(time.Second))
+	}
+	dd.connection = connectionState{connected: true}
+}
+
+// Connection returns the state of the connection to docker. While disconnected, the last known records are
+// answered.
+func (dd *DockerDiscovery) Connection() ConnectionStatus {
+	dd.connectionMu.Lock()
+	defer dd.connectionMu.Unlock()
+	status := ConnectionStatus{Endpoint: dd.dockerEndpoint, Connected: dd.connection.connected, Failures: dd.connection.failures}
+	if dd.connection.failures > 0 {
+		since := dd.connection.since
+		status.DisconnectedSince = &since
+	}
+	if dd.connection.lastError != nil {
+		status.LastError = dd.connection.lastError.Error()
+	}
+	return status
+}
+
+// Ready implements the Readiness interface of the ready plugin: the server block is ready once the initial sync
+// with every docker host is done and their events are watched. Only the first instance of the chain of docker hosts
+// is registered, it answers for all of them.
+func (dd *DockerDiscovery) Ready() bool {
+	peers := dd.peers
+	if len(peers) == 0 {
+		peers = []*DockerDiscovery{dd}
+	}
+	for _, peer := range peers {
+		if !peer.Connection().Connected {
+			return false
+		}
+	}
+	return true
+}
+
+// unhealthy returns why the plugin is unhealthy: docker unreachable for longer than unhealthy_after, nil otherwise.
+// The last known records are still answered meanwhile.
+func (dd *DockerDiscovery) unhealthy() error {
+	status := dd.Connection()
+	if status.Connected || status.DisconnectedSince == nil || dd.unhealthyAfter == 0 {
+		return nil
+	}
+	if down := time.Since(*status.DisconnectedSince); down > dd.unhealthyAfter {
+		return fmt.Errorf("docker %s unreachable for %s: %s", dd.dockerEndpoint, down.Round(time.Second), status.LastError)
+	}
+	return nil
+}
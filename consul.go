@@ -0,0 +1,179 @@
+package dockerdiscovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// consulDefaultPrefix is the Consul KV prefix of the records by default
+const consulDefaultPrefix = "dockerdiscovery"
+
+// consulMaxTxnOps is the limit of operations in a Consul transaction
+const consulMaxTxnOps = 64
+
+// consulTokenEnv is the ACL token of the Consul requests, as for the Consul CLI
+const consulTokenEnv = "CONSUL_HTTP_TOKEN"
+
+// consulBackend writes the records of the containers to the Consul KV store, one key per domain and container,
+// <prefix>/<domain>/<short container ID>, the value being the SkyDNS record written to etcd. The prefix belongs to
+// this instance: the keys under it which aren't records of the containers are deleted.
+type consulBackend struct {
+	url     string // of the Consul HTTP API, e.g. http://127.0.0.1:8500
+	prefix  string
+	token   string
+	client  *http.Client
+	written map[string]string // records known to be written, by key
+	adopted bool              // whether the records written before this run are loaded
+}
+
+// consulKV is a key of the KV store as listed by the Consul API
+type consulKV struct {
+	Key   string
+	Value []byte // base64 in JSON
+}
+
+// consulTxnOp is an operation of a Consul transaction
+type consulTxnOp struct {
+	KV consulTxnKV
+}
+
+type consulTxnKV struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+}
+
+func newConsulBackend(url, prefix string) *consulBackend {
+	return &consulBackend{
+		url:     strings.TrimSuffix(url, "/"),
+		prefix:  strings.Trim(prefix, "/"),
+		token:   os.Getenv(consulTokenEnv),
+		client:  &http.Client{Timeout: backendTimeout},
+		written: make(map[string]string),
+	}
+}
+
+func (backend *consulBackend) name() string {
+	return "consul"
+}
+
+func (backend *consulBackend) sync(ctx context.Context, containers []*ContainerInfo) error {
+	if !backend.adopted {
+		if err := backend.adopt(ctx); err != nil {
+			return err
+		}
+	}
+
+	records := make(map[string]string)
+	for _, containerInfo := range containers {
+		for _, key := range backend.keys(containerInfo) {
+			records[key] = containerInfo.etcdRecord
+		}
+	}
+	ops := consulOps(backend.written, records)
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > consulMaxTxnOps {
+			n = consulMaxTxnOps
+		}
+		body, err := json.Marshal(ops[:n])
+		if err != nil {
+			return err
+		}
+		resp, err := backend.do(ctx, http.MethodPut, "/v1/txn", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s of the transaction", resp.Status)
+		}
+		for _, op := range ops[:n] {
+			if op.KV.Verb == "set" {
+				backend.written[op.KV.Key] = string(op.KV.Value)
+			} else {
+				delete(backend.written, op.KV.Key)
+			}
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// adopt loads the records written before this run, e.g. by CoreDNS before a restart, so the records of the
+// containers removed meanwhile are deleted by the next sync.
+func (backend *consulBackend) adopt(ctx context.Context) error {
+	resp, err := backend.do(ctx, http.MethodGet, "/v1/kv/"+backend.prefix+"/?recurse=true", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var kvs []consulKV
+		if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			backend.written[kv.Key] = string(kv.Value)
+		}
+	case http.StatusNotFound: // nothing written yet
+	default:
+		return fmt.Errorf("unexpected status %s listing %s", resp.Status, backend.prefix)
+	}
+	backend.adopted = true
+	return nil
+}
+
+// reload drops the records known to be written, the next sync loads them from Consul again and writes the ones
+// missing or modified there.
+func (backend *consulBackend) reload() {
+	backend.written = make(map[string]string)
+	backend.adopted = false
+}
+
+func (backend *consulBackend) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, backend.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if backend.token != "" {
+		req.Header.Set("X-Consul-Token", backend.token)
+	}
+	return backend.client.Do(req)
+}
+
+// keys returns the Consul keys of the records of the container
+func (backend *consulBackend) keys(containerInfo *ContainerInfo) []string {
+	var keys []string
+	for _, domain := range containerInfo.domains {
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		keys = append(keys, backend.prefix+"/"+domain+"/"+containerInfo.container.ID[:12])
+	}
+	return keys
+}
+
+// consulOps returns the operations turning the written records into the wanted ones, sorted by key. Unchanged
+// records are not written again.
+func consulOps(written, records map[string]string) []consulTxnOp {
+	var ops []consulTxnOp
+	for key, value := range records {
+		if previous, ok := written[key]; !ok || previous != value {
+			ops = append(ops, consulTxnOp{KV: consulTxnKV{Verb: "set", Key: key, Value: []byte(value)}})
+		}
+	}
+	for key := range written {
+		if _, ok := records[key]; !ok {
+			ops = append(ops, consulTxnOp{KV: consulTxnKV{Verb: "delete", Key: key}})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].KV.Key < ops[j].KV.Key })
+	return ops
+}
@@ -0,0 +1,67 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/backends"
+)
+
+// eventCursorInterval is how often the event cursor is saved to the event_cursor_file
+const eventCursorInterval = time.Second
+
+// advanceEventCursor records the time of a handled event, the cursor never goes back as the events are
+// handled concurrently.
+func (dd *DockerDiscovery) advanceEventCursor(timeNano int64) {
+	for {
+		lastEvent := atomic.LoadInt64(&dd.lastEvent)
+		if timeNano <= lastEvent || atomic.CompareAndSwapInt64(&dd.lastEvent, lastEvent, timeNano) {
+			return
+		}
+	}
+}
+
+// loadEventCursor reads the event cursor saved by a previous run, a missing file means no cursor.
+func (dd *DockerDiscovery) loadEventCursor() error {
+	data, err := os.ReadFile(dd.eventCursorFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lastEvent, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&dd.lastEvent, lastEvent)
+	log.Printf("[docker] Replaying the docker events since %s", time.Unix(0, lastEvent))
+	return nil
+}
+
+// persistEventCursor saves the event cursor to the event_cursor_file when it moved, until the final shutdown
+func (dd *DockerDiscovery) persistEventCursor() {
+	saved := atomic.LoadInt64(&dd.lastEvent)
+	ticker := time.NewTicker(eventCursorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dd.ctx.Done():
+			return
+		}
+		lastEvent := atomic.LoadInt64(&dd.lastEvent)
+		if lastEvent == saved {
+			continue
+		}
+		if err := backends.WriteFileAtomic(dd.eventCursorFile, []byte(strconv.FormatInt(lastEvent, 10)+"\n")); err != nil {
+			log.Printf("[docker] Error saving the event cursor: %s", err)
+			continue
+		}
+		saved = lastEvent
+	}
+}
@@ -0,0 +1,115 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// debugRecord is an entry of the record table as held in memory, served by the debug dump
+type debugRecord struct {
+	ContainerRecord
+	Networks map[string]string `json:"networks"` // addresses of the container by network name
+	Added    time.Time         `json:"added"`
+	Updated  time.Time         `json:"updated"`           // last update from docker
+	Removed  *time.Time        `json:"removed,omitempty"` // set for the stale entries answered by serve_stale
+}
+
+// debugRecords returns the entries of the record table, the stale ones included, sorted by name
+func (dd *DockerDiscovery) debugRecords() []debugRecord {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	var records []debugRecord
+	for _, containerInfos := range []ContainerInfoMap{dd.containerInfoMap, dd.staleContainerInfoMap} {
+		for _, containerInfo := range containerInfos {
+			record := debugRecord{
+				ContainerRecord: dd.containerRecord(containerInfo),
+				Networks:        make(map[string]string),
+				Added:           containerInfo.added,
+				Updated:         containerInfo.updated,
+			}
+			for name, network := range containerInfo.container.NetworkSettings.Networks {
+				record.Networks[name] = joinAddresses(net.ParseIP(network.IPAddress), net.ParseIP(network.GlobalIPv6Address))
+			}
+			if !containerInfo.removed.IsZero() {
+				removed := containerInfo.removed
+				record.Removed = &removed
+			}
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+// debugHandler serves the dump of the record table on GET /records, in plain text, or in JSON for the clients
+// accepting it, to see why a name is answered wrong.
+func (dd *DockerDiscovery) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/records", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		records := dd.debugRecords()
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(records)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, record := range records {
+			fmt.Fprintf(w, "%s (%s) %s\n", record.Name, record.ID[:12], record.Image)
+			fmt.Fprintf(w, "  address: %s (%s)\n", joinAddresses(record.Address, record.Address6), record.Network)
+			var networks []string
+			for name, addresses := range record.Networks {
+				networks = append(networks, name+"="+addresses)
+			}
+			sort.Strings(networks)
+			fmt.Fprintf(w, "  networks: %s\n", strings.Join(networks, " "))
+			fmt.Fprintf(w, "  domains: %s\n", strings.Join(record.Domains, " "))
+			fmt.Fprintf(w, "  added: %s, updated: %s (%s ago)\n", record.Added.Format(time.RFC3339),
+				record.Updated.Format(time.RFC3339), time.Since(record.Updated).Round(time.Second))
+			if record.Exited != nil {
+				fmt.Fprintf(w, "  exited: %s, code %d\n", record.Exited.Format(time.RFC3339), *record.ExitCode)
+			}
+			if record.Removed != nil {
+				fmt.Fprintf(w, "  removed: %s, served stale\n", record.Removed.Format(time.RFC3339))
+			}
+		}
+	})
+	return mux
+}
+
+// startDebug starts listening for the debug dump, if enabled.
+func (dd *DockerDiscovery) startDebug() error {
+	if dd.debugAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", dd.debugAddress)
+	if err != nil {
+		return err
+	}
+	dd.debugServer = &http.Server{Handler: dd.debugHandler()}
+	go dd.debugServer.Serve(listener)
+	log.Printf("[docker] Debug dump listening on %s", listener.Addr())
+	return nil
+}
+
+// stopDebug stops the debug dump, on reload it's closed before the new instance listens on the same address.
+func (dd *DockerDiscovery) stopDebug() error {
+	if dd.debugServer == nil {
+		return nil
+	}
+	err := dd.debugServer.Shutdown(context.Background())
+	dd.debugServer = nil
+	return err
+}
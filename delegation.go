@@ -0,0 +1,55 @@
+package dockerdiscovery
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// delegateLabel lets a container (e.g. a Samba AD DC or another DNS server) claim sub-zones, comma separated
+const delegateLabel = "coredns.dockerdiscovery.delegate"
+
+// delegatedZones returns the sub-zones delegated to the container (lower case, with trailing dot)
+func delegatedZones(containerInfo *ContainerInfo) []string {
+	var zones []string
+	for _, zone := range strings.Split(containerInfo.container.Config.Labels[delegateLabel], ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zones = append(zones, dns.Fqdn(strings.ToLower(zone)))
+		}
+	}
+	return zones
+}
+
+// referral returns the NS records of the delegated zone the name belongs to, with the glue records of the
+// name servers, the containers claiming it. The most specific zone wins.
+func (dd *DockerDiscovery) referral(qname string) (ns, glue []dns.RR) {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	name := strings.ToLower(qname)
+	zone := ""
+	var servers []*ContainerInfo
+	for _, containerInfo := range dd.containerInfoMap {
+		for _, delegated := range delegatedZones(containerInfo) {
+			if !dns.IsSubDomain(delegated, name) || len(delegated) < len(zone) {
+				continue
+			}
+			if len(delegated) > len(zone) {
+				zone, servers = delegated, nil
+			}
+			servers = append(servers, containerInfo)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].container.ID < servers[j].container.ID })
+
+	for _, containerInfo := range servers {
+		target := dns.Fqdn(strings.ToLower(containerInfo.domains[0]))
+		ns = append(ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: dd.ttl},
+			Ns:  target,
+		})
+		glue = append(glue, containerGlue(target, containerInfo)...)
+	}
+	return ns, glue
+}
@@ -0,0 +1,8 @@
+// Package discovery holds the types and the errors of the Go API of the docker discovery plugin: the records of the
+// containers, the record table, the resolver configurations and the status of the discovery. They only depend on
+// the standard library, so the admin and backends packages and the programs consuming the API (e.g. the JSON of the
+// admin API or of the webhook) use them without CoreDNS.
+//
+// The discovery engine itself, *dockerdiscovery.DockerDiscovery, is part of the CoreDNS plugin: it watches docker,
+// keeps the record table and answers the DNS queries, so using it requires CoreDNS.
+package discovery
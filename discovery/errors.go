@@ -0,0 +1,44 @@
+package discovery
+
+import "errors"
+
+// The failure modes of the discovery. The errors returned are wrapped with their context (the container, network
+// or backend), errors.Is tells them apart.
+var (
+	// ErrNoNetwork is the network the address of a container is taken from missing from its settings, e.g. while
+	// the container is disconnected from it
+	ErrNoNetwork = errors.New("unable to find network settings")
+	// ErrNoAddress is a container without address in the network it's answered from
+	ErrNoAddress = errors.New("no address")
+	// ErrRecordLimit is a container not registered as the max_records limit is reached
+	ErrRecordLimit = errors.New("record limit reached")
+	// ErrDockerUnavailable is a docker API call failing for a reason which tells nothing about the container, e.g.
+	// a busy or restarting daemon
+	ErrDockerUnavailable = errors.New("docker unavailable")
+	// ErrBackendUnavailable is a backend failing to publish the record table, e.g. etcd unreachable
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrInvalidResolver is a resolver configuration which can't be enabled, e.g. an invalid domain
+	ErrInvalidResolver = errors.New("invalid resolver")
+	// ErrNoResolver is the removal of a resolver which isn't enabled
+	ErrNoResolver = errors.New("resolver not enabled")
+	// ErrNoClaim is the approval or rejection of a container which isn't held
+	ErrNoClaim = errors.New("no pending claim")
+)
+
+// BackendError is the failure of a backend to publish the record table, it is an ErrBackendUnavailable
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+func (err *BackendError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *BackendError) Unwrap() error {
+	return err.Err
+}
+
+func (err *BackendError) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
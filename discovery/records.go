@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"net"
+	"time"
+)
+
+// ContainerRecord is a snapshot of a discovered container and its domains
+type ContainerRecord struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Image   string `json:"image"`
+	Network string `json:"network"`
+	Address net.IP `json:"address"`
+	// Address6 is the IPv6 address of dual-stack or IPv6-only containers
+	Address6 net.IP   `json:"address6,omitempty"`
+	Domains  []string `json:"domains"` // without trailing dot
+	// ExitCode and Exited are set for the exited containers whose records are kept by keep_exited
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Exited   *time.Time `json:"exited,omitempty"`
+	// PreviousAddress and PreviousAddress6 are set by the webhook for the containers whose addresses changed since
+	// the last post (e.g. restarted or reconnected), so allow-lists can drop the old ones
+	PreviousAddress  net.IP `json:"previous_address,omitempty"`
+	PreviousAddress6 net.IP `json:"previous_address6,omitempty"`
+}
+
+// RecordTable is the record table exported and imported by the admin API, e.g. to migrate the names of a docker
+// host to another one or restore them after a disaster
+type RecordTable struct {
+	Version   uint64              `json:"version"`
+	Records   map[string][]string `json:"records"`   // addresses of the names, the containers' and the imported ones
+	Overrides map[string]string   `json:"overrides"` // overridden names and their address
+	Rcodes    map[string]string   `json:"rcodes"`    // names whose response code is forced, and the code
+}
+
+// PendingClaim is a container held out of the answers with approve_conflicts, as it claims names owned by other
+// containers or record directives, until it's approved or rejected
+type PendingClaim struct {
+	ID        string    `json:"id"`
+	Container string    `json:"container"`
+	Names     []string  `json:"names"`  // names claimed which are already owned
+	Owners    []string  `json:"owners"` // containers owning them, "record" for the record directives
+	Since     time.Time `json:"since"`
+}
+
+// ResolverConfig is a resolver as configured by its directive, in the admin API
+type ResolverConfig struct {
+	Name     string   `json:"name"`               // label, name, hostname, compose, alias, registrator or template
+	Domain   string   `json:"domain,omitempty"`   // suffix of the names of name, hostname, compose, alias and registrator
+	Network  string   `json:"network,omitempty"`  // network of the aliases of alias, all of them by default
+	Labels   []string `json:"labels,omitempty"`   // labels holding the names of label
+	Template string   `json:"template,omitempty"` // Go template of the names of template
+}
@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"time"
+)
+
+// Status is the summary of the discovery served by the status page
+type Status struct {
+	Endpoint   string               `json:"endpoint"`
+	Connected  bool                 `json:"connected"`
+	Containers int                  `json:"containers"`
+	Records    int                  `json:"records"`             // names answered with the container addresses
+	LastSync   *time.Time           `json:"last_sync,omitempty"` // last full listing of the containers
+	SyncAge    *float64             `json:"last_sync_age_seconds,omitempty"`
+	Zones      []ZoneStatus         `json:"zones"` // freshness of the records, by zone
+	Backends   []BackendStatus      `json:"backends"`
+	Etcd       []EtcdEndpointStatus `json:"etcd_endpoints,omitempty"` // health of the etcd endpoints
+}
+
+// ConnectionStatus is the state of the connection to docker
+type ConnectionStatus struct {
+	Endpoint          string     `json:"endpoint"`
+	Connected         bool       `json:"connected"`
+	Failures          int        `json:"failures,omitempty"` // failed attempts to connect since the connection was lost
+	DisconnectedSince *time.Time `json:"disconnected_since,omitempty"`
+	LastError         string     `json:"last_error,omitempty"`
+}
+
+// BackendStatus is the health of a backend
+type BackendStatus struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	Pending   uint64 `json:"pending"` // changes of the record table not published yet
+	LastError string `json:"last_error,omitempty"`
+	// Err is the last error, a *BackendError, nil while healthy
+	Err error `json:"-"`
+}
+
+// ZoneStatus is the freshness of the records of a zone of the server block
+type ZoneStatus struct {
+	Zone          string    `json:"zone"`
+	LastChange    time.Time `json:"last_change"`             // newest change of the records of the zone
+	LastChangeAge float64   `json:"last_change_age_seconds"` // seconds since the last change
+}
+
+// EtcdEndpointStatus is the health of an etcd endpoint, from its last check
+type EtcdEndpointStatus struct {
+	Endpoint  string `json:"endpoint"`
+	Healthy   bool   `json:"healthy"`
+	InUse     bool   `json:"in_use"` // whether the client sends its requests to the endpoint
+	LastError string `json:"last_error,omitempty"`
+}
+
+// NetworkSubnets are the subnets of a docker network hosting discovered containers
+type NetworkSubnets struct {
+	Network string   `json:"network"`
+	Subnets []string `json:"subnets"`
+}
@@ -0,0 +1,52 @@
+package dockerdiscovery
+
+import (
+	"errors"
+	"net"
+)
+
+const defaultDNS64Prefix = "64:ff9b::/96"
+
+// validDNS64Prefix reports whether the prefix length is one of the lengths allowed by RFC 6052.
+func validDNS64Prefix(prefix *net.IPNet) bool {
+	if prefix.IP.To4() != nil {
+		return false
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 {
+		return false
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// to6 embeds an IPv4 address into the NAT64 prefix according to RFC 6052.
+// Bits 64 to 71 (the "u" octet) are always left zero.
+func to6(prefix *net.IPNet, addr net.IP) (net.IP, error) {
+	addr = addr.To4()
+	if addr == nil {
+		return nil, errors.New("not a valid IPv4 address")
+	}
+
+	n, _ := prefix.Mask.Size()
+	v6 := make(net.IP, net.IPv6len)
+	i, j := 0, 0
+
+	for ; i < n/8; i++ {
+		v6[i] = prefix.IP[i]
+	}
+	for ; i < 8 && j < 4; i, j = i+1, j+1 {
+		v6[i] = addr[j]
+	}
+	if i == 8 {
+		i++
+	}
+	for ; j < 4; i, j = i+1, j+1 {
+		v6[i] = addr[j]
+	}
+
+	return v6, nil
+}
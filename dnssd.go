@@ -0,0 +1,159 @@
+package dockerdiscovery
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// serviceLabel sets the DNS-SD service type of a container, e.g. `http`, `_http._tcp` or `_sip._udp`, instead of
+// the one of its lowest exposed TCP port
+const serviceLabel = "coredns.dockerdiscovery.service"
+
+// serviceTXTLabel holds the comma separated key=value pairs of the DNS-SD TXT record of a container
+const serviceTXTLabel = "coredns.dockerdiscovery.txt"
+
+// servicesEnumeration lists the service types of a zone (RFC 6763 section 9)
+const servicesEnumeration = "_services._dns-sd._udp."
+
+// wellKnownServices are the IANA service names of the common ports, the service types of the containers exposing
+// them without service label
+var wellKnownServices = map[string]string{
+	"21":    "ftp",
+	"22":    "ssh",
+	"25":    "smtp",
+	"80":    "http",
+	"389":   "ldap",
+	"443":   "https",
+	"1883":  "mqtt",
+	"3306":  "mysql",
+	"5432":  "postgresql",
+	"5672":  "amqp",
+	"6379":  "redis",
+	"8080":  "http-alt",
+	"11211": "memcache",
+	"27017": "mongodb",
+}
+
+// serviceInstance is the DNS-SD service instance of a container: <instance>.<service>.<zone>
+type serviceInstance struct {
+	containerInfo *ContainerInfo
+	instance      string // the container name, a single label
+	service       string // e.g. _http._tcp.
+	port          uint16
+}
+
+// containerServiceInstance returns the DNS-SD service instance of the container, false when it has no service
+// type: no service label and no exposed port of a well-known service.
+func (dd *DockerDiscovery) containerServiceInstance(containerInfo *ContainerInfo) (serviceInstance, bool) {
+	labels := containerInfo.container.Config.Labels
+	service, proto := strings.TrimSpace(labels[serviceLabel]), "tcp"
+	if service == "" {
+		service = wellKnownServices[firstExposedPort(containerInfo)]
+	} else if parts := strings.Split(strings.TrimPrefix(service, "_"), "._"); len(parts) == 2 {
+		service, proto = parts[0], parts[1]
+	}
+	if service == "" || (proto != "tcp" && proto != "udp") {
+		return serviceInstance{}, false
+	}
+	exposed := exposedPort(containerInfo, proto)
+	if proto == "tcp" {
+		exposed = firstExposedPort(containerInfo)
+	}
+	port, err := strconv.ParseUint(exposed, 10, 16)
+	if err != nil {
+		return serviceInstance{}, false
+	}
+	return serviceInstance{
+		containerInfo: containerInfo,
+		// the dots of the name are escaped, an instance name is a single label
+		instance: strings.ReplaceAll(strings.ToLower(dd.containerName(containerInfo.container)), ".", `\.`),
+		service:  "_" + strings.ToLower(service) + "._" + proto + ".",
+		port:     uint16(port),
+	}, true
+}
+
+// serviceZones returns the zones the DNS-SD and swarm names are answered under: the server block zones,
+// docker.local when there is none but the root zone.
+func (dd *DockerDiscovery) serviceZones() []string {
+	var zones []string
+	for _, zone := range dd.zones {
+		if zone != "." {
+			zones = append(zones, strings.ToLower(dns.Fqdn(zone)))
+		}
+	}
+	if len(zones) == 0 {
+		zones = []string{defaultDockerDomain + "."}
+	}
+	return zones
+}
+
+// serviceRecords answers the DNS-SD queries (RFC 6763) of the dns_sd directive: the PTR records of the service types
+// of a zone (_services._dns-sd._udp.<zone>) and of the instances of a service type (<service>.<zone>), and the
+// SRV and TXT records of an instance (<instance>.<service>.<zone>). The caller must hold the lock.
+func (dd *DockerDiscovery) serviceRecords(name string, qtype uint16) (answers, extras []dns.RR) {
+	if !dd.dnsSD {
+		return nil, nil
+	}
+	for _, zone := range dd.serviceZones() {
+		if !strings.HasSuffix(name, "."+zone) {
+			continue
+		}
+		rest := strings.TrimSuffix(name, zone)
+		if rest != servicesEnumeration && !strings.HasSuffix(rest, "._tcp.") && !strings.HasSuffix(rest, "._udp.") {
+			return nil, nil // not a DNS-SD name, the containers are not listed
+		}
+
+		var instances []serviceInstance
+		for _, containerInfo := range dd.containerInfoMap {
+			if instance, ok := dd.containerServiceInstance(containerInfo); ok {
+				instances = append(instances, instance)
+			}
+		}
+		sort.Slice(instances, func(i, j int) bool {
+			if instances[i].service != instances[j].service {
+				return instances[i].service < instances[j].service
+			}
+			return instances[i].instance < instances[j].instance
+		})
+
+		header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: dd.ttl}
+		seen := make(map[string]bool)
+		for _, instance := range instances {
+			switch {
+			case rest == servicesEnumeration && qtype == dns.TypePTR:
+				if !seen[instance.service] {
+					seen[instance.service] = true
+					answers = append(answers, &dns.PTR{Hdr: header, Ptr: instance.service + zone})
+				}
+			case rest == instance.service && qtype == dns.TypePTR:
+				answers = append(answers, &dns.PTR{Hdr: header, Ptr: instance.instance + "." + instance.service + zone})
+			case rest == instance.instance+"."+instance.service && qtype == dns.TypeSRV:
+				target := dns.Fqdn(srvTarget(instance.containerInfo))
+				answers = append(answers, &dns.SRV{Hdr: header, Weight: srvWeight(instance.containerInfo), Port: instance.port, Target: target})
+				extras = append(extras, containerGlue(target, instance.containerInfo)...)
+			case rest == instance.instance+"."+instance.service && qtype == dns.TypeTXT:
+				answers = append(answers, &dns.TXT{Hdr: header, Txt: serviceTXT(instance.containerInfo)})
+			}
+		}
+		return answers, extras
+	}
+	return nil, nil
+}
+
+// serviceTXT returns the strings of the DNS-SD TXT record of the container, from its txt label. A record without
+// key is a single empty string (RFC 6763 section 6.1).
+func serviceTXT(containerInfo *ContainerInfo) []string {
+	var txt []string
+	for _, pair := range strings.Split(containerInfo.container.Config.Labels[serviceTXTLabel], ",") {
+		if pair = strings.TrimSpace(pair); pair != "" {
+			txt = append(txt, pair)
+		}
+	}
+	if len(txt) == 0 {
+		return []string{""}
+	}
+	return txt
+}
@@ -0,0 +1,11 @@
+// Package dockerdiscovery is a CoreDNS plugin registering DNS records for docker containers.
+//
+// The plugin is made of a discovery engine, which watches docker and keeps the record table (start,
+// updateContainerInfo, removeContainerInfo and applyChange), and the DNS handler answering from that table
+// (ServeDNS and records). They share the container maps and their lock, and are both part of this package. The
+// packages without CoreDNS are:
+//
+//   - discovery: the types and the errors of the Go API, aliased here
+//   - admin: the HTTP handler of the admin API, serving small interfaces *DockerDiscovery implements
+//   - backends: the zone file, hosts file and webhook backends, publishing the records of the containers
+package dockerdiscovery
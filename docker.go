@@ -0,0 +1,163 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// defaultAPITimeout bounds each docker API call, so a hung (e.g. remote) daemon can't stall the discovery
+const defaultAPITimeout = 10 * time.Second
+
+// eventKeepAlive is the TCP keep-alive period of the connections to the daemon, which detects a dead daemon
+// behind the idle event stream
+const eventKeepAlive = 30 * time.Second
+
+// inspectRetries bounds the retries of the inspections failing with transient errors
+const inspectRetries = 3
+
+// inspectRetryWait is the wait before the first retry, it grows linearly with the next ones
+var inspectRetryWait = time.Second
+
+// transientError is a docker API error which does not tell anything about the container, e.g. a busy or
+// restarting daemon: the records of the container are kept as they are.
+type transientError struct {
+	err error
+}
+
+func (err *transientError) Error() string {
+	return err.err.Error()
+}
+
+func (err *transientError) Unwrap() error {
+	return err.err
+}
+
+func (err *transientError) Is(target error) bool {
+	return target == ErrDockerUnavailable
+}
+
+func isTransient(err error) bool {
+	var transient *transientError
+	return errors.As(err, &transient)
+}
+
+// containerGone reports whether the error means the container does not exist anymore, so its records are removed
+func containerGone(err error) bool {
+	var noSuchContainer *dockerapi.NoSuchContainer
+	return errors.As(err, &noSuchContainer)
+}
+
+// acquireAPI waits for a free slot of the max_concurrent_api limit and returns the function releasing it
+func (dd *DockerDiscovery) acquireAPI() func() {
+	if dd.apiLimiter == nil {
+		return func() {}
+	}
+	dd.apiLimiter <- struct{}{}
+	return func() { <-dd.apiLimiter }
+}
+
+// setAPITimeout applies the api_timeout to the calls of the docker client: the HTTP client timeout bounds the
+// calls without context (e.g. ListNetworks), the dialer the connection of the event stream.
+func (dd *DockerDiscovery) setAPITimeout(client *dockerapi.Client) {
+	client.SetTimeout(dd.apiTimeout)
+	client.Dialer = &net.Dialer{Timeout: dd.apiTimeout, KeepAlive: eventKeepAlive}
+}
+
+func (dd *DockerDiscovery) inspectContainer(ctx context.Context, id string) (*dockerapi.Container, error) {
+	defer stageRegion(ctx, "inspect").End()
+	release := dd.acquireAPI()
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, dd.apiTimeout)
+	defer cancel()
+	return dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: id, Context: ctx})
+}
+
+// inspectContainerRetry inspects the container, retrying the transient errors. The errors other than the
+// container being gone are returned as transient errors. The retries stop when the context is done.
+func (dd *DockerDiscovery) inspectContainerRetry(ctx context.Context, id string) (*dockerapi.Container, error) {
+	container, err := dd.inspectContainer(ctx, id)
+	for i := 1; err != nil && !containerGone(err) && i < inspectRetries; i++ {
+		if !sleepContext(ctx, inspectRetryWait*time.Duration(i)) {
+			break
+		}
+		container, err = dd.inspectContainer(ctx, id)
+	}
+	if err != nil && !containerGone(err) {
+		return nil, &transientError{err}
+	}
+	return container, err
+}
+
+func (dd *DockerDiscovery) listContainers(ctx context.Context) ([]dockerapi.APIContainers, error) {
+	release := dd.acquireAPI()
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, dd.apiTimeout)
+	defer cancel()
+	return dd.dockerClient.ListContainers(dockerapi.ListContainersOptions{Context: ctx})
+}
+
+// listNetworks lists the docker networks. The docker client has no context for this call, only the api_timeout
+// bounds it, the context is checked before.
+func (dd *DockerDiscovery) listNetworks(ctx context.Context) ([]dockerapi.Network, error) {
+	release := dd.acquireAPI()
+	defer release()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return dd.dockerClient.ListNetworks()
+}
+
+// inspectNetwork inspects the docker network, like listNetworks only the api_timeout bounds it
+func (dd *DockerDiscovery) inspectNetwork(ctx context.Context, id string) (*dockerapi.Network, error) {
+	release := dd.acquireAPI()
+	defer release()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return dd.dockerClient.NetworkInfo(id)
+}
+
+// sleepContext waits for the duration, it returns false early when the context is done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recordEvents are the docker events updating the records, whose latency is observed
+var recordEvents = map[string]bool{"container:start": true, "container:die": true, "container:health_status": true,
+	"container:rename": true, "container:pause": true, "container:unpause": true, "container:stop": true,
+	"container:kill": true, "container:destroy": true, "network:connect": true, "network:disconnect": true}
+
+// observeEventLatency exports the time from the docker event to the update of its records. The events replayed
+// after a reconnection count the time disconnected.
+func observeEventLatency(event string, timeNano int64) {
+	if !recordEvents[event] || timeNano == 0 {
+		return
+	}
+	eventLatency.WithLabelValues(event).Observe(time.Since(time.Unix(0, timeNano)).Seconds())
+}
+
+// inspectFailed handles the failed inspection of the container of an event: the records of a container which is
+// gone are removed, they are kept on transient errors.
+func (dd *DockerDiscovery) inspectFailed(event, containerID string, err error) {
+	log.Printf("[docker] Event error %s #%s: %s", event, containerID[:12], err)
+	eventErrorCount.WithLabelValues(event).Inc()
+	countError(err)
+	if !containerGone(err) {
+		return
+	}
+	if err := dd.removeContainerInfo(containerID); err != nil {
+		log.Printf("[docker] Error deleting A record for container: %s: %s", containerID[:12], err)
+	}
+}
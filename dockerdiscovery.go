@@ -3,13 +3,24 @@ package dockerdiscovery
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/etcd/msg"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/request"
 	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/miekg/dns"
@@ -18,9 +29,27 @@ import (
 )
 
 type ContainerInfo struct {
-	container *dockerapi.Container
-	address   net.IP
-	domains   []string // resolved domain
+	container   *dockerapi.Container
+	address     net.IP
+	address6    net.IP          // IPv6 address, nil if none; address is nil for IPv6-only containers
+	network     string          // name of the network the address belongs to
+	domains     []string        // resolved domain
+	groups      []string        // domains of the group the container joined, also in domains
+	aliases     []string        // names of the alias label, answered with a CNAME to the first domain
+	wildcards   []string        // wildcard names, e.g. *.app.loc., answering the subdomains no container owns
+	health      *HealthEndpoint // HTTP healthcheck probe, if any
+	added       time.Time
+	updated     time.Time // when the entry was last updated from docker
+	removed     time.Time // when the container was removed, for stale entries
+	exited      time.Time // when the container exited, for the entries kept by keep_exited
+	exitCode    int
+	ttl         uint32        // TTL of the answers and etcd record, from the ttl label or directive
+	rcode       int           // response code forced by the rcode label, RcodeSuccess for none
+	ramp        time.Duration // ramp up of the share of first answers, from the ramp label, none if 0
+	ptrOptOut   bool          // left out of the PTR answers by the ptr label
+	ptrPriority int           // precedence in the PTR answers of a shared address, from the ptr.priority label
+	servicePort string        // port of the SRV records from the registrator SERVICE_PORT, instead of the exposed one
+	etcdRecord  string        // etcd record written for the container
 }
 
 type ContainerInfoMap map[string]*ContainerInfo
@@ -30,253 +59,947 @@ type ContainerDomainResolver interface {
 	resolve(container *dockerapi.Container) ([]string, error)
 }
 
+// defaultTTL is the TTL of the answers and etcd records
+const defaultTTL = 3600
+
 // DockerDiscovery is a plugin that conforms to the coredns plugin interface
 type DockerDiscovery struct {
-	Next             plugin.Handler
-	dockerEndpoint   string
-	resolvers        []ContainerDomainResolver
-	dockerClient     *dockerapi.Client
-	containerInfoMap ContainerInfoMap
-	domainIPMap      map[string]*net.IP
-	endpoints        []string
-	etcd             *etcdcv3.Client
+	Next                  plugin.Handler
+	dockerEndpoint        string
+	resolvers             []ContainerDomainResolver
+	resolversMu           sync.RWMutex      // guards the resolvers, changed through the admin API
+	addressSelectors      []AddressSelector // chain picking the addresses of the containers
+	hostIPs               []net.IP          // addresses of the host network containers, the bridge gateway if empty
+	dockerClient          *dockerapi.Client
+	shared                *sharedDocker // the client shared with the server blocks watching the same endpoint
+	dockerTLSCert         string        // client certificate file of the docker daemon, with dockerTLSKey
+	dockerTLSKey          string        // client key file of the docker daemon
+	dockerTLSCA           string        // CA certificate file the certificate of the docker daemon is verified with
+	containerInfoMap      ContainerInfoMap
+	addressIndex          map[string][]*ContainerInfo // containers by address, for the PTR answers
+	domainIndex           map[string][]*ContainerInfo // containers by lower case FQDN and wildcard name, in registration order
+	endpoints             []string
+	etcdDiscovery         string        // DNS SRV name the etcd endpoints are discovered from, instead of endpoints
+	etcdPrefix            string        // template of the zone-specific etcd key prefixes, empty for /docker/docker
+	etcdZones             []string      // zones of the etcd keys with etcdPrefix, empty for the server block zones
+	etcdLease             bool          // write the etcd records with a lease kept alive, revoked on the final shutdown
+	etcdLeaseTTL          time.Duration // TTL of the lease, 0 for the TTL of the answers
+	etcdFallback          bool          // answer the names missing here with the etcd records of the other docker hosts
+	etcdPurge             bool          // delete the etcd records of the instance on the final shutdown
+	etcdOwner             string        // owner of the etcd records of the instance, empty for the hostname and endpoint
+	etcdTLS               *tls.Config
+	etcdUsername          string
+	etcdPassword          string
+	backends              []*backendQueue
+	staticRecords         []dns.RR     // records of the record directives
+	queryLog              *queryLogger // nil to not log the queries
+	compress              bool         // compress the answers, answers too large otherwise are compressed anyway
+	maxUDPSize            int          // limit of the UDP answers below the client's buffer size, 0 for no limit
+	etcd                  *etcdcv3.Client
+	etcdHealth            *etcdHealth           // health of the etcd endpoints, nil until connected
+	names                 nameRules             // normalization of the container names of the records and etcd keys
+	dns64Prefix           *net.IPNet            // synthesize AAAA records for IPv4 containers when set
+	dnsSD                 bool                  // answer the DNS-SD service instances of the containers
+	roundRobin            bool                  // shuffle the addresses of the names owned by several containers
+	swarm                 bool                  // answer the services and tasks of the swarm
+	swarmNames            map[string][]net.IP   // addresses of the swarm services and tasks by lower case FQDN
+	hostFacts             []string              // facts of the docker host answered for the containers, empty for none
+	hostInfo              *dockerapi.DockerInfo // the docker host, loaded with hostFacts or hostSuffixFromInfo
+	runtime               string                // docker, podman or auto of the runtime directive
+	podman                int32                 // 1 when the runtime is podman, set or detected; atomic
+	txtMetadata           bool                  // answer the TXT queries of the container names with their metadata
+	wildcards             bool                  // answer the subdomains of the container domains, *.<domain>
+	metadataLabels        []string              // patterns of the labels answered with txtMetadata
+	hostSuffix            string                // label of the docker host inserted in the domains, empty for none
+	hostSuffixFromInfo    bool                  // the host label is the name of the docker host
+	hostSuffixMerge       bool                  // the names are also answered without the host label while unique
+	userNetworksFirst     bool                  // the user-defined networks come before the default bridge
+	peers                 []*DockerDiscovery    // the instances of the docker hosts of the server block
+	portsZone             string                // zone answering the published ports, empty for none
+	networkZones          map[string]string     // zones of the network directive by network name, lower case FQDNs
+	networkInfoMap        NetworkInfoMap
+	internalNames         []string        // answered with the gateway of the client's network
+	shadowDomains         map[string]bool // domains last registered by "shadow-only" containers, never answered while they are down
+	zones                 []string        // zones of the server block, every domain is registered under each of them
+	fall                  fall.F          // zones of the fallthrough directive, the unknown names are passed to the next plugin
+	strictNames           bool            // reject domains which are not valid hostnames (e.g. with underscores)
+	maxRecords            int             // limit of registered domains, 0 for no limit
+	limitPolicy           string          // what happens when the limit is reached: refuse or evict
+	synced                chan struct{}   // closed once the initial container sync is done
+	syncTimeout           time.Duration   // how long queries wait for the initial sync, 0 to not wait
+	queryBudget           time.Duration   // time the lookups of a query may take before it's passed to the next plugin, 0 for none
+	lameDuck              time.Duration   // drain period before the shutdown, 0 to shut down immediately
+	draining              int32           // set (atomically) during the lame duck period
+	prometheusSDFile      string          // Prometheus file_sd targets of the scraped containers
+	acmeChallenges        map[string][]string
+	ttlJitter             int                      // percent of the TTL randomly added or removed in answers
+	ttlRamp               time.Duration            // uptime after which the containers get the full TTL, 0 to not scale it
+	ttlRampMin            uint32                   // TTL of the containers which just started, with ttlRamp
+	serveStale            time.Duration            // how long removed containers are still answered, 0 to not serve stale
+	staleTTL              uint32                   // TTL of the stale answers
+	keepClean             time.Duration            // how long the records of cleanly exited containers are kept
+	keepCrashed           time.Duration            // how long the records of crashed containers are kept
+	oneShotLifetime       time.Duration            // how long one-shot containers are registered before checking them, 0 for ever
+	resyncInterval        time.Duration            // how often all the containers are listed again, 0 only on connection
+	onlyImages            []string                 // patterns of the images registered, empty to register all the images
+	onlyProjects          []string                 // patterns of the compose projects registered, empty for all the containers
+	filters               []containerFilter        // terms of the filter directives the containers registered match
+	hideByDefault         bool                     // register only the containers with the enable label, expose_by_default false
+	requireHealthy        bool                     // register the containers with a healthcheck only while they are healthy
+	hidePaused            bool                     // remove the records of the paused containers until they are unpaused
+	restartPolicies       map[string]restartPolicy // TTL and grace period by restart policy, of the restart_policy directives
+	selfPolicy            string                   // register or exclude the container of CoreDNS, empty to handle it like the others
+	selfID                string                   // ID of the container of CoreDNS, detected with the self directive
+	selfHostname          string                   // hostname of CoreDNS, when its container ID is not found in /proc
+	soa                   *soaConfig               // SOA record of the zone apexes, nil to not answer it
+	nameServers           []string                 // NS records of the zone apexes
+	hostAddresses         map[string]net.IP        // by network ("*" for all), answered to the clients outside of the docker networks
+	clientAddresses       []clientAddress          // answered to the clients of their subnet, first match wins
+	annotateClients       []*net.IPNet             // subnets of the resolvers whose answers carry the containers as EDNS0 options
+	internalClients       []*net.IPNet             // subnets of the clients answered the container addresses, besides the docker networks
+	staleContainerInfoMap ContainerInfoMap
+	apiLimiter            chan struct{}            // limits concurrent docker API calls, nil for no limit
+	apiTimeout            time.Duration            // bounds each docker API call
+	ipv4Networks          []string                 // networks the IPv4 addresses are taken from, by preference
+	ipv6Networks          []string                 // networks the IPv6 addresses are taken from, by preference
+	addressFamily         int                      // 4 or 6 to only store and answer this address family, 0 for both
+	lastEvent             int64                    // time (unix nano) of the last docker event handled, set atomically
+	eventCursorFile       string                   // where lastEvent is saved across restarts, empty to not save it
+	overrides             map[string]net.IP        // names answered instead of the containers, set by hand
+	rcodes                map[string]int           // response codes forced by name with SetRcode
+	approveConflicts      bool                     // hold the containers claiming names already owned until approved
+	approvalWebhook       string                   // URL notified of the claims held
+	pendingClaims         map[string]*PendingClaim // claims held by container ID
+	claimDecisions        map[string]bool          // approval of the claims decided, by container ID
+	aliases               map[string]string        // targets of the alias directive by name, lower case FQDNs
+	importedNames         map[string][]net.IP      // addresses of the names imported by ImportTable until a container owns them, by lower case FQDN
+	composeNames          map[string]net.IP        // placeholder addresses of the names of the compose_file services by lower case FQDN
+	version               uint64                   // version of the record table, increased (atomically) by every change
+	ttl                   uint32                   // TTL of the answers and etcd records
+	overridesFile         string                   // where the overrides are saved, empty to not persist them
+	adminAddress          string                   // listen address of the admin API, empty to disable it
+	admin                 *http.Server
+	statusAddress         string // listen address of the status page, empty to disable it
+	statusServer          *http.Server
+	debugAddress          string // listen address of the debug dump of the records, empty to disable it
+	debugServer           *http.Server
+	unhealthyAfter        time.Duration          // how long docker can be unreachable before the health check fails
+	lastSync              time.Time              // time of the last full listing of the containers
+	zoneChanges           map[string]time.Time   // time of the newest change of the records, by zone
+	overridesMu           sync.Mutex             // serializes the changes of the overrides and their saving
+	teardowns             map[string]*teardown   // die events collected by compose project
+	teardownMu            sync.Mutex             // guards teardowns
+	reconnects            map[string]*time.Timer // containers disconnected awaiting their reconnection, by ID
+	reconnectMu           sync.Mutex             // guards reconnects
+	events                *eventQueue            // docker events waiting for the workers
+	eventWorkers          int                    // number of docker events handled at once
+	connection            connectionState        // state of the connection to docker, updated by the watch loop
+	faultInjection        bool                   // the fault injection mode, enabled by the environment
+	faults                faults                 // faults injected in the fault injection mode, guarded by mu
+	connectionMu          sync.Mutex             // guards connection
+	ctx                   context.Context        // done on the shutdown, bounds the docker and etcd calls
+	stop                  context.CancelFunc     // cancels ctx
+	running               sync.WaitGroup         // goroutines of the instance, waited for by the shutdown
+	replaced              int32                  // 1 while a Corefile reload replaces the instance; atomic
+	shutdownOnce          sync.Once
+
+	mu sync.RWMutex // guards the container (live and stale) maps and their indexes, the network, shadow, ACME and override maps
 }
 
 // NewDockerDiscovery constructs a new DockerDiscovery object
-func NewDockerDiscovery(dockerEndpoint string) DockerDiscovery {
-	return DockerDiscovery{
-		dockerEndpoint:   dockerEndpoint,
-		containerInfoMap: make(ContainerInfoMap),
+func NewDockerDiscovery(dockerEndpoint string) *DockerDiscovery {
+	ctx, stop := context.WithCancel(context.Background())
+	return &DockerDiscovery{
+		dockerEndpoint:        dockerEndpoint,
+		containerInfoMap:      make(ContainerInfoMap),
+		addressIndex:          make(map[string][]*ContainerInfo),
+		domainIndex:           make(map[string][]*ContainerInfo),
+		staleContainerInfoMap: make(ContainerInfoMap),
+		networkInfoMap:        make(NetworkInfoMap),
+		shadowDomains:         make(map[string]bool),
+		synced:                make(chan struct{}),
+		acmeChallenges:        make(map[string][]string),
+		overrides:             make(map[string]net.IP),
+		rcodes:                make(map[string]int),
+		pendingClaims:         make(map[string]*PendingClaim),
+		claimDecisions:        make(map[string]bool),
+		aliases:               make(map[string]string),
+		importedNames:         make(map[string][]net.IP),
+		composeNames:          make(map[string]net.IP),
+		teardowns:             make(map[string]*teardown),
+		reconnects:            make(map[string]*time.Timer),
+		events:                newEventQueue(),
+		eventWorkers:          defaultEventWorkers,
+		networkZones:          make(map[string]string),
+		zoneChanges:           make(map[string]time.Time),
+		addressSelectors:      defaultAddressSelectors,
+		ttl:                   defaultTTL,
+		runtime:               runtimeDocker,
+		unhealthyAfter:        defaultUnhealthyAfter,
+		compress:              true,
+		apiTimeout:            defaultAPITimeout,
+		ctx:                   ctx,
+		stop:                  stop,
 	}
 }
 
-func (dd DockerDiscovery) resolveDomainsByContainer(container *dockerapi.Container) ([]string, error) {
+func (dd *DockerDiscovery) resolveDomainsByContainer(container *dockerapi.Container) ([]string, error) {
+	defer stageRegion(context.Background(), "resolve").End()
 	var domains []string
-	for _, resolver := range dd.resolvers {
-		var d, err = resolver.resolve(container)
+	named := dd.namedContainer(container)
+	for _, resolver := range dd.currentResolvers() {
+		var d, err = resolver.resolve(named)
 		if err != nil {
 			log.Printf("[docker] Error resolving container domains %s", err)
 		}
-		domains = append(domains, d...)
+		for _, domain := range d {
+			if !validDomain(domain, dd.strictNames) {
+				log.Printf("[docker] Ignoring invalid domain %q of container %s", domain, container.ID[:12])
+				continue
+			}
+			domains = append(domains, domain)
+		}
 	}
 
-	return domains, nil
+	return uniqueDomains(append(dd.zoneDomains(container, dd.suffixHost(domains)), dd.groupDomains(container)...)), nil
 }
 
-func (dd DockerDiscovery) containerInfoByDomain(requestName string) (*ContainerInfo, error) {
-	for _, containerInfo := range dd.containerInfoMap {
-		for _, d := range containerInfo.domains {
-			if fmt.Sprintf("%s.", d) == requestName { // qualified domain name must be specified with a trailing dot
-				return containerInfo, nil
+// suffixHost namespaces the domains with the label of the docker host of the host_suffix directive, inserted
+// before the server block zone of the domain (or after its first label outside of the zones), e.g.
+// nginx.host1.docker.local, so the containers of several docker hosts answered together don't collide.
+func (dd *DockerDiscovery) suffixHost(domains []string) []string {
+	host := dd.hostLabel()
+	if host == "" {
+		return domains
+	}
+
+	suffixed := make([]string, 0, len(domains))
+	if dd.hostSuffixMerge {
+		suffixed = append(suffixed, domains...)
+	}
+	for _, domain := range domains {
+		fqdn := dns.Fqdn(strings.ToLower(domain))
+		if zone := plugin.Zones(dd.zones).Matches(fqdn); zone != "" && zone != "." && fqdn != zone {
+			suffixed = append(suffixed, strings.TrimSuffix(strings.TrimSuffix(fqdn, zone)+host+"."+zone, "."))
+		} else if labels := dns.SplitDomainName(fqdn); len(labels) > 1 {
+			suffixed = append(suffixed, strings.Join(append([]string{labels[0], host}, labels[1:]...), "."))
+		} else {
+			suffixed = append(suffixed, domain)
+		}
+	}
+	return suffixed
+}
+
+// ambiguous reports whether the name is owned by the containers of another docker host of the server block with
+// host_suffix_merge, which answers it only under the names namespaced with the host label. Each lock is taken
+// on its own, never while holding another.
+func (dd *DockerDiscovery) ambiguous(qname string) bool {
+	if !dd.hostSuffixMerge || !dd.ownsDomain(qname) {
+		return false
+	}
+	for _, peer := range dd.peers {
+		if peer != dd && peer.ownsDomain(qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsDomain reports whether a container of the docker host has the name
+func (dd *DockerDiscovery) ownsDomain(qname string) bool {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	return len(dd.domainIndex[strings.ToLower(qname)]) > 0
+}
+
+// hostLabel returns the label of the docker host namespacing the domains: the name of the host_suffix directive,
+// otherwise the name of the docker host once loaded, empty without host_suffix.
+func (dd *DockerDiscovery) hostLabel() string {
+	if dd.hostSuffix != "" || !dd.hostSuffixFromInfo {
+		return dd.hostSuffix
+	}
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	if dd.hostInfo == nil {
+		return ""
+	}
+	return strings.ToLower(strings.SplitN(dd.hostInfo.Name, ".", 2)[0])
+}
+
+// uniqueDomains removes the domains produced more than once (e.g. by both the label and the hostname
+// resolvers), keeping the first one so the precedence of the resolvers is preserved.
+func uniqueDomains(domains []string) []string {
+	seen := make(map[string]bool, len(domains))
+	unique := domains[:0]
+	for _, domain := range domains {
+		key := strings.ToLower(strings.TrimSuffix(domain, "."))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, domain)
+	}
+	return unique
+}
+
+// expandZones registers the domains found in one of the server block zones under all the other zones.
+func (dd *DockerDiscovery) expandZones(domains []string) []string {
+	if len(dd.zones) < 2 {
+		return domains
+	}
+
+	var expanded []string
+	for _, domain := range domains {
+		expanded = append(expanded, domain)
+		fqdn := dns.Fqdn(strings.ToLower(domain))
+		zone := plugin.Zones(dd.zones).Matches(fqdn)
+		if zone == "" || zone == "." {
+			continue
+		}
+		name := strings.TrimSuffix(fqdn, zone)
+		for _, other := range dd.zones {
+			if other != zone && other != "." {
+				expanded = append(expanded, strings.TrimSuffix(name+other, "."))
 			}
 		}
 	}
+	return expanded
+}
 
+// containerInfoByDomain returns the container owning the domain, the first registered when several do, from the
+// domain index. The caller must hold the lock.
+func (dd *DockerDiscovery) containerInfoByDomain(requestName string) (*ContainerInfo, error) {
+	if owners := dd.domainOwners(requestName); len(owners) > 0 {
+		return owners[0], nil
+	}
 	return nil, nil
 }
 
-// ServeDNS implements plugin.Handler
-func (dd DockerDiscovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	state := request.Request{W: w, Req: r}
+// containersByDomain returns the containers owning the domain, sorted by ID. The caller must hold the lock.
+func (dd *DockerDiscovery) containersByDomain(requestName string) []*ContainerInfo {
+	owners := append([]*ContainerInfo{}, dd.domainOwners(requestName)...)
+	sort.Slice(owners, func(i, j int) bool { return owners[i].container.ID < owners[j].container.ID })
+	return owners
+}
+
+// domainOwners returns the containers owning the domain, otherwise those of the closest wildcard name covering it.
+// The caller must hold the lock.
+func (dd *DockerDiscovery) domainOwners(requestName string) []*ContainerInfo {
+	if owners := dd.domainIndex[strings.ToLower(requestName)]; len(owners) > 0 {
+		return owners
+	}
+	return dd.wildcardOwners(requestName)
+}
+
+func (containerInfo *ContainerInfo) hasDomain(requestName string) bool {
+	for _, d := range containerInfo.domains {
+		if strings.EqualFold(dns.Fqdn(d), requestName) { // qualified domain name must be specified with a trailing dot
+			return true
+		}
+	}
+	return false
+}
+
+// indexDomains adds the container to the domain index, under its domains and wildcard names. The caller must hold
+// the lock.
+func (dd *DockerDiscovery) indexDomains(containerInfo *ContainerInfo) {
+	for _, domain := range containerInfo.domains {
+		key := strings.ToLower(dns.Fqdn(domain))
+		dd.domainIndex[key] = append(dd.domainIndex[key], containerInfo)
+	}
+	for _, wildcard := range containerInfo.wildcards {
+		dd.domainIndex[wildcard] = append(dd.domainIndex[wildcard], containerInfo)
+	}
+}
+
+// unindexDomains removes the container from the domain index. The caller must hold the lock.
+func (dd *DockerDiscovery) unindexDomains(containerInfo *ContainerInfo) {
+	for _, domain := range containerInfo.domains {
+		removeOwner(dd.domainIndex, strings.ToLower(dns.Fqdn(domain)), containerInfo)
+	}
+	for _, wildcard := range containerInfo.wildcards {
+		removeOwner(dd.domainIndex, wildcard, containerInfo)
+	}
+}
+
+// removeOwner removes the container from the owners of the key in the index
+func removeOwner(index map[string][]*ContainerInfo, key string, containerInfo *ContainerInfo) {
+	owners := index[key][:0]
+	for _, owner := range index[key] {
+		if owner != containerInfo {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = owners
+	}
+}
+
+// rebuildIndexes indexes the domains and addresses of all the containers, e.g. taken over from a reload. The
+// caller must hold the lock.
+func (dd *DockerDiscovery) rebuildIndexes() {
+	dd.domainIndex = make(map[string][]*ContainerInfo, len(dd.containerInfoMap))
+	dd.addressIndex = make(map[string][]*ContainerInfo, len(dd.containerInfoMap))
+	for _, containerInfo := range dd.containerInfoMap {
+		dd.indexDomains(containerInfo)
+		dd.indexAddresses(containerInfo)
+	}
+}
+
+// isShadowed reports whether the domain belongs to a "shadow-only" container which is currently down,
+// so that the query falls through to the next plugin.
+func (dd *DockerDiscovery) isShadowed(requestName string) bool {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	domain := strings.ToLower(strings.TrimSuffix(requestName, "."))
+	if !dd.shadowDomains[domain] {
+		return false
+	}
+	containerInfo, _ := dd.containerInfoByDomain(requestName)
+	return containerInfo == nil
+}
+
+// records returns the answer and additional records for the question asked by the client.
+// The client address may be nil, then the records depending on the client are not answered. The ANY queries get
+// the records of every type of the name.
+func (dd *DockerDiscovery) records(qname string, qtype uint16, client net.IP) (answers, extras []dns.RR) {
+	if qtype == dns.TypeANY {
+		return dd.anyRecords(qname, client), nil
+	}
+	if dd.ambiguous(qname) {
+		return nil, nil
+	}
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	name := strings.ToLower(qname)
+	if dd.isInternalName(qname) {
+		// only containers can reach the docker host through the gateway of their network
+		gateway := dd.gatewayByClient(client, qtype == dns.TypeAAAA)
+		switch {
+		case gateway == nil:
+		case qtype == dns.TypeA:
+			answers = a(name, []net.IP{gateway})
+		case qtype == dns.TypeAAAA:
+			answers = aaaa(name, []net.IP{gateway})
+		}
+	} else if static := dd.staticRecordsFor(name, qtype); len(static) > 0 {
+		answers = static
+	} else if apex := dd.apexRecords(name, qtype); len(apex) > 0 {
+		answers = apex
+	} else if strings.HasPrefix(name, healthServicePrefix) {
+		answers, extras = dd.healthRecords(qname, qtype)
+	} else if strings.HasPrefix(name, subnetsPrefix) {
+		answers = dd.subnetRecords(name, qtype)
+	} else if strings.HasPrefix(name, acmeChallengePrefix) {
+		answers = dd.acmeChallengeRecords(qname, qtype)
+	} else if ports := dd.portRecords(name, qtype); len(ports) > 0 {
+		answers = ports
+	} else if network := dd.networkZoneRecords(name, qtype); len(network) > 0 {
+		answers = network
+	} else if _, ok := dd.overrides[name]; ok {
+		answers = dd.overrideRecords(name, qtype)
+	} else if target := dd.aliasTarget(name); target != "" {
+		answers, extras = dd.aliasRecords(name, target, qtype, client)
+	} else if service, serviceExtras := dd.serviceRecords(name, qtype); len(service) > 0 {
+		answers, extras = service, serviceExtras
+	} else if qtype == dns.TypePTR {
+		answers = dd.ptrRecords(name)
+	} else if members := dd.groupMembers(name); len(members) > 0 && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		answers = dd.groupRecords(name, qtype, rampOrder(members))
+	} else if qtype == dns.TypeSRV {
+		answers, extras = dd.srvRecords(qname, client)
+	} else if swarm := dd.swarmRecords(name, qtype); len(swarm) > 0 {
+		answers = swarm
+	} else if owners := dd.containersByDomain(qname); dd.txtMetadata && qtype == dns.TypeTXT && len(owners) > 0 {
+		answers = append(dd.metadataRecords(name, owners), dd.hostFactRecords(name, qtype)...)
+	} else if facts := dd.hostFactRecords(name, qtype); len(facts) > 0 && len(dd.containersByDomain(qname)) > 0 {
+		answers = facts
+	} else if owners := dd.containersByDomain(qname); len(owners) > 0 {
+		// every container owning the name, e.g. the replicas of a scaled service sharing a label
+		if dd.roundRobin {
+			rand.Shuffle(len(owners), func(i, j int) { owners[i], owners[j] = owners[j], owners[i] })
+		}
+		for _, containerInfo := range rampOrder(owners) {
+			answers = append(answers, dd.addressRecords(qname, qtype, containerInfo, client, dd.containerTTL(containerInfo))...)
+		}
+	} else if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		if containerInfo := dd.staleContainerInfoByDomain(qname); containerInfo != nil {
+			answers = dd.addressRecords(qname, qtype, containerInfo, client, dd.staleTTL)
+		} else if imported := dd.importedRecords(name, qtype); len(imported) > 0 {
+			answers = imported
+		} else {
+			answers = dd.composeRecords(name, qtype)
+		}
+	}
+	return dd.filterFamilyRecords(answers), dd.filterFamilyRecords(extras)
+}
+
+// addressRecords returns the A or AAAA record of the container for the name, the AAAA one synthesized with dns64
+// when the container has no IPv6 address. The caller must hold the lock.
+func (dd *DockerDiscovery) addressRecords(qname string, qtype uint16, containerInfo *ContainerInfo, client net.IP, ttl uint32) []dns.RR {
+	name := strings.ToLower(qname)
+	address := containerInfo.address
+	if hostAddress := dd.hostAddressFor(containerInfo, client); address != nil && hostAddress != nil {
+		address = hostAddress
+	}
+
 	var answers []dns.RR
-	switch state.QType() {
+	switch qtype {
 	case dns.TypeA:
-		containerInfo, _ := dd.containerInfoByDomain(state.QName())
-		if containerInfo != nil {
-			log.Printf("[docker] Found ip %v for host %s", containerInfo.address, state.QName())
-			answers = a(state.Name(), []net.IP{containerInfo.address})
+		if address != nil {
+			log.Printf("[docker] Found ip %v for host %s", address, qname)
+			answers = a(name, []net.IP{address})
+		}
+	case dns.TypeAAAA:
+		if containerInfo.address6 != nil {
+			log.Printf("[docker] Found ip %v for host %s", containerInfo.address6, qname)
+			answers = aaaa(name, []net.IP{containerInfo.address6})
+		} else if address != nil && dd.dns64Prefix != nil {
+			address, err := to6(dd.dns64Prefix, address)
+			if err != nil {
+				break
+			}
+			log.Printf("[docker] Synthesized ip %v for host %s", address, qname)
+			answers = aaaa(name, []net.IP{address})
 		}
 	}
+	for _, rr := range answers {
+		rr.Header().Ttl = ttl
+	}
+	return answers
+}
 
-	if len(answers) == 0 {
-		return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+// ServeDNS implements plugin.Handler
+func (dd *DockerDiscovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+	budget, cancel := dd.withBudget(ctx)
+	defer cancel()
+	if !dd.waitForSync(budget) {
+		if overBudget(ctx, budget) {
+			return dd.passOverBudget(ctx, w, r)
+		}
+		log.Printf("[docker] Initial sync is not complete, passing %s to the next plugin", state.QName())
+		return dd.passToNext(ctx, w, r)
+	}
+	if !servedClass(state.QClass()) || dd.isShadowed(state.QName()) {
+		return dd.passToNext(ctx, w, r)
+	}
+	if rcode := dd.forcedRcode(state.QName()); rcode != dns.RcodeSuccess {
+		return dd.forceRcode(ctx, w, r, state, rcode)
 	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
-	m.Answer = answers
+	m.RecursionAvailable, m.Compress = true, dd.compress
+	if ns, glue := dd.referral(state.QName()); len(ns) > 0 {
+		// the delegated sub-zone is answered by the containers claiming it
+		m.Ns = ns
+		m.Extra = glue
+	} else {
+		answers, extras := dd.records(state.QName(), state.QType(), net.ParseIP(state.IP()))
+		if len(answers) == 0 {
+			answers = dd.etcdRecords(budget, state.QName(), state.QType())
+		}
+		if len(answers) == 0 && overBudget(ctx, budget) {
+			return dd.passOverBudget(ctx, w, r)
+		}
+		if len(answers) == 0 {
+			return dd.unanswered(ctx, w, r, state)
+		}
+		m.Authoritative = true
+		m.Answer = matchQuestionCase(answers, state.QName())
+		m.Extra = extras
+	}
+	// the answers ordered by round_robin or by the ramp of a container keep their order
+	m.Answer = canonicalize(m.Answer, dd.roundRobin || dd.ramping(state.QName()))
+	m.Ns = canonicalize(m.Ns, dd.roundRobin)
+	m.Extra = canonicalize(m.Extra, dd.roundRobin)
+	dd.adjustTTLs(m.Answer)
+	dd.adjustTTLs(m.Ns)
+	dd.adjustTTLs(m.Extra)
 
+	// the message is built for each query and never cached: SizeAndDo and Scrub adapt it to the EDNS0 buffer size
+	// and DO bit of this client, so a response cache would have to include them in its key
 	state.SizeAndDo(m)
-	m = state.Scrub(m)
+	dd.annotate(state, m)
+	if dd.maxUDPSize > 0 && state.Proto() == "udp" && state.Size() > dd.maxUDPSize {
+		m.Truncate(dd.maxUDPSize) // sets TC when the answers don't fit, compressed
+	} else {
+		m = state.Scrub(m)
+	}
+	queryCount.WithLabelValues(metrics.WithServer(ctx), "hit").Inc()
 	err := w.WriteMsg(m)
 	if err != nil {
 		log.Printf("[docker] Error: %s", err.Error())
 	}
+	if dd.queryLog != nil {
+		dd.logQuery(state, m)
+	}
 	return dns.RcodeSuccess, nil
 }
 
+// passToNext passes the query the plugin doesn't answer to the next plugin
+func (dd *DockerDiscovery) passToNext(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	queryCount.WithLabelValues(metrics.WithServer(ctx), "fallthrough").Inc()
+	return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+}
+
 // Name implements plugin.Handler
-func (dd DockerDiscovery) Name() string {
+func (dd *DockerDiscovery) Name() string {
 	return "docker"
 }
 
-func (dd DockerDiscovery) getContainerAddress(container *dockerapi.Container) (net.IP, error) {
-
-	// save this away
-	netName, hasNetName := container.Config.Labels["coredns.dockerdiscovery.network"]
-
-	var networkMode string
-
-	for {
-		if container.NetworkSettings.IPAddress != "" && !hasNetName {
-			return net.ParseIP(container.NetworkSettings.IPAddress), nil
+// getContainerAddress returns the IPv4 and IPv6 addresses of the container picked by the chain of address
+// selectors, the IPv6 one selected independently with ipv6_networks. The containers sharing the network namespace
+// of another container get its addresses.
+func (dd *DockerDiscovery) getContainerAddress(container *dockerapi.Container) (net.IP, net.IP, error) {
+	for strings.HasPrefix(container.HostConfig.NetworkMode, "container:") {
+		log.Printf("Container %s is in another container's network namspace", container.ID[:12])
+		otherID := container.HostConfig.NetworkMode[len("container:"):]
+		var err error
+		container, err = dd.inspectContainerRetry(dd.ctx, otherID)
+		if err != nil {
+			return nil, nil, err
 		}
+	}
 
-		networkMode = container.HostConfig.NetworkMode
+	for _, selector := range dd.addressSelectors {
+		address, address6, err := selector.selectAddress(dd, container)
+		if err != nil || address != nil || address6 != nil {
+			return address, address6, err
+		}
+	}
+	return nil, nil, nil
+}
 
-		// TODO: Deal with containers run with host ip (--net=host)
-		// if networkMode == "host" {
-		// 	log.Println("[docker] Container uses host network")
-		// 	return nil, nil
-		// }
+func (dd *DockerDiscovery) updateContainerInfo(container *dockerapi.Container) error {
+	defer dd.writePrometheusTargets()
 
-		if strings.HasPrefix(networkMode, "container:") {
-			log.Printf("Container %s is in another container's network namspace", container.ID[:12])
-			otherID := container.HostConfig.NetworkMode[len("container:"):]
-			var err error
-			container, err = dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: otherID})
-			if err != nil {
-				return nil, err
-			}
+	// docker API calls are made before taking the lock
+	containerAddress, containerAddress6, err := dd.getContainerAddress(container)
+	if isTransient(err) {
+		log.Printf("[docker] Keeping the records of container %s (%s): %s", normalizeContainerName(container), container.ID[:12], err)
+		return err
+	}
+	containerAddress, containerAddress6 = dd.filterFamily(containerAddress, containerAddress6)
+	var domains []string
+	hasAddress := containerAddress != nil || containerAddress6 != nil
+	if err == nil && hasAddress {
+		if !dd.allowed(container) {
+			log.Printf("[docker] Ignoring container %s (%s) of image %s, not exposed", normalizeContainerName(container), container.ID[:12], container.Config.Image)
+		} else if dd.hidePaused && container.State.Paused {
+			log.Printf("[docker] Ignoring container %s (%s) while paused", normalizeContainerName(container), container.ID[:12])
+		} else if remaining := dd.graceRemaining(container); remaining > 0 && !dd.registered(container.ID) {
+			log.Printf("[docker] Registering container %s (%s) in %s, after the grace period of its restart policy", normalizeContainerName(container), container.ID[:12], remaining.Round(time.Millisecond))
+			dd.registerAfterGrace(container.ID, remaining)
+		} else if dd.requireHealthy && !healthy(container) {
+			log.Printf("[docker] Ignoring container %s (%s) until healthy, %s", normalizeContainerName(container), container.ID[:12], container.State.Health.Status)
 		} else {
-			break
+			domains, _ = dd.resolveDomainsByContainer(container)
 		}
 	}
 
-	network, ok := container.NetworkSettings.Networks[networkMode]
-	if hasNetName {
-		log.Printf("[docker] network name %s specified (%s)", netName, container.ID[:12])
-		network, ok = container.NetworkSettings.Networks[netName]
-	}
-
-	if !ok { // sometime while "network:disconnect" event fire
-		return nil, fmt.Errorf("unable to find network settings for the network %s", networkMode)
-	}
+	servicePort := dd.registratorPort(container)
 
-	return net.ParseIP(network.IPAddress), nil // ParseIP return nil when IPAddress equals ""
-}
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
 
-func (dd DockerDiscovery) updateContainerInfo(container *dockerapi.Container) error {
-	_, isExist := dd.containerInfoMap[container.ID]
-	containerAddress, err := dd.getContainerAddress(container)
+	change := &containerChange{dropStale: []string{container.ID}}
+	previous, isExist := dd.containerInfoMap[container.ID]
 	if isExist { // remove previous resolved container info
-		delete(dd.containerInfoMap, container.ID)
+		change.remove(previous)
 	}
 
-	if err != nil || containerAddress == nil {
+	if err != nil || !hasAddress {
 		log.Printf("[docker] Remove container entry %s (%s)", normalizeContainerName(container), container.ID[:12])
+		dd.applyChange(change)
 		return err
 	}
 
-	domains, _ := dd.resolveDomainsByContainer(container)
-	if len(domains) > 0 {
-		dd.containerInfoMap[container.ID] = &ContainerInfo{
-			container: container,
-			address:   containerAddress,
-			domains:   domains,
+	// the name is shadow-only as long as its last container registering it is
+	shadow := container.Config.Labels["coredns.dockerdiscovery.shadow"] == "true"
+	for _, domain := range domains {
+		if shadow {
+			dd.shadowDomains[strings.ToLower(domain)] = true
+		} else {
+			delete(dd.shadowDomains, strings.ToLower(domain))
 		}
+	}
+	if len(domains) == 0 {
+		dd.applyChange(change)
+		return nil
+	}
+
+	dd.replaceRecreated(change, container)
+	if dd.approveConflicts && dd.holdConflicting(change, container, previous, domains) {
+		return nil
+	}
+	if !dd.makeRoom(change, container, len(domains)) {
+		dd.applyChange(change)
+		return fmt.Errorf("%w, %d records", ErrRecordLimit, dd.maxRecords)
+	}
 
-		if !isExist {
-			dd.etcd.Put(context.TODO(), fmt.Sprintf("/docker/docker/%s", normalizeContainerName(container)), `{"host":"`+containerAddress.String()+`","ttl":15}`)
-			log.Printf("[docker] Add entry of container %s (%s). IP: %v", normalizeContainerName(container), container.ID[:12], containerAddress)
+	added := time.Now()
+	if isExist {
+		added = previous.added
+		if !previous.address.Equal(containerAddress) || !previous.address6.Equal(containerAddress6) {
+			log.Printf("[docker] Address of container %s (%s) changed from %s to %s", normalizeContainerName(container), container.ID[:12],
+				joinAddresses(previous.address, previous.address6), joinAddresses(containerAddress, containerAddress6))
 		}
-	} else if isExist {
-		dd.etcd.Delete(context.TODO(), fmt.Sprintf("/docker/docker/%s", normalizeContainerName(container)))
-		log.Printf("[docker] Remove container entry %s (%s)", normalizeContainerName(container), container.ID[:12])
+	}
+	change.added = append(change.added, &ContainerInfo{
+		container:   container,
+		address:     containerAddress,
+		address6:    containerAddress6,
+		groups:      dd.groupDomains(container),
+		aliases:     dd.labelAliases(container),
+		wildcards:   dd.wildcardDomains(container, domains),
+		network:     containerNetworkName(container),
+		domains:     domains,
+		health:      healthEndpointByContainer(container),
+		ttl:         dd.labelTTL(container),
+		rcode:       labelRcode(container),
+		ramp:        labelRamp(container),
+		ptrOptOut:   labelReverseOptOut(container),
+		ptrPriority: labelPTRPriority(container),
+		servicePort: servicePort,
+		added:       added,
+		updated:     time.Now(),
+	})
+	dd.applyChange(change)
+	if !isExist && dd.oneShotLifetime > 0 && isOneShot(container) {
+		dd.expireOneShot(container.ID, added)
 	}
 	return nil
 }
 
-func (dd DockerDiscovery) removeContainerInfo(containerID string) error {
+func (dd *DockerDiscovery) removeContainerInfo(containerID string) error {
+	dd.mu.Lock()
 	containerInfo, ok := dd.containerInfoMap[containerID]
+	if ok {
+		dd.applyChange(&containerChange{removed: []*ContainerInfo{containerInfo}, keepStale: true})
+	}
+	dd.mu.Unlock()
+
 	if !ok {
 		log.Printf("[docker] No entry associated with the container %s", containerID[:12])
 		return nil
 	}
-	log.Printf("[docker] Deleting entry %s (%s)", normalizeContainerName(containerInfo.container), containerInfo.container.ID[:12])
-	dd.etcd.Delete(context.TODO(), fmt.Sprintf("/docker/docker/%s", normalizeContainerName(containerInfo.container)))
-	delete(dd.containerInfoMap, containerID)
+	dd.writePrometheusTargets()
 
 	return nil
 }
 
-func (dd DockerDiscovery) start() error {
+// waitForSync blocks until the initial container sync is done, the wait_for_sync timeout
+// expires or the query is cancelled. It reports whether the sync is done.
+func (dd *DockerDiscovery) waitForSync(ctx context.Context) bool {
+	if dd.syncTimeout == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(dd.syncTimeout)
+	defer timer.Stop()
+	select {
+	case <-dd.synced:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (dd *DockerDiscovery) markSynced() {
+	select {
+	case <-dd.synced:
+	default:
+		close(dd.synced)
+	}
+}
+
+func (dd *DockerDiscovery) start() error {
 	log.Println("[docker] start")
-	var err error
-	dd.etcd, err = newEtcdClient(dd.endpoints, nil, "", "")
-	if err != nil {
-		return err
+	defer dd.markSynced() // queries must not keep waiting when the start fails
+	dd.startBackends()
+	dd.startEventWorkers()
+	if dd.eventCursorFile != "" {
+		dd.spawn("event_cursor", dd.persistEventCursor)
 	}
-	events := make(chan *dockerapi.APIEvents)
+	if dd.swarm {
+		dd.spawn("swarm", dd.watchSwarm)
+	}
+	if dd.resyncInterval > 0 {
+		dd.spawn("resync", dd.resyncPeriodically)
+	}
+
+	dockerConnected.WithLabelValues(dd.dockerEndpoint).Set(0)
+	for {
+		err := dd.watch(dd.ctx)
+		dd.markSynced() // queries must not keep waiting while docker is unreachable
+		if dd.ctx.Err() != nil {
+			log.Println("[docker] stop")
+			return nil
+		}
+		if !sleepContext(dd.ctx, dd.disconnected(err)) {
+			return nil
+		}
+	}
+}
 
-	if err := dd.dockerClient.AddEventListener(events); err != nil {
+// watch syncs the containers and handles the docker events until the connection to docker is lost or the context
+// is done. The events are requested since the last one handled, so the events missed while disconnected, reloading
+// or restarting (with event_cursor_file) are replayed, in addition to the full listing of the containers.
+func (dd *DockerDiscovery) watch(ctx context.Context) error {
+	events := make(chan *dockerapi.APIEvents)
+	var eventOpts dockerapi.EventsOptions
+	if lastEvent := atomic.LoadInt64(&dd.lastEvent); lastEvent > 0 {
+		eventOpts.Since = strconv.FormatInt(time.Unix(0, lastEvent).Unix(), 10)
+	}
+	if err := dd.dockerClient.AddEventListenerWithOptions(eventOpts, events); err != nil {
 		return err
 	}
+	defer dd.dockerClient.RemoveEventListener(events)
 
-	containers, err := dd.dockerClient.ListContainers(dockerapi.ListContainersOptions{})
-	if err != nil {
+	if dd.runtime == runtimeAuto {
+		if err := dd.detectRuntime(ctx); err != nil {
+			log.Printf("[docker] Error detecting the runtime: %s", err)
+		}
+	}
+	// the networks give the gateways of the internal names and the reverse zones
+	if err := dd.refreshNetworks(ctx); err != nil {
+		log.Printf("[docker] Error loading networks: %s", err)
+	}
+	if len(dd.hostFacts) > 0 || dd.hostSuffixFromInfo {
+		if err := dd.refreshHostInfo(ctx); err != nil {
+			log.Printf("[docker] Error loading the docker host facts: %s", err)
+		}
+	}
+	if dd.swarm {
+		if err := dd.refreshSwarm(ctx); err != nil {
+			log.Printf("[docker] Error loading the swarm services: %s", err)
+		}
+	}
+
+	if err := dd.resync(ctx); err != nil {
 		return err
 	}
+	dd.markSynced()
+	dd.connected()
+	dd.writePrometheusTargets()
+	log.Printf("[docker] Sync done, %d containers registered", len(dd.Containers()))
+
+	for {
+		var msg *dockerapi.APIEvents
+		select {
+		case msg = <-events:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if msg == nil {
+			return errors.New("docker event loop closed")
+		}
+		dd.queueEvent(msg)
+	}
+}
+
+// handleEvent updates the records after the docker event
+func (dd *DockerDiscovery) handleEvent(ctx context.Context, msg *dockerapi.APIEvents) {
+	if !dd.delayEvent(ctx) {
+		return
+	}
+	if dd.injectedFaults().serveStale {
+		log.Printf("[docker] Fault injection: ignoring the %s:%s event", msg.Type, msg.Action)
+		return
+	}
+	defer dd.advanceEventCursor(msg.TimeNano)
+	if dd.isPodman() {
+		msg = podmanEvent(msg)
+	}
+	event := fmt.Sprintf("%s:%s", msg.Type, msg.Action)
+	if strings.HasPrefix(event, "container:health_status") {
+		event = "container:health_status" // the action has the status, e.g. health_status: healthy
+	}
+	defer observeEventLatency(event, msg.TimeNano)
+	dd.swarmEvent(ctx, event, msg.Actor.Attributes)
+	switch event {
+	case "container:start":
+		log.Println("[docker] New container spawned. Attempt to add A record for it")
 
-	for _, apiContainer := range containers {
-		container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: apiContainer.ID})
+		container, err := dd.inspectEventContainer(ctx, msg.Actor.ID, msg.TimeNano)
 		if err != nil {
-			// TODO err
+			dd.inspectFailed(event, msg.Actor.ID, err)
+			return
 		}
 		if err := dd.updateContainerInfo(container); err != nil {
-			log.Printf("[docker] Error adding A record for container %s: %s\n", container.ID[:12], err)
-		}
-	}
-
-	for msg := range events {
-		go func(msg *dockerapi.APIEvents) {
-			event := fmt.Sprintf("%s:%s", msg.Type, msg.Action)
-			switch event {
-			case "container:start":
-				log.Println("[docker] New container spawned. Attempt to add A record for it")
-
-				container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.ID})
-				if err != nil {
-					log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.ID[:12], err)
-					return
-				}
-				if err := dd.updateContainerInfo(container); err != nil {
-					log.Printf("[docker] Error adding A record for container %s: %s", container.ID[:12], err)
-				}
-			case "container:die":
-				log.Println("[docker] Container being stopped. Attempt to remove its A record from the DNS", msg.Actor.ID[:12])
-				if err := dd.removeContainerInfo(msg.Actor.ID); err != nil {
-					log.Printf("[docker] Error deleting A record for container: %s: %s", msg.Actor.ID[:12], err)
-				}
-			case "network:connect":
-				// take a look https://gist.github.com/josefkarasek/be9bac36921f7bc9a61df23451594fbf for example of same event's types attributes
-				log.Printf("[docker] Container %s being connected to network %s.", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
-
-				container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.Attributes["container"]})
-				if err != nil {
-					log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.Attributes["container"][:12], err)
-					return
-				}
-				if err := dd.updateContainerInfo(container); err != nil {
-					log.Printf("[docker] Error adding A record for container %s: %s", container.ID[:12], err)
-				}
-			case "network:disconnect":
-				log.Printf("[docker] Container %s being disconnected from network %s", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
-
-				container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.Attributes["container"]})
-				if err != nil {
-					log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.Attributes["container"][:12], err)
-					return
-				}
-				if err := dd.updateContainerInfo(container); err != nil {
-					log.Printf("[docker] Error adding A record for container %s: %s", container.ID[:12], err)
-				}
-			}
-		}(msg)
+			log.Printf("[docker] Error adding A record for container %s: %s", container.ID[:12], err)
+			eventErrorCount.WithLabelValues(event).Inc()
+			countError(err)
+		}
+	case "container:health_status":
+		if dd.requireHealthy {
+			dd.refreshContainer(ctx, event, msg.Actor.ID, msg.TimeNano)
+		}
+	case "container:rename":
+		log.Printf("[docker] Container %s renamed from %s", msg.Actor.ID[:12], strings.TrimPrefix(msg.Actor.Attributes["oldName"], "/"))
+		dd.refreshContainer(ctx, event, msg.Actor.ID, msg.TimeNano)
+	case "container:pause", "container:unpause":
+		if dd.hidePaused {
+			dd.refreshContainer(ctx, event, msg.Actor.ID, msg.TimeNano)
+		}
+	case "container:stop", "container:kill":
+		dd.containerStopped(ctx, event, msg.Actor.ID, msg.TimeNano)
+	case "container:destroy":
+		dd.containerDestroyed(msg.Actor.ID)
+	case "container:die":
+		if err := dd.containerDied(msg.Actor.ID, msg.Actor.Attributes); err != nil {
+			log.Printf("[docker] Error deleting A record for container: %s: %s", msg.Actor.ID[:12], err)
+			eventErrorCount.WithLabelValues(event).Inc()
+			countError(err)
+		}
+	case "network:connect":
+		// take a look https://gist.github.com/josefkarasek/be9bac36921f7bc9a61df23451594fbf for example of same event's types attributes
+		log.Printf("[docker] Container %s being connected to network %s.", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
+		dd.containerConnected(ctx, event, msg.Actor.Attributes["container"], msg.TimeNano)
+	case "network:disconnect":
+		log.Printf("[docker] Container %s being disconnected from network %s", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
+		dd.containerDisconnected(ctx, event, msg.Actor.Attributes["container"], msg.TimeNano)
+	case "network:create", "network:update":
+		if err := dd.networkChanged(ctx, msg.Actor.ID); err != nil {
+			log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.ID[:12], err)
+			eventErrorCount.WithLabelValues(event).Inc()
+			countError(err)
+		}
+	case "network:destroy", "network:remove":
+		dd.networkRemoved(msg.Actor.ID)
 	}
+}
+
+// etcdRecord returns the etcd record of the container, in the SkyDNS format of the CoreDNS etcd plugin, with the
+// port and priority of the SRV records when the container exposes a port, and its compose project as group, so the
+// etcd plugin answers the records of a project together. The caller must hold the lock.
+func (dd *DockerDiscovery) etcdRecord(containerInfo *ContainerInfo) string {
+	service := msg.Service{
+		Host:  containerInfo.addresses()[0].String(),
+		TTL:   containerInfo.ttl,
+		Group: containerInfo.container.Config.Labels["com.docker.compose.project"],
+	}
+	if port, err := strconv.Atoi(firstExposedPort(containerInfo)); err == nil {
+		service.Port = port
+		service.Priority = dd.startOrder(containerInfo, nil)
+	}
+	record, _ := json.Marshal(service)
+	return string(record)
+}
+
+// etcdDefaultPrefix is the etcd prefix of the container records without etcd_prefix
+const etcdDefaultPrefix = "/docker/docker/"
 
-	return errors.New("docker event loop closed")
+// etcdKey returns the etcd key of the container record
+func (dd *DockerDiscovery) etcdKey(container *dockerapi.Container) string {
+	return etcdDefaultPrefix + dd.containerName(container)
 }
 
 func newEtcdClient(endpoints []string, cc *tls.Config, username, password string) (*etcdcv3.Client, error) {
@@ -311,3 +1034,20 @@ func a(zone string, ips []net.IP) []dns.RR {
 	}
 	return answers
 }
+
+// aaaa takes a slice of net.IPs and returns a slice of AAAA RRs.
+func aaaa(zone string, ips []net.IP) []dns.RR {
+	answers := []dns.RR{}
+	for _, ip := range ips {
+		r := new(dns.AAAA)
+		r.Hdr = dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		}
+		r.AAAA = ip
+		answers = append(answers, r)
+	}
+	return answers
+}
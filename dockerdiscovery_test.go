@@ -0,0 +1,3771 @@
+package dockerdiscovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/backends"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/coredns/coredns/request"
+	"github.com/docker/docker/api/types/swarm"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestDNS64Synthesis(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	dns64
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	err = dd.updateContainerInfo(container)
+	assert.Nil(t, err)
+
+	msg := query(t, dd, "evil_ptolemy.docker.loc.", dns.TypeAAAA, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "64:ff9b::ac11:2", msg.Answer[0].(*dns.AAAA).AAAA.String())
+}
+
+func TestDNS64Prefixes(t *testing.T) {
+	testCases := []struct {
+		prefix   string
+		expected string
+	}{
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+	}
+
+	for _, tc := range testCases {
+		_, prefix, err := net.ParseCIDR(tc.prefix)
+		assert.Nil(t, err)
+		assert.True(t, validDNS64Prefix(prefix))
+		address, err := to6(prefix, net.ParseIP("192.0.2.33"))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, address.String(), tc.prefix)
+	}
+
+	c := caddy.NewTestController("dns", `docker {
+	dns64 64:ff9b::/80
+}`)
+	_, err := createPlugin(c)
+	assert.NotNil(t, err)
+}
+
+func TestInternalNames(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	internal_names
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	dd.networkInfoMap["4b1d"] = newNetworkInfo(&dockerapi.Network{
+		Name: "bridge",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{
+			{Subnet: "172.17.0.0/16", Gateway: "172.17.0.1"},
+		}},
+	})
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "my_project_network_name",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{
+			{Subnet: "172.20.0.0/16"},
+			{Subnet: "fd00:20::/64", Gateway: "fd00:20::1"},
+		}},
+	})
+
+	msg := query(t, dd, "host.docker.internal.", dns.TypeA, "172.17.0.5")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "172.17.0.1", msg.Answer[0].(*dns.A).A.String())
+
+	msg = query(t, dd, "Gateway.Docker.Internal.", dns.TypeA, "172.20.3.4")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "172.20.0.1", msg.Answer[0].(*dns.A).A.String())
+
+	msg = query(t, dd, "host.docker.internal.", dns.TypeAAAA, "172.20.3.4")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "fd00:20::1", msg.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// clients outside of the docker networks are passed to the next plugin
+	assert.Nil(t, query(t, dd, "host.docker.internal.", dns.TypeA, "10.240.0.1"))
+}
+
+// query sends a question to the plugin from the remote address (the test default when empty)
+// and returns the written response, or nil if the query was passed to the next plugin.
+func query(t *testing.T, dd *DockerDiscovery, name string, qtype uint16, remote string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: remote})
+	dd.Next = test.NextHandler(dns.RcodeRefused, nil)
+	_, err := dd.ServeDNS(context.Background(), rec, m)
+	assert.Nil(t, err)
+	return rec.Msg
+}
+
+func TestShadowContainerFallthrough(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	dns64
+}`)
+	c.ServerBlockKeys = []string{"loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels["coredns.dockerdiscovery.shadow"] = "true"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Len(t, msg.Answer, 1)
+
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	assert.True(t, dd.isShadowed("label-host.loc."))
+	assert.True(t, dd.isShadowed("evil_ptolemy.docker.loc."))
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeAAAA, ""))
+
+	// recreated without the label, the names are no longer shadow-only
+	container = genContainerDefn("", "bridge", "172.17.0.3")
+	container.ID = "0123456789ab" + container.ID[12:]
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	assert.False(t, dd.isShadowed("label-host.loc."))
+	msg = query(t, dd, "label-host.loc.", dns.TypeA, "")
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	}
+}
+
+func TestHealthcheckRecords(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Healthcheck = &dockerapi.HealthConfig{
+		Test: []string{"CMD-SHELL", "curl -f http://localhost:8080/healthz?full=1 || exit 1"},
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	msg := query(t, dd, "_health._tcp.evil_ptolemy.docker.loc.", dns.TypeSRV, "")
+	assert.Len(t, msg.Answer, 1)
+	srv := msg.Answer[0].(*dns.SRV)
+	assert.Equal(t, uint16(8080), srv.Port)
+	assert.Equal(t, "evil_ptolemy.docker.loc.", srv.Target)
+	assert.Len(t, msg.Extra, 1)
+
+	msg = query(t, dd, "_health._tcp.evil_ptolemy.docker.loc.", dns.TypeTXT, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, []string{"scheme=http", "path=/healthz"}, msg.Answer[0].(*dns.TXT).Txt)
+
+	container.Config.Healthcheck.Test = []string{"CMD", "pg_isready"}
+	assert.Nil(t, healthEndpointByContainer(container))
+}
+
+func TestWaitForSync(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	wait_for_sync 50ms
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 50*time.Millisecond, dd.syncTimeout)
+
+	dd = NewDockerDiscovery(defaultDockerEndpoint)
+	dd.syncTimeout = 50 * time.Millisecond
+	assert.False(t, dd.waitForSync(context.Background()))
+
+	dd.markSynced()
+	assert.True(t, dd.waitForSync(context.Background()))
+}
+
+func TestLameDuck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "docker.zone")
+	c := caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	lameduck 10ms
+	zone_file %s
+}`, file))
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Millisecond, dd.lameDuck)
+
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, uint32(3600), msg.Answer[0].Header().Ttl)
+	zone := func() string {
+		data, _ := os.ReadFile(file)
+		return string(data)
+	}
+	assert.Eventually(t, func() bool { return strings.Contains(zone(), "172.17.0.2") }, time.Second, time.Millisecond)
+
+	// the backends delete their records and publish no more
+	assert.Nil(t, dd.drain())
+	msg = query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, uint32(0), msg.Answer[0].Header().Ttl)
+	assert.Equal(t, "; docker containers, 0 records\n", zone())
+	other := genContainerDefn("", "bridge", "172.17.0.3")
+	other.ID = "0ab1c2d3e4f5" + other.ID[12:]
+	other.Config.Labels["com.docker.compose.container-number"] = "2"
+	assert.Nil(t, dd.updateContainerInfo(other))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, "; docker containers, 0 records\n", zone())
+}
+
+func TestPrometheusTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "docker.json")
+	c := caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	prometheus_sd %s
+}`, file))
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Image = "nginx:latest"
+	container.Config.Labels["prometheus.scrape"] = "true"
+	container.Config.ExposedPorts = map[dockerapi.Port]struct{}{"9113/tcp": {}, "80/tcp": {}}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	var groups []PrometheusTargetGroup
+	assert.Nil(t, json.Unmarshal(data, &groups))
+	assert.Len(t, groups, 1)
+	assert.Equal(t, []string{"172.17.0.2:80"}, groups[0].Targets)
+	assert.Equal(t, "evil_ptolemy", groups[0].Labels["container"])
+
+	container.Config.Labels["prometheus.port"] = "9113"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, []string{"172.17.0.2:9113"}, dd.prometheusTargetGroups()[0].Targets)
+
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	data, err = os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.JSONEq(t, "[]", string(data))
+}
+
+func TestACMEChallengeRecords(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels["coredns.dockerdiscovery.acme_challenge"] = "gfj9Xq...Rg85nM"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	dd.SetACMEChallenge("label-host.loc.", []string{"LoqXcYV8...jxAjEuX0"})
+
+	msg := query(t, dd, "_acme-challenge.label-host.loc.", dns.TypeTXT, "")
+	assert.Len(t, msg.Answer, 2)
+	assert.Equal(t, uint32(acmeChallengeTTL), msg.Answer[0].Header().Ttl)
+
+	dd.SetACMEChallenge("label-host.loc", nil)
+	msg = query(t, dd, "_acme-challenge.label-host.loc.", dns.TypeTXT, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, []string{"gfj9Xq...Rg85nM"}, msg.Answer[0].(*dns.TXT).Txt)
+
+	assert.Nil(t, query(t, dd, "_acme-challenge.evil_ptolemy.docker.loc.", dns.TypeA, ""))
+}
+
+func TestMetadata(t *testing.T) {
+	dd := NewDockerDiscovery(defaultDockerEndpoint)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.Config.Image = "nginx:latest"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	m := new(dns.Msg)
+	m.SetQuestion("label-host.loc.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	ctx := dd.Metadata(metadata.ContextWithMetadata(context.Background()), state)
+
+	assert.Equal(t, container.ID, metadata.ValueFunc(ctx, "docker/container_id")())
+	assert.Equal(t, "evil_ptolemy", metadata.ValueFunc(ctx, "docker/container_name")())
+	assert.Equal(t, "nginx:latest", metadata.ValueFunc(ctx, "docker/image")())
+	assert.Equal(t, "my_project_network_name", metadata.ValueFunc(ctx, "docker/network")())
+}
+
+func TestLookupAPI(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			dd.Lookup("label-host.loc", dns.TypeA)
+		}
+	}()
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Image = "nginx:latest"
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, dd.updateContainerInfo(container))
+	}
+	<-done
+
+	answers := dd.Lookup("label-host.loc", dns.TypeA)
+	assert.Len(t, answers, 1)
+	assert.Equal(t, "172.17.0.2", answers[0].(*dns.A).A.String())
+	assert.Empty(t, dd.Lookup("host.docker.internal", dns.TypeA))
+
+	containers := dd.Containers()
+	assert.Len(t, containers, 1)
+	assert.Equal(t, "evil_ptolemy", containers[0].Name)
+	assert.Equal(t, "nginx:latest", containers[0].Image)
+	assert.Equal(t, []string{"label-host.loc", "evil_ptolemy.docker.loc"}, containers[0].Domains)
+}
+
+func TestTTLJitter(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	ttl_jitter 10%
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, dd.ttlJitter)
+
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	ttls := make(map[uint32]bool)
+	for i := 0; i < 50; i++ {
+		msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+		ttl := msg.Answer[0].Header().Ttl
+		assert.True(t, ttl >= 3240 && ttl <= 3960, ttl)
+		ttls[ttl] = true
+	}
+	assert.Greater(t, len(ttls), 1)
+
+	assert.Equal(t, uint32(5), jitter(5, 10))
+}
+
+func TestServeStale(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	serve_stale 100ms 5
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, uint32(5), msg.Answer[0].Header().Ttl)
+
+	// restarted container is answered as usual
+	assert.Nil(t, dd.updateContainerInfo(container))
+	msg = query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, uint32(3600), msg.Answer[0].Header().Ttl)
+
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+}
+
+func TestAPILimiter(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	max_concurrent_api 2
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cap(dd.apiLimiter))
+
+	first, second := dd.acquireAPI(), dd.acquireAPI()
+	acquired := make(chan struct{})
+	go func() {
+		dd.acquireAPI()()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("third docker API call should wait for a free slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	first()
+	<-acquired
+	second()
+}
+
+func TestEventQueue(t *testing.T) {
+	defer func(debounce time.Duration) { eventDebounce = debounce }(eventDebounce)
+	eventDebounce = 20 * time.Millisecond
+	c := caddy.NewTestController("dns", `docker {
+	event_workers 2
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dd.eventWorkers)
+	for _, config := range []string{"docker {\nevent_workers\n}", "docker {\nevent_workers 0\n}"} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+
+	dd = NewDockerDiscovery(defaultDockerEndpoint)
+	event := func(kind, action, id string, attributes map[string]string) *dockerapi.APIEvents {
+		return &dockerapi.APIEvents{Type: kind, Action: action, Actor: dockerapi.APIActor{ID: id, Attributes: attributes}}
+	}
+	// the events of a container are handled one at a time in order, those of other containers meanwhile
+	dd.queueEvent(event("container", "start", "first", nil))
+	dd.queueEvent(event("container", "die", "first", nil))
+	dd.queueEvent(event("container", "start", "second", nil))
+	key, msg := dd.events.next(context.Background())
+	assert.Equal(t, "start", msg.Action)
+	_, other := dd.events.next(context.Background())
+	assert.Equal(t, "second", other.Actor.ID)
+	dd.events.done(key)
+	_, msg = dd.events.next(context.Background())
+	assert.Equal(t, "die", msg.Action)
+
+	// only the last network event of a rapid sequence is handled
+	before := testutil.ToFloat64(eventDebounceCount.WithLabelValues(dd.dockerEndpoint))
+	for _, action := range []string{"disconnect", "connect", "disconnect", "connect"} {
+		dd.queueEvent(event("network", action, "net", map[string]string{"container": "third"}))
+	}
+	dd.events.mu.Lock()
+	assert.Empty(t, dd.events.pending["third"])
+	dd.events.mu.Unlock()
+	time.Sleep(3 * eventDebounce)
+	dd.events.mu.Lock()
+	if assert.Len(t, dd.events.pending["third"], 1) {
+		assert.Equal(t, "connect", dd.events.pending["third"][0].Action)
+	}
+	dd.events.mu.Unlock()
+	assert.Equal(t, before+3, testutil.ToFloat64(eventDebounceCount.WithLabelValues(dd.dockerEndpoint)))
+
+	// another event of the container queues the waiting one first
+	dd.queueEvent(event("network", "disconnect", "net", map[string]string{"container": "fourth"}))
+	dd.queueEvent(event("container", "die", "fourth", nil))
+	dd.events.mu.Lock()
+	if assert.Len(t, dd.events.pending["fourth"], 2) {
+		assert.Equal(t, "disconnect", dd.events.pending["fourth"][0].Action)
+		assert.Equal(t, "die", dd.events.pending["fourth"][1].Action)
+	}
+	dd.events.mu.Unlock()
+
+	// the workers return on the shutdown
+	dd.startEventWorkers()
+	dd.stop()
+	dd.running.Wait()
+}
+
+func TestReloadHandover(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker`)
+	old, err := createPlugin(c)
+	assert.Nil(t, err)
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	assert.Nil(t, old.updateContainerInfo(container))
+	old.lastEvent = time.Now().UnixNano()
+
+	key := handoverKey(c.ServerBlockKeys, old.dockerEndpoint)
+	assert.Nil(t, old.handOver(key))
+
+	c = caddy.NewTestController("dns", `docker {
+	wait_for_sync 1m
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, old.lastEvent, dd.lastEvent)
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Len(t, msg.Answer, 1)
+
+	// the handover is used only once
+	assert.False(t, dd.takeOver(key))
+
+	// containers stopped during the reload are removed by the initial sync
+	dd.reconcile(map[string]bool{})
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+}
+
+func TestPersistentOverrides(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "overrides.json")
+	c := caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	overrides_file %s
+}`, file))
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	admin := httptest.NewServer(dd.adminHandler())
+	defer admin.Close()
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/overrides/label-host.loc", strings.NewReader(`{"address": "10.0.0.1"}`))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	req, _ = http.NewRequest(http.MethodPut, admin.URL+"/overrides/manual.loc", strings.NewReader(`{"address": "invalid"}`))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, "10.0.0.1", msg.Answer[0].(*dns.A).A.String())
+
+	// overrides survive restarts
+	dd, err = createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	overrides_file %s
+}`, file)))
+	assert.Nil(t, err)
+	msg = query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, "10.0.0.1", msg.Answer[0].(*dns.A).A.String())
+
+	assert.Nil(t, dd.SetOverride("label-host.loc", nil))
+	assert.Empty(t, dd.Overrides())
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{}`, string(data))
+}
+
+func TestFaultInjection(t *testing.T) {
+	f, err := parseFaults("event_delay=2s, drop_etcd_writes,serve_stale")
+	assert.Nil(t, err)
+	assert.Equal(t, faults{eventDelay: 2 * time.Second, dropEtcdWrites: true, serveStale: true}, f)
+	assert.Equal(t, "event_delay=2s,drop_etcd_writes,serve_stale", f.String())
+	f, err = parseFaults("")
+	assert.Nil(t, err)
+	assert.Equal(t, faults{}, f)
+	for _, spec := range []string{"event_delay", "event_delay=soon", "serve_stale=true", "crash"} {
+		_, err = parseFaults(spec)
+		assert.NotNil(t, err, spec)
+	}
+
+	// disabled without the environment variable
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	recorder := httptest.NewRecorder()
+	dd.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/faults", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	t.Setenv(faultsEnv, "crash")
+	_, err = createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.NotNil(t, err)
+	t.Setenv(faultsEnv, "serve_stale")
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	assert.True(t, dd.faultInjection)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	// the destroy event is ignored, the records are answered as they were
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "container", Action: "destroy", Actor: dockerapi.APIActor{ID: container.ID}})
+	assert.NotNil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+
+	admin := httptest.NewServer(dd.adminHandler())
+	defer admin.Close()
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/faults", strings.NewReader(`{"faults": "event_delay=1h"}`))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, faults{eventDelay: time.Hour}, dd.injectedFaults())
+	req, _ = http.NewRequest(http.MethodPut, admin.URL+"/faults", strings.NewReader(`{"faults": "crash"}`))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// the delayed event is dropped on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dd.handleEvent(ctx, &dockerapi.APIEvents{Type: "container", Action: "destroy", Actor: dockerapi.APIActor{ID: container.ID}})
+	assert.NotNil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+}
+
+func TestEtcdOps(t *testing.T) {
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	key := NewDockerDiscovery(defaultDockerEndpoint).etcdKey(container)
+	written := map[string]string{key: `{"host":"172.17.0.2","ttl":3600}`}
+
+	ops := etcdOps(map[string]string{}, written)
+	assert.Len(t, ops, 1)
+	assert.True(t, ops[0].IsPut())
+
+	// unchanged records are not written again
+	assert.Empty(t, etcdOps(written, written))
+
+	ops = etcdOps(written, map[string]string{key: `{"host":"172.17.0.3","ttl":3600}`})
+	assert.Len(t, ops, 1)
+	assert.True(t, ops[0].IsPut())
+	assert.Equal(t, `{"host":"172.17.0.3","ttl":3600}`, string(ops[0].ValueBytes()))
+
+	// deleted while still the record written
+	ops = etcdOps(written, map[string]string{})
+	assert.Len(t, ops, 1)
+	cmps, deletes, _ := ops[0].Txn()
+	assert.Len(t, cmps, 1)
+	assert.Equal(t, `{"host":"172.17.0.2","ttl":3600}`, string(cmps[0].ValueBytes()))
+	assert.True(t, deletes[0].IsDelete())
+	assert.Equal(t, key, string(deletes[0].KeyBytes()))
+}
+
+// fakeEtcd is an in-memory etcd key-value store, for the instances of several docker hosts sharing it. The
+// transactions only compare values.
+type fakeEtcd struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newFakeEtcd() *etcdcv3.Client {
+	return &etcdcv3.Client{KV: &fakeEtcd{data: make(map[string]string)}}
+}
+
+func (kv *fakeEtcd) Put(ctx context.Context, key, val string, opts ...etcdcv3.OpOption) (*etcdcv3.PutResponse, error) {
+	_, err := kv.Do(ctx, etcdcv3.OpPut(key, val, opts...))
+	return &etcdcv3.PutResponse{}, err
+}
+
+func (kv *fakeEtcd) Get(ctx context.Context, key string, opts ...etcdcv3.OpOption) (*etcdcv3.GetResponse, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	resp := &etcdcv3.GetResponse{}
+	for _, k := range kv.keys(etcdcv3.OpGet(key, opts...)) {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(kv.data[k])})
+	}
+	return resp, nil
+}
+
+func (kv *fakeEtcd) Delete(ctx context.Context, key string, opts ...etcdcv3.OpOption) (*etcdcv3.DeleteResponse, error) {
+	_, err := kv.Do(ctx, etcdcv3.OpDelete(key, opts...))
+	return &etcdcv3.DeleteResponse{}, err
+}
+
+func (kv *fakeEtcd) Compact(ctx context.Context, rev int64, opts ...etcdcv3.CompactOption) (*etcdcv3.CompactResponse, error) {
+	return &etcdcv3.CompactResponse{}, nil
+}
+
+func (kv *fakeEtcd) Do(ctx context.Context, op etcdcv3.Op) (etcdcv3.OpResponse, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.apply(op)
+	return etcdcv3.OpResponse{}, nil
+}
+
+func (kv *fakeEtcd) Txn(ctx context.Context) etcdcv3.Txn {
+	return &fakeEtcdTxn{kv: kv}
+}
+
+// keys returns the keys of the range of the operation, sorted. The caller must hold the lock.
+func (kv *fakeEtcd) keys(op etcdcv3.Op) []string {
+	key, end := string(op.KeyBytes()), string(op.RangeBytes())
+	var keys []string
+	for k := range kv.data {
+		if k == key || (end != "" && k > key && k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// apply applies the operation and reports whether its comparisons succeeded. The caller must hold the lock.
+func (kv *fakeEtcd) apply(op etcdcv3.Op) bool {
+	switch {
+	case op.IsPut():
+		kv.data[string(op.KeyBytes())] = string(op.ValueBytes())
+	case op.IsDelete():
+		for _, k := range kv.keys(op) {
+			delete(kv.data, k)
+		}
+	case op.IsTxn():
+		cmps, thenOps, elseOps := op.Txn()
+		succeeded := true
+		for i := range cmps {
+			value, ok := kv.data[string(cmps[i].KeyBytes())]
+			succeeded = succeeded && ok && value == string(cmps[i].ValueBytes())
+		}
+		ops := thenOps
+		if !succeeded {
+			ops = elseOps
+		}
+		for _, op := range ops {
+			kv.apply(op)
+		}
+		return succeeded
+	}
+	return true
+}
+
+type fakeEtcdTxn struct {
+	kv               *fakeEtcd
+	cmps             []etcdcv3.Cmp
+	thenOps, elseOps []etcdcv3.Op
+}
+
+func (txn *fakeEtcdTxn) If(cs ...etcdcv3.Cmp) etcdcv3.Txn {
+	txn.cmps = append(txn.cmps, cs...)
+	return txn
+}
+
+func (txn *fakeEtcdTxn) Then(ops ...etcdcv3.Op) etcdcv3.Txn {
+	txn.thenOps = append(txn.thenOps, ops...)
+	return txn
+}
+
+func (txn *fakeEtcdTxn) Else(ops ...etcdcv3.Op) etcdcv3.Txn {
+	txn.elseOps = append(txn.elseOps, ops...)
+	return txn
+}
+
+func (txn *fakeEtcdTxn) Commit() (*etcdcv3.TxnResponse, error) {
+	txn.kv.mu.Lock()
+	defer txn.kv.mu.Unlock()
+	succeeded := txn.kv.apply(etcdcv3.OpTxn(txn.cmps, txn.thenOps, txn.elseOps))
+	return &etcdcv3.TxnResponse{Succeeded: succeeded}, nil
+}
+
+// etcdData returns the records of the fake etcd of the client by key
+func etcdData(client *etcdcv3.Client) map[string]string {
+	kv := client.KV.(*fakeEtcd)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	data := make(map[string]string, len(kv.data))
+	for k, v := range kv.data {
+		data[k] = v
+	}
+	return data
+}
+
+func TestEtcdOwners(t *testing.T) {
+	client := newFakeEtcd()
+	// instance starts the instance of the docker host with the containers and syncs its etcd backend
+	instance := func(owner string, containers ...*dockerapi.Container) *etcdBackend {
+		dd := NewDockerDiscovery(defaultDockerEndpoint)
+		dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+		dd.etcd, dd.etcdOwner = client, owner
+		for _, container := range containers {
+			assert.Nil(t, dd.updateContainerInfo(container))
+		}
+		backend := &etcdBackend{dd: dd, written: make(map[string]string)}
+		assert.Nil(t, backend.sync(context.Background(), dd.backendSnapshot()))
+		return backend
+	}
+	owners := func() map[string]string {
+		owners := make(map[string]string)
+		for key, value := range etcdData(client) {
+			owners[key] = etcdRecordOwner(value)
+		}
+		return owners
+	}
+	web := genContainerDefn("", "bridge", "172.17.0.2")
+	db := genContainerDefn("", "bridge", "172.17.0.3")
+	db.ID, db.Name = "0ab1c2d3e4f5"+db.ID[12:], "db"
+
+	// two docker hosts write their records under the same prefix, with their owner
+	hostA := instance("host-a", web)
+	hostB := instance("host-b", db)
+	assert.Equal(t, map[string]string{"/docker/docker/evil_ptolemy": "host-a", "/docker/docker/db": "host-b"}, owners())
+	assert.Len(t, hostB.written, 1)
+
+	// the resyncs load the records of the instance only, the other host's are kept
+	hostB.reload()
+	assert.Nil(t, hostB.sync(context.Background(), hostB.dd.backendSnapshot()))
+	assert.Equal(t, map[string]string{"/docker/docker/evil_ptolemy": "host-a", "/docker/docker/db": "host-b"}, owners())
+
+	// restarted without its containers, the instance deletes its records only
+	restarted := instance("host-b")
+	assert.Empty(t, restarted.written)
+	assert.Equal(t, map[string]string{"/docker/docker/evil_ptolemy": "host-a"}, owners())
+
+	// the record written by another host since, for a container of the same name, is not deleted
+	instance("host-c", web)
+	assert.Nil(t, hostA.sync(context.Background(), nil))
+	assert.Empty(t, hostA.written)
+	assert.Equal(t, map[string]string{"/docker/docker/evil_ptolemy": "host-c"}, owners())
+}
+
+func TestEtcdPurge(t *testing.T) {
+	client := newFakeEtcd()
+	record := func(host, owner string) string {
+		return ownedEtcdRecord(fmt.Sprintf(`{"host":"%s","ttl":3600}`, host), owner)
+	}
+
+	dd := NewDockerDiscovery(defaultDockerEndpoint)
+	dd.etcdOwner = "host-a"
+	backend := &etcdBackend{dd: dd, written: map[string]string{
+		"/docker/docker/evil_ptolemy": record("172.17.0.2", "host-a"),
+		"/docker/docker/db":           record("172.17.0.3", "host-b"),
+		"/docker/docker/cache":        record("172.17.0.4", "host-a"),
+	}}
+	dd.addBackend(backend)
+	for key, value := range backend.written {
+		if key == "/docker/docker/cache" {
+			// written by another host since
+			value = record("172.17.0.5", "host-c")
+		}
+		_, err := client.Put(context.Background(), key, value)
+		assert.Nil(t, err)
+	}
+
+	// only the records of the instance still as written are deleted
+	dd.purgeEtcd(client)
+	assert.Empty(t, backend.written)
+	assert.Equal(t, map[string]string{
+		"/docker/docker/db":    record("172.17.0.3", "host-b"),
+		"/docker/docker/cache": record("172.17.0.5", "host-c"),
+	}, etcdData(client))
+}
+
+func TestBackends(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "docker.zone")
+	// the plugin publishes in the background too, the same records
+	var postedMu sync.Mutex
+	var posted []ContainerRecord
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var records []ContainerRecord
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&records))
+		postedMu.Lock()
+		posted = records
+		postedMu.Unlock()
+	}))
+	defer webhook.Close()
+
+	dd, err := createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	zone_file %s
+	webhook %s
+	ttl 60
+}`, file, webhook.URL)))
+	assert.Nil(t, err)
+	assert.Len(t, dd.backends, 2)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	// the backends are not started, the change is pending
+	for _, status := range dd.Backends() {
+		assert.True(t, status.Healthy)
+		assert.Equal(t, uint64(1), status.Pending)
+	}
+
+	containers := dd.backendSnapshot()
+	assert.Nil(t, dd.backends[0].backend.sync(context.Background(), containers))
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "; docker containers, 1 records\nlabel-host.loc.\t60\tIN\tA\t172.17.0.2\n", string(data))
+
+	// another instance, the one of the plugin keeps the state of its own posts
+	assert.Nil(t, (&recordBackend{dd: dd, backend: backends.NewWebhook(webhook.URL, http.DefaultClient)}).sync(context.Background(), containers))
+	postedMu.Lock()
+	defer postedMu.Unlock()
+	assert.Len(t, posted, 1)
+	assert.Equal(t, []string{"label-host.loc"}, posted[0].Domains)
+}
+
+func TestPublishers(t *testing.T) {
+	dir := t.TempDir()
+
+	// a Consul KV store
+	var kvMu sync.Mutex
+	kv := map[string]string{"dockerdiscovery/gone.loc/bbbbbbbbbbbb": "{}"}
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kvMu.Lock()
+		defer kvMu.Unlock()
+		switch r.URL.Path {
+		case "/v1/kv/dockerdiscovery/":
+			var kvs []consulKV
+			for key, value := range kv {
+				kvs = append(kvs, consulKV{Key: key, Value: []byte(value)})
+			}
+			json.NewEncoder(w).Encode(kvs)
+		case "/v1/txn":
+			var ops []consulTxnOp
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&ops))
+			for _, op := range ops {
+				if op.KV.Verb == "set" {
+					kv[op.KV.Key] = string(op.KV.Value)
+				} else {
+					delete(kv, op.KV.Key)
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer consul.Close()
+
+	// a redis server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	var hashMu sync.Mutex
+	hash := map[string]string{"gone": "{}"}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+				for {
+					command, err := c.reply()
+					if err != nil {
+						return
+					}
+					args := command.([]interface{})
+					hashMu.Lock()
+					reply := ":1\r\n"
+					switch args[0] {
+					case "HGETALL":
+						reply = fmt.Sprintf("*%d\r\n", 2*len(hash))
+						for field, value := range hash {
+							reply += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+						}
+					case "HSET":
+						hash[args[2].(string)] = args[3].(string)
+					case "HDEL":
+						delete(hash, args[2].(string))
+					}
+					hashMu.Unlock()
+					conn.Write([]byte(reply))
+				}
+			}()
+		}
+	}()
+
+	c := caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	hosts_file %s
+	consul %s
+	redis %s
+}`, filepath.Join(dir, "hosts"), consul.URL, listener.Addr()))
+	c.ServerBlockKeys = []string{"loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Len(t, dd.backends, 3)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	// other instances, the ones of the plugin publish in the background too
+	hostsFile := &recordBackend{dd: dd, backend: backends.NewHostsFile(filepath.Join(dir, "hosts"),
+		&backends.Snippet{Path: filepath.Join(dir, "hosts.conf"), Zones: dd.zones, Source: dd.dockerEndpoint, TTL: dd.ttl})}
+	for _, backend := range []backend{hostsFile, newConsulBackend(consul.URL, consulDefaultPrefix),
+		newRedisBackend(dd, listener.Addr().String(), "")} {
+		assert.Nil(t, backend.sync(context.Background(), dd.backendSnapshot()), backend.name())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "hosts"))
+	assert.Nil(t, err)
+	assert.Equal(t, "# docker containers, 1 addresses\n172.17.0.2\tlabel-host.loc\n", string(data))
+	// the snippet to import serves the file with the hosts plugin
+	data, err = os.ReadFile(filepath.Join(dir, "hosts.conf"))
+	assert.Nil(t, err)
+	assert.Equal(t, "# docker containers, from unix:///var/run/docker.sock\nhosts "+filepath.Join(dir, "hosts")+
+		" loc. {\n\tttl 3600\n\treload 5s\n\tfallthrough\n}\n", string(data))
+	// the files unchanged are not written again, the hosts plugin doesn't reload them
+	assert.Nil(t, os.Remove(filepath.Join(dir, "hosts.conf")))
+	assert.Nil(t, hostsFile.sync(context.Background(), dd.backendSnapshot()))
+	assert.NoFileExists(t, filepath.Join(dir, "hosts.conf"))
+	hostsFile.reload()
+	assert.Nil(t, hostsFile.sync(context.Background(), dd.backendSnapshot()))
+	assert.FileExists(t, filepath.Join(dir, "hosts.conf"))
+
+	// the records written before of the containers gone are deleted
+	kvMu.Lock()
+	assert.Equal(t, map[string]string{"dockerdiscovery/label-host.loc/fa155d6fd141": `{"host":"172.17.0.2","ttl":3600,"group":"cproject"}`}, kv)
+	kvMu.Unlock()
+
+	hashMu.Lock()
+	assert.Len(t, hash, 2)
+	assert.JSONEq(t, `{"a":[{"ttl":3600,"ip":"172.17.0.2"}]}`, hash["label-host"])
+	assert.Contains(t, hash["@"], `"soa":{"ttl":3600`)
+	hashMu.Unlock()
+
+	for _, config := range []string{"docker {\nconsul 127.0.0.1:8500\n}", "docker {\nconsul http://127.0.0.1:8500 /\n}",
+		"docker {\nredis localhost\n}", "docker {\nhosts_file\n}", "docker {\nhosts_file a b c\n}"} {
+		_, err = createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	max_records 1
+}`))
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels["coredns.dockerdiscovery.network"] = "missing"
+	err = dd.updateContainerInfo(container)
+	assert.True(t, errors.Is(err, ErrNoNetwork))
+	assert.Equal(t, "unable to find network settings for the network missing", err.Error())
+	container.Config.Labels["coredns.dockerdiscovery.network"] = "bridge"
+	container.NetworkSettings.Networks["bridge"] = dockerapi.ContainerNetwork{}
+	err = dd.updateContainerInfo(container)
+	assert.True(t, errors.Is(err, ErrNoAddress))
+	assert.Equal(t, "no_address", errorKind(err))
+
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	other := genContainerDefn("", "bridge", "172.17.0.3")
+	other.ID, other.Config.Labels = strings.Repeat("b", 64), map[string]string{"coredns.dockerdiscovery.host": "other.loc"}
+	err = dd.updateContainerInfo(other)
+	assert.True(t, errors.Is(err, ErrRecordLimit))
+	assert.Equal(t, "record_limit", errorKind(err))
+
+	err = &transientError{errors.New("daemon busy")}
+	assert.True(t, errors.Is(err, ErrDockerUnavailable))
+	assert.Equal(t, "docker_unavailable", errorKind(err))
+	assert.Equal(t, "container_gone", errorKind(&dockerapi.NoSuchContainer{ID: other.ID}))
+
+	err = &BackendError{Backend: "etcd", Err: errors.New("connection refused")}
+	assert.True(t, errors.Is(err, ErrBackendUnavailable))
+	assert.Equal(t, "connection refused", err.Error())
+	var backendError *BackendError
+	assert.True(t, errors.As(fmt.Errorf("publishing: %w", err), &backendError))
+	assert.Equal(t, "etcd", backendError.Backend)
+
+	before := testutil.ToFloat64(errorCount.WithLabelValues("backend_unavailable"))
+	countError(err)
+	assert.Equal(t, before+1, testutil.ToFloat64(errorCount.WithLabelValues("backend_unavailable")))
+	assert.Equal(t, "other", errorKind(errors.New("unexpected")))
+}
+
+func TestWebhookPreviousAddress(t *testing.T) {
+	var posted []ContainerRecord
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = nil
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&posted))
+	}))
+	defer webhook.Close()
+
+	dd := NewDockerDiscovery(defaultDockerEndpoint)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	backend := &recordBackend{dd: dd, backend: backends.NewWebhook(webhook.URL, http.DefaultClient)}
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	assert.Nil(t, backend.sync(context.Background(), dd.backendSnapshot()))
+	assert.Nil(t, posted[0].PreviousAddress)
+
+	// the webhook gets the old address of the containers whose address changed since the last post
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.3")))
+	assert.Nil(t, backend.sync(context.Background(), dd.backendSnapshot()))
+	assert.Equal(t, "172.17.0.3", posted[0].Address.String())
+	assert.Equal(t, "172.17.0.2", posted[0].PreviousAddress.String())
+	assert.Nil(t, backend.sync(context.Background(), dd.backendSnapshot()))
+	assert.Nil(t, posted[0].PreviousAddress)
+}
+
+func TestRecordTableVersion(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), dd.Version())
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, uint64(1), dd.Version())
+	assert.Nil(t, dd.SetOverride("manual.loc", net.ParseIP("10.0.0.1")))
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	assert.Equal(t, uint64(3), dd.Version())
+
+	// nothing to remove, nothing changed
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	assert.Equal(t, uint64(3), dd.Version())
+}
+
+func TestSRVPriorityFromDependsOn(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+
+	primary := genContainerDefn("", "bridge", "172.17.0.2")
+	primary.Config.Labels = map[string]string{
+		"coredns.dockerdiscovery.host": "db.loc",
+		"com.docker.compose.project":   "cproject",
+		"com.docker.compose.service":   "db",
+	}
+	primary.Config.ExposedPorts = map[dockerapi.Port]struct{}{"5432/tcp": {}}
+	replica := genContainerDefn("", "bridge", "172.17.0.3")
+	replica.ID = "0b1d6e4c2e1f5a4d8f6e3c9b7a5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d"
+	replica.Config.Labels = map[string]string{
+		"coredns.dockerdiscovery.host":  "db.loc",
+		"com.docker.compose.project":    "cproject",
+		"com.docker.compose.service":    "db-replica",
+		"com.docker.compose.depends_on": "db:service_healthy:false",
+	}
+	assert.Nil(t, dd.updateContainerInfo(primary))
+	assert.Nil(t, dd.updateContainerInfo(replica))
+
+	msg := query(t, dd, "db.loc.", dns.TypeSRV, "")
+	assert.Len(t, msg.Answer, 2)
+	priorities := map[uint16]uint16{}
+	for _, rr := range msg.Answer {
+		srv := rr.(*dns.SRV)
+		priorities[srv.Priority] = srv.Port
+	}
+	assert.Equal(t, map[uint16]uint16{0: 5432, 1: 0}, priorities)
+
+	// the etcd records carry the SRV data too
+	assert.JSONEq(t, `{"host":"172.17.0.2","port":5432,"ttl":3600,"group":"cproject"}`, dd.containerInfoMap[primary.ID].etcdRecord)
+	replica.Config.ExposedPorts = map[dockerapi.Port]struct{}{"5432/tcp": {}}
+	assert.Nil(t, dd.updateContainerInfo(replica))
+	assert.JSONEq(t, `{"host":"172.17.0.3","port":5432,"priority":1,"ttl":3600,"group":"cproject"}`, dd.containerInfoMap[replica.ID].etcdRecord)
+}
+
+func TestEtcdDiscovery(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	etcd_discovery srv _etcd-client-ssl._tcp.example.com
+}`))
+	assert.Nil(t, err)
+	endpoints := etcdEndpoints(dd.etcdDiscovery, []*net.SRV{
+		{Target: "etcd2.example.com.", Port: 2379, Priority: 10},
+		{Target: "etcd1.example.com.", Port: 2379, Priority: 0},
+	})
+	assert.Equal(t, []string{"https://etcd1.example.com:2379", "https://etcd2.example.com:2379"}, endpoints)
+
+	_, err = createPlugin(caddy.NewTestController("dns", `docker {
+	etcd_discovery dns _etcd-client._tcp.example.com
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestEtcdHealth(t *testing.T) {
+	health := newEtcdHealth([]string{"http://etcd1:2379", "http://etcd2:2379", "http://etcd3:2379"})
+	down := errors.New("connection refused")
+
+	// a failing endpoint is rotated out until it answers again
+	assert.Nil(t, health.update(map[string]error{"http://etcd1:2379": nil, "http://etcd2:2379": nil, "http://etcd3:2379": nil}))
+	assert.Equal(t, []string{"http://etcd1:2379", "http://etcd3:2379"}, health.update(map[string]error{"http://etcd2:2379": down}))
+	statuses := health.statuses()
+	assert.False(t, statuses[1].Healthy)
+	assert.False(t, statuses[1].InUse)
+	assert.Equal(t, "connection refused", statuses[1].LastError)
+	assert.True(t, statuses[0].Healthy && statuses[0].InUse)
+	assert.Equal(t, []string{"http://etcd1:2379", "http://etcd2:2379", "http://etcd3:2379"}, health.update(map[string]error{"http://etcd2:2379": nil}))
+
+	// the client keeps trying them all when none answers
+	assert.Nil(t, health.update(map[string]error{"http://etcd1:2379": down, "http://etcd2:2379": down, "http://etcd3:2379": down}))
+	assert.False(t, health.statuses()[0].Healthy)
+
+	// the endpoints discovered again are all used until checked
+	health.setEndpoints([]string{"http://etcd3:2379", "http://etcd4:2379"})
+	assert.Equal(t, []string{"http://etcd4:2379"}, health.update(map[string]error{"http://etcd4:2379": nil}))
+	assert.Len(t, health.statuses(), 2)
+
+	// the checks of an unreachable endpoint fail, on the metrics too
+	defer func(timeout time.Duration) { etcdHealthTimeout = timeout }(etcdHealthTimeout)
+	etcdHealthTimeout = 100 * time.Millisecond
+	dd := NewDockerDiscovery("unix:///etcd-health.sock")
+	defer dd.stop()
+	client, err := newEtcdClient([]string{"http://127.0.0.1:1"}, nil, "", "")
+	assert.Nil(t, err)
+	defer client.Close()
+	health = newEtcdHealth([]string{"http://127.0.0.1:1"})
+	dd.checkEtcdEndpoints(client, health)
+	assert.False(t, health.statuses()[0].Healthy)
+	assert.Equal(t, 0.0, testutil.ToFloat64(etcdEndpointHealthy.WithLabelValues(dd.dockerEndpoint, "http://127.0.0.1:1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(etcdEndpointFailureCount.WithLabelValues(dd.dockerEndpoint, "http://127.0.0.1:1")))
+}
+
+func TestDelegation(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels = map[string]string{
+		"coredns.dockerdiscovery.host":     "dc1.ad.docker.loc",
+		"coredns.dockerdiscovery.delegate": "ad.docker.loc",
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	for _, name := range []string{"ad.docker.loc.", "_ldap._tcp.AD.docker.loc.", "dc1.ad.docker.loc."} {
+		msg := query(t, dd, name, dns.TypeA, "")
+		assert.False(t, msg.Authoritative, name)
+		assert.Empty(t, msg.Answer, name)
+		assert.Len(t, msg.Ns, 1, name)
+		assert.Equal(t, "ad.docker.loc.", msg.Ns[0].Header().Name)
+		assert.Equal(t, "dc1.ad.docker.loc.", msg.Ns[0].(*dns.NS).Ns)
+		assert.Len(t, msg.Extra, 1, name)
+		assert.Equal(t, "172.17.0.2", msg.Extra[0].(*dns.A).A.String())
+	}
+
+	assert.Nil(t, query(t, dd, "docker.loc.", dns.TypeA, ""))
+}
+
+func TestQueryLog(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	log_queries 2
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	query(t, dd, "label-host.loc.", dns.TypeA, "10.0.0.9")
+	assert.Contains(t, buf.String(), "[docker] query client=10.0.0.9 name=label-host.loc. type=A rcode=NOERROR container=fa155d6fd141")
+
+	now := time.Now()
+	logger := &queryLogger{rate: 2}
+	for i, expected := range []bool{true, true, false, false} {
+		ok, _ := logger.allow(now)
+		assert.Equal(t, expected, ok, i)
+	}
+	ok, dropped := logger.allow(now.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 2, dropped)
+}
+
+func TestMaxUDPSize(t *testing.T) {
+	for _, config := range []string{"docker", "docker {\n\tmax_udp_size 512\n\tcompress false\n}"} {
+		dd, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.Nil(t, err)
+		for i := 0; i < 30; i++ {
+			container := genContainerDefn("", "bridge", fmt.Sprintf("172.17.0.%d", i+2))
+			container.ID = fmt.Sprintf("%064d", i)
+			container.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "big.loc"}
+			assert.Nil(t, dd.updateContainerInfo(container))
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("big.loc.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err = dd.ServeDNS(context.Background(), rec, m)
+		assert.Nil(t, err)
+		if dd.maxUDPSize == 0 {
+			assert.False(t, rec.Msg.Truncated)
+			assert.Len(t, rec.Msg.Answer, 30)
+		} else {
+			assert.True(t, rec.Msg.Truncated)
+			assert.LessOrEqual(t, rec.Msg.Len(), 512)
+		}
+	}
+}
+
+func TestCanonicalAnswers(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	ttl_jitter 20
+}`))
+	assert.Nil(t, err)
+	for i, address := range []string{"172.17.0.30", "172.17.0.4", "172.17.0.200"} {
+		container := genContainerDefn("", "bridge", address)
+		container.ID = fmt.Sprintf("%064d", i)
+		container.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "web.loc", "coredns.dockerdiscovery.ttl": fmt.Sprint(100 * (i + 1))}
+		assert.Nil(t, dd.updateContainerInfo(container))
+	}
+
+	// sorted by address whatever the order of the containers, sharing the lowest TTL, jittered once
+	msg := query(t, dd, "web.loc.", dns.TypeA, "")
+	var addresses []string
+	for _, rr := range msg.Answer {
+		addresses = append(addresses, rr.(*dns.A).A.String())
+		assert.Equal(t, msg.Answer[0].Header().Ttl, rr.Header().Ttl)
+	}
+	assert.Equal(t, []string{"172.17.0.4", "172.17.0.30", "172.17.0.200"}, addresses)
+	assert.InDelta(t, 100, msg.Answer[0].Header().Ttl, 20)
+
+	// the duplicates are dropped, the RR sets keep their order
+	records := canonicalize([]dns.RR{
+		test.A("b.loc. 60 IN A 172.17.0.3"), test.A("a.loc. 30 IN A 172.17.0.2"), test.A("b.loc. 10 IN A 172.17.0.2"),
+		test.A("b.loc. 20 IN A 172.17.0.3"),
+	}, false)
+	assert.Equal(t, []string{"b.loc.\t10\tIN\tA\t172.17.0.2", "b.loc.\t10\tIN\tA\t172.17.0.3", "a.loc.\t30\tIN\tA\t172.17.0.2"},
+		[]string{records[0].String(), records[1].String(), records[2].String()})
+	assert.Len(t, records, 3)
+
+	// shuffled by round_robin, not sorted
+	records = canonicalize([]dns.RR{test.A("b.loc. 60 IN A 172.17.0.3"), test.A("b.loc. 10 IN A 172.17.0.2")}, true)
+	assert.Equal(t, "b.loc.\t10\tIN\tA\t172.17.0.3", records[0].String())
+}
+
+func TestEventCursor(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cursor")
+	assert.Nil(t, os.WriteFile(file, []byte("1700000000000000000\n"), 0644))
+	dd, err := createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	event_cursor_file %s
+}`, file)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1700000000000000000), atomic.LoadInt64(&dd.lastEvent))
+
+	// events are handled concurrently, the cursor only moves forward
+	dd.advanceEventCursor(1700000002000000000)
+	dd.advanceEventCursor(1700000001000000000)
+	assert.Equal(t, int64(1700000002000000000), atomic.LoadInt64(&dd.lastEvent))
+
+	assert.Nil(t, os.WriteFile(file, []byte("invalid"), 0644))
+	_, err = createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker {
+	event_cursor_file %s
+}`, file)))
+	assert.NotNil(t, err)
+}
+
+func TestInspectErrors(t *testing.T) {
+	inspectRetryWait = time.Millisecond
+	var status int32 = http.StatusInternalServerError
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer daemon.Close()
+
+	dd := NewDockerDiscovery(daemon.URL)
+	client, err := dockerapi.NewClient(daemon.URL)
+	assert.Nil(t, err)
+	dd.dockerClient = client
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// the daemon failing doesn't tell anything about the container, its records are kept
+	_, err = dd.inspectContainerRetry(context.Background(), container.ID)
+	assert.True(t, isTransient(err))
+	dd.inspectFailed("container:start", container.ID, err)
+	other := genContainerDefn("", "container:"+container.ID, "")
+	other.ID = "0ab1c2d3e4f5" + other.ID[12:]
+	assert.True(t, isTransient(dd.updateContainerInfo(other)))
+	assert.Len(t, dd.Containers(), 1)
+
+	// the container is gone, its records are removed
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	_, err = dd.inspectContainerRetry(context.Background(), container.ID)
+	assert.True(t, containerGone(err))
+	dd.inspectFailed("container:start", container.ID, err)
+	assert.Len(t, dd.Containers(), 0)
+}
+
+func TestOneShotLifetime(t *testing.T) {
+	inspectRetryWait = time.Millisecond
+	var running int32 = 1
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.State.Running = true
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&running) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	dd.oneShotLifetime = 20 * time.Millisecond
+
+	// restarted containers are not one-shot
+	service := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	service.ID = "0ab1c2d3e4f5" + service.ID[12:]
+	service.Config.Labels["com.docker.compose.container-number"] = "2"
+	service.HostConfig.RestartPolicy = dockerapi.AlwaysRestart()
+	assert.False(t, isOneShot(service))
+	assert.Nil(t, dd.updateContainerInfo(service))
+
+	// the one-shot container still running is kept past its lifetime
+	assert.True(t, isOneShot(container))
+	assert.Nil(t, dd.updateContainerInfo(container))
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, dd.Containers(), 2)
+
+	// its die event missed, it's removed once docker no longer knows it
+	atomic.StoreInt32(&running, 0)
+	assert.Eventually(t, func() bool { return len(dd.Containers()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, service.ID, dd.Containers()[0].ID)
+
+	_, err := createPlugin(caddy.NewTestController("dns", `docker {
+	one_shot_lifetime 0s
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestSharedDocker(t *testing.T) {
+	var inspections int32
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&inspections, 1)
+		time.Sleep(20 * time.Millisecond)
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+
+	first, second := NewDockerDiscovery(daemon.URL), NewDockerDiscovery(daemon.URL)
+	assert.Nil(t, first.acquireDocker())
+	assert.Nil(t, second.acquireDocker())
+	assert.Same(t, first.dockerClient, second.dockerClient, "one client, one event stream")
+	assert.Equal(t, 2, sharedDockers[daemon.URL].refs)
+
+	// both instances handle the same event, the container is inspected once
+	done := make(chan *dockerapi.Container)
+	for _, dd := range []*DockerDiscovery{first, second} {
+		go func(dd *DockerDiscovery) {
+			inspected, err := dd.inspectEventContainer(context.Background(), container.ID, 1700000000000000000)
+			assert.Nil(t, err)
+			done <- inspected
+		}(dd)
+	}
+	assert.Equal(t, container.ID, (<-done).ID)
+	assert.Equal(t, container.ID, (<-done).ID)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&inspections))
+
+	// another event, another inspection
+	_, err := first.inspectEventContainer(context.Background(), container.ID, 1700000001000000000)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&inspections))
+
+	assert.Nil(t, first.releaseDocker())
+	assert.Contains(t, sharedDockers, daemon.URL)
+	assert.Nil(t, second.releaseDocker())
+	assert.NotContains(t, sharedDockers, daemon.URL)
+}
+
+func TestPTRRecords(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`))
+	assert.Nil(t, err)
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "my_project_network_name",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{
+			{Subnet: "172.20.0.0/16"},
+			{Subnet: "10.1.2.0/20"},
+			{Subnet: "fd00:20::/64"},
+		}},
+	})
+	assert.Equal(t, []string{"0.0.0.0.0.0.0.0.0.2.0.0.0.0.d.f.ip6.arpa.", "1.10.in-addr.arpa.", "20.172.in-addr.arpa."}, dd.ReverseZones())
+
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+
+	msg := query(t, dd, "2.0.20.172.in-addr.arpa.", dns.TypePTR, "")
+	assert.Len(t, msg.Answer, 2)
+	assert.Equal(t, "label-host.loc.", msg.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, "evil_ptolemy.docker.loc.", msg.Answer[1].(*dns.PTR).Ptr)
+
+	// addresses without container are passed to the next plugin
+	assert.Nil(t, query(t, dd, "3.0.20.172.in-addr.arpa.", dns.TypePTR, ""))
+
+	// the reverse index follows the containers, whatever their network
+	macvlan := genContainerDefn("", "lan", "192.168.1.50")
+	macvlan.ID = "0ab1c2d3e4f5" + macvlan.ID[12:]
+	macvlan.Config.Labels["coredns.dockerdiscovery.host"] = "nas.loc"
+	macvlan.Config.Labels["com.docker.compose.container-number"] = "2"
+	assert.Nil(t, dd.updateContainerInfo(macvlan))
+	assert.Equal(t, "nas.loc.", dd.Lookup("50.1.168.192.in-addr.arpa", dns.TypePTR)[0].(*dns.PTR).Ptr)
+	assert.Nil(t, dd.removeContainerInfo(macvlan.ID))
+	assert.Len(t, dd.Lookup("50.1.168.192.in-addr.arpa", dns.TypePTR), 0)
+	assert.Len(t, dd.addressIndex, 1)
+}
+
+func TestNetworkEvents(t *testing.T) {
+	id := strings.Repeat("93c2", 16)
+	var exists int32 = 1
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/networks/"+id) || atomic.LoadInt32(&exists) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(dockerapi.Network{ID: id, Name: "my_project_network_name",
+			IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.20.0.0/16"}}}})
+	}))
+	defer daemon.Close()
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	assert.Empty(t, dd.ReverseZones())
+
+	// the created network is inspected alone
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "network", Action: "create", Actor: dockerapi.APIActor{ID: id}})
+	assert.Equal(t, []string{"20.172.in-addr.arpa."}, dd.ReverseZones())
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "network", Action: "destroy", Actor: dockerapi.APIActor{ID: id}})
+	assert.Empty(t, dd.ReverseZones())
+
+	// gone before its inspection
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "network", Action: "create", Actor: dockerapi.APIActor{ID: id}})
+	atomic.StoreInt32(&exists, 0)
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "network", Action: "update", Actor: dockerapi.APIActor{ID: id}})
+	assert.Empty(t, dd.ReverseZones())
+}
+
+func TestPodman(t *testing.T) {
+	var containerMu sync.Mutex
+	container := genContainerDefn("", "bridge", "")
+	container.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "web.loc"}
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{"podman": {IPAddress: "10.88.0.5"}}
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/version") {
+			w.Write([]byte(`{"Version": "4.9.3", "Components": [{"Name": "Podman Engine", "Version": "4.9.3"}]}`))
+			return
+		}
+		containerMu.Lock()
+		defer containerMu.Unlock()
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	dd.runtime = runtimeAuto
+	assert.False(t, dd.isPodman())
+	assert.Nil(t, dd.detectRuntime(context.Background()))
+	assert.True(t, dd.isPodman())
+
+	// the bridge network mode takes the address of the podman network
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "container", Action: "start", Actor: dockerapi.APIActor{ID: container.ID}})
+	assert.Equal(t, "10.88.0.5", dd.Lookup("web.loc", dns.TypeA)[0].(*dns.A).A.String())
+
+	// the podman network events are by container, the address of the user-defined network is answered
+	containerMu.Lock()
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{"web": {IPAddress: "10.89.0.2"}}
+	containerMu.Unlock()
+	event := &dockerapi.APIEvents{Type: "network", Action: "connect", Actor: dockerapi.APIActor{ID: container.ID, Attributes: map[string]string{"network": "web"}}}
+	dd.handleEvent(context.Background(), event)
+	assert.Equal(t, "10.89.0.2", dd.Lookup("web.loc", dns.TypeA)[0].(*dns.A).A.String())
+	assert.Equal(t, map[string]string{"network": "web"}, event.Actor.Attributes, "the shared event is not modified")
+
+	// died stands for die
+	dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "container", Action: "died", Actor: dockerapi.APIActor{ID: container.ID}})
+	assert.Empty(t, dd.Containers())
+	assert.Equal(t, "destroy", podmanEvent(&dockerapi.APIEvents{Type: "container", Action: "remove"}).Action)
+
+	// the rootless containers are answered with the address of the host
+	dd.hostIPs = []net.IP{net.ParseIP("192.168.1.10")}
+	rootless := genContainerDefn("", "slirp4netns", "")
+	rootless.NetworkSettings.Networks = nil
+	assert.Nil(t, dd.updateContainerInfo(rootless))
+	assert.Equal(t, "192.168.1.10", dd.Lookup("label-host.loc", dns.TypeA)[0].(*dns.A).A.String())
+
+	c := caddy.NewTestController("dns", `docker {
+	runtime podman
+}`)
+	plugin, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.True(t, plugin.isPodman())
+	assert.Equal(t, podmanEndpoint(), plugin.dockerEndpoint)
+	for _, config := range []string{"docker {\nruntime\n}", "docker {\nruntime containerd\n}", "docker {\nruntime podman auto\n}"} {
+		_, err = createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	reconnectWindow = 50 * time.Millisecond
+	defer func() { reconnectWindow = 2 * time.Second }()
+	var containerMu sync.Mutex
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.State.Running = true
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		containerMu.Lock()
+		defer containerMu.Unlock()
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+	setNetworks := func(networks map[string]dockerapi.ContainerNetwork) {
+		containerMu.Lock()
+		container.NetworkSettings.Networks = networks
+		containerMu.Unlock()
+	}
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	address := func() string {
+		answers := dd.Lookup("label-host.loc", dns.TypeA)
+		if len(answers) == 0 {
+			return ""
+		}
+		return answers[0].(*dns.A).A.String()
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+	event := func(action string) *dockerapi.APIEvents {
+		return &dockerapi.APIEvents{Type: "network", Action: action,
+			Actor: dockerapi.APIActor{ID: "n", Attributes: map[string]string{"container": container.ID, "name": "my_project_network_name"}}}
+	}
+
+	// disconnected then connected again, the address is swapped without being removed in between
+	setNetworks(map[string]dockerapi.ContainerNetwork{})
+	dd.handleEvent(context.Background(), event("disconnect"))
+	assert.Equal(t, "172.20.0.2", address())
+	setNetworks(map[string]dockerapi.ContainerNetwork{"my_project_network_name": {IPAddress: "172.20.0.9"}})
+	dd.handleEvent(context.Background(), event("connect"))
+	assert.Equal(t, "172.20.0.9", address())
+	time.Sleep(2 * reconnectWindow)
+	assert.Equal(t, "172.20.0.9", address())
+
+	// not reconnected, the records are removed once the window is over
+	setNetworks(map[string]dockerapi.ContainerNetwork{})
+	dd.handleEvent(context.Background(), event("disconnect"))
+	assert.Equal(t, "172.20.0.9", address())
+	assert.Eventually(t, func() bool { return address() == "" }, time.Second, 10*time.Millisecond)
+}
+
+func TestPTROptOut(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`))
+	assert.Nil(t, err)
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.State.StartedAt = time.Now().Add(-time.Hour)
+	container.Config.Labels[ptrLabel] = "false"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Empty(t, dd.Lookup("2.0.17.172.in-addr.arpa", dns.TypePTR))
+	assert.NotEmpty(t, dd.Lookup("label-host.loc", dns.TypeA), "the names are still answered")
+
+	// the other containers of the address are answered, the invalid labels validated on registration
+	sidecar := genContainerDefn("", "bridge", "172.17.0.2")
+	sidecar.ID, sidecar.Name = strings.Repeat("b", 64), "sidecar"
+	sidecar.State.StartedAt = time.Now()
+	sidecar.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "sidecar.loc", ptrLabel: "invalid"}
+	assert.Nil(t, dd.updateContainerInfo(sidecar))
+	answers := dd.Lookup("2.0.17.172.in-addr.arpa", dns.TypePTR)
+	if assert.Len(t, answers, 2) {
+		assert.Equal(t, "sidecar.loc.", answers[0].(*dns.PTR).Ptr)
+		assert.Equal(t, "sidecar.docker.loc.", answers[1].(*dns.PTR).Ptr)
+	}
+}
+
+func TestPTRConflict(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`))
+	assert.Nil(t, err)
+	ptrs := func() []string {
+		var names []string
+		for _, answer := range dd.Lookup("2.0.17.172.in-addr.arpa", dns.TypePTR) {
+			names = append(names, answer.(*dns.PTR).Ptr)
+		}
+		return names
+	}
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.ID = strings.Repeat("c", 64)
+	container.State.StartedAt = time.Now().Add(-time.Hour)
+	sidecar := genContainerDefn("", "bridge", "172.17.0.2")
+	sidecar.ID, sidecar.Name = strings.Repeat("b", 64), "sidecar"
+	sidecar.State.StartedAt = time.Now()
+	sidecar.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "sidecar.loc"}
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.updateContainerInfo(sidecar))
+
+	// one container answers the address: the one started first, whatever their IDs
+	assert.Equal(t, []string{"label-host.loc.", "evil_ptolemy.docker.loc."}, ptrs())
+
+	// the lowest ID among the ones started at the same time
+	sidecar.State.StartedAt = container.State.StartedAt
+	assert.Nil(t, dd.updateContainerInfo(sidecar))
+	assert.Equal(t, []string{"sidecar.loc.", "sidecar.docker.loc."}, ptrs())
+
+	// the highest priority first
+	container.Config.Labels[ptrPriorityLabel] = "10"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, []string{"label-host.loc.", "evil_ptolemy.docker.loc."}, ptrs())
+	sidecar.Config.Labels[ptrPriorityLabel] = "invalid"
+	assert.Nil(t, dd.updateContainerInfo(sidecar))
+	assert.Equal(t, []string{"label-host.loc.", "evil_ptolemy.docker.loc."}, ptrs())
+}
+
+func TestKeepExited(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	keep_exited 50ms
+}`))
+	assert.Nil(t, err)
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+
+	// crashed containers are removed right away
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.containerExited(container.ID, map[string]string{"exitCode": "1", "name": "evil_ptolemy"}))
+	assert.Len(t, dd.Containers(), 0)
+
+	// cleanly exited containers are kept for the window, with their exit code
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.containerExited(container.ID, map[string]string{"exitCode": "143", "name": "evil_ptolemy"}))
+	containers := dd.Containers()
+	assert.Len(t, containers, 1)
+	assert.Equal(t, sigtermExitCode, *containers[0].ExitCode)
+	assert.NotNil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+	assert.Eventually(t, func() bool { return len(dd.Containers()) == 0 }, time.Second, 10*time.Millisecond)
+
+	// restarted containers are not removed at the end of the window
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.containerExited(container.ID, map[string]string{"exitCode": "0", "name": "evil_ptolemy"}))
+	assert.Nil(t, dd.updateContainerInfo(container))
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, dd.Containers(), 1)
+	assert.Nil(t, dd.Containers()[0].ExitCode)
+
+	_, err = createPlugin(caddy.NewTestController("dns", `docker {
+	keep_exited 1m soon
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestHostAddress(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	host_address my_project_network_name 192.168.1.10
+}`))
+	assert.Nil(t, err)
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "my_project_network_name",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.20.0.0/16"}}},
+	})
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+
+	for client, address := range map[string]string{"192.168.1.20": "192.168.1.10", "172.20.0.5": "172.20.0.2", "127.0.0.1": "172.20.0.2"} {
+		msg := query(t, dd, "label-host.loc.", dns.TypeA, client)
+		assert.Len(t, msg.Answer, 1)
+		assert.Equal(t, address, msg.Answer[0].(*dns.A).A.String(), client)
+	}
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nhost_address bridge ::1\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestSplitHorizon(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	host_address * 192.168.1.10
+	internal_clients 10.8.0.0/24
+}`))
+	assert.Nil(t, err)
+	assert.Len(t, dd.internalClients, 1)
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.Config.ExposedPorts = map[dockerapi.Port]struct{}{"8080/tcp": {}}
+	container.NetworkSettings.Ports = map[dockerapi.Port][]dockerapi.PortBinding{
+		"8080/tcp": {{HostIP: "0.0.0.0", HostPort: "49153"}, {HostIP: "::", HostPort: "49153"}},
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// the internal clients get the container address and port, the others the host ones
+	for client, expected := range map[string]struct {
+		address string
+		port    uint16
+	}{"10.8.0.5": {"172.20.0.2", 8080}, "127.0.0.1": {"172.20.0.2", 8080}, "192.168.1.20": {"192.168.1.10", 49153}} {
+		msg := query(t, dd, "label-host.loc.", dns.TypeA, client)
+		assert.Equal(t, expected.address, msg.Answer[0].(*dns.A).A.String(), client)
+		msg = query(t, dd, "label-host.loc.", dns.TypeSRV, client)
+		if assert.Len(t, msg.Answer, 1, client) && assert.Len(t, msg.Extra, 1, client) {
+			assert.Equal(t, expected.port, msg.Answer[0].(*dns.SRV).Port, client)
+			assert.Equal(t, expected.address, msg.Extra[0].(*dns.A).A.String(), client)
+		}
+	}
+
+	// the unpublished ports are unreachable from the LAN
+	container.NetworkSettings.Ports = nil
+	assert.Nil(t, dd.updateContainerInfo(container))
+	answers, _ := dd.records("label-host.loc.", dns.TypeSRV, net.ParseIP("192.168.1.20"))
+	assert.Empty(t, answers)
+	answers, _ = dd.records("label-host.loc.", dns.TypeSRV, net.ParseIP("10.8.0.5"))
+	assert.Len(t, answers, 1)
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\ninternal_clients 10.8.0.5\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestAnnotateAnswers(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	annotate_answers 10.8.0.0/24 fd00::/8
+}`))
+	assert.Nil(t, err)
+	assert.Len(t, dd.annotateClients, 2)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	annotations := func(remote string, edns bool) []string {
+		m := new(dns.Msg)
+		m.SetQuestion("label-host.loc.", dns.TypeA)
+		if edns {
+			m.SetEdns0(4096, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: remote})
+		_, err := dd.ServeDNS(context.Background(), rec, m)
+		assert.Nil(t, err)
+		assert.Len(t, rec.Msg.Answer, 1, remote)
+		var values []string
+		if opt := rec.Msg.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == annotationOptionCode {
+					values = append(values, string(local.Data))
+				}
+			}
+		}
+		return values
+	}
+	// the trusted resolvers get the container, the other clients and the queries without EDNS0 don't
+	assert.Equal(t, []string{"fa155d6fd141 evil_ptolemy"}, annotations("10.8.0.53", true))
+	assert.Nil(t, annotations("192.168.1.20", true))
+	assert.Nil(t, annotations("10.8.0.53", false))
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nannotate_answers 10.8.0.0\n}"))
+	assert.NotNil(t, err)
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nannotate_answers\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestClientAddress(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	client_address 10.8.0.0/24 fd00:8::/64 203.0.113.10
+	host_address * 192.168.1.10
+}`))
+	assert.Nil(t, err)
+	assert.Len(t, dd.clientAddresses, 2)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+
+	// the VPN clients get the NAT address, before host_address
+	for client, address := range map[string]string{"10.8.0.5": "203.0.113.10", "fd00:8::5": "203.0.113.10", "192.168.1.20": "192.168.1.10", "127.0.0.1": "172.20.0.2"} {
+		msg := query(t, dd, "label-host.loc.", dns.TypeA, client)
+		assert.Len(t, msg.Answer, 1)
+		assert.Equal(t, address, msg.Answer[0].(*dns.A).A.String(), client)
+	}
+
+	for _, config := range []string{
+		"docker {\nclient_address 203.0.113.10\n}",
+		"docker {\nclient_address 10.8.0.0/24 fd00::10\n}",
+		"docker {\nclient_address 10.8.0.0 203.0.113.10\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestAPITimeout(t *testing.T) {
+	inspectRetryWait = time.Millisecond
+	hung := make(chan struct{})
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer daemon.Close()
+	defer close(hung)
+
+	dd, err := createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker %s {
+	api_timeout 20ms
+}`, daemon.URL)))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = dd.inspectContainerRetry(context.Background(), "fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7")
+	assert.True(t, isTransient(err))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	_, err = dd.listNetworks(context.Background())
+	assert.NotNil(t, err)
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\napi_timeout never\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestShutdown(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 100 * time.Millisecond
+	hung := make(chan struct{})
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer daemon.Close()
+	defer close(hung)
+
+	dd, err := createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker %s {
+	api_timeout 1m
+}`, daemon.URL)))
+	assert.Nil(t, err)
+
+	// the calls in progress are cancelled by the shutdown, not bounded by the api_timeout
+	stopped := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() {
+		assert.Nil(t, dd.shutdown())
+		close(stopped)
+	})
+	start := time.Now()
+	_, err = dd.inspectContainerRetry(dd.ctx, "fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7")
+	assert.True(t, isTransient(err))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	_, err = dd.listNetworks(dd.ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	// the shutdown doesn't wait longer for the docker calls without context
+	<-stopped
+
+	// the instance replaced by a reload is shut down once the replacement started, not when the reload failed
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	dd, err = createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker %s`, failing.URL)))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.replacing())
+	assert.Nil(t, dd.replaceFailed())
+	assert.Nil(t, dd.shutdownReplaced())
+	assert.Nil(t, dd.ctx.Err())
+	assert.Nil(t, dd.replacing())
+	assert.Nil(t, dd.shutdownReplaced())
+	assert.ErrorIs(t, dd.ctx.Err(), context.Canceled)
+	// its goroutines returned
+	dd.running.Wait()
+	// the final shutdown afterwards has nothing left to do
+	assert.Nil(t, dd.shutdown())
+}
+
+func TestEtcdPrefix(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	endpoint http://127.0.0.1:2379
+	etcd_prefix /skydns/{zone}
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53", "lab.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	dd.mu.RLock()
+	keys := dd.etcdKeys(dd.containerInfoMap["fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7"])
+	dd.mu.RUnlock()
+	// label-host.loc is outside of the zones
+	assert.ElementsMatch(t, []string{"/skydns/loc/docker/evil_ptolemy/fa155d6fd141", "/skydns/loc/lab/evil_ptolemy/fa155d6fd141"}, keys)
+
+	// the keys of the plugin are told from the records of the etcd plugin sharing the prefixes
+	assert.Equal(t, []string{"/skydns/loc/docker/", "/skydns/loc/lab/"}, dd.etcdRoots())
+	assert.True(t, dd.isEtcdRecordKey("/skydns/loc/docker/old-name/fa155d6fd141"))
+	assert.False(t, dd.isEtcdRecordKey("/skydns/loc/docker/db/x1"))
+
+	// a plugin of its own, the backend of the started one reads the prefix
+	dd = NewDockerDiscovery(defaultDockerEndpoint)
+	assert.Equal(t, []string{etcdDefaultPrefix}, dd.etcdRoots())
+	assert.True(t, dd.isEtcdRecordKey("/docker/docker/evil_ptolemy"))
+
+	// the keys of a root zone server block laid out for the etcd plugin serving docker.loc
+	c = caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	endpoint http://127.0.0.1:2379
+	etcd_zone Docker.loc
+}`)
+	c.ServerBlockKeys = []string{".:53"}
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, etcdDefaultZonePrefix, dd.etcdPrefix)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	dd.mu.RLock()
+	keys = dd.etcdKeys(dd.containerInfoMap["fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7"])
+	dd.mu.RUnlock()
+	assert.Equal(t, []string{"/skydns/loc/docker/evil_ptolemy/fa155d6fd141"}, keys)
+	assert.Equal(t, []string{"/skydns/loc/docker/"}, dd.etcdRoots())
+	assert.Equal(t, "/skydns/loc/docker/web/", dd.etcdLookupKey("web.docker.loc."))
+
+	for _, config := range []string{"docker {\netcd_zone docker.loc\n}", "docker {\nendpoint http://127.0.0.1:2379\netcd_zone\n}"} {
+		_, err = createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestEtcdLease(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	endpoint http://127.0.0.1:2379
+	ttl 60
+	etcd_lease
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.True(t, dd.etcdLease)
+	assert.Equal(t, int64(60), dd.etcdLeaseSeconds())
+
+	// never shorter than the renewals allow
+	dd.ttl = 1
+	assert.Equal(t, int64(etcdMinLeaseTTL), dd.etcdLeaseSeconds())
+	dd.etcdLeaseTTL = 2 * time.Minute
+	assert.Equal(t, int64(120), dd.etcdLeaseSeconds())
+
+	// the changed records are put with the lease
+	ops := etcdOps(map[string]string{"/a": "1"}, map[string]string{"/a": "2"}, etcdcv3.WithLease(42))
+	assert.Len(t, ops, 1)
+	assert.True(t, ops[0].IsPut())
+
+	// revoked on the final shutdown, no lease is granted afterwards
+	dd = NewDockerDiscovery(defaultDockerEndpoint)
+	backend := &etcdBackend{dd: dd, written: make(map[string]string)}
+	backend.lease = 42
+	dd.addBackend(backend)
+	assert.Nil(t, dd.revokeEtcdLease())
+	assert.Equal(t, etcdcv3.LeaseID(0), backend.lease)
+	_, err = backend.grantLease(context.Background(), nil)
+	assert.NotNil(t, err)
+
+	for _, config := range []string{"docker {\netcd_lease\n}", "docker {\nendpoint http://127.0.0.1:2379\netcd_lease 1s\n}",
+		"docker {\nendpoint http://127.0.0.1:2379\netcd_lease 1m 2m\n}"} {
+		_, err = createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestResyncDiff(t *testing.T) {
+	dd := NewDockerDiscovery(defaultDockerEndpoint)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+	before := dd.recordSet()
+	assert.Equal(t, map[string]string{"label-host.loc": "172.20.0.2"}, before)
+
+	other := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	other.ID = "0ab1c2d3e4f5" + other.ID[12:]
+	other.Config.Labels["coredns.dockerdiscovery.host"] = "other.loc"
+	other.Config.Labels["com.docker.compose.container-number"] = "2"
+	assert.Nil(t, dd.updateContainerInfo(other))
+	assert.Equal(t, resyncDiff{added: 1}, diffRecords(before, dd.recordSet()))
+
+	assert.Equal(t, resyncDiff{removed: 1, changed: 1}, diffRecords(
+		map[string]string{"label-host.loc": "172.20.0.2", "gone.loc": "172.20.0.9"},
+		map[string]string{"label-host.loc": "172.20.0.4"}))
+}
+
+func TestResync(t *testing.T) {
+	listed := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	listed.ID = "0ab1c2d3e4f5" + listed.ID[12:]
+	listed.Config.Labels["com.docker.compose.container-number"] = "2"
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/containers/json") {
+			json.NewEncoder(w).Encode([]dockerapi.APIContainers{{ID: listed.ID}})
+			return
+		}
+		json.NewEncoder(w).Encode(listed)
+	}))
+	defer daemon.Close()
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	dd.markSynced()
+
+	// the container whose die event was missed is removed, the one whose start event was missed is added
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+	assert.Nil(t, dd.resync(context.Background()))
+	containers := dd.Containers()
+	assert.Len(t, containers, 1)
+	assert.Equal(t, listed.ID, containers[0].ID)
+
+	// the etcd backend loads the keys again, to write the ones deleted behind its back
+	backend := &etcdBackend{dd: dd, written: map[string]string{"/docker/docker/evil_ptolemy": "{}"}, adopted: true}
+	backend.reload()
+	assert.Empty(t, backend.written)
+	assert.False(t, backend.adopted)
+
+	_, err := createPlugin(caddy.NewTestController("dns", `docker {
+	resync_interval never
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestSetResolvers(t *testing.T) {
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/containers/json") {
+			json.NewEncoder(w).Encode([]dockerapi.APIContainers{{ID: container.ID}})
+			return
+		}
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	dd.markSynced()
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		dd.adminHandler().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+
+	// the resolver enabled registers the names of the running containers at once
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/resolvers/name", `{"domain": "docker.loc"}`).Code)
+	assert.Len(t, dd.Lookup("evil_ptolemy.docker.loc", dns.TypeA), 1)
+	assert.JSONEq(t, `[{"name": "label", "labels": ["coredns.dockerdiscovery.host"]}, {"name": "name", "domain": "docker.loc"}]`,
+		do(http.MethodGet, "/resolvers", "").Body.String())
+
+	// the suffix changed replaces the names
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/resolvers/name", `{"domain": "other.loc"}`).Code)
+	assert.Len(t, dd.Lookup("evil_ptolemy.other.loc", dns.TypeA), 1)
+	assert.Empty(t, dd.Lookup("evil_ptolemy.docker.loc", dns.TypeA))
+	assert.Len(t, dd.Resolvers(), 2)
+
+	// the resolver disabled removes its names
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/resolvers/label", "").Code)
+	assert.Empty(t, dd.Lookup("label-host.loc", dns.TypeA))
+	assert.Len(t, dd.Lookup("evil_ptolemy.other.loc", dns.TypeA), 1)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/resolvers/label", "").Code)
+
+	// the aliases keep their own domain suffix, none by default
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/resolvers/alias", `{"network": "bridge", "domain": "docker.local."}`).Code)
+	assert.Equal(t, ResolverConfig{Name: "alias", Network: "bridge", Domain: "docker.local"}, dd.Resolvers()[1])
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/resolvers/unknown", "{}").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/resolvers/name", `{"domain": "bad..domain"}`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/resolvers", "").Code)
+}
+
+func TestTTL(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	ttl 60
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(60), dd.ttl)
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.ExposedPorts = map[dockerapi.Port]struct{}{"80/tcp": {}}
+	assert.Nil(t, dd.updateContainerInfo(container))
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, uint32(60), msg.Answer[0].Header().Ttl)
+	dd.mu.RLock()
+	assert.JSONEq(t, `{"host":"172.17.0.2","port":80,"ttl":60,"group":"cproject"}`, dd.containerInfoMap[container.ID].etcdRecord)
+	dd.mu.RUnlock()
+
+	// the label overrides the directive, in the answers and the etcd record
+	container.Config.Labels[ttlLabel] = "5"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	msg = query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, uint32(5), msg.Answer[0].Header().Ttl)
+	msg = query(t, dd, "label-host.loc.", dns.TypeSRV, "")
+	assert.Equal(t, uint32(5), msg.Answer[0].Header().Ttl)
+	dd.mu.RLock()
+	assert.JSONEq(t, `{"host":"172.17.0.2","port":80,"ttl":5,"group":"cproject"}`, dd.containerInfoMap[container.ID].etcdRecord)
+	dd.mu.RUnlock()
+
+	container.Config.Labels[ttlLabel] = "soon"
+	assert.Equal(t, uint32(60), dd.labelTTL(container))
+
+	_, err = createPlugin(caddy.NewTestController("dns", `docker {
+	ttl -1
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestTTLRamp(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	ttl_ramp 24h 5
+}`))
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.State.StartedAt = time.Now()
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, uint32(5), dd.Lookup("label-host.loc", dns.TypeA)[0].Header().Ttl)
+
+	container.State.StartedAt = time.Now().Add(-12 * time.Hour)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.InDelta(t, 5+(3600-5)/2, dd.Lookup("label-host.loc", dns.TypeA)[0].Header().Ttl, 1)
+
+	container.State.StartedAt = time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, uint32(3600), dd.Lookup("label-host.loc", dns.TypeA)[0].Header().Ttl)
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nttl_ramp 0s\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestAddressFamilyNetworks(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	ipv4_networks lan
+	ipv6_networks bridge
+}`))
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.NetworkSettings.Networks["bridge"] = dockerapi.ContainerNetwork{IPAddress: "172.17.0.2", GlobalIPv6Address: "fd00:17::2"}
+	container.NetworkSettings.Networks["lan"] = dockerapi.ContainerNetwork{IPAddress: "192.168.1.50", GlobalIPv6Address: "2001:db8::50"}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	assert.Equal(t, "192.168.1.50", dd.Lookup("label-host.loc", dns.TypeA)[0].(*dns.A).A.String())
+	assert.Equal(t, "fd00:17::2", dd.Lookup("label-host.loc", dns.TypeAAAA)[0].(*dns.AAAA).AAAA.String())
+
+	// containers outside of the listed networks keep the default addresses
+	container = genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "other.loc"
+	container.Config.Labels["com.docker.compose.container-number"] = "2"
+	container.ID = "0ab1c2d3e4f5" + container.ID[12:]
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "172.17.0.3", dd.Lookup("other.loc", dns.TypeA)[0].(*dns.A).A.String())
+	assert.Len(t, dd.Lookup("other.loc", dns.TypeAAAA), 0)
+}
+
+func TestDualStack(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`))
+	assert.Nil(t, err)
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "my_project_network_name",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.20.0.0/16"}, {Subnet: "fd00:20::/64"}}},
+	})
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	network := container.NetworkSettings.Networks["my_project_network_name"]
+	network.GlobalIPv6Address = "fd00:20::2"
+	container.NetworkSettings.Networks["my_project_network_name"] = network
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	assert.Equal(t, "172.20.0.2", dd.Lookup("label-host.loc", dns.TypeA)[0].(*dns.A).A.String())
+	assert.Equal(t, "fd00:20::2", dd.Lookup("label-host.loc", dns.TypeAAAA)[0].(*dns.AAAA).AAAA.String())
+	assert.Len(t, dd.Lookup("2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.2.0.0.0.0.d.f.ip6.arpa", dns.TypePTR), 2)
+	assert.Equal(t, net.ParseIP("fd00:20::2"), dd.Containers()[0].Address6)
+
+	// IPv6-only containers only get AAAA records
+	network.IPAddress = ""
+	container.NetworkSettings.Networks["my_project_network_name"] = network
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeAAAA), 1)
+
+	msg := query(t, dd, "evil_ptolemy.docker.loc.", dns.TypeSRV, "")
+	assert.Len(t, msg.Extra, 1)
+	assert.Equal(t, dns.TypeAAAA, msg.Extra[0].Header().Rrtype)
+}
+
+func TestGroups(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	for i, address := range []string{"172.20.0.2", "172.20.0.3"} {
+		container := genContainerDefn("", "my_project_network_name", address)
+		container.ID = fmt.Sprintf("%d", i) + container.ID[1:]
+		container.Config.Labels["coredns.dockerdiscovery.host"] = fmt.Sprintf("api-%d.docker.loc", i)
+		container.Config.Labels["com.docker.compose.container-number"] = fmt.Sprintf("%d", i)
+		container.Config.Labels[groupLabel] = "api"
+		assert.Nil(t, dd.updateContainerInfo(container))
+	}
+
+	answers := dd.Lookup("API.docker.loc", dns.TypeA)
+	assert.Len(t, answers, 2)
+	assert.Equal(t, "172.20.0.2", answers[0].(*dns.A).A.String())
+	assert.Equal(t, "172.20.0.3", answers[1].(*dns.A).A.String())
+	assert.Len(t, dd.Lookup("api-1.docker.loc", dns.TypeA), 1)
+}
+
+func TestWeightedGroupSRV(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+
+	for i, weight := range []string{"30", ""} {
+		container := genContainerDefn("", "my_project_network_name", fmt.Sprintf("172.20.0.%d", i+2))
+		container.ID = fmt.Sprintf("%d", i) + container.ID[1:]
+		container.Config.Labels["coredns.dockerdiscovery.host"] = fmt.Sprintf("api-%d.loc", i)
+		container.Config.Labels["com.docker.compose.container-number"] = fmt.Sprintf("%d", i)
+		container.Config.Labels[groupLabel] = "api"
+		if weight != "" {
+			container.Config.Labels[weightLabel] = weight
+		}
+		assert.Nil(t, dd.updateContainerInfo(container))
+	}
+
+	answers := dd.Lookup("api.docker.local", dns.TypeSRV)
+	assert.Len(t, answers, 2)
+	assert.Equal(t, "api-0.loc.", answers[0].(*dns.SRV).Target)
+	assert.Equal(t, uint16(30), answers[0].(*dns.SRV).Weight)
+	assert.Equal(t, "api-1.loc.", answers[1].(*dns.SRV).Target)
+	assert.Equal(t, uint16(defaultSRVWeight), answers[1].(*dns.SRV).Weight)
+}
+
+func TestAddressFamilyFilter(t *testing.T) {
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	network := container.NetworkSettings.Networks["my_project_network_name"]
+	network.GlobalIPv6Address = "fd00:20::2"
+	container.NetworkSettings.Networks["my_project_network_name"] = network
+
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	only_ipv4
+	dns64
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 1)
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeAAAA), 0)
+	assert.Nil(t, dd.Containers()[0].Address6)
+
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	only_ipv6
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeAAAA), 1)
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nonly_ipv4\nonly_ipv6\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestComposeTeardown(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	var containers []*dockerapi.Container
+	for i, id := range []string{"fa155d6fd141", "0ab1c2d3e4f5", "1bc2d3e4f5a6"} {
+		container := genContainerDefn("", "my_project_network_name", fmt.Sprintf("172.20.0.%d", i+2))
+		container.ID = id + container.ID[12:]
+		container.Config.Labels["coredns.dockerdiscovery.host"] = fmt.Sprintf("web%d.loc", i+1)
+		container.Config.Labels["com.docker.compose.container-number"] = fmt.Sprint(i + 1)
+		assert.Nil(t, dd.updateContainerInfo(container))
+		containers = append(containers, container)
+	}
+	version := dd.Version()
+
+	// the exits are collected, the records are answered until the project is torn down
+	for _, container := range containers {
+		assert.Nil(t, dd.containerDied(container.ID, map[string]string{"exitCode": "0", "name": container.Name, "com.docker.compose.project": "cproject"}))
+	}
+	assert.Len(t, dd.Containers(), 3)
+	// a container restarted meanwhile keeps its records
+	assert.Nil(t, dd.updateContainerInfo(containers[2]))
+	version = dd.Version()
+
+	dd.tearDown("cproject")
+	assert.Equal(t, version+1, dd.Version(), "the exits are applied as one change")
+	if assert.Len(t, dd.Containers(), 1) {
+		assert.Equal(t, containers[2].ID, dd.Containers()[0].ID)
+	}
+	assert.Nil(t, query(t, dd, "web1.loc.", dns.TypeA, ""))
+	assert.NotNil(t, query(t, dd, "web3.loc.", dns.TypeA, ""))
+
+	// the timer of the applied teardown finds nothing left to do
+	dd.tearDown("cproject")
+	assert.Equal(t, version+1, dd.Version())
+}
+
+func TestDomainIndex(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	other := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	other.ID = "0ab1c2d3e4f5" + other.ID[12:]
+	other.Config.Labels["com.docker.compose.container-number"] = "2"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Nil(t, dd.updateContainerInfo(other))
+
+	dd.mu.RLock()
+	owners := dd.containersByDomain("LABEL-HOST.loc.")
+	first, _ := dd.containerInfoByDomain("label-host.loc.")
+	dd.mu.RUnlock()
+	assert.Len(t, owners, 2)
+	assert.Equal(t, container.ID, first.container.ID, "the first registered owner")
+
+	// the index follows the removals
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	dd.mu.RLock()
+	first, _ = dd.containerInfoByDomain("label-host.loc.")
+	dd.mu.RUnlock()
+	assert.Equal(t, other.ID, first.container.ID)
+	assert.Nil(t, dd.removeContainerInfo(other.ID))
+	assert.Empty(t, dd.domainIndex)
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+}
+
+func TestReplicatedDomain(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	round_robin
+}`))
+	assert.Nil(t, err)
+	assert.True(t, dd.roundRobin)
+	first := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	second := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	second.ID = "0ab1c2d3e4f5" + second.ID[12:]
+	second.Config.Labels["com.docker.compose.container-number"] = "2"
+	assert.Nil(t, dd.updateContainerInfo(first))
+	assert.Nil(t, dd.updateContainerInfo(second))
+
+	var addresses []string
+	for _, rr := range query(t, dd, "label-host.loc.", dns.TypeA, "").Answer {
+		addresses = append(addresses, rr.(*dns.A).A.String())
+	}
+	assert.ElementsMatch(t, []string{"172.20.0.2", "172.20.0.3"}, addresses)
+
+	// only the address of the dying replica is removed
+	assert.Nil(t, dd.removeContainerInfo(first.ID))
+	answers := query(t, dd, "label-host.loc.", dns.TypeA, "").Answer
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, "172.20.0.3", answers[0].(*dns.A).A.String())
+	}
+}
+
+func TestRamp(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	stable := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	canary := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	canary.ID = "0ab1c2d3e4f5" + canary.ID[12:]
+	canary.Config.Labels["com.docker.compose.container-number"] = "2"
+	canary.Config.Labels[rampLabel] = "10m"
+	canary.State.StartedAt = time.Now()
+	assert.Nil(t, dd.updateContainerInfo(stable))
+	assert.Nil(t, dd.updateContainerInfo(canary))
+
+	defer func(pick func() float64) { rampPick = pick }(rampPick)
+	first := func(pick float64) string {
+		rampPick = func() float64 { return pick }
+		answers := query(t, dd, "label-host.loc.", dns.TypeA, "").Answer
+		assert.Len(t, answers, 2)
+		return answers[0].(*dns.A).A.String()
+	}
+	// the canary which just started is never answered first
+	assert.Equal(t, "172.20.0.3", first(0.01))
+	// half way through its ramp, it is answered first a third of the time: the picks below a third
+	canary.State.StartedAt = time.Now().Add(-5 * time.Minute)
+	assert.Equal(t, "172.20.0.2", first(0.3))
+	assert.Equal(t, "172.20.0.3", first(0.35))
+	// once ramped up, the answers are in the canonical order again
+	canary.State.StartedAt = time.Now().Add(-time.Hour)
+	assert.Equal(t, "172.20.0.2", first(0.9))
+
+	canary.Config.Labels[rampLabel] = "soon"
+	assert.Equal(t, time.Duration(0), labelRamp(canary))
+}
+
+func TestSwarm(t *testing.T) {
+	services := []swarm.Service{
+		{ID: "web-id", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "web"}},
+			Endpoint: swarm.Endpoint{VirtualIPs: []swarm.EndpointVirtualIP{{NetworkID: "overlay", Addr: "10.0.1.2/24"}}}},
+		{ID: "db-id", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "db"}}},
+	}
+	task := func(serviceID, address string) swarm.Task {
+		return swarm.Task{ServiceID: serviceID, Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{
+				{Network: swarm.Network{Spec: swarm.NetworkSpec{Ingress: true}}, Addresses: []string{"10.255.0.9/16"}},
+				{Addresses: []string{address}},
+			}}
+	}
+	tasks := []swarm.Task{task("web-id", "10.0.1.4/24"), task("web-id", "10.0.1.3/24"), task("db-id", "10.0.1.5/24")}
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/services"):
+			json.NewEncoder(w).Encode(services)
+		case strings.HasSuffix(r.URL.Path, "/tasks"):
+			json.NewEncoder(w).Encode(tasks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daemon.Close()
+
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	swarm
+}`))
+	assert.Nil(t, err)
+	assert.True(t, dd.swarm)
+
+	dd = NewDockerDiscovery(daemon.URL)
+	dd.swarm, dd.zones = true, []string{"docker.loc."}
+	dd.dockerClient, err = dockerapi.NewClient(daemon.URL)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.refreshSwarm(context.Background()))
+
+	addresses := func(name string) []string {
+		var addresses []string
+		answers, _ := dd.records(name, dns.TypeA, nil)
+		for _, rr := range answers {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+		return addresses
+	}
+	assert.Equal(t, []string{"10.0.1.2"}, addresses("web.docker.loc."), "the virtual IP")
+	assert.Equal(t, []string{"10.0.1.3", "10.0.1.4"}, addresses("tasks.web.docker.loc."), "the tasks, without the ingress")
+	assert.Equal(t, []string{"10.0.1.5"}, addresses("db.docker.loc."), "the tasks without virtual IP")
+	assert.Empty(t, addresses("tasks.cache.docker.loc."))
+}
+
+func TestHostFacts(t *testing.T) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(dockerapi.DockerInfo{Name: "lab-arm", Architecture: "aarch64", OperatingSystem: "Debian GNU/Linux 12", ServerVersion: "24.0.7"})
+	}))
+	defer daemon.Close()
+
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	host_facts hostname arch
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hostname", "arch"}, dd.hostFacts)
+
+	dd = NewDockerDiscovery(daemon.URL)
+	dd.hostFacts = []string{"hostname", "arch"}
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	dd.dockerClient, err = dockerapi.NewClient(daemon.URL)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.refreshHostInfo(context.Background()))
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+
+	answers, _ := dd.records("label-host.loc.", dns.TypeHINFO, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, "aarch64", answers[0].(*dns.HINFO).Cpu)
+		assert.Equal(t, "Debian GNU/Linux 12", answers[0].(*dns.HINFO).Os)
+	}
+	answers, _ = dd.records("label-host.loc.", dns.TypeTXT, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, []string{"hostname=lab-arm", "arch=aarch64"}, answers[0].(*dns.TXT).Txt)
+	}
+	answers, _ = dd.records("unknown.loc.", dns.TypeTXT, nil)
+	assert.Empty(t, answers, "only the container names")
+
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	host_facts
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, hostFactNames, dd.hostFacts)
+	_, err = createPlugin(caddy.NewTestController("dns", `docker {
+	host_facts kernel
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestTXTMetadata(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	txt_metadata org.opencontainers.* team
+}`))
+	assert.Nil(t, err)
+	assert.True(t, dd.txtMetadata)
+	assert.Equal(t, []string{"org.opencontainers.*", "team"}, dd.metadataLabels)
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.Config.Image = "nginx:1.25"
+	container.Config.Labels["team"] = "payments"
+	container.Config.Labels["org.opencontainers.image.version"] = strings.Repeat("1", 300)
+	container.Config.Labels["secret"] = "hidden"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	answers, _ := dd.records("label-host.loc.", dns.TypeTXT, nil)
+	if assert.Len(t, answers, 1) {
+		txt := answers[0].(*dns.TXT).Txt
+		assert.Equal(t, []string{"id=fa155d6fd141", "image=nginx:1.25", "project=cproject", "service=cservice"}, txt[:4])
+		assert.Equal(t, "org.opencontainers.image.version="+strings.Repeat("1", 222), txt[4], "cut to 255 bytes")
+		assert.Equal(t, "team=payments", txt[5])
+		assert.Len(t, txt, 6)
+	}
+	answers, _ = dd.records("unknown.loc.", dns.TypeTXT, nil)
+	assert.Empty(t, answers, "only the container names")
+
+	_, err = createPlugin(caddy.NewTestController("dns", `docker {
+	txt_metadata [
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestNetworkZones(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	network frontend => FE.example.internal
+	network backend storage => be.example.internal.
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"frontend": "fe.example.internal.", "backend": "be.example.internal.", "storage": "be.example.internal."}, dd.networkZones)
+
+	container := genContainerDefn("", "frontend", "172.21.0.2")
+	container.NetworkSettings.Networks["frontend"] = dockerapi.ContainerNetwork{IPAddress: "172.21.0.2", Aliases: []string{"web", container.ID[:12]}}
+	container.NetworkSettings.Networks["backend"] = dockerapi.ContainerNetwork{IPAddress: "172.22.0.2", GlobalIPv6Address: "fd00::2"}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// a record per network, with the address the container holds on it
+	for name, address := range map[string]string{
+		"evil_ptolemy.fe.example.internal": "172.21.0.2",
+		"web.fe.example.internal":          "172.21.0.2",
+		"evil_ptolemy.be.example.internal": "172.22.0.2",
+		"cservice.be.example.internal":     "172.22.0.2",
+	} {
+		answers := dd.Lookup(name, dns.TypeA)
+		if assert.Len(t, answers, 1, name) {
+			assert.Equal(t, address, answers[0].(*dns.A).A.String(), name)
+		}
+	}
+	answers := dd.Lookup("evil_ptolemy.be.example.internal", dns.TypeAAAA)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, "fd00::2", answers[0].(*dns.AAAA).AAAA.String())
+	}
+	assert.Empty(t, dd.Lookup("web.be.example.internal", dns.TypeA), "the aliases are per network")
+	assert.Empty(t, dd.Lookup(container.ID[:12]+".fe.example.internal", dns.TypeA))
+	assert.Empty(t, dd.Lookup("evil_ptolemy.fe.example.internal", dns.TypeAAAA))
+
+	for _, config := range []string{"network frontend", "network frontend fe.loc", "network => fe.loc", "network frontend => ."} {
+		_, err = createPlugin(caddy.NewTestController("dns", "docker {\n"+config+"\n}"))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestPortsZone(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	ports_zone ports.docker.loc
+	host_ip 192.168.1.10
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "ports.docker.loc.", dd.portsZone)
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.NetworkSettings.Ports = map[dockerapi.Port][]dockerapi.PortBinding{
+		"8080/tcp": {{HostIP: "0.0.0.0", HostPort: "49153"}, {HostIP: "::", HostPort: "49153"}},
+		"9090/tcp": {{HostIP: "127.0.0.1", HostPort: "9090"}},
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// by container name and by compose service name
+	for _, name := range []string{"8080.evil_ptolemy.ports.docker.loc.", "8080.cservice.ports.docker.loc."} {
+		answers, _ := dd.records(name, dns.TypeSRV, nil)
+		if assert.Len(t, answers, 1, name) {
+			assert.Equal(t, uint16(49153), answers[0].(*dns.SRV).Port)
+			assert.Equal(t, name, answers[0].(*dns.SRV).Target)
+		}
+	}
+	answers, _ := dd.records("8080.cservice.ports.docker.loc.", dns.TypeTXT, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, []string{"container=evil_ptolemy", "port=8080/tcp", "host_ip=0.0.0.0", "host_port=49153"}, answers[0].(*dns.TXT).Txt)
+	}
+	answers, _ = dd.records("8080.cservice.ports.docker.loc.", dns.TypeA, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, "192.168.1.10", answers[0].(*dns.A).A.String(), "the host_ip address")
+	}
+	answers, _ = dd.records("9090.cservice.ports.docker.loc.", dns.TypeA, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, "127.0.0.1", answers[0].(*dns.A).A.String(), "the address the port is published on")
+	}
+	answers, _ = dd.records("80.cservice.ports.docker.loc.", dns.TypeSRV, nil)
+	assert.Empty(t, answers, "not published")
+}
+
+func TestDNSSD(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	dns_sd
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	web := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	web.Config.ExposedPorts = map[dockerapi.Port]struct{}{"80/tcp": {}}
+	web.Config.Labels[serviceTXTLabel] = "path=/, version=2"
+	wiki := genContainerDefn("", "my_project_network_name", "172.20.0.3")
+	wiki.ID, wiki.Name = "0ab1c2d3e4f5"+wiki.ID[12:], "/wiki"
+	wiki.Config.ExposedPorts = map[dockerapi.Port]struct{}{"3000/tcp": {}}
+	wiki.Config.Labels["com.docker.compose.container-number"] = "2"
+	wiki.Config.Labels[serviceLabel] = "_http._tcp"
+	db := genContainerDefn("", "my_project_network_name", "172.20.0.4")
+	db.ID, db.Name = "1bc2d3e4f5a6"+db.ID[12:], "/db"
+	db.Config.ExposedPorts = map[dockerapi.Port]struct{}{"5432/tcp": {}}
+	db.Config.Labels["com.docker.compose.container-number"] = "3"
+	for _, container := range []*dockerapi.Container{web, wiki, db} {
+		assert.Nil(t, dd.updateContainerInfo(container))
+	}
+
+	answers, _ := dd.records("_services._dns-sd._udp.docker.loc.", dns.TypePTR, nil)
+	assert.Len(t, answers, 2)
+	assert.Equal(t, "_http._tcp.docker.loc.", answers[0].(*dns.PTR).Ptr)
+	assert.Equal(t, "_postgresql._tcp.docker.loc.", answers[1].(*dns.PTR).Ptr)
+
+	answers, _ = dd.records("_http._tcp.docker.loc.", dns.TypePTR, nil)
+	if assert.Len(t, answers, 2) {
+		assert.Equal(t, "evil_ptolemy._http._tcp.docker.loc.", answers[0].(*dns.PTR).Ptr)
+		assert.Equal(t, "wiki._http._tcp.docker.loc.", answers[1].(*dns.PTR).Ptr)
+	}
+
+	answers, extras := dd.records("wiki._http._tcp.docker.loc.", dns.TypeSRV, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, uint16(3000), answers[0].(*dns.SRV).Port)
+		assert.Equal(t, "label-host.loc.", answers[0].(*dns.SRV).Target)
+		assert.Len(t, extras, 1)
+	}
+	answers, _ = dd.records("evil_ptolemy._http._tcp.docker.loc.", dns.TypeTXT, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, []string{"path=/", "version=2"}, answers[0].(*dns.TXT).Txt)
+	}
+	answers, _ = dd.records("wiki._http._tcp.docker.loc.", dns.TypeTXT, nil)
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, []string{""}, answers[0].(*dns.TXT).Txt)
+	}
+
+	// the instances are only answered with dns_sd
+	dd.dnsSD = false
+	answers, _ = dd.records("_http._tcp.docker.loc.", dns.TypePTR, nil)
+	assert.Empty(t, answers)
+}
+
+func TestNetworkAliasesResolver(t *testing.T) {
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.NetworkSettings.Networks["bridge"] = dockerapi.ContainerNetwork{Aliases: []string{"web", "api"}}
+	container.NetworkSettings.Networks["backend"] = dockerapi.ContainerNetwork{Aliases: []string{"db"}}
+
+	domains, err := NetworkAliasesResolver{network: "bridge", domain: "docker.local"}.resolve(container)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"web.docker.local", "api.docker.local"}, domains)
+	// without domain suffix, the aliases are the names
+	domains, err = NetworkAliasesResolver{network: "backend"}.resolve(container)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db"}, domains)
+	domains, err = NetworkAliasesResolver{network: "frontend", domain: "docker.local"}.resolve(container)
+	assert.Nil(t, err)
+	assert.Empty(t, domains)
+}
+
+func TestConnectionLogThrottling(t *testing.T) {
+	var connection connectionState
+	now := time.Now()
+	assert.True(t, connection.fail(now), "the first failure is logged")
+	assert.False(t, connection.fail(now.Add(watchRetryInterval)))
+	assert.False(t, connection.fail(now.Add(connectionLogInterval-time.Second)))
+	assert.True(t, connection.fail(now.Add(connectionLogInterval)))
+	assert.False(t, connection.fail(now.Add(connectionLogInterval+watchRetryInterval)))
+	assert.Equal(t, 5, connection.failures)
+	assert.Equal(t, now, connection.since)
+
+	// an endpoint of its own, the plugins started by the other tests fail to connect to the default one
+	endpoint := "unix:///var/run/connection-test.sock"
+	dd := NewDockerDiscovery(endpoint)
+	dd.connection = connection
+	dd.connected()
+	assert.Equal(t, connectionState{connected: true}, dd.connection)
+	assert.Equal(t, ConnectionStatus{Endpoint: endpoint, Connected: true}, dd.Connection())
+	assert.Equal(t, 1.0, testutil.ToFloat64(dockerConnected.WithLabelValues(endpoint)))
+
+	// the reconnection backs off exponentially
+	var waits []time.Duration
+	for i := 0; i < 6; i++ {
+		waits = append(waits, dd.disconnected(errors.New("connection refused")))
+	}
+	assert.Equal(t, []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}, waits)
+	assert.Equal(t, 0.0, testutil.ToFloat64(dockerConnected.WithLabelValues(endpoint)))
+	status := dd.Connection()
+	assert.False(t, status.Connected)
+	assert.Equal(t, 6, status.Failures)
+	assert.NotNil(t, status.DisconnectedSince)
+	assert.Equal(t, "connection refused", status.LastError)
+}
+
+func TestSubnets(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "my_project_network_name",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.20.0.0/16"}, {Subnet: "fd00:20::/64"}}},
+	})
+	dd.networkInfoMap["5b1f"] = newNetworkInfo(&dockerapi.Network{
+		Name: "unused",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.30.0.0/16"}}},
+	})
+	assert.Empty(t, dd.Subnets())
+
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+	assert.Equal(t, []NetworkSubnets{{Network: "my_project_network_name", Subnets: []string{"172.20.0.0/16", "fd00:20::/64"}}}, dd.Subnets())
+
+	answers, _ := dd.records("_subnets.docker.loc.", dns.TypeTXT, nil)
+	if assert.Len(t, answers, 2) {
+		assert.Equal(t, []string{"network=my_project_network_name", "subnet=172.20.0.0/16"}, answers[0].(*dns.TXT).Txt)
+	}
+	// only at the apex of the zones
+	answers, _ = dd.records("_subnets.other.loc.", dns.TypeTXT, nil)
+	assert.Empty(t, answers)
+
+	recorder := httptest.NewRecorder()
+	dd.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/subnets", nil))
+	assert.Equal(t, `[{"network":"my_project_network_name","subnets":["172.20.0.0/16","fd00:20::/64"]}]`+"\n", recorder.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	first, second := NewDockerDiscovery("unix:///var/run/ready-1.sock"), NewDockerDiscovery("unix:///var/run/ready-2.sock")
+	first.peers = []*DockerDiscovery{first, second}
+	assert.False(t, first.Ready())
+	first.connected()
+	assert.False(t, first.Ready())
+	second.connected()
+	assert.True(t, first.Ready())
+
+	// unhealthy once docker is unreachable for longer than unhealthy_after
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	unhealthy_after 30s
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, dd.unhealthyAfter)
+	dd = NewDockerDiscovery("unix:///var/run/ready-1.sock")
+	dd.connection = connectionState{failures: 1, since: time.Now().Add(-10 * time.Second), lastError: errors.New("connection refused")}
+	recorder := httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	dd.connection.since = time.Now().Add(-2 * time.Minute)
+	recorder = httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "connection refused")
+
+	_, err = createPlugin(caddy.NewTestController("dns", `docker {
+	unhealthy_after soon
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestHostSuffixMerge(t *testing.T) {
+	var peers []*DockerDiscovery
+	for _, host := range []string{"nas1", "nas2"} {
+		dd := NewDockerDiscovery(defaultDockerEndpoint)
+		dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+		dd.zones = []string{"loc."}
+		dd.hostSuffix = host
+		dd.hostSuffixMerge = true
+		peers = append(peers, dd)
+	}
+	for _, dd := range peers {
+		dd.peers = peers
+	}
+	nas1, nas2 := peers[0], peers[1]
+	assert.Nil(t, nas1.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+
+	// unique, the name is answered both namespaced and merged
+	answers, _ := nas1.records("label-host.nas1.loc.", dns.TypeA, nil)
+	assert.Len(t, answers, 1)
+	answers, _ = nas1.records("label-host.loc.", dns.TypeA, nil)
+	assert.Len(t, answers, 1)
+
+	// taken on both hosts, only the namespaced names are answered
+	assert.Nil(t, nas2.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.3")))
+	for _, dd := range peers {
+		answers, _ = dd.records("label-host.loc.", dns.TypeA, nil)
+		assert.Empty(t, answers)
+	}
+	answers, _ = nas2.records("label-host.nas2.loc.", dns.TypeA, nil)
+	assert.Equal(t, "172.20.0.3", answers[0].(*dns.A).A.String())
+}
+
+func TestStatusPage(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	status localhost:8054
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:8054", dd.statusAddress)
+
+	dd = NewDockerDiscovery(defaultDockerEndpoint)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+	recorder := httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, "docker: "+defaultDockerEndpoint+", disconnected\ncontainers: 1\nrecords: 1\nlast sync: never\n", recorder.Body.String())
+
+	dd.connected()
+	dd.lastSync = time.Now()
+	request := httptest.NewRequest(http.MethodGet, "/status", nil)
+	request.Header.Set("Accept", "application/json")
+	recorder = httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, request)
+	var status Status
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&status))
+	assert.True(t, status.Connected)
+	assert.Equal(t, 1, status.Records)
+	assert.NotNil(t, status.LastSync)
+
+	recorder = httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/status", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestZoneFreshness(t *testing.T) {
+	dd := NewDockerDiscovery("unix:///var/run/freshness.sock")
+	dd.zones = []string{"loc."}
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	zones := dd.ZoneStatuses()
+	if assert.Len(t, zones, 1) {
+		assert.Equal(t, "loc.", zones[0].Zone)
+		assert.Equal(t, float64(zones[0].LastChange.Unix()), testutil.ToFloat64(zoneChangeTime.WithLabelValues(dd.dockerEndpoint, "loc.")))
+	}
+	changed := zones[0].LastChange
+
+	// updated without change, e.g. by a resync, the zone keeps its last change
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, changed, dd.ZoneStatuses()[0].LastChange)
+	// a new address is a change
+	container.NetworkSettings.Networks["my_project_network_name"] = dockerapi.ContainerNetwork{IPAddress: "172.20.0.3"}
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.True(t, dd.ZoneStatuses()[0].LastChange.After(changed))
+
+	// the last sync and the zones are on the status page
+	dd.mu.Lock()
+	dd.markSyncDone()
+	dd.mu.Unlock()
+	assert.Equal(t, float64(dd.lastSync.Unix()), testutil.ToFloat64(lastSyncTime.WithLabelValues(dd.dockerEndpoint)))
+	request := httptest.NewRequest(http.MethodGet, "/status", nil)
+	request.Header.Set("Accept", "application/json")
+	recorder := httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, request)
+	var status Status
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&status))
+	assert.NotNil(t, status.SyncAge)
+	if assert.Len(t, status.Zones, 1) {
+		assert.Equal(t, "loc.", status.Zones[0].Zone)
+	}
+	recorder = httptest.NewRecorder()
+	dd.statusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Contains(t, recorder.Body.String(), "zone loc.: last change ")
+}
+
+func TestDebugDump(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	debug_listen localhost:8055
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:8055", dd.debugAddress)
+
+	dd = NewDockerDiscovery(defaultDockerEndpoint)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	dd.serveStale = time.Minute
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2")))
+	request := httptest.NewRequest(http.MethodGet, "/records", nil)
+	request.Header.Set("Accept", "application/json")
+	recorder := httptest.NewRecorder()
+	dd.debugHandler().ServeHTTP(recorder, request)
+	var records []debugRecord
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&records))
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "evil_ptolemy", records[0].Name)
+		assert.Equal(t, []string{"label-host.loc"}, records[0].Domains)
+		assert.Equal(t, map[string]string{"my_project_network_name": "172.20.0.2"}, records[0].Networks)
+		assert.False(t, records[0].Updated.IsZero())
+		assert.Nil(t, records[0].Removed)
+	}
+
+	// the stale entries are dumped too
+	assert.Nil(t, dd.removeContainerInfo(genContainerDefn("", "my_project_network_name", "172.20.0.2").ID))
+	recorder = httptest.NewRecorder()
+	dd.debugHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/records", nil))
+	assert.Contains(t, recorder.Body.String(), "evil_ptolemy (fa155d6fd141)")
+	assert.Contains(t, recorder.Body.String(), "  networks: my_project_network_name=172.20.0.2\n")
+	assert.Contains(t, recorder.Body.String(), "served stale")
+
+	recorder = httptest.NewRecorder()
+	dd.debugHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/records", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestAddressSelectors(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	address_selectors published-port-host-ip host-mode fallback-bridge
+}`))
+	assert.Nil(t, err)
+	assert.Len(t, dd.addressSelectors, 3)
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "bridge",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.17.0.0/16", Gateway: "172.17.0.1"}}},
+	})
+
+	// the host address of the published ports, those published on all the addresses skipped
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.NetworkSettings.Ports = map[dockerapi.Port][]dockerapi.PortBinding{
+		"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "8080"}},
+		"443/tcp": {{HostIP: "192.168.1.10", HostPort: "443"}},
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "192.168.1.10", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	// the next selector decides when there is none
+	container.NetworkSettings.Ports = nil
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "172.17.0.2", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	// the host network containers get the docker host address
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "host", "")))
+	assert.Equal(t, "172.17.0.1", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\naddress_selectors label-network nearest\n}"))
+	assert.NotNil(t, err)
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\naddress_selectors host-mode host-mode\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestBridgePrecedence(t *testing.T) {
+	// on the default bridge and a user-defined network, e.g. `docker network connect app_net`
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.NetworkSettings.Networks["app_net"] = dockerapi.ContainerNetwork{IPAddress: "172.20.0.2"}
+
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	assert.False(t, dd.userNetworksFirst)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "172.17.0.2", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	bridge_precedence user
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "172.20.0.2", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	// only on the default bridge
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")))
+	assert.Equal(t, "172.17.0.3", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	for _, config := range []string{
+		"docker {\nbridge_precedence\n}",
+		"docker {\nbridge_precedence compose\n}",
+		"docker {\nbridge_precedence user default\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestHostNetwork(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	dd.networkInfoMap["93c2"] = newNetworkInfo(&dockerapi.Network{
+		Name: "bridge",
+		IPAM: dockerapi.IPAMOptions{Config: []dockerapi.IPAMConfig{{Subnet: "172.17.0.0/16", Gateway: "172.17.0.1"}}},
+	})
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "host", "")))
+	assert.Equal(t, "172.17.0.1", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	host_ip 192.168.1.10 fd00::10
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "host", "")))
+	assert.Equal(t, "192.168.1.10", dd.Lookup("label-host.loc.", dns.TypeA)[0].(*dns.A).A.String())
+	assert.Equal(t, "fd00::10", dd.Lookup("label-host.loc.", dns.TypeAAAA)[0].(*dns.AAAA).AAAA.String())
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nhost_ip lan\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestMetrics(t *testing.T) {
+	// an endpoint of its own, the plugins started by the other tests export theirs
+	endpoint := "unix:///var/run/metrics-test.sock"
+	dd := NewDockerDiscovery(endpoint)
+	dd.resolvers = append(dd.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, 1.0, testutil.ToFloat64(containerCount.WithLabelValues(endpoint)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(domainCount.WithLabelValues(endpoint)))
+
+	hits, fallthroughs := testutil.ToFloat64(queryCount.WithLabelValues("", "hit")), testutil.ToFloat64(queryCount.WithLabelValues("", "fallthrough"))
+	query(t, dd, "label-host.loc.", dns.TypeA, "")
+	query(t, dd, "unknown.loc.", dns.TypeA, "")
+	assert.Equal(t, hits+1, testutil.ToFloat64(queryCount.WithLabelValues("", "hit")))
+	assert.Equal(t, fallthroughs+1, testutil.ToFloat64(queryCount.WithLabelValues("", "fallthrough")))
+
+	errors := testutil.ToFloat64(eventErrorCount.WithLabelValues("container:start"))
+	dd.inspectFailed("container:start", container.ID, &dockerapi.NoSuchContainer{ID: container.ID})
+	assert.Equal(t, errors+1, testutil.ToFloat64(eventErrorCount.WithLabelValues("container:start")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(containerCount.WithLabelValues(endpoint)))
+
+	// only the events updating the records are observed
+	series := testutil.CollectAndCount(eventLatency)
+	observeEventLatency("image:pull", time.Now().UnixNano())
+	assert.Equal(t, series, testutil.CollectAndCount(eventLatency))
+	observeEventLatency("network:disconnect", time.Now().Add(-time.Second).UnixNano())
+	assert.Equal(t, series+1, testutil.CollectAndCount(eventLatency))
+}
+
+func TestForcedRcode(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels[rcodeLabel] = "servfail"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT} {
+		msg := query(t, dd, "label-host.loc.", qtype, "")
+		assert.Equal(t, dns.RcodeServerFailure, msg.Rcode)
+		assert.Empty(t, msg.Answer)
+	}
+	assert.Equal(t, dns.RcodeServerFailure, query(t, dd, "evil_ptolemy.docker.loc.", dns.TypeA, "").Rcode)
+
+	// the replicas keep answering the shared names
+	replica := genContainerDefn("", "bridge", "172.17.0.3")
+	replica.ID, replica.Name = strings.Repeat("f", 64), "replica"
+	delete(replica.Config.Labels, "com.docker.compose.service") // not a recreation of the container
+	assert.Nil(t, dd.updateContainerInfo(replica))
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.NotEmpty(t, msg.Answer)
+	replica.Config.Labels[rcodeLabel] = "NXDOMAIN"
+	assert.Nil(t, dd.updateContainerInfo(replica))
+	assert.Equal(t, dns.RcodeServerFailure, query(t, dd, "label-host.loc.", dns.TypeA, "").Rcode, "the lowest container ID first")
+
+	// invalid labels are ignored
+	container.Config.Labels[rcodeLabel] = "NOERROR"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, dns.RcodeSuccess, query(t, dd, "label-host.loc.", dns.TypeA, "").Rcode)
+
+	// forced by name through the admin API, with the SOA record for NXDOMAIN
+	admin := httptest.NewServer(dd.adminHandler())
+	defer admin.Close()
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/rcodes/missing.docker.loc", strings.NewReader(`{"rcode": "NXDOMAIN"}`))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	req, _ = http.NewRequest(http.MethodPut, admin.URL+"/rcodes/missing.docker.loc", strings.NewReader(`{"rcode": "NOERROR"}`))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, map[string]string{"missing.docker.loc.": "NXDOMAIN"}, dd.Rcodes())
+	msg = query(t, dd, "missing.docker.loc.", dns.TypeA, "")
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Len(t, msg.Ns, 1)
+
+	req, _ = http.NewRequest(http.MethodDelete, admin.URL+"/rcodes/missing.docker.loc", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, dd.Rcodes())
+}
+
+func TestNXDOMAIN(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	fallthrough lab.docker.loc
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	msg := query(t, dd, "missing.docker.loc.", dns.TypeA, "")
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.True(t, msg.Authoritative)
+	assert.Len(t, msg.Ns, 1)
+	soa := msg.Ns[0].(*dns.SOA)
+	assert.Equal(t, "docker.loc.", soa.Hdr.Name)
+	assert.Equal(t, "ns.dns.docker.loc.", soa.Ns)
+	assert.Equal(t, "hostmaster.docker.loc.", soa.Mbox)
+	assert.Equal(t, uint32(30), soa.Hdr.Ttl)
+
+	// the name has an A record
+	msg = query(t, dd, "evil_ptolemy.docker.loc.", dns.TypeMX, "")
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Empty(t, msg.Answer)
+	assert.Len(t, msg.Ns, 1)
+	// the apex has names below it
+	msg = query(t, dd, "docker.loc.", dns.TypeA, "")
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+
+	// the fallthrough zones and the names outside of the zones are passed to the next plugin
+	assert.Nil(t, query(t, dd, "missing.lab.docker.loc.", dns.TypeA, ""))
+	assert.Nil(t, query(t, dd, "missing.example.com.", dns.TypeA, ""))
+	// the known names outside of the zones are still answered
+	assert.Len(t, query(t, dd, "label-host.loc.", dns.TypeA, "").Answer, 1)
+
+	// the root zone passes the unknown names to the next plugin, e.g. forward
+	c = caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`)
+	c.ServerBlockKeys = []string{".:53"}
+	root, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, root.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	assert.Nil(t, query(t, root, "missing.docker.loc.", dns.TypeA, ""))
+	assert.Nil(t, query(t, root, "example.com.", dns.TypeA, ""))
+	assert.Len(t, query(t, root, "evil_ptolemy.docker.loc.", dns.TypeA, "").Answer, 1)
+
+	// a docker host followed by another one in the chain lets it answer
+	first, last := NewDockerDiscovery(defaultDockerEndpoint), NewDockerDiscovery(defaultDockerEndpoint)
+	first.zones, last.zones = []string{"loc."}, []string{"loc."}
+	last.resolvers = append(last.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	first.peers = []*DockerDiscovery{first, last}
+	last.peers = first.peers
+	first.Next, last.Next = last, test.NextHandler(dns.RcodeRefused, nil)
+	assert.Nil(t, last.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	m := new(dns.Msg)
+	m.SetQuestion("label-host.loc.", dns.TypeAAAA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = first.ServeDNS(context.Background(), rec, m)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, rec.Msg.Rcode)
+	assert.Empty(t, rec.Msg.Answer)
+	m.SetQuestion("missing.loc.", dns.TypeA)
+	_, err = first.ServeDNS(context.Background(), rec, m)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, rec.Msg.Rcode)
+}
+
+func TestQuestions(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	record docker.loc. CAA 0 issue "letsencrypt.org"
+	alias www.docker.loc => evil_ptolemy.docker.loc
+	fallthrough
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+
+	// the names are matched whatever their case, and answered with the case of the question (DNS 0x20)
+	msg := query(t, dd, "EviL_PtoLemy.Docker.LOC.", dns.TypeA, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "EviL_PtoLemy.Docker.LOC.", msg.Answer[0].Header().Name)
+
+	// ANY gets the records of every type of the name, not those of the target of an alias
+	msg = query(t, dd, "evil_ptolemy.docker.loc.", dns.TypeANY, "")
+	assert.Len(t, msg.Answer, 2)
+	assert.Equal(t, dns.TypeA, msg.Answer[0].Header().Rrtype)
+	assert.Equal(t, dns.TypeSRV, msg.Answer[1].Header().Rrtype)
+	msg = query(t, dd, "docker.loc.", dns.TypeANY, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, dns.TypeCAA, msg.Answer[0].Header().Rrtype)
+	msg = query(t, dd, "WWW.docker.loc.", dns.TypeANY, "")
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "WWW.docker.loc.", msg.Answer[0].(*dns.CNAME).Hdr.Name)
+
+	// the types not answered of an existing name are NODATA despite fallthrough, the missing names fall through
+	msg = query(t, dd, "evil_ptolemy.docker.loc.", dns.TypeHINFO, "")
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.True(t, msg.Authoritative)
+	assert.Empty(t, msg.Answer)
+	assert.Len(t, msg.Ns, 1)
+	assert.Nil(t, query(t, dd, "missing.docker.loc.", dns.TypeHINFO, ""))
+
+	// the class ANY is answered as IN, the other classes are passed to the next plugin
+	m := new(dns.Msg)
+	m.SetQuestion("evil_ptolemy.docker.loc.", dns.TypeA)
+	m.Question[0].Qclass = dns.ClassANY
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = dd.ServeDNS(context.Background(), rec, m)
+	assert.Nil(t, err)
+	assert.Len(t, rec.Msg.Answer, 1)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = dd.ServeDNS(context.Background(), rec, m)
+	assert.Nil(t, err)
+	assert.Nil(t, rec.Msg)
+}
+
+func TestEtcdFallback(t *testing.T) {
+	dd := NewDockerDiscovery(defaultDockerEndpoint)
+	dd.etcdFallback, dd.zones = true, []string{"docker.loc."}
+	assert.Equal(t, "/docker/docker/web", dd.etcdLookupKey("Web.docker.loc."))
+	assert.Empty(t, dd.etcdLookupKey("web.example.com."))
+	assert.Empty(t, dd.etcdLookupKey("docker.loc."))
+
+	answers := dd.etcdAnswers("web.docker.loc.", dns.TypeA, map[string]string{
+		"/docker/docker/web": `{"host":"10.0.0.5","ttl":60}`,
+	})
+	if assert.Len(t, answers, 1) {
+		assert.Equal(t, "10.0.0.5", answers[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(60), answers[0].Header().Ttl)
+	}
+	assert.Empty(t, dd.etcdAnswers("web.docker.loc.", dns.TypeAAAA, map[string]string{
+		"/docker/docker/web": `{"host":"10.0.0.5","ttl":60}`,
+	}))
+
+	// with etcd_prefix, the records of the containers under the path of the name, not the etcd plugin's
+	dd.etcdPrefix = "/skydns/{zone}"
+	assert.Equal(t, "/skydns/loc/docker/web/", dd.etcdLookupKey("web.docker.loc."))
+	answers = dd.etcdAnswers("web.docker.loc.", dns.TypeA, map[string]string{
+		"/skydns/loc/docker/web/0ab1c2d3e4f5": `{"host":"10.0.0.6"}`,
+		"/skydns/loc/docker/web/fa155d6fd141": `{"host":"10.0.0.5"}`,
+		"/skydns/loc/docker/web/x1":           `{"host":"10.0.0.7"}`,
+	})
+	if assert.Len(t, answers, 2) {
+		assert.Equal(t, "10.0.0.6", answers[0].(*dns.A).A.String())
+		assert.Equal(t, "10.0.0.5", answers[1].(*dns.A).A.String())
+		assert.Equal(t, uint32(defaultTTL), answers[0].Header().Ttl)
+	}
+
+	// not connected to etcd yet
+	assert.Empty(t, dd.etcdRecords(context.Background(), "web.docker.loc.", dns.TypeA))
+
+	_, err := createPlugin(caddy.NewTestController("dns", "docker {\netcd_fallback\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestAliases(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	alias www.example.org WWW.example.net => evil_ptolemy.docker.loc
+	alias external.example.org => example.com
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels[aliasLabel] = "app.example.org, bad..alias"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	msg := query(t, dd, "www.example.net.", dns.TypeA, "")
+	if assert.Len(t, msg.Answer, 2) {
+		assert.Equal(t, "evil_ptolemy.docker.loc.", msg.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "evil_ptolemy.docker.loc.", msg.Answer[1].Header().Name)
+		assert.Equal(t, "172.17.0.2", msg.Answer[1].(*dns.A).A.String())
+	}
+
+	// the label points to the first domain of the container
+	msg = query(t, dd, "app.example.org.", dns.TypeCNAME, "")
+	if assert.Len(t, msg.Answer, 1) && assert.Len(t, msg.Extra, 1) {
+		assert.Equal(t, "label-host.loc.", msg.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "172.17.0.2", msg.Extra[0].(*dns.A).A.String())
+	}
+	assert.Nil(t, query(t, dd, "bad.alias.", dns.TypeA, ""))
+
+	// the targets outside of the containers are answered with the CNAME only
+	msg = query(t, dd, "external.example.org.", dns.TypeA, "")
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "example.com.", msg.Answer[0].(*dns.CNAME).Target)
+	}
+
+	for _, config := range []string{
+		"docker {\nalias www.example.org web.docker.loc\n}",
+		"docker {\nalias => web.docker.loc\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	proxy := genContainerDefn("", "bridge", "172.17.0.2")
+	proxy.Config.Labels[wildcardLabel] = "*.apps.loc, *.b.apps.loc, apps.loc"
+	assert.Nil(t, dd.updateContainerInfo(proxy))
+	other := genContainerDefn("", "bridge", "172.17.0.3")
+	other.ID = "0ab1c2d3e4f5" + other.ID[12:]
+	other.Name = "other"
+	other.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "shop.apps.loc"}
+	assert.Nil(t, dd.updateContainerInfo(other))
+
+	for name, address := range map[string]string{
+		"x.apps.loc.":      "172.17.0.2",
+		"a.b.c.apps.loc.":  "172.17.0.2",
+		"x.b.apps.loc.":    "172.17.0.2",
+		"shop.apps.loc.":   "172.17.0.3", // owned by a container
+		"x.shop.apps.loc.": "172.17.0.2",
+	} {
+		msg := query(t, dd, name, dns.TypeA, "")
+		if assert.NotNil(t, msg, name) && assert.Len(t, msg.Answer, 1, name) {
+			assert.Equal(t, name, msg.Answer[0].Header().Name)
+			assert.Equal(t, address, msg.Answer[0].(*dns.A).A.String(), name)
+		}
+	}
+	// the invalid pattern is ignored, the wildcard doesn't cover its own parent
+	assert.Empty(t, dd.Lookup("apps.loc", dns.TypeA))
+
+	// the wildcards are dropped with the container
+	assert.Nil(t, dd.removeContainerInfo(proxy.ID))
+	assert.Empty(t, dd.Lookup("x.apps.loc", dns.TypeA))
+
+	// the directive gives every container the wildcard of its domains, unless opted out
+	c = caddy.NewTestController("dns", `docker {
+	wildcards
+}`)
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+	assert.True(t, dd.wildcards)
+	delete(proxy.Config.Labels, wildcardLabel)
+	assert.Nil(t, dd.updateContainerInfo(proxy))
+	assert.Len(t, dd.Lookup("x.label-host.loc", dns.TypeA), 1)
+	other.Config.Labels[wildcardLabel] = "false"
+	assert.Nil(t, dd.updateContainerInfo(other))
+	assert.Len(t, dd.Lookup("shop.apps.loc", dns.TypeA), 1)
+	assert.Empty(t, dd.Lookup("x.shop.apps.loc", dns.TypeA))
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nwildcards yes\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestRequireHealthy(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	require_healthy
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	// without healthcheck
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 1)
+
+	for status, answered := range map[string]bool{"starting": false, "healthy": true, "unhealthy": false} {
+		container.State.Health.Status = status
+		assert.Nil(t, dd.updateContainerInfo(container))
+		assert.Equal(t, answered, len(dd.Lookup("label-host.loc", dns.TypeA)) == 1, status)
+	}
+}
+
+func TestZoneLabel(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain prod.loc
+}`)
+	c.ServerBlockKeys = []string{"prod.loc.:53", "staging.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels[groupLabel] = "api"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("evil_ptolemy.staging.loc", dns.TypeA), 1)
+
+	container.Config.Labels[zoneLabel] = "Staging.loc"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("evil_ptolemy.staging.loc", dns.TypeA), 1)
+	assert.Len(t, dd.Lookup("api.staging.loc", dns.TypeA), 1)
+	assert.Empty(t, dd.Lookup("evil_ptolemy.prod.loc", dns.TypeA))
+	assert.Empty(t, dd.Lookup("api.prod.loc", dns.TypeA))
+	// outside of the zones
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 1)
+
+	// not a zone of the server block
+	container.Config.Labels[zoneLabel] = "dev.loc"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("evil_ptolemy.prod.loc", dns.TypeA), 1)
+	assert.Len(t, dd.Lookup("evil_ptolemy.staging.loc", dns.TypeA), 1)
+}
+
+func TestContainerEvents(t *testing.T) {
+	inspectRetryWait = time.Millisecond
+	var mu sync.Mutex
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	delete(container.Config.Labels, "com.docker.compose.project")
+	container.State.Running = true
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+	update := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+
+	dd := NewDockerDiscovery(daemon.URL)
+	dd.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	dd.resolvers = append(dd.resolvers, &SubDomainContainerNameResolver{domain: "docker.loc"})
+	dd.hidePaused = true
+	event := func(action string, attributes map[string]string) {
+		dd.handleEvent(context.Background(), &dockerapi.APIEvents{Type: "container", Action: action, TimeNano: time.Now().UnixNano(),
+			Actor: dockerapi.APIActor{ID: container.ID, Attributes: attributes}})
+	}
+	event("start", nil)
+	assert.Len(t, dd.Lookup("evil_ptolemy.docker.loc", dns.TypeA), 1)
+
+	// the domains based on the name follow the renames
+	update(func() { container.Name = "/web" })
+	event("rename", map[string]string{"oldName": "/evil_ptolemy", "name": "web"})
+	assert.Empty(t, dd.Lookup("evil_ptolemy.docker.loc", dns.TypeA))
+	assert.Len(t, dd.Lookup("web.docker.loc", dns.TypeA), 1)
+
+	update(func() { container.State.Paused = true })
+	event("pause", nil)
+	assert.Empty(t, dd.Lookup("web.docker.loc", dns.TypeA))
+	update(func() { container.State.Paused = false })
+	event("unpause", nil)
+	assert.Len(t, dd.Lookup("web.docker.loc", dns.TypeA), 1)
+
+	// killed with a signal the container handles
+	event("kill", map[string]string{"signal": "1"})
+	assert.Len(t, dd.Lookup("web.docker.loc", dns.TypeA), 1)
+	// stopped, the die event missed
+	update(func() { container.State.Running = false })
+	event("stop", nil)
+	assert.Empty(t, dd.Lookup("web.docker.loc", dns.TypeA))
+
+	// the entries kept by keep_exited are removed with the container
+	dd.keepClean = time.Hour
+	update(func() { container.State.Running = true })
+	event("start", nil)
+	event("die", map[string]string{"exitCode": "0", "name": "web"})
+	assert.Len(t, dd.Containers(), 1)
+	event("destroy", nil)
+	assert.Empty(t, dd.Containers())
+}
+
+func TestRestartPolicy(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	restart_policy always 7200
+	restart_policy on-failure 10 50ms
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]restartPolicy{"always": {ttl: 7200}, "on-failure": {ttl: 10, grace: 50 * time.Millisecond}}, dd.restartPolicies)
+
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.HostConfig.RestartPolicy = dockerapi.AlwaysRestart()
+	container.State.Running, container.State.StartedAt = true, time.Now()
+	assert.Equal(t, uint32(7200), dd.labelTTL(container))
+	container.HostConfig.RestartPolicy = dockerapi.NeverRestart()
+	assert.Equal(t, uint32(defaultTTL), dd.labelTTL(container))
+
+	// the ephemeral containers are registered after their grace period, if still running
+	var mu sync.Mutex
+	container.HostConfig.RestartPolicy = dockerapi.RestartOnFailure(3)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(container)
+	}))
+	defer daemon.Close()
+	ephemeral := NewDockerDiscovery(daemon.URL)
+	ephemeral.dockerClient, _ = dockerapi.NewClient(daemon.URL)
+	ephemeral.resolvers = append(ephemeral.resolvers, &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}})
+	ephemeral.restartPolicies = dd.restartPolicies
+
+	mu.Lock()
+	assert.Nil(t, ephemeral.updateContainerInfo(container))
+	mu.Unlock()
+	assert.Empty(t, ephemeral.Lookup("label-host.loc", dns.TypeA))
+	assert.Eventually(t, func() bool { return len(ephemeral.Lookup("label-host.loc", dns.TypeA)) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(10), ephemeral.Lookup("label-host.loc", dns.TypeA)[0].Header().Ttl)
+
+	for _, config := range []string{
+		"docker {\nrestart_policy sometimes 10\n}",
+		"docker {\nrestart_policy always\n}",
+		"docker {\nrestart_policy no 10 soon\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestApproveConflicts(t *testing.T) {
+	var notifiedMu sync.Mutex
+	var notified []PendingClaim
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var claim PendingClaim
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&claim))
+		notifiedMu.Lock()
+		notified = append(notified, claim)
+		notifiedMu.Unlock()
+	}))
+	defer webhook.Close()
+
+	owner := genContainerDefn("", "bridge", "172.17.0.2")
+	claimant := genContainerDefn("", "bridge", "172.17.0.3")
+	claimant.ID, claimant.Name = strings.Repeat("b", 64), "claimant"
+	delete(claimant.Config.Labels, "com.docker.compose.service") // another service
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/"+claimant.ID+"/json") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(claimant)
+	}))
+	defer daemon.Close()
+
+	dd, err := createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker %s {
+	approve_conflicts %s
+	record static.loc. A 10.0.0.1
+}`, daemon.URL, webhook.URL)))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(owner))
+
+	// the replicas of the service share the name
+	replica := genContainerDefn("", "bridge", "172.17.0.4")
+	replica.ID, replica.Name = strings.Repeat("a", 64), "replica"
+	replica.Config.Labels["com.docker.compose.container-number"] = "2"
+	assert.Nil(t, dd.updateContainerInfo(replica))
+	answers, _ := dd.records("label-host.loc.", dns.TypeA, nil)
+	assert.Len(t, answers, 2)
+
+	// another container claiming the name is held, once
+	assert.Nil(t, dd.updateContainerInfo(claimant))
+	assert.Nil(t, dd.updateContainerInfo(claimant))
+	answers, _ = dd.records("label-host.loc.", dns.TypeA, nil)
+	assert.Len(t, answers, 2)
+	claims := dd.PendingClaims()
+	if assert.Len(t, claims, 1) {
+		assert.Equal(t, claimant.ID, claims[0].ID)
+		assert.Equal(t, []string{"label-host.loc."}, claims[0].Names)
+		assert.Equal(t, []string{"evil_ptolemy", "replica"}, claims[0].Owners)
+	}
+	assert.Eventually(t, func() bool {
+		notifiedMu.Lock()
+		defer notifiedMu.Unlock()
+		return len(notified) == 1 && notified[0].ID == claimant.ID
+	}, time.Second, 10*time.Millisecond)
+
+	// approved through the admin API
+	admin := httptest.NewServer(dd.adminHandler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/claims")
+	assert.Nil(t, err)
+	var listed []PendingClaim
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&listed))
+	resp.Body.Close()
+	assert.Len(t, listed, 1)
+	resp, err = http.Post(admin.URL+"/claims/"+claimant.ID[:12], "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	answers, _ = dd.records("label-host.loc.", dns.TypeA, nil)
+	assert.Len(t, answers, 3)
+	assert.Empty(t, dd.PendingClaims())
+
+	// a container claiming the name of a record directive, rejected
+	rejected := genContainerDefn("", "bridge", "172.17.0.5")
+	rejected.ID, rejected.Name = strings.Repeat("c", 64), "rejected"
+	rejected.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "static.loc"}
+	assert.Nil(t, dd.updateContainerInfo(rejected))
+	claims = dd.PendingClaims()
+	if assert.Len(t, claims, 1) {
+		assert.Equal(t, []string{recordOwner}, claims[0].Owners)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/claims/"+rejected.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Nil(t, dd.updateContainerInfo(rejected))
+	assert.Empty(t, dd.PendingClaims())
+	assert.Len(t, dd.Containers(), 3)
+	resp, err = http.Post(admin.URL+"/claims/"+rejected.ID, "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// forgotten once removed
+	dd.containerDestroyed(rejected.ID)
+	assert.Nil(t, dd.updateContainerInfo(rejected))
+	assert.Len(t, dd.PendingClaims(), 1)
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\napprove_conflicts ftp://host\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestTransfer(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	soa ns1.docker.loc hostmaster@docker.loc
+	ns ns1.docker.loc
+	record docker.loc. CAA 0 issue "letsencrypt.org"
+	record example.org. TXT "outside"
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	transferred := func(zone string, serial uint32) []dns.RR {
+		ch, err := dd.Transfer(zone, serial)
+		assert.Nil(t, err)
+		var records []dns.RR
+		for rrs := range ch {
+			records = append(records, rrs...)
+		}
+		return records
+	}
+
+	// the zone between two SOA records, with the serial of the SOA queries
+	records := transferred("docker.loc.", 0)
+	if assert.Len(t, records, 5) {
+		soa := query(t, dd, "docker.loc.", dns.TypeSOA, "").Answer[0].(*dns.SOA)
+		assert.Equal(t, soa.Serial, records[0].(*dns.SOA).Serial)
+		assert.Equal(t, "ns1.docker.loc.", records[0].(*dns.SOA).Ns)
+		assert.Equal(t, dns.TypeNS, records[1].Header().Rrtype)
+		assert.Equal(t, dns.TypeCAA, records[2].Header().Rrtype)
+		assert.Equal(t, "evil_ptolemy.docker.loc.\t3600\tIN\tA\t172.17.0.2", records[3].String())
+		assert.Equal(t, dns.TypeSOA, records[4].Header().Rrtype)
+	}
+
+	// IXFR of the current serial gets the SOA alone, of an older one the zone
+	serial := records[0].(*dns.SOA).Serial
+	assert.Len(t, transferred("docker.loc.", serial), 1)
+	assert.Len(t, transferred("docker.loc.", serial-1), 5)
+
+	_, err = dd.Transfer("example.org.", 0)
+	assert.Equal(t, transfer.ErrNotAuthoritative, err)
+}
+
+func TestStageLabels(t *testing.T) {
+	dd := NewDockerDiscovery("unix:///labels.sock")
+	pprof.Do(context.Background(), dd.stageLabels("backend", "docker_backend", "etcd"), func(ctx context.Context) {
+		for label, expected := range map[string]string{"docker_endpoint": "unix:///labels.sock", "docker_stage": "backend", "docker_backend": "etcd"} {
+			value, ok := pprof.Label(ctx, label)
+			assert.True(t, ok, label)
+			assert.Equal(t, expected, value)
+		}
+	})
+}
+
+func TestRecordTable(t *testing.T) {
+	old, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	assert.Nil(t, old.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	assert.Nil(t, old.SetOverride("manual.loc", net.ParseIP("10.0.0.1")))
+	assert.Nil(t, old.SetRcode("broken.loc", "SERVFAIL"))
+
+	// the table of a docker host is imported by another one through the admin API
+	source := httptest.NewServer(old.adminHandler())
+	defer source.Close()
+	resp, err := http.Get(source.URL + "/table")
+	assert.Nil(t, err)
+	var table RecordTable
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&table))
+	assert.Equal(t, []string{"172.17.0.2"}, table.Records["label-host.loc."])
+	assert.Equal(t, map[string]string{"manual.loc.": "10.0.0.1"}, table.Overrides)
+	assert.Equal(t, map[string]string{"broken.loc.": "SERVFAIL"}, table.Rcodes)
+
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	admin := httptest.NewServer(dd.adminHandler())
+	defer admin.Close()
+	body, _ := json.Marshal(table)
+	resp, err = http.Post(admin.URL+"/table", "application/json", bytes.NewReader(body))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	msg := query(t, dd, "label-host.loc.", dns.TypeA, "")
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "172.17.0.2", msg.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(importedTTL), msg.Answer[0].Header().Ttl)
+	}
+	assert.Equal(t, "10.0.0.1", query(t, dd, "manual.loc.", dns.TypeA, "").Answer[0].(*dns.A).A.String())
+	assert.Equal(t, dns.RcodeServerFailure, query(t, dd, "broken.loc.", dns.TypeA, "").Rcode)
+
+	// the containers started here take their names over
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.9")))
+	assert.Equal(t, "172.17.0.9", query(t, dd, "label-host.loc.", dns.TypeA, "").Answer[0].(*dns.A).A.String())
+	assert.Nil(t, dd.removeContainerInfo("fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7"))
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+
+	// an invalid table is not imported, a replacing one drops the imported names, overrides and rcodes
+	assert.NotNil(t, dd.ImportTable(RecordTable{Records: map[string][]string{"web.loc.": {"10.0.0.2"}, "db.loc.": {"invalid"}}}, true))
+	assert.Len(t, dd.ExportTable().Overrides, 1)
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/table", strings.NewReader(`{"records": {"web.loc": ["10.0.0.2"]}}`))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	table = dd.ExportTable()
+	assert.Equal(t, map[string][]string{"web.loc.": {"10.0.0.2"}}, table.Records)
+	assert.Empty(t, table.Overrides)
+	assert.Empty(t, table.Rcodes)
+}
+
+func TestQueryBudget(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	wait_for_sync 1m
+	query_budget 20ms
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 20*time.Millisecond, dd.queryBudget)
+	assert.Nil(t, dd.updateContainerInfo(genContainerDefn("", "bridge", "172.17.0.2")))
+	// the instance stops trying docker, which isn't there, and waits for the initial sync again
+	dd.shutdown()
+	dd.synced = make(chan struct{})
+
+	// the query waiting for the initial sync is passed to the next plugin once the budget ran out
+	before := testutil.ToFloat64(queryCount.WithLabelValues("", "budget"))
+	start := time.Now()
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, before+1, testutil.ToFloat64(queryCount.WithLabelValues("", "budget")))
+
+	dd.markSynced()
+	assert.Len(t, query(t, dd, "label-host.loc.", dns.TypeA, "").Answer, 1)
+
+	for _, config := range []string{"docker {\nquery_budget\n}", "docker {\nquery_budget 0s\n}", "docker {\nquery_budget fast\n}"} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,48 @@
+package dockerdiscovery
+
+import (
+	"errors"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+)
+
+// The failure modes of the discovery, defined by the discovery package. The errors returned are wrapped with their
+// context (the container, network or backend), errors.Is tells them apart.
+var (
+	ErrNoNetwork          = discovery.ErrNoNetwork
+	ErrNoAddress          = discovery.ErrNoAddress
+	ErrRecordLimit        = discovery.ErrRecordLimit
+	ErrDockerUnavailable  = discovery.ErrDockerUnavailable
+	ErrBackendUnavailable = discovery.ErrBackendUnavailable
+	ErrInvalidResolver    = discovery.ErrInvalidResolver
+	ErrNoResolver         = discovery.ErrNoResolver
+	ErrNoClaim            = discovery.ErrNoClaim
+)
+
+// BackendError is the failure of a backend to publish the record table, it is an ErrBackendUnavailable
+type BackendError = discovery.BackendError
+
+// errorKind classifies the error for the errors_total metric
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNoNetwork):
+		return "no_network"
+	case errors.Is(err, ErrNoAddress):
+		return "no_address"
+	case errors.Is(err, ErrRecordLimit):
+		return "record_limit"
+	case errors.Is(err, ErrBackendUnavailable):
+		return "backend_unavailable"
+	case containerGone(err):
+		return "container_gone"
+	case errors.Is(err, ErrDockerUnavailable):
+		return "docker_unavailable"
+	default:
+		return "other"
+	}
+}
+
+// countError exports the error by kind
+func countError(err error) {
+	errorCount.WithLabelValues(errorKind(err)).Inc()
+}
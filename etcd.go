@@ -0,0 +1,378 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/etcd/msg"
+	"github.com/miekg/dns"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdMaxTxnOps is the default limit of operations in an etcd transaction
+const etcdMaxTxnOps = 128
+
+// etcdBackend writes the containers to etcd, in the record format of the CoreDNS etcd plugin
+type etcdBackend struct {
+	dd      *DockerDiscovery
+	written map[string]string // records written by key
+	adopted bool              // whether the records written by a previous run were loaded into written
+	reloads int               // reloads by the periodic resyncs
+	rewrite bool              // whether the records unchanged are written again, with a new lease
+
+	leaseMu sync.Mutex
+	lease   etcdcv3.LeaseID // lease of the records with etcd_lease, 0 until granted and once lost
+	revoked bool            // the lease is revoked by the final shutdown
+}
+
+func (backend *etcdBackend) name() string {
+	return "etcd"
+}
+
+// sync writes the records which changed since the last sync, in transactions of at most etcdMaxTxnOps operations
+func (backend *etcdBackend) sync(ctx context.Context, containers []*ContainerInfo) error {
+	if backend.dd.injectedFaults().dropEtcdWrites {
+		log.Printf("[docker] Fault injection: dropping the etcd writes of %d containers", len(containers))
+		return nil
+	}
+	backend.dd.mu.RLock()
+	client := backend.dd.etcd
+	backend.dd.mu.RUnlock()
+	if client == nil {
+		// connected on the first sync, and retried with the sync while it fails
+		var err error
+		if client, err = backend.dd.startEtcd(ctx); err != nil {
+			return err
+		}
+	}
+	if !backend.adopted {
+		if err := backend.adopt(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	owner := backend.dd.etcdOwnerName()
+	records := make(map[string]string)
+	for _, containerInfo := range containers {
+		for _, key := range backend.dd.etcdKeys(containerInfo) {
+			records[key] = ownedEtcdRecord(containerInfo.etcdRecord, owner)
+		}
+	}
+	var opts []etcdcv3.OpOption
+	if backend.dd.etcdLease {
+		lease, err := backend.grantLease(ctx, client)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, etcdcv3.WithLease(lease))
+	}
+	ops := etcdOps(backend.written, records, opts...)
+	if backend.rewrite {
+		for key, value := range records {
+			if previous, ok := backend.written[key]; ok && previous == value {
+				ops = append(ops, etcdcv3.OpPut(key, value, opts...))
+			}
+		}
+	}
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > etcdMaxTxnOps {
+			n = etcdMaxTxnOps
+		}
+		txnCtx, cancel := context.WithTimeout(ctx, backendTimeout)
+		_, err := client.Txn(txnCtx).Then(ops[:n]...).Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, op := range ops[:n] {
+			if op.IsPut() {
+				backend.written[string(op.KeyBytes())] = string(op.ValueBytes())
+			} else {
+				// deleted, or left to the instance which wrote it since
+				_, deletes, _ := op.Txn()
+				delete(backend.written, string(deletes[0].KeyBytes()))
+			}
+		}
+		ops = ops[n:]
+	}
+	backend.rewrite = false
+	return nil
+}
+
+// adopt loads the records written before this run, e.g. by CoreDNS before a restart, so the records of the
+// containers removed meanwhile, or of names they no longer have, are deleted by the next sync. Only the records of
+// the instance are loaded, the other instances sharing the prefixes write their own.
+func (backend *etcdBackend) adopt(ctx context.Context, client *etcdcv3.Client) error {
+	owner := backend.dd.etcdOwnerName()
+	adopted := 0
+	for _, root := range backend.dd.etcdRoots() {
+		getCtx, cancel := context.WithTimeout(ctx, backendTimeout)
+		resp, err := client.Get(getCtx, root, etcdcv3.WithPrefix())
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			if key := string(kv.Key); backend.dd.isEtcdRecordKey(key) && etcdRecordOwner(string(kv.Value)) == owner {
+				backend.written[key] = string(kv.Value)
+				adopted++
+			}
+		}
+	}
+	backend.adopted = true
+	if adopted > 0 && backend.reloads == 0 {
+		log.Printf("[docker] Found %d records in etcd written before, the ones of the containers gone are deleted", adopted)
+	}
+	return nil
+}
+
+// reload drops the records known to be written, the next sync loads them from etcd again and writes the ones
+// missing or modified there.
+func (backend *etcdBackend) reload() {
+	backend.written = make(map[string]string)
+	backend.adopted = false
+	backend.reloads++
+}
+
+// etcdRoots returns the etcd prefixes the records are written under: /docker/docker/ by default, the prefix of
+// every zone with etcd_prefix.
+func (dd *DockerDiscovery) etcdRoots() []string {
+	if dd.etcdPrefix == "" {
+		return []string{etcdDefaultPrefix}
+	}
+	var roots []string
+	seen := make(map[string]bool)
+	for _, zone := range dd.etcdZoneNames() {
+		root := path.Join("/", strings.ReplaceAll(dd.etcdPrefix, "{zone}", etcdPath(strings.ToLower(zone)))) + "/"
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// etcdDefaultZonePrefix is the etcd_prefix with etcd_zone alone, the layout of the etcd plugin with its default path
+const etcdDefaultZonePrefix = "/skydns/{zone}"
+
+// etcdZoneNames returns the zones the etcd keys are laid out under with etcd_prefix: the etcd_zone ones, otherwise
+// the server block zones
+func (dd *DockerDiscovery) etcdZoneNames() []string {
+	if len(dd.etcdZones) > 0 {
+		return dd.etcdZones
+	}
+	return dd.zones
+}
+
+// etcdRecordIDRegexp matches the last element of the keys written with etcd_prefix, the short container ID
+var etcdRecordIDRegexp = regexp.MustCompile(`/[0-9a-f]{12}$`)
+
+// isEtcdRecordKey reports whether the key is laid out as the keys of the plugin, written by this instance or the
+// instances of the other docker hosts. With etcd_prefix, the zone prefixes are shared with the records of the etcd
+// plugin, only the keys ending with a short container ID are the plugin's.
+func (dd *DockerDiscovery) isEtcdRecordKey(key string) bool {
+	if dd.etcdPrefix == "" {
+		return strings.HasPrefix(key, etcdDefaultPrefix)
+	}
+	return etcdRecordIDRegexp.MatchString(key)
+}
+
+// etcdEnabled reports whether the records are written to etcd, the plugin runs in memory only otherwise
+func (dd *DockerDiscovery) etcdEnabled() bool {
+	return len(dd.endpoints) > 0 || dd.etcdDiscovery != ""
+}
+
+// startEtcd connects to the etcd servers of the endpoint or etcd_discovery directive
+func (dd *DockerDiscovery) startEtcd(ctx context.Context) (*etcdcv3.Client, error) {
+	endpoints := dd.endpoints
+	if dd.etcdDiscovery != "" {
+		discovered, err := discoverEtcdEndpoints(ctx, dd.etcdDiscovery)
+		if err != nil {
+			return nil, err
+		}
+		if len(discovered) == 0 {
+			return nil, fmt.Errorf("no etcd endpoints found at %s", dd.etcdDiscovery)
+		}
+		endpoints = discovered
+	}
+	etcd, err := newEtcdClient(endpoints, dd.etcdTLS, dd.etcdUsername, dd.etcdPassword)
+	if err != nil {
+		return nil, err
+	}
+	health := newEtcdHealth(endpoints)
+	dd.spawn("etcd_health", func() { dd.watchEtcdHealth(etcd, health) })
+	if dd.etcdDiscovery != "" {
+		dd.spawn("etcd_discovery", func() { dd.watchEtcdEndpoints(etcd, health, endpoints) })
+	}
+	dd.mu.Lock()
+	dd.etcd, dd.etcdHealth = etcd, health
+	dd.mu.Unlock()
+	return etcd, nil
+}
+
+// etcdKeys returns the etcd keys of the container record: /docker/docker/<container name> by default. With the
+// etcd_prefix template, one key per domain of the container under the prefix of the domain's zone, in the path
+// layout of the etcd plugin, e.g. /skydns/loc/docker/web/<container ID> for web.docker.loc with /skydns/{zone},
+// so each zone can be served by its own etcd plugin. The domains outside of the zones (the etcd_zone ones, otherwise
+// the server block ones) are skipped.
+func (dd *DockerDiscovery) etcdKeys(containerInfo *ContainerInfo) []string {
+	if dd.etcdPrefix == "" {
+		return []string{dd.etcdKey(containerInfo.container)}
+	}
+	var keys []string
+	for _, domain := range containerInfo.domains {
+		fqdn := dns.Fqdn(strings.ToLower(domain))
+		zone := plugin.Zones(dd.etcdZoneNames()).Matches(fqdn)
+		if zone == "" {
+			continue
+		}
+		prefix := strings.ReplaceAll(dd.etcdPrefix, "{zone}", etcdPath(zone))
+		keys = append(keys, path.Join("/", prefix, etcdPath(strings.TrimSuffix(fqdn, zone)), containerInfo.container.ID[:12]))
+	}
+	return keys
+}
+
+// etcdPath returns the path of the name in the etcd plugin layout, its labels reversed: loc/docker for docker.loc
+func etcdPath(name string) string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, "/")
+}
+
+// etcdOps returns the etcd operations turning the written records into the wanted ones, the records put with the
+// options (e.g. the lease). Unchanged records (e.g. an updated container keeping its address) are not written again.
+// The records are deleted only while they are the ones written, not once another instance wrote the key (e.g. a
+// container of the same name on another docker host).
+func etcdOps(written, records map[string]string, opts ...etcdcv3.OpOption) []etcdcv3.Op {
+	var ops []etcdcv3.Op
+	for key, value := range records {
+		if previous, ok := written[key]; !ok || previous != value {
+			ops = append(ops, etcdcv3.OpPut(key, value, opts...))
+		}
+	}
+	for key, value := range written {
+		if _, ok := records[key]; !ok {
+			ops = append(ops, etcdDelete(key, value))
+		}
+	}
+	return ops
+}
+
+// etcdDelete returns the etcd operation deleting the record of the key if its value is still the one written
+func etcdDelete(key, value string) etcdcv3.Op {
+	written := etcdcv3.Compare(etcdcv3.Value(key), "=", value)
+	return etcdcv3.OpTxn([]etcdcv3.Cmp{written}, []etcdcv3.Op{etcdcv3.OpDelete(key)}, nil)
+}
+
+// etcdOwnedRecord is the etcd record of a container with its owner, the instance which wrote it. The etcd plugin
+// ignores the owner.
+type etcdOwnedRecord struct {
+	msg.Service
+	Owner string `json:"owner,omitempty"`
+}
+
+// ownedEtcdRecord returns the etcd record with its owner
+func ownedEtcdRecord(record, owner string) string {
+	var owned etcdOwnedRecord
+	if err := json.Unmarshal([]byte(record), &owned); err != nil {
+		return record
+	}
+	owned.Owner = owner
+	data, _ := json.Marshal(owned)
+	return string(data)
+}
+
+// etcdRecordOwner returns the owner of the etcd record, empty for the records of the etcd plugin or of versions of
+// the plugin which didn't write it
+func etcdRecordOwner(record string) string {
+	var owned etcdOwnedRecord
+	if err := json.Unmarshal([]byte(record), &owned); err != nil {
+		return ""
+	}
+	return owned.Owner
+}
+
+// etcdOwnerName returns the owner of the etcd records of the instance: the etcd_owner directive, by default the
+// hostname and the docker endpoint, stable across the restarts and distinct between the docker hosts
+func (dd *DockerDiscovery) etcdOwnerName() string {
+	if dd.etcdOwner != "" {
+		return dd.etcdOwner
+	}
+	hostname, _ := os.Hostname()
+	return hostname + " " + dd.dockerEndpoint
+}
+
+// etcdDiscoveryInterval is how often the etcd endpoints are discovered again, following the cluster membership
+const etcdDiscoveryInterval = time.Minute
+
+// discoverEtcdEndpoints returns the etcd endpoints published under the DNS SRV name
+func discoverEtcdEndpoints(ctx context.Context, name string) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	return etcdEndpoints(name, records), nil
+}
+
+// etcdEndpoints returns the endpoints of the SRV records of the name, e.g. _etcd-client._tcp.example.com
+// (https endpoints for _etcd-client-ssl._tcp.example.com), sorted by priority.
+func etcdEndpoints(name string, records []*net.SRV) []string {
+	scheme := "http"
+	if strings.HasPrefix(name, "_etcd-client-ssl.") || strings.HasPrefix(name, "_etcd-server-ssl.") {
+		scheme = "https"
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	var endpoints []string
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		endpoints = append(endpoints, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return endpoints
+}
+
+// watchEtcdEndpoints discovers the etcd endpoints periodically and updates the client and the health checks when
+// they changed, until the final shutdown
+func (dd *DockerDiscovery) watchEtcdEndpoints(client *etcdcv3.Client, health *etcdHealth, endpoints []string) {
+	ticker := time.NewTicker(etcdDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dd.ctx.Done():
+			return
+		}
+		discovered, err := discoverEtcdEndpoints(dd.ctx, dd.etcdDiscovery)
+		if err != nil || len(discovered) == 0 {
+			log.Printf("[docker] Error discovering etcd endpoints from %s: %v", dd.etcdDiscovery, err)
+			continue
+		}
+		if reflect.DeepEqual(discovered, endpoints) {
+			continue
+		}
+		log.Printf("[docker] etcd endpoints changed to %v", discovered)
+		for _, endpoint := range endpoints {
+			if !containsString(discovered, endpoint) {
+				etcdEndpointHealthy.DeleteLabelValues(dd.dockerEndpoint, endpoint)
+			}
+		}
+		health.setEndpoints(discovered)
+		client.SetEndpoints(discovered...)
+		endpoints = discovered
+	}
+}
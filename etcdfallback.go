@@ -0,0 +1,103 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/etcd/msg"
+	"github.com/miekg/dns"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdLookupTimeout bounds the etcd lookup of the etcd_fallback queries, the client is waiting for the answer
+const etcdLookupTimeout = time.Second
+
+// etcdLookupKey returns the etcd key the records of the name are looked up under, in the layout they are written
+// in: the container name, the first label of the name, under /docker/docker/ by default, the keys under the path of
+// the name with etcd_prefix. Only the names inside the server block zones are looked up, empty otherwise.
+func (dd *DockerDiscovery) etcdLookupKey(qname string) string {
+	fqdn := strings.ToLower(dns.Fqdn(qname))
+	zone := plugin.Zones(dd.etcdZoneNames()).Matches(fqdn)
+	if zone == "" || fqdn == zone {
+		return ""
+	}
+	if dd.etcdPrefix == "" {
+		return etcdDefaultPrefix + dns.SplitDomainName(fqdn)[0]
+	}
+	prefix := strings.ReplaceAll(dd.etcdPrefix, "{zone}", etcdPath(zone))
+	return path.Join("/", prefix, etcdPath(strings.TrimSuffix(fqdn, zone))) + "/"
+}
+
+// etcdRecords answers the A and AAAA queries the containers of this docker host don't answer with the records
+// written to etcd by the instances of the other hosts, with the etcd_fallback directive. The etcd errors are
+// logged and leave the query unanswered.
+func (dd *DockerDiscovery) etcdRecords(ctx context.Context, qname string, qtype uint16) []dns.RR {
+	if !dd.etcdFallback || (qtype != dns.TypeA && qtype != dns.TypeAAAA) {
+		return nil
+	}
+	key := dd.etcdLookupKey(qname)
+	dd.mu.RLock()
+	client := dd.etcd
+	dd.mu.RUnlock()
+	if key == "" || client == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, etcdLookupTimeout)
+	defer cancel()
+	var opts []etcdcv3.OpOption
+	if strings.HasSuffix(key, "/") {
+		opts = append(opts, etcdcv3.WithPrefix())
+	}
+	resp, err := client.Get(ctx, key, opts...)
+	if err != nil {
+		log.Printf("[docker] Error looking up %s in etcd: %s", qname, err)
+		return nil
+	}
+	records := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		records[string(kv.Key)] = string(kv.Value)
+	}
+	return dd.etcdAnswers(strings.ToLower(qname), qtype, records)
+}
+
+// etcdAnswers returns the A or AAAA records of the etcd records of the name by key, sorted by key, the records of
+// the etcd plugin sharing the prefixes with etcd_prefix excepted
+func (dd *DockerDiscovery) etcdAnswers(name string, qtype uint16, records map[string]string) []dns.RR {
+	var keys []string
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var answers []dns.RR
+	for _, key := range keys {
+		var service msg.Service
+		if !dd.isEtcdRecordKey(key) || json.Unmarshal([]byte(records[key]), &service) != nil {
+			continue
+		}
+		address := net.ParseIP(service.Host)
+		if address == nil || (address.To4() != nil) != (qtype == dns.TypeA) {
+			continue
+		}
+		var rr []dns.RR
+		if qtype == dns.TypeA {
+			rr = a(name, []net.IP{address})
+		} else {
+			rr = aaaa(name, []net.IP{address})
+		}
+		rr[0].Header().Ttl = dd.ttl
+		if service.TTL > 0 {
+			rr[0].Header().Ttl = service.TTL
+		}
+		answers = append(answers, rr...)
+	}
+	return answers
+}
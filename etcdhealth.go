@@ -0,0 +1,153 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdHealthInterval is how often the etcd endpoints are health checked
+var etcdHealthInterval = 10 * time.Second
+
+// etcdHealthTimeout bounds the health check of an etcd endpoint, a member slower to answer is failing
+var etcdHealthTimeout = 2 * time.Second
+
+// etcdHealth tracks the health of the etcd endpoints, the configured or discovered ones, and the endpoints the
+// client is set to: the healthy ones, all of them when none is.
+type etcdHealth struct {
+	mu        sync.Mutex
+	endpoints []string         // configured or discovered endpoints
+	failing   map[string]error // endpoints whose last check failed
+	inUse     []string         // endpoints the client is set to
+}
+
+func newEtcdHealth(endpoints []string) *etcdHealth {
+	return &etcdHealth{endpoints: endpoints, failing: make(map[string]error), inUse: endpoints}
+}
+
+// list returns the endpoints to check
+func (health *etcdHealth) list() []string {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	return append([]string{}, health.endpoints...)
+}
+
+// setEndpoints replaces the endpoints, e.g. discovered again, the client being set to all of them until checked
+func (health *etcdHealth) setEndpoints(endpoints []string) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	for endpoint := range health.failing {
+		if !containsString(endpoints, endpoint) {
+			delete(health.failing, endpoint)
+		}
+	}
+	health.endpoints, health.inUse = endpoints, endpoints
+}
+
+// update records the result of the checks of the endpoints, and returns the endpoints the client is to be set to
+// when they changed, nil otherwise. The results of endpoints replaced meanwhile are ignored.
+func (health *etcdHealth) update(checked map[string]error) []string {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	var usable []string
+	for _, endpoint := range health.endpoints {
+		err, ok := checked[endpoint]
+		if !ok {
+			err = health.failing[endpoint]
+		}
+		if err != nil {
+			health.failing[endpoint] = err
+			continue
+		}
+		delete(health.failing, endpoint)
+		usable = append(usable, endpoint)
+	}
+	if len(usable) == 0 {
+		// none answers, the client keeps trying them all
+		usable = health.endpoints
+	}
+	if reflect.DeepEqual(usable, health.inUse) {
+		return nil
+	}
+	health.inUse = usable
+	return usable
+}
+
+// statuses returns the health of the endpoints, in their order
+func (health *etcdHealth) statuses() []EtcdEndpointStatus {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	statuses := make([]EtcdEndpointStatus, 0, len(health.endpoints))
+	for _, endpoint := range health.endpoints {
+		status := EtcdEndpointStatus{Endpoint: endpoint, Healthy: true, InUse: containsString(health.inUse, endpoint)}
+		if err := health.failing[endpoint]; err != nil {
+			status.Healthy, status.LastError = false, err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// watchEtcdHealth checks the etcd endpoints periodically until the shutdown
+func (dd *DockerDiscovery) watchEtcdHealth(client *etcdcv3.Client, health *etcdHealth) {
+	ticker := time.NewTicker(etcdHealthInterval)
+	defer ticker.Stop()
+	for {
+		dd.checkEtcdEndpoints(client, health)
+		select {
+		case <-ticker.C:
+		case <-dd.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkEtcdEndpoints asks every endpoint for its status, the client being set to the ones answering: the requests
+// rotate away from a failing member instead of waiting for the client to give up on it, and come back to it once it
+// answers again.
+func (dd *DockerDiscovery) checkEtcdEndpoints(client *etcdcv3.Client, health *etcdHealth) {
+	checked := make(map[string]error)
+	for _, endpoint := range health.list() {
+		ctx, cancel := context.WithTimeout(dd.ctx, etcdHealthTimeout)
+		_, err := client.Status(ctx, endpoint)
+		cancel()
+		if dd.ctx.Err() != nil {
+			return
+		}
+		checked[endpoint] = err
+		if err != nil {
+			etcdEndpointHealthy.WithLabelValues(dd.dockerEndpoint, endpoint).Set(0)
+			etcdEndpointFailureCount.WithLabelValues(dd.dockerEndpoint, endpoint).Inc()
+		} else {
+			etcdEndpointHealthy.WithLabelValues(dd.dockerEndpoint, endpoint).Set(1)
+		}
+	}
+	if endpoints := health.update(checked); endpoints != nil {
+		log.Printf("[docker] etcd endpoints in use changed to %v", endpoints)
+		client.SetEndpoints(endpoints...)
+	}
+}
+
+// EtcdEndpoints returns the health of the etcd endpoints, nil until connected to etcd
+func (dd *DockerDiscovery) EtcdEndpoints() []EtcdEndpointStatus {
+	dd.mu.RLock()
+	health := dd.etcdHealth
+	dd.mu.RUnlock()
+	if health == nil {
+		return nil
+	}
+	return health.statuses()
+}
@@ -0,0 +1,104 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdMinLeaseTTL is the shortest lease of the etcd records, in seconds, etcd renews it every third of it
+const etcdMinLeaseTTL = 10
+
+// etcdLeaseSeconds returns the TTL of the lease of the etcd records with etcd_lease: its TTL, by default the TTL of
+// the answers, so the records of a publisher gone expire like the answers cached.
+func (dd *DockerDiscovery) etcdLeaseSeconds() int64 {
+	ttl := int64(dd.etcdLeaseTTL / time.Second)
+	if ttl == 0 {
+		ttl = int64(dd.ttl)
+	}
+	if ttl < etcdMinLeaseTTL {
+		ttl = etcdMinLeaseTTL
+	}
+	return ttl
+}
+
+// grantLease returns the lease the records are written with, granted on the first sync and again once lost, then
+// kept alive until the final shutdown. The records written before are written again with it.
+func (backend *etcdBackend) grantLease(ctx context.Context, client *etcdcv3.Client) (etcdcv3.LeaseID, error) {
+	backend.leaseMu.Lock()
+	lease, revoked := backend.lease, backend.revoked
+	backend.leaseMu.Unlock()
+	if lease != 0 {
+		return lease, nil
+	}
+	if revoked {
+		return 0, errors.New("etcd lease revoked")
+	}
+
+	grantCtx, cancel := context.WithTimeout(ctx, backendTimeout)
+	resp, err := client.Grant(grantCtx, backend.dd.etcdLeaseSeconds())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	keepAlive, err := client.KeepAlive(backend.dd.ctx, resp.ID)
+	if err != nil {
+		return 0, err
+	}
+	backend.leaseMu.Lock()
+	backend.lease = resp.ID
+	backend.leaseMu.Unlock()
+	backend.rewrite = true
+	go backend.keepLeaseAlive(resp.ID, keepAlive)
+	log.Printf("[docker] Writing the etcd records with lease %x of %ds", resp.ID, resp.TTL)
+	return resp.ID, nil
+}
+
+// keepLeaseAlive consumes the renewals of the lease until it's lost, e.g. expired while etcd was unreachable, then
+// has the records, deleted with it, written again with a new lease.
+func (backend *etcdBackend) keepLeaseAlive(lease etcdcv3.LeaseID, keepAlive <-chan *etcdcv3.LeaseKeepAliveResponse) {
+	for range keepAlive {
+	}
+	if backend.dd.ctx.Err() != nil {
+		return
+	}
+	backend.leaseMu.Lock()
+	if backend.lease == lease {
+		backend.lease = 0
+	}
+	backend.leaseMu.Unlock()
+	log.Printf("[docker] Lost the etcd lease %x, writing the records again", lease)
+	backend.dd.reloadBackends()
+}
+
+// revokeEtcdLease revokes the lease of the etcd records on the final shutdown, etcd deletes them with it
+func (dd *DockerDiscovery) revokeEtcdLease() error {
+	dd.mu.RLock()
+	client := dd.etcd
+	dd.mu.RUnlock()
+	for _, queue := range dd.backends {
+		backend, ok := queue.backend.(*etcdBackend)
+		if !ok {
+			continue
+		}
+		backend.leaseMu.Lock()
+		lease := backend.lease
+		backend.lease, backend.revoked = 0, true
+		backend.leaseMu.Unlock()
+		if lease == 0 || client == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+		_, err := client.Revoke(ctx, lease)
+		cancel()
+		if err != nil {
+			log.Printf("[docker] Error revoking the etcd lease %x of the records: %s", lease, err)
+			continue
+		}
+		log.Printf("[docker] Revoked the etcd lease %x, the records are deleted", lease)
+	}
+	return nil
+}
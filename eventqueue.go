@@ -0,0 +1,178 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// defaultEventWorkers is the number of docker events handled at once by default, see event_workers
+const defaultEventWorkers = 8
+
+// eventDebounce is how long the network connect and disconnect events of a container wait for the next one: only
+// the last one of a rapid sequence (e.g. a reconnect loop) is handled, the container being inspected anyway
+var eventDebounce = 100 * time.Millisecond
+
+// eventQueue holds the docker events until a worker handles them. The events are queued by key (the container, or
+// the network of the network events without container), a key being handled by one worker at a time in the order
+// of its events, so the final state of a container is the one of its last event, while the events of different
+// containers are handled concurrently by the workers.
+type eventQueue struct {
+	mu        sync.Mutex
+	ready     *sync.Cond
+	keys      []string                          // keys with events queued, in the order of their first event
+	pending   map[string][]*dockerapi.APIEvents // events queued, by key
+	busy      map[string]bool                   // keys whose event is being handled
+	debounced map[string]*debouncedEvent        // network events waiting for the next one, by key
+}
+
+// debouncedEvent is the last network event of a rapid sequence, queued once eventDebounce passes without another
+type debouncedEvent struct {
+	msg   *dockerapi.APIEvents
+	timer *time.Timer
+}
+
+func newEventQueue() *eventQueue {
+	queue := &eventQueue{
+		pending:   make(map[string][]*dockerapi.APIEvents),
+		busy:      make(map[string]bool),
+		debounced: make(map[string]*debouncedEvent),
+	}
+	queue.ready = sync.NewCond(&queue.mu)
+	return queue
+}
+
+// eventKey returns the key the event is queued by: the container of the container and network connection events,
+// otherwise the type and actor of the event
+func eventKey(msg *dockerapi.APIEvents) string {
+	if container := msg.Actor.Attributes["container"]; msg.Type == "network" && container != "" {
+		return container
+	}
+	if msg.Type == "container" {
+		return msg.Actor.ID
+	}
+	return msg.Type + ":" + msg.Actor.ID
+}
+
+// debounces reports whether the event waits for the next one of its container
+func debounces(msg *dockerapi.APIEvents) bool {
+	return msg.Type == "network" && (msg.Action == "connect" || msg.Action == "disconnect")
+}
+
+// queueEvent queues the event, the network connection events after the debounce. An event of the container of a
+// debounced event queues it first, so the events of a container are handled in order.
+func (dd *DockerDiscovery) queueEvent(msg *dockerapi.APIEvents) {
+	if dd.isPodman() {
+		msg = podmanEvent(msg)
+	}
+	queue := dd.events
+	key := eventKey(msg)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if waiting, ok := queue.debounced[key]; ok {
+		waiting.timer.Stop()
+		delete(queue.debounced, key)
+		if debounces(msg) {
+			eventDebounceCount.WithLabelValues(dd.dockerEndpoint).Inc()
+		} else {
+			queue.enqueue(key, waiting.msg)
+		}
+	}
+	if !debounces(msg) || eventDebounce == 0 {
+		queue.enqueue(key, msg)
+		dd.updateEventQueueDepth()
+		return
+	}
+
+	waiting := &debouncedEvent{msg: msg}
+	waiting.timer = time.AfterFunc(eventDebounce, func() {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		if queue.debounced[key] == waiting {
+			delete(queue.debounced, key)
+			queue.enqueue(key, msg)
+			dd.updateEventQueueDepth()
+		}
+	})
+	queue.debounced[key] = waiting
+}
+
+// enqueue adds the event to the events of its key and wakes a worker up. The caller must hold the lock.
+func (queue *eventQueue) enqueue(key string, msg *dockerapi.APIEvents) {
+	if len(queue.pending[key]) == 0 {
+		queue.keys = append(queue.keys, key)
+	}
+	queue.pending[key] = append(queue.pending[key], msg)
+	queue.ready.Signal()
+}
+
+// next waits for the first event of a key no worker is handling, and marks the key busy until done. It returns
+// nil once the context is done.
+func (queue *eventQueue) next(ctx context.Context) (string, *dockerapi.APIEvents) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for ctx.Err() == nil {
+		for i, key := range queue.keys {
+			if queue.busy[key] {
+				continue
+			}
+			msg := queue.pending[key][0]
+			if queue.pending[key] = queue.pending[key][1:]; len(queue.pending[key]) == 0 {
+				delete(queue.pending, key)
+				queue.keys = append(queue.keys[:i], queue.keys[i+1:]...)
+			}
+			queue.busy[key] = true
+			return key, msg
+		}
+		queue.ready.Wait()
+	}
+	return "", nil
+}
+
+// done marks the key handled, its next event can be handled
+func (queue *eventQueue) done(key string) {
+	queue.mu.Lock()
+	delete(queue.busy, key)
+	queue.mu.Unlock()
+	queue.ready.Broadcast()
+}
+
+// updateEventQueueDepth exports the number of events queued. The caller must hold the lock of the queue.
+func (dd *DockerDiscovery) updateEventQueueDepth() {
+	depth := 0
+	for _, events := range dd.events.pending {
+		depth += len(events)
+	}
+	eventQueueDepth.WithLabelValues(dd.dockerEndpoint).Set(float64(depth))
+}
+
+// handleEvents is a worker handling the queued events until the shutdown
+func (dd *DockerDiscovery) handleEvents() {
+	for {
+		key, msg := dd.events.next(dd.ctx)
+		if msg == nil {
+			return
+		}
+		dd.events.mu.Lock()
+		dd.updateEventQueueDepth()
+		dd.events.mu.Unlock()
+		dd.handleEventTraced(dd.ctx, msg)
+		dd.events.done(key)
+	}
+}
+
+// startEventWorkers starts the workers of the event queue, which are woken up on the shutdown to return
+func (dd *DockerDiscovery) startEventWorkers() {
+	for i := 0; i < dd.eventWorkers; i++ {
+		dd.spawn("event", dd.handleEvents)
+	}
+	dd.spawn("event", func() {
+		<-dd.ctx.Done()
+		dd.events.mu.Lock()
+		dd.events.ready.Broadcast()
+		dd.events.mu.Unlock()
+	})
+}
@@ -0,0 +1,98 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// sigtermExitCode is the exit code of a container stopped by the SIGTERM of docker stop
+const sigtermExitCode = 128 + 15
+
+// exitedCleanly reports whether the exit code is a clean exit (e.g. docker stop) rather than a crash
+func exitedCleanly(exitCode int) bool {
+	return exitCode == 0 || exitCode == sigtermExitCode
+}
+
+// keepExitedFor returns how long the records of the exited container are kept by the keep_exited policy
+func (dd *DockerDiscovery) keepExitedFor(exitCode int) time.Duration {
+	if exitedCleanly(exitCode) {
+		return dd.keepClean
+	}
+	return dd.keepCrashed
+}
+
+// exitCode returns the exit code of a die event, -1 when it's missing
+func exitCode(attributes map[string]string) int {
+	code, err := strconv.Atoi(attributes["exitCode"])
+	if err != nil {
+		return -1
+	}
+	return code
+}
+
+// logExit logs the exit code of the container and whether it crashed
+func logExit(containerID string, attributes map[string]string) {
+	kind := "crashed"
+	if exitedCleanly(exitCode(attributes)) {
+		kind = "exited cleanly"
+	}
+	log.Printf("[docker] Container %s (%s) %s with code %d", attributes["name"], containerID[:12], kind, exitCode(attributes))
+}
+
+// exit adds the exit of the container to the change: its entry is removed, or replaced by the exited entry, flagged
+// with the exit code, for the keep_exited window of this kind of exit. The exited entry is returned to be expired
+// once the change is applied, nil when not kept. The caller must hold the lock.
+func (dd *DockerDiscovery) exit(change *containerChange, containerInfo *ContainerInfo, exitCode int) *ContainerInfo {
+	change.remove(containerInfo)
+	if dd.keepExitedFor(exitCode) == 0 {
+		return nil
+	}
+	exited := *containerInfo
+	exited.exitCode, exited.exited = exitCode, time.Now()
+	change.added = append(change.added, &exited)
+	return &exited
+}
+
+// containerExited handles the die event of a container: the exit code is logged, and the records are removed
+// right away or kept for the keep_exited window of this kind of exit.
+func (dd *DockerDiscovery) containerExited(containerID string, attributes map[string]string) error {
+	logExit(containerID, attributes)
+
+	dd.mu.Lock()
+	containerInfo, ok := dd.containerInfoMap[containerID]
+	if ok {
+		change := &containerChange{keepStale: true}
+		exited := dd.exit(change, containerInfo, exitCode(attributes))
+		dd.applyChange(change)
+		if exited != nil {
+			dd.expireExited(exited, dd.keepExitedFor(exited.exitCode))
+		}
+	}
+	dd.mu.Unlock()
+
+	if !ok {
+		log.Printf("[docker] No entry associated with the container %s", containerID[:12])
+		return nil
+	}
+	dd.writePrometheusTargets()
+	return nil
+}
+
+// expireExited removes the entry of the exited container after the delay, unless it was restarted meanwhile.
+func (dd *DockerDiscovery) expireExited(containerInfo *ContainerInfo, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		if dd.ctx.Err() != nil {
+			return // shut down, the instance replacing it expires the entry
+		}
+		dd.mu.Lock()
+		expired := dd.containerInfoMap[containerInfo.container.ID] == containerInfo
+		if expired {
+			dd.applyChange(&containerChange{removed: []*ContainerInfo{containerInfo}, keepStale: true})
+		}
+		dd.mu.Unlock()
+		if expired {
+			dd.writePrometheusTargets()
+		}
+	})
+}
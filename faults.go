@@ -0,0 +1,124 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// faultsEnv enables the fault injection mode when set, its value being the faults injected from the start
+const faultsEnv = "COREDNS_DOCKERDISCOVERY_FAULTS"
+
+// faults are the failures injected in the discovery pipeline to validate its monitoring, never in production
+type faults struct {
+	eventDelay     time.Duration // delay of the processing of each docker event
+	dropEtcdWrites bool          // the etcd syncs succeed without writing anything
+	serveStale     bool          // the docker events and resyncs are ignored, the records are answered as they were
+}
+
+// parseFaults parses the comma separated faults: event_delay=DURATION, drop_etcd_writes and serve_stale, none
+// when empty
+func parseFaults(spec string) (faults, error) {
+	var f faults
+	for _, fault := range strings.Split(spec, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(fault), "=")
+		switch {
+		case name == "":
+		case name == "event_delay" && hasValue:
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay < 0 {
+				return faults{}, fmt.Errorf("invalid event_delay value: '%s'", value)
+			}
+			f.eventDelay = delay
+		case name == "drop_etcd_writes" && !hasValue:
+			f.dropEtcdWrites = true
+		case name == "serve_stale" && !hasValue:
+			f.serveStale = true
+		default:
+			return faults{}, fmt.Errorf("unknown fault: '%s'", fault)
+		}
+	}
+	return f, nil
+}
+
+func (f faults) String() string {
+	var spec []string
+	if f.eventDelay > 0 {
+		spec = append(spec, "event_delay="+f.eventDelay.String())
+	}
+	if f.dropEtcdWrites {
+		spec = append(spec, "drop_etcd_writes")
+	}
+	if f.serveStale {
+		spec = append(spec, "serve_stale")
+	}
+	return strings.Join(spec, ",")
+}
+
+// enableFaultInjection enables the fault injection mode if the environment asks for it
+func (dd *DockerDiscovery) enableFaultInjection() error {
+	spec, ok := os.LookupEnv(faultsEnv)
+	if !ok {
+		return nil
+	}
+	f, err := parseFaults(spec)
+	if err != nil {
+		return fmt.Errorf("%s: %s", faultsEnv, err)
+	}
+	dd.faultInjection = true
+	dd.faults = f
+	log.Printf("[docker] Fault injection enabled, injecting %q", f)
+	return nil
+}
+
+// injectedFaults returns the faults injected now
+func (dd *DockerDiscovery) injectedFaults() faults {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	return dd.faults
+}
+
+// setFaults replaces the faults injected
+func (dd *DockerDiscovery) setFaults(f faults) {
+	dd.mu.Lock()
+	dd.faults = f
+	dd.mu.Unlock()
+	log.Printf("[docker] Injecting faults %q", f)
+}
+
+// delayEvent waits for the event_delay fault before the event is processed, false when the context is done meanwhile
+func (dd *DockerDiscovery) delayEvent(ctx context.Context) bool {
+	delay := dd.injectedFaults().eventDelay
+	if delay == 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// faultsAPI changes the faults injected through the admin API
+type faultsAPI struct {
+	dd *DockerDiscovery
+}
+
+func (api faultsAPI) Faults() string {
+	return api.dd.injectedFaults().String()
+}
+
+func (api faultsAPI) SetFaults(spec string) error {
+	f, err := parseFaults(spec)
+	if err != nil {
+		return err
+	}
+	api.dd.setFaults(f)
+	return nil
+}
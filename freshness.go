@@ -0,0 +1,79 @@
+package dockerdiscovery
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// zoneRecords returns the records of the containers by zone of the server block, as "name address" strings. The
+// names outside of the zones are left out.
+func (dd *DockerDiscovery) zoneRecords(containers []*ContainerInfo) map[string]map[string]bool {
+	records := make(map[string]map[string]bool)
+	for _, containerInfo := range containers {
+		for _, domain := range containerInfo.domains {
+			fqdn := strings.ToLower(dns.Fqdn(domain))
+			zone := plugin.Zones(dd.zones).Matches(fqdn)
+			if zone == "" {
+				continue
+			}
+			if records[zone] == nil {
+				records[zone] = make(map[string]bool)
+			}
+			for _, address := range containerInfo.addresses() {
+				records[zone][fqdn+" "+address.String()] = true
+			}
+		}
+	}
+	return records
+}
+
+// markZoneChanges records the time of the change in the zones whose records it changed, the containers updated
+// without change of their names and addresses (e.g. by a resync) leave them as they are. The caller must hold the
+// lock.
+func (dd *DockerDiscovery) markZoneChanges(change *containerChange) {
+	removed, added := dd.zoneRecords(change.removed), dd.zoneRecords(change.added)
+	now := time.Now()
+	for _, zones := range []map[string]map[string]bool{removed, added} {
+		for zone := range zones {
+			if !sameRecords(removed[zone], added[zone]) {
+				dd.zoneChanges[zone] = now
+				zoneChangeTime.WithLabelValues(dd.dockerEndpoint, zone).Set(float64(now.Unix()))
+			}
+		}
+	}
+}
+
+func sameRecords(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for record := range a {
+		if !b[record] {
+			return false
+		}
+	}
+	return true
+}
+
+// markSyncDone records the time of the full listing of the containers. The caller must hold the lock.
+func (dd *DockerDiscovery) markSyncDone() {
+	dd.lastSync = time.Now()
+	lastSyncTime.WithLabelValues(dd.dockerEndpoint).Set(float64(dd.lastSync.Unix()))
+}
+
+// ZoneStatuses returns the freshness of the records of the zones which had records, by zone name
+func (dd *DockerDiscovery) ZoneStatuses() []ZoneStatus {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	statuses := make([]ZoneStatus, 0, len(dd.zoneChanges))
+	for zone, changed := range dd.zoneChanges {
+		statuses = append(statuses, ZoneStatus{Zone: zone, LastChange: changed, LastChangeAge: time.Since(changed).Seconds()})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Zone < statuses[j].Zone })
+	return statuses
+}
@@ -0,0 +1,60 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// groupLabel lets containers join a named group, answered with the addresses of all its members, a lightweight
+// virtual service without virtual IP
+const groupLabel = "coredns.dockerdiscovery.group"
+
+// groupDomains returns the domains of the group the container joined, <group>.<zone> under every server block
+// zone, or the zone of its zone label (docker.local when there is none but the root zone).
+func (dd *DockerDiscovery) groupDomains(container *dockerapi.Container) []string {
+	group := strings.TrimSpace(container.Config.Labels[groupLabel])
+	if group == "" {
+		return nil
+	}
+	zone := defaultDockerDomain
+	for _, z := range dd.zones {
+		if z != "." {
+			zone = strings.TrimSuffix(z, ".")
+			break
+		}
+	}
+	domain := group + "." + zone
+	if !validDomain(domain, dd.strictNames) {
+		log.Printf("[docker] Ignoring invalid group %q of container %s", group, container.ID[:12])
+		return nil
+	}
+	return dd.zoneDomains(container, []string{domain})
+}
+
+// groupMembers returns the containers of the group the name belongs to, sorted by ID. The caller must hold the lock.
+func (dd *DockerDiscovery) groupMembers(name string) []*ContainerInfo {
+	var members []*ContainerInfo
+	for _, containerInfo := range dd.containersByDomain(name) {
+		if containsDomain(containerInfo.groups, strings.TrimSuffix(name, ".")) {
+			members = append(members, containerInfo)
+		}
+	}
+	return members
+}
+
+// groupRecords answers the A and AAAA queries for a group with the addresses of all its members
+func (dd *DockerDiscovery) groupRecords(name string, qtype uint16, members []*ContainerInfo) []dns.RR {
+	var answers []dns.RR
+	for _, containerInfo := range members {
+		for _, rr := range containerGlue(name, containerInfo) {
+			if rr.Header().Rrtype == qtype {
+				rr.Header().Ttl = dd.ttl
+				answers = append(answers, rr)
+			}
+		}
+	}
+	return answers
+}
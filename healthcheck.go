@@ -0,0 +1,85 @@
+package dockerdiscovery
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+const healthServicePrefix = "_health._tcp."
+
+var healthURLRegexp = regexp.MustCompile(`https?://[^\s'"|;&]+`)
+
+// healthy reports whether the container passes its healthcheck, the containers without healthcheck always do. The
+// containers whose healthcheck didn't succeed yet (starting) don't.
+func healthy(container *dockerapi.Container) bool {
+	status := container.State.Health.Status
+	return status == "" || status == "none" || status == "healthy"
+}
+
+// HealthEndpoint describes the HTTP probe of the container healthcheck
+type HealthEndpoint struct {
+	scheme string
+	port   uint16
+	path   string
+}
+
+// healthEndpointByContainer returns the HTTP endpoint probed by the container healthcheck, or nil
+// when the container has no healthcheck or it doesn't look like an HTTP one.
+func healthEndpointByContainer(container *dockerapi.Container) *HealthEndpoint {
+	if container.Config.Healthcheck == nil {
+		return nil
+	}
+
+	probe := healthURLRegexp.FindString(strings.Join(container.Config.Healthcheck.Test, " "))
+	if probe == "" {
+		return nil
+	}
+	u, err := url.Parse(probe)
+	if err != nil {
+		return nil
+	}
+
+	endpoint := &HealthEndpoint{scheme: u.Scheme, port: 80, path: u.EscapedPath()}
+	if u.Scheme == "https" {
+		endpoint.port = 443
+	}
+	if u.Port() != "" {
+		port, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return nil
+		}
+		endpoint.port = uint16(port)
+	}
+	if endpoint.path == "" {
+		endpoint.path = "/"
+	}
+	return endpoint
+}
+
+// healthRecords answers SRV and TXT queries for _health._tcp.<domain> of containers with an HTTP healthcheck.
+func (dd *DockerDiscovery) healthRecords(qname string, qtype uint16) (answers, extras []dns.RR) {
+	target := qname[len(healthServicePrefix):]
+	containerInfo, _ := dd.containerInfoByDomain(target)
+	if containerInfo == nil || containerInfo.health == nil {
+		return nil, nil
+	}
+
+	header := dns.RR_Header{Name: qname, Rrtype: qtype, Class: dns.ClassINET, Ttl: dd.ttl}
+	switch qtype {
+	case dns.TypeSRV:
+		answers = append(answers, &dns.SRV{Hdr: header, Port: containerInfo.health.port, Target: target})
+		extras = containerGlue(target, containerInfo)
+	case dns.TypeTXT:
+		answers = append(answers, &dns.TXT{Hdr: header, Txt: []string{
+			"scheme=" + containerInfo.health.scheme,
+			"path=" + containerInfo.health.path,
+		}})
+	}
+	return answers, extras
+}
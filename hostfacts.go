@@ -0,0 +1,77 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// hostFactNames are the facts of the docker host answered in the TXT records of the containers, by default all
+var hostFactNames = []string{"hostname", "arch", "os", "docker_version"}
+
+func isHostFact(fact string) bool {
+	for _, name := range hostFactNames {
+		if fact == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hostFact returns the value of the fact of the docker host
+func hostFact(info *dockerapi.DockerInfo, fact string) string {
+	switch fact {
+	case "hostname":
+		return info.Name
+	case "arch":
+		return info.Architecture
+	case "os":
+		return info.OperatingSystem
+	case "docker_version":
+		return info.ServerVersion
+	}
+	return ""
+}
+
+// refreshHostInfo loads the facts of the docker host. The docker client has no context for this call, only the
+// api_timeout bounds it, the context is checked before.
+func (dd *DockerDiscovery) refreshHostInfo(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	release := dd.acquireAPI()
+	info, err := dd.dockerClient.Info()
+	release()
+	if err != nil {
+		return err
+	}
+
+	dd.mu.Lock()
+	dd.hostInfo = info
+	dd.mu.Unlock()
+	log.Printf("[docker] Docker host %s: %s, %s, docker %s", info.Name, info.Architecture, info.OperatingSystem, info.ServerVersion)
+	return nil
+}
+
+// hostFactRecords answers the HINFO and TXT queries of the container names with the facts of the docker host of
+// the host_facts directive: the HINFO record with its architecture and operating system, the TXT record with the
+// facts as key=value strings. The caller must hold the lock.
+func (dd *DockerDiscovery) hostFactRecords(name string, qtype uint16) []dns.RR {
+	if len(dd.hostFacts) == 0 || dd.hostInfo == nil {
+		return nil
+	}
+	header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: dd.ttl}
+	switch qtype {
+	case dns.TypeHINFO:
+		return []dns.RR{&dns.HINFO{Hdr: header, Cpu: dd.hostInfo.Architecture, Os: dd.hostInfo.OperatingSystem}}
+	case dns.TypeTXT:
+		var txt []string
+		for _, fact := range dd.hostFacts {
+			txt = append(txt, fact+"="+hostFact(dd.hostInfo, fact))
+		}
+		return []dns.RR{&dns.TXT{Hdr: header, Txt: txt}}
+	}
+	return nil
+}
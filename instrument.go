@@ -0,0 +1,34 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"runtime/pprof"
+	"runtime/trace"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// The goroutines of an instance carry profiler labels, so the CPU and blocking profiles of a live CoreDNS (e.g.
+// from the pprof plugin) attribute their time to the discovery: docker_endpoint, the docker host, docker_stage,
+// what the goroutine does (watch, event, backend, resync...), and docker_event or docker_backend, the event being
+// handled or the backend published to. For the execution traces, the events are docker/event tasks and the inspect,
+// resolve, store and backend phases runtime/trace regions named docker/<phase>.
+
+// stageLabels returns the profiler labels of the goroutines of the discovery stage, with the extra label pairs
+func (dd *DockerDiscovery) stageLabels(stage string, labels ...string) pprof.LabelSet {
+	return pprof.Labels(append([]string{"docker_endpoint", dd.dockerEndpoint, "docker_stage", stage}, labels...)...)
+}
+
+// stageRegion starts the trace region of the phase, to be ended on the same goroutine
+func stageRegion(ctx context.Context, phase string) *trace.Region {
+	return trace.StartRegion(ctx, "docker/"+phase)
+}
+
+// handleEventTraced handles the event in a trace task, its goroutine labelled with the event
+func (dd *DockerDiscovery) handleEventTraced(ctx context.Context, msg *dockerapi.APIEvents) {
+	ctx, task := trace.NewTask(ctx, "docker/event")
+	defer task.End()
+	pprof.Do(ctx, dd.stageLabels("event", "docker_event", msg.Type+":"+msg.Action), func(ctx context.Context) {
+		dd.handleEvent(ctx, msg)
+	})
+}
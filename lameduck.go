@@ -0,0 +1,24 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// drain runs the lame duck period on the final shutdown: answers are served with TTL 0 and the
+// backends stop publishing and delete their records before the listener stops, so clients and the
+// consumers of the backends stop relying on this server in advance.
+func (dd *DockerDiscovery) drain() error {
+	if dd.lameDuck == 0 {
+		return nil
+	}
+
+	log.Printf("[docker] Going into lame duck mode for %s", dd.lameDuck)
+	atomic.StoreInt32(&dd.draining, 1)
+	for _, queue := range dd.backends {
+		queue.drain(dd)
+	}
+	time.Sleep(dd.lameDuck)
+	return nil
+}
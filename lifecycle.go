@@ -0,0 +1,76 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// refreshContainer inspects the container of the event and updates its records, e.g. after a rename the domains
+// based on its name are resolved again
+func (dd *DockerDiscovery) refreshContainer(ctx context.Context, event, containerID string, eventTime int64) {
+	container, err := dd.inspectEventContainer(ctx, containerID, eventTime)
+	if err != nil {
+		dd.inspectFailed(event, containerID, err)
+		return
+	}
+	if err := dd.updateContainerInfo(container); err != nil {
+		log.Printf("[docker] Error updating A record for container %s: %s", container.ID[:12], err)
+		eventErrorCount.WithLabelValues(event).Inc()
+		countError(err)
+	}
+}
+
+// containerStopped handles the stop and kill events. The die event of a stopped container normally comes first, but
+// isn't received when the events are missed, so the container is inspected: still running (e.g. killed with a signal
+// it handles) its records are kept, stopped and still live they are handled like after its die event.
+func (dd *DockerDiscovery) containerStopped(ctx context.Context, event, containerID string, eventTime int64) {
+	dd.mu.RLock()
+	containerInfo, ok := dd.containerInfoMap[containerID]
+	live := ok && containerInfo.exited.IsZero()
+	dd.mu.RUnlock()
+	if !live || dd.teardownPending(containerInfo.container.Config.Labels["com.docker.compose.project"], containerID) {
+		return // handled by the die event already
+	}
+
+	container, err := dd.inspectEventContainer(ctx, containerID, eventTime)
+	if err != nil {
+		dd.inspectFailed(event, containerID, err)
+		return
+	}
+	if container.State.Running {
+		return
+	}
+	if err := dd.containerDied(containerID, exitAttributes(container)); err != nil {
+		log.Printf("[docker] Error deleting A record for container: %s: %s", containerID[:12], err)
+		eventErrorCount.WithLabelValues(event).Inc()
+		countError(err)
+	}
+}
+
+// exitAttributes returns the attributes of the die event of the stopped container
+func exitAttributes(container *dockerapi.Container) map[string]string {
+	attributes := map[string]string{"exitCode": strconv.Itoa(container.State.ExitCode), "name": normalizeContainerName(container)}
+	for label, value := range container.Config.Labels {
+		attributes[label] = value
+	}
+	return attributes
+}
+
+// containerDestroyed removes the entry of the removed container, kept by keep_exited or never stopped for docker
+// (e.g. docker rm -f while its events were missed). Its records are kept as stale like after a die event.
+func (dd *DockerDiscovery) containerDestroyed(containerID string) {
+	dd.mu.Lock()
+	dd.forgetClaim(containerID)
+	containerInfo, ok := dd.containerInfoMap[containerID]
+	if ok {
+		log.Printf("[docker] Container %s (%s) removed", normalizeContainerName(containerInfo.container), containerID[:12])
+		dd.applyChange(&containerChange{removed: []*ContainerInfo{containerInfo}, keepStale: true})
+	}
+	dd.mu.Unlock()
+	if ok {
+		dd.writePrometheusTargets()
+	}
+}
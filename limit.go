@@ -0,0 +1,57 @@
+package dockerdiscovery
+
+import (
+	"log"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	limitRefuse = "refuse"
+	limitEvict  = "evict"
+)
+
+// recordCount returns the number of domains registered for all the containers, the caller must hold the lock.
+func (dd *DockerDiscovery) recordCount() int {
+	count := 0
+	for _, containerInfo := range dd.containerInfoMap {
+		count += len(containerInfo.domains)
+	}
+	return count
+}
+
+// makeRoom checks the max_records limit before registering n more records of the container, as if the
+// change was applied. Depending on the limit policy either the registration is refused or the oldest
+// containers are evicted by the change. The caller must hold the lock.
+func (dd *DockerDiscovery) makeRoom(change *containerChange, container *dockerapi.Container, n int) bool {
+	if dd.maxRecords == 0 {
+		return true
+	}
+
+	for dd.recordCount()-change.removedRecords()+n > dd.maxRecords {
+		oldest := dd.oldestContainerInfo(change)
+		if dd.limitPolicy != limitEvict || oldest == nil {
+			log.Printf("[docker] ALERT: record limit of %d reached, refusing container %s (%s)", dd.maxRecords, normalizeContainerName(container), container.ID[:12])
+			recordLimitCount.WithLabelValues(limitRefuse).Inc()
+			return false
+		}
+		log.Printf("[docker] ALERT: record limit of %d reached, evicting container %s (%s)", dd.maxRecords, normalizeContainerName(oldest.container), oldest.container.ID[:12])
+		recordLimitCount.WithLabelValues(limitEvict).Inc()
+		change.remove(oldest)
+	}
+	return true
+}
+
+// oldestContainerInfo returns the oldest entry not removed by the change yet
+func (dd *DockerDiscovery) oldestContainerInfo(change *containerChange) *ContainerInfo {
+	var oldest *ContainerInfo
+	for _, containerInfo := range dd.containerInfoMap {
+		if change.removes(containerInfo.container.ID) {
+			continue
+		}
+		if oldest == nil || containerInfo.added.Before(oldest.added) {
+			oldest = containerInfo
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,39 @@
+package dockerdiscovery
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Metadata implements the metadata.Provider interface, so the plugins after this one (e.g. acl, view, log)
+// can act on the identity of the container owning the queried domain.
+func (dd *DockerDiscovery) Metadata(ctx context.Context, state request.Request) context.Context {
+	dd.mu.RLock()
+	containerInfo, _ := dd.containerInfoByDomain(state.QName())
+	dd.mu.RUnlock()
+	if containerInfo == nil {
+		return ctx
+	}
+
+	container := containerInfo.container
+	metadata.SetValueFunc(ctx, "docker/container_id", func() string { return container.ID })
+	metadata.SetValueFunc(ctx, "docker/container_name", func() string { return dd.containerName(container) })
+	metadata.SetValueFunc(ctx, "docker/image", func() string { return container.Config.Image })
+	metadata.SetValueFunc(ctx, "docker/network", func() string { return containerInfo.network })
+	return ctx
+}
+
+// containerNetworkName returns the name of the network the container address is taken from
+func containerNetworkName(container *dockerapi.Container) string {
+	if netName, ok := container.Config.Labels["coredns.dockerdiscovery.network"]; ok {
+		return netName
+	}
+	if container.HostConfig.NetworkMode == "default" || container.HostConfig.NetworkMode == "" {
+		return "bridge"
+	}
+	return container.HostConfig.NetworkMode
+}
@@ -0,0 +1,174 @@
+package dockerdiscovery
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// recordLimitCount is the counter of containers refused or evicted because of the max_records limit.
+	recordLimitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "record_limit_total",
+		Help:      "Counter of containers refused or evicted because the max_records limit was reached.",
+	}, []string{"action"})
+
+	// recordTableVersion is the version of the record table, by docker endpoint.
+	recordTableVersion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "record_table_version",
+		Help:      "Version of the record table, increased by every change of the records.",
+	}, []string{"endpoint"})
+
+	// backendHealthy is 1 when the last publication of the record table to the backend succeeded.
+	backendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "backend_healthy",
+		Help:      "Whether the last publication of the record table to the backend succeeded.",
+	}, []string{"backend"})
+
+	// backendPending is the number of changes of the record table not published to the backend yet.
+	backendPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "backend_pending",
+		Help:      "Number of changes of the record table not published to the backend yet.",
+	}, []string{"backend"})
+
+	// resyncRecordCount is the counter of records changed by the resyncs with docker, by change.
+	resyncRecordCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "resync_records_total",
+		Help:      "Counter of records added, removed or changed by the resyncs with docker, i.e. of missed events.",
+	}, []string{"change"})
+
+	// teardownCount is the counter of compose project teardowns whose exits were applied at once, by project.
+	teardownCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "teardowns_total",
+		Help:      "Counter of compose project teardowns whose container exits were applied as one change.",
+	}, []string{"project"})
+
+	// containerCount is the number of containers registered, by docker endpoint.
+	containerCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "containers",
+		Help:      "Number of containers registered.",
+	}, []string{"endpoint"})
+
+	// domainCount is the number of names answered with the container addresses, by docker endpoint.
+	domainCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "domains",
+		Help:      "Number of names answered with the addresses of the containers.",
+	}, []string{"endpoint"})
+
+	// eventErrorCount is the counter of the docker events which failed to be applied, by event.
+	eventErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "event_errors_total",
+		Help:      "Counter of docker events which failed to be applied to the records.",
+	}, []string{"event"})
+
+	// eventLatency is the time from the docker events to their records, by event.
+	eventLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "event_latency_seconds",
+		Help:      "Histogram of the time from the docker events to the update of their records.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8), // 1ms to 16s
+	}, []string{"event"})
+
+	// backendErrorCount is the counter of the failed publications of the record table, e.g. the etcd writes, by
+	// backend.
+	backendErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "backend_errors_total",
+		Help:      "Counter of the failed publications of the record table to the backend.",
+	}, []string{"backend"})
+
+	// errorCount is the counter of the errors of the discovery, by kind (see errorKind).
+	errorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "errors_total",
+		Help:      "Counter of the errors of the discovery, by kind.",
+	}, []string{"kind"})
+
+	// queryCount is the counter of the queries answered with the records (hit) or passed to the next plugin
+	// (fallthrough), by server.
+	queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "queries_total",
+		Help:      "Counter of the queries answered (hit), answered negatively (nxdomain, nodata), with a forced rcode (forced) or passed to the next plugin (fallthrough), or once their query_budget ran out (budget).",
+	}, []string{"server", "result"})
+
+	// lastSyncTime is the time of the last full listing of the containers, by docker endpoint.
+	lastSyncTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Unix time of the last full listing of the containers.",
+	}, []string{"endpoint"})
+
+	// zoneChangeTime is the time of the newest change of the records of a zone, by docker endpoint and zone.
+	zoneChangeTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "zone_change_timestamp_seconds",
+		Help:      "Unix time of the newest change of the records of the zone.",
+	}, []string{"endpoint", "zone"})
+
+	// eventQueueDepth is the number of docker events queued for the workers, by docker endpoint.
+	eventQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "event_queue",
+		Help:      "Number of docker events queued, waiting for a worker.",
+	}, []string{"endpoint"})
+
+	// eventDebounceCount is the counter of network events superseded by the next one of their container, by docker
+	// endpoint.
+	eventDebounceCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "events_debounced_total",
+		Help:      "Counter of network events of a container superseded by its next one before being handled.",
+	}, []string{"endpoint"})
+
+	// etcdEndpointHealthy is 1 when the last health check of the etcd endpoint succeeded, by docker endpoint.
+	etcdEndpointHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "etcd_endpoint_healthy",
+		Help:      "Whether the last health check of the etcd endpoint succeeded.",
+	}, []string{"endpoint", "etcd_endpoint"})
+
+	// etcdEndpointFailureCount is the counter of the failed health checks of the etcd endpoint, by docker endpoint.
+	etcdEndpointFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "etcd_endpoint_failures_total",
+		Help:      "Counter of the failed health checks of the etcd endpoint.",
+	}, []string{"endpoint", "etcd_endpoint"})
+
+	// dockerConnected is 1 while the plugin is connected to docker and in sync, by docker endpoint.
+	dockerConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "connected",
+		Help:      "Whether the plugin is connected to docker, 0 while docker is unreachable.",
+	}, []string{"endpoint"})
+)
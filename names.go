@@ -0,0 +1,57 @@
+package dockerdiscovery
+
+import (
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// nameRules turn the docker container names into the names of their records and etcd keys, set by the name_slashes,
+// name_map and name_max_length directives. The zero value strips the leading slash docker adds, as docker shows the
+// names.
+type nameRules struct {
+	allSlashes bool     // strip every slash, not only the leading ones
+	mapping    []string // pairs of a character replaced and its replacement, for strings.NewReplacer
+	maxLength  int      // length the names are truncated to, 0 for none
+}
+
+// normalize applies the rules to the container name: the slashes are stripped, the characters mapped, then the name
+// truncated, without the hyphens, underscores and dots left at its end
+func (rules *nameRules) normalize(name string) string {
+	if rules.allSlashes {
+		name = strings.ReplaceAll(name, "/", "")
+	} else {
+		name = strings.TrimLeft(name, "/")
+	}
+	if len(rules.mapping) > 0 {
+		name = strings.NewReplacer(rules.mapping...).Replace(name)
+	}
+	if rules.maxLength > 0 && len(name) > rules.maxLength {
+		name = strings.TrimRight(name[:rules.maxLength], "-_.")
+	}
+	return name
+}
+
+// addMapping maps every character of chars to the replacement, the later mappings of a character winning
+func (rules *nameRules) addMapping(chars, replacement string) {
+	for _, char := range chars {
+		rules.mapping = append([]string{string(char), replacement}, rules.mapping...)
+	}
+}
+
+// containerName returns the name of the container in its records and etcd keys, normalized by the name rules
+func (dd *DockerDiscovery) containerName(container *dockerapi.Container) string {
+	return dd.names.normalize(container.Name)
+}
+
+// namedContainer returns the container with the name of its records, for the resolvers: a shallow copy when the
+// name rules change it
+func (dd *DockerDiscovery) namedContainer(container *dockerapi.Container) *dockerapi.Container {
+	name := dd.containerName(container)
+	if name == normalizeContainerName(container) {
+		return container
+	}
+	named := *container
+	named.Name = name
+	return &named
+}
@@ -0,0 +1,164 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+var defaultInternalNames = []string{"host.docker.internal", "gateway.docker.internal"}
+
+type NetworkInfo struct {
+	name     string
+	subnets  []*net.IPNet
+	gateways []net.IP // gateway of the subnet with the same index
+}
+
+type NetworkInfoMap map[string]*NetworkInfo
+
+func newNetworkInfo(network *dockerapi.Network) *NetworkInfo {
+	info := &NetworkInfo{name: network.Name}
+	for _, config := range network.IPAM.Config {
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			continue
+		}
+		gateway := net.ParseIP(config.Gateway)
+		if gateway == nil {
+			// docker assigns the first address of the subnet when no gateway is configured
+			gateway = make(net.IP, len(subnet.IP))
+			copy(gateway, subnet.IP)
+			gateway[len(gateway)-1]++
+		}
+		info.subnets = append(info.subnets, subnet)
+		info.gateways = append(info.gateways, gateway)
+	}
+	return info
+}
+
+func (dd *DockerDiscovery) refreshNetworks(ctx context.Context) error {
+	networks, err := dd.listNetworks(ctx)
+	if err != nil {
+		return err
+	}
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	for id := range dd.networkInfoMap {
+		delete(dd.networkInfoMap, id)
+	}
+	for i := range networks {
+		dd.networkInfoMap[networks[i].ID] = newNetworkInfo(&networks[i])
+	}
+	log.Printf("[docker] Loaded %d networks, answering PTR queries in %s", len(networks), strings.Join(dd.reverseZones(), " "))
+	return nil
+}
+
+// networkChanged updates the cached network after its create or update event, with its inspection, so the cache
+// loaded at startup stays current without listing all the networks again. A network already gone is dropped.
+func (dd *DockerDiscovery) networkChanged(ctx context.Context, id string) error {
+	network, err := dd.inspectNetwork(ctx, id)
+	var noSuchNetwork *dockerapi.NoSuchNetwork
+	if errors.As(err, &noSuchNetwork) {
+		dd.networkRemoved(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	dd.networkInfoMap[id] = newNetworkInfo(network)
+	log.Printf("[docker] Network %s (%s) updated, answering PTR queries in %s", network.Name, id[:12], strings.Join(dd.reverseZones(), " "))
+	return nil
+}
+
+// networkRemoved drops the cached network after its destroy event
+func (dd *DockerDiscovery) networkRemoved(id string) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	if networkInfo, ok := dd.networkInfoMap[id]; ok {
+		delete(dd.networkInfoMap, id)
+		log.Printf("[docker] Network %s (%s) removed, answering PTR queries in %s", networkInfo.name, id[:12], strings.Join(dd.reverseZones(), " "))
+	}
+}
+
+// gatewayByClient returns the gateway of the docker network the client address belongs to,
+// which is the address of the docker host as seen from the containers of that network.
+// The caller must hold the lock.
+func (dd *DockerDiscovery) gatewayByClient(client net.IP, ipv6 bool) net.IP {
+	for _, networkInfo := range dd.networkInfoMap {
+		if !networkInfo.contains(client) {
+			continue
+		}
+		for _, gateway := range networkInfo.gateways {
+			if (gateway.To4() == nil) == ipv6 {
+				return gateway
+			}
+		}
+	}
+	return nil
+}
+
+// clientAddress is the address answered instead of the container addresses to the clients of a subnet, e.g. the
+// NAT address of the docker host for the clients of a VPN
+type clientAddress struct {
+	subnet  *net.IPNet
+	address net.IP
+}
+
+// hostAddressFor returns the host address answered instead of the container address to the clients of the
+// client_address subnets, then to the clients outside of the docker networks and of the internal_clients subnets
+// (off-host clients which can't route into the bridges), nil to answer the container address. The caller must hold the lock.
+func (dd *DockerDiscovery) hostAddressFor(containerInfo *ContainerInfo, client net.IP) net.IP {
+	if client == nil {
+		return nil
+	}
+	for _, clientAddress := range dd.clientAddresses {
+		if clientAddress.subnet.Contains(client) {
+			return clientAddress.address
+		}
+	}
+	if len(dd.hostAddresses) == 0 || client.IsLoopback() {
+		return nil
+	}
+	for _, subnet := range dd.internalClients {
+		if subnet.Contains(client) {
+			return nil
+		}
+	}
+	for _, networkInfo := range dd.networkInfoMap {
+		if networkInfo.contains(client) {
+			return nil
+		}
+	}
+	if address, ok := dd.hostAddresses[containerInfo.network]; ok {
+		return address
+	}
+	return dd.hostAddresses["*"]
+}
+
+func (networkInfo *NetworkInfo) contains(ip net.IP) bool {
+	for _, subnet := range networkInfo.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dd *DockerDiscovery) isInternalName(qname string) bool {
+	for _, name := range dd.internalNames {
+		if strings.EqualFold(dns.Fqdn(name), qname) {
+			return true
+		}
+	}
+	return false
+}
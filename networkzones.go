@@ -0,0 +1,66 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// networkZoneNames returns the names a container is found under in the zone of a network: its container name, its
+// compose service name and its aliases in the network, without the short container ID docker adds, lower case
+func (dd *DockerDiscovery) networkZoneNames(container *dockerapi.Container, network dockerapi.ContainerNetwork) []string {
+	names := dd.portNames(container)
+	for _, alias := range network.Aliases {
+		alias = strings.ToLower(strings.TrimSuffix(alias, "."))
+		if alias != "" && alias != container.ID[:12] && !containsDomain(names, alias) {
+			names = append(names, alias)
+		}
+	}
+	return names
+}
+
+// networkZoneRecords answers the A and AAAA queries of <name>.<zone> of the zones of the network directive with
+// the addresses the containers of the name hold in the networks of the zone, so a container attached to several
+// networks has a name per network. The caller must hold the lock.
+func (dd *DockerDiscovery) networkZoneRecords(name string, qtype uint16) []dns.RR {
+	if len(dd.networkZones) == 0 || (qtype != dns.TypeA && qtype != dns.TypeAAAA) {
+		return nil
+	}
+	var networks []string
+	for network, zone := range dd.networkZones {
+		if strings.HasSuffix(name, "."+zone) {
+			networks = append(networks, network)
+		}
+	}
+	if len(networks) == 0 {
+		return nil
+	}
+	sort.Strings(networks)
+
+	var answers []dns.RR
+	for _, containerInfo := range dd.containerInfoMap {
+		container := containerInfo.container
+		for _, networkName := range networks {
+			network, ok := container.NetworkSettings.Networks[networkName]
+			relative := strings.TrimSuffix(name, "."+dd.networkZones[networkName])
+			if !ok || !containsDomain(dd.networkZoneNames(container, network), relative) {
+				continue
+			}
+			var records []dns.RR
+			switch address, address6 := net.ParseIP(network.IPAddress), net.ParseIP(network.GlobalIPv6Address); {
+			case qtype == dns.TypeA && address != nil:
+				records = a(name, []net.IP{address})
+			case qtype == dns.TypeAAAA && address6 != nil:
+				records = aaaa(name, []net.IP{address6})
+			}
+			for _, rr := range records {
+				rr.Header().Ttl = dd.containerTTL(containerInfo)
+			}
+			answers = append(answers, records...)
+		}
+	}
+	return answers
+}
@@ -0,0 +1,48 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// isOneShot reports whether the container is a one-shot job: removed once exited (--rm) or never restarted
+// (restart policy "no")
+func isOneShot(container *dockerapi.Container) bool {
+	if container.HostConfig == nil {
+		return false
+	}
+	return container.HostConfig.AutoRemove || container.HostConfig.RestartPolicy.Name == "" || container.HostConfig.RestartPolicy.Name == "no"
+}
+
+// expireOneShot checks the one-shot container registered at added once its one_shot_lifetime is over, so its records
+// don't outlive it when its die event is missed: they are removed unless docker reports it still running, then it's
+// checked again after another lifetime.
+func (dd *DockerDiscovery) expireOneShot(containerID string, added time.Time) {
+	time.AfterFunc(dd.oneShotLifetime, func() {
+		dd.mu.RLock()
+		containerInfo, ok := dd.containerInfoMap[containerID]
+		dd.mu.RUnlock()
+		if !ok || !containerInfo.added.Equal(added) || !containerInfo.exited.IsZero() || dd.ctx.Err() != nil {
+			return // removed, registered again or exited meanwhile
+		}
+
+		container, err := dd.inspectContainerRetry(dd.ctx, containerID)
+		if isTransient(err) || (err == nil && container.State.Running) {
+			dd.expireOneShot(containerID, added)
+			return
+		}
+		log.Printf("[docker] One-shot container %s (%s) not running after %s, removing its records", normalizeContainerName(containerInfo.container), containerID[:12], dd.oneShotLifetime)
+
+		dd.mu.Lock()
+		expired := dd.containerInfoMap[containerID] == containerInfo
+		if expired {
+			dd.applyChange(&containerChange{removed: []*ContainerInfo{containerInfo}, keepStale: true})
+		}
+		dd.mu.Unlock()
+		if expired {
+			dd.writePrometheusTargets()
+		}
+	})
+}
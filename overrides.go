@@ -0,0 +1,101 @@
+package dockerdiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/backends"
+	"github.com/miekg/dns"
+)
+
+// SetOverride answers the name with the address instead of the discovered containers, e.g. to pin or add a
+// record by hand. A nil address removes the override. Overrides are saved to the overrides_file when set.
+func (dd *DockerDiscovery) SetOverride(name string, address net.IP) error {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return errors.New("invalid domain name")
+	}
+
+	dd.overridesMu.Lock()
+	defer dd.overridesMu.Unlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	dd.mu.Lock()
+	if address == nil {
+		delete(dd.overrides, name)
+	} else {
+		dd.overrides[name] = address
+	}
+	dd.bumpVersion()
+	dd.mu.Unlock()
+	return dd.saveOverrides()
+}
+
+// Overrides returns a snapshot of the overridden names (with trailing dot) and their address
+func (dd *DockerDiscovery) Overrides() map[string]net.IP {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	overrides := make(map[string]net.IP, len(dd.overrides))
+	for name, address := range dd.overrides {
+		overrides[name] = append(net.IP{}, address...)
+	}
+	return overrides
+}
+
+// loadOverrides reads the overrides saved to the overrides_file, a missing file means no overrides.
+func (dd *DockerDiscovery) loadOverrides() error {
+	data, err := os.ReadFile(dd.overridesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for name, value := range saved {
+		address := net.ParseIP(value)
+		if address == nil {
+			return errors.New("invalid address of " + name + ": " + value)
+		}
+		dd.overrides[strings.ToLower(dns.Fqdn(name))] = address
+	}
+	log.Printf("[docker] Loaded %d overrides from %s", len(dd.overrides), dd.overridesFile)
+	return nil
+}
+
+// saveOverrides writes the overrides to the overrides_file, the caller must hold overridesMu.
+func (dd *DockerDiscovery) saveOverrides() error {
+	if dd.overridesFile == "" {
+		return nil
+	}
+
+	saved := make(map[string]string)
+	for name, address := range dd.Overrides() {
+		saved[name] = address.String()
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return backends.WriteFileAtomic(dd.overridesFile, data)
+}
+
+// overrideRecords answers A and AAAA queries for the overridden names, the caller must hold the lock.
+func (dd *DockerDiscovery) overrideRecords(name string, qtype uint16) (answers []dns.RR) {
+	address := dd.overrides[name]
+	switch {
+	case qtype == dns.TypeA && address.To4() != nil:
+		answers = a(name, []net.IP{address})
+	case qtype == dns.TypeAAAA && address.To4() == nil:
+		answers = aaaa(name, []net.IP{address})
+	}
+	return answers
+}
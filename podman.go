@@ -0,0 +1,129 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// runtimes of the runtime directive: podman adjusts the events and addresses to the docker compatible API of
+// podman, auto detects podman on connection
+const (
+	runtimeDocker = "docker"
+	runtimePodman = "podman"
+	runtimeAuto   = "auto"
+)
+
+// podmanBridge is the default network of podman, bridge for docker
+const podmanBridge = "podman"
+
+// podmanRootlessModes are the network modes of the rootless podman containers without address of their own, reached
+// through the ports published on the host
+var podmanRootlessModes = map[string]bool{"slirp4netns": true, "pasta": true}
+
+// podmanActions are the docker actions of the podman events named differently
+var podmanActions = map[string]string{
+	"container:died":   "die",
+	"container:remove": "destroy",
+}
+
+// podmanEndpoint returns the socket of the podman API service: the rootless one of the user when it exists,
+// otherwise the rootful one
+func podmanEndpoint() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		socket := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// isPodman reports whether the runtime is podman, set by the runtime directive or detected on connection
+func (dd *DockerDiscovery) isPodman() bool {
+	return atomic.LoadInt32(&dd.podman) == 1
+}
+
+// detectRuntime sets the runtime from the components of the version of the daemon, with runtime auto. The docker
+// client has no context for this call, only the api_timeout bounds it, the context is checked before.
+func (dd *DockerDiscovery) detectRuntime(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	release := dd.acquireAPI()
+	version, err := dd.dockerClient.Version()
+	release()
+	if err != nil {
+		return err
+	}
+
+	var components []struct{ Name string }
+	json.Unmarshal([]byte(version.Get("Components")), &components)
+	podman := int32(0)
+	for _, component := range components {
+		if strings.Contains(strings.ToLower(component.Name), runtimePodman) {
+			podman = 1
+		}
+	}
+	if atomic.SwapInt32(&dd.podman, podman) != podman {
+		log.Printf("[docker] Runtime detected: %s", map[int32]string{0: runtimeDocker, 1: runtimePodman}[podman])
+	}
+	return nil
+}
+
+// podmanEvent returns the docker event the podman event stands for: the actions named differently are renamed, and
+// the network events of podman (by container ID) get the container attribute. The events are shared with the other
+// server blocks, the ones changed are copies.
+func podmanEvent(msg *dockerapi.APIEvents) *dockerapi.APIEvents {
+	action, renamed := podmanActions[msg.Type+":"+msg.Action]
+	connection := msg.Type == "network" && (msg.Action == "connect" || msg.Action == "disconnect") && msg.Actor.Attributes["container"] == ""
+	if !renamed && !connection {
+		return msg
+	}
+
+	event := *msg
+	if renamed {
+		event.Action, event.Status = action, action
+	}
+	if connection {
+		event.Actor.Attributes = make(map[string]string, len(msg.Actor.Attributes)+1)
+		for key, value := range msg.Actor.Attributes {
+			event.Actor.Attributes[key] = value
+		}
+		event.Actor.Attributes["container"] = msg.Actor.ID
+		if network := msg.Actor.Attributes["network"]; network != "" {
+			event.Actor.Attributes["name"] = network
+		}
+	}
+	return &event
+}
+
+// bridgeNetwork returns the name of the default network of the runtime
+func (dd *DockerDiscovery) bridgeNetwork() string {
+	if dd.isPodman() {
+		return podmanBridge
+	}
+	return "bridge"
+}
+
+// podmanNetwork returns the network of the podman containers of the bridge network mode, which podman keeps for
+// the user-defined networks too: the default network if connected, otherwise the first one by name with an address
+func podmanNetwork(container *dockerapi.Container) (dockerapi.ContainerNetwork, bool) {
+	if network, ok := container.NetworkSettings.Networks[podmanBridge]; ok {
+		return network, true
+	}
+	var first string
+	for name, network := range container.NetworkSettings.Networks {
+		if (network.IPAddress != "" || network.GlobalIPv6Address != "") && (first == "" || name < first) {
+			first = name
+		}
+	}
+	network, ok := container.NetworkSettings.Networks[first]
+	return network, ok
+}
@@ -0,0 +1,137 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// portPublication is a container port published on the docker host
+type portPublication struct {
+	containerInfo *ContainerInfo
+	containerPort string // e.g. 8080/tcp
+	hostIP        net.IP // nil when published on all the host addresses
+	hostPort      uint16
+}
+
+// portNames returns the names a container is found under in the ports zone: its container name and its compose
+// service name, lower case
+func (dd *DockerDiscovery) portNames(container *dockerapi.Container) []string {
+	names := []string{strings.ToLower(dd.containerName(container))}
+	if service := strings.ToLower(container.Config.Labels["com.docker.compose.service"]); service != "" && service != names[0] {
+		names = append(names, service)
+	}
+	return names
+}
+
+// portPublications returns the publications of the container port (all the protocols) of the containers named
+// name, sorted by container ID. The caller must hold the lock.
+func (dd *DockerDiscovery) portPublications(port, name string) []portPublication {
+	var publications []portPublication
+	seen := make(map[string]bool)
+	for _, containerInfo := range dd.containerInfoMap {
+		if !containsDomain(dd.portNames(containerInfo.container), name) {
+			continue
+		}
+		for containerPort, bindings := range containerInfo.container.NetworkSettings.Ports {
+			if containerPort.Port() != port {
+				continue
+			}
+			for _, binding := range bindings {
+				hostPort, err := strconv.ParseUint(binding.HostPort, 10, 16)
+				if err != nil {
+					continue
+				}
+				hostIP := net.ParseIP(binding.HostIP)
+				if hostIP != nil && hostIP.IsUnspecified() {
+					hostIP = nil
+				}
+				// the ports published on all the addresses have a binding per address family
+				key := fmt.Sprintf("%s %s %s %d", containerInfo.container.ID, containerPort, hostIP, hostPort)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				publications = append(publications, portPublication{
+					containerInfo: containerInfo,
+					containerPort: string(containerPort),
+					hostIP:        hostIP,
+					hostPort:      uint16(hostPort),
+				})
+			}
+		}
+	}
+	sort.Slice(publications, func(i, j int) bool {
+		if publications[i].containerInfo != publications[j].containerInfo {
+			return publications[i].containerInfo.container.ID < publications[j].containerInfo.container.ID
+		}
+		if publications[i].containerPort != publications[j].containerPort {
+			return publications[i].containerPort < publications[j].containerPort
+		}
+		return publications[i].hostPort < publications[j].hostPort
+	})
+	return publications
+}
+
+// portRecords answers the queries of the ports_zone: <port>.<name>.<ports zone> tells which host port the container
+// port of the containers named name (container or compose service name) is published on, e.g. 8080.app.ports.docker.loc.
+// The SRV records target the same name, answered with the host addresses the port is published on (host_ip when
+// published on all of them); the TXT records describe each publication. The caller must hold the lock.
+func (dd *DockerDiscovery) portRecords(name string, qtype uint16) []dns.RR {
+	if dd.portsZone == "" || !strings.HasSuffix(name, "."+dd.portsZone) {
+		return nil
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, dd.portsZone))
+	if len(labels) != 2 {
+		return nil
+	}
+	if _, err := strconv.ParseUint(labels[0], 10, 16); err != nil {
+		return nil
+	}
+
+	var answers []dns.RR
+	seen := make(map[string]bool)
+	header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: dd.ttl}
+	for _, publication := range dd.portPublications(labels[0], labels[1]) {
+		switch qtype {
+		case dns.TypeSRV:
+			answers = append(answers, &dns.SRV{Hdr: header, Weight: 10, Port: publication.hostPort, Target: name})
+		case dns.TypeTXT:
+			hostIP := "0.0.0.0"
+			if publication.hostIP != nil {
+				hostIP = publication.hostIP.String()
+			}
+			answers = append(answers, &dns.TXT{Hdr: header, Txt: []string{
+				"container=" + dd.containerName(publication.containerInfo.container),
+				"port=" + publication.containerPort,
+				"host_ip=" + hostIP,
+				fmt.Sprintf("host_port=%d", publication.hostPort),
+			}})
+		case dns.TypeA, dns.TypeAAAA:
+			addresses := dd.hostIPs
+			if publication.hostIP != nil {
+				addresses = []net.IP{publication.hostIP}
+			}
+			for _, address := range addresses {
+				if (address.To4() != nil) != (qtype == dns.TypeA) || seen[address.String()] {
+					continue
+				}
+				seen[address.String()] = true
+				if qtype == dns.TypeA {
+					answers = append(answers, a(name, []net.IP{address})...)
+				} else {
+					answers = append(answers, aaaa(name, []net.IP{address})...)
+				}
+			}
+		}
+	}
+	for _, rr := range answers {
+		rr.Header().Ttl = dd.ttl
+	}
+	return answers
+}
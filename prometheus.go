@@ -0,0 +1,102 @@
+package dockerdiscovery
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/backends"
+)
+
+// PrometheusTargetGroup is an entry of the Prometheus file-based service discovery
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#file_sd_config
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// prometheusTargetGroups returns target groups of the containers labeled with prometheus.scrape=true
+func (dd *DockerDiscovery) prometheusTargetGroups() []PrometheusTargetGroup {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	groups := []PrometheusTargetGroup{}
+	for _, containerInfo := range dd.containerInfoMap {
+		labels := containerInfo.container.Config.Labels
+		if labels["prometheus.scrape"] != "true" {
+			continue
+		}
+
+		port := labels["prometheus.port"]
+		if port == "" {
+			port = firstExposedPort(containerInfo)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			log.Printf("[docker] No valid prometheus.port for container %s (%s)", normalizeContainerName(containerInfo.container), containerInfo.container.ID[:12])
+			continue
+		}
+
+		group := PrometheusTargetGroup{
+			Targets: []string{net.JoinHostPort(containerInfo.addresses()[0].String(), port)},
+			Labels: map[string]string{
+				"container": dd.containerName(containerInfo.container),
+				"image":     containerInfo.container.Config.Image,
+				"domain":    containerInfo.domains[0],
+			},
+		}
+		if path := labels["prometheus.path"]; path != "" {
+			group.Labels["__metrics_path__"] = path
+		}
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Labels["container"] < groups[j].Labels["container"] })
+	return groups
+}
+
+// firstExposedPort returns the port of the registrator SERVICE_PORT of the container, otherwise the lowest TCP port
+// it exposes, or an empty string
+func firstExposedPort(containerInfo *ContainerInfo) string {
+	if containerInfo.servicePort != "" {
+		return containerInfo.servicePort
+	}
+	return exposedPort(containerInfo, "tcp")
+}
+
+// exposedPort returns the lowest port of the protocol exposed by the container, or an empty string
+func exposedPort(containerInfo *ContainerInfo, proto string) string {
+	var ports []int
+	for exposed := range containerInfo.container.Config.ExposedPorts {
+		if exposed.Proto() != proto {
+			continue
+		}
+		if port, err := strconv.Atoi(exposed.Port()); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return ""
+	}
+	sort.Ints(ports)
+	return strconv.Itoa(ports[0])
+}
+
+// writePrometheusTargets replaces the file_sd file, Prometheus picks the new version up on its own.
+func (dd *DockerDiscovery) writePrometheusTargets() {
+	if dd.prometheusSDFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(dd.prometheusTargetGroups(), "", "  ")
+	if err != nil {
+		log.Printf("[docker] Error encoding prometheus targets: %s", err)
+		return
+	}
+
+	// Prometheus must never read a partial file
+	if err := backends.WriteFileAtomic(dd.prometheusSDFile, data); err != nil {
+		log.Printf("[docker] Error writing prometheus targets: %s", err)
+	}
+}
@@ -0,0 +1,153 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// reverseZone returns the reverse zone of the subnet, e.g. 18.172.in-addr.arpa. for 172.18.0.0/16. Subnets not
+// aligned on an octet (a nibble for IPv6) get the zone of the enclosing aligned subnet.
+func reverseZone(subnet *net.IPNet) string {
+	ones, bits := subnet.Mask.Size()
+	labels, label := bits/8, 8
+	if subnet.IP.To4() == nil {
+		labels, label = bits/4, 4
+	}
+	name, err := dns.ReverseAddr(subnet.IP.String())
+	if err != nil {
+		return ""
+	}
+	return strings.Join(dns.SplitDomainName(name)[labels-ones/label:], ".") + "."
+}
+
+// reverseZones returns the reverse zones of the subnets of the docker networks, sorted. The caller must hold
+// the lock.
+func (dd *DockerDiscovery) reverseZones() []string {
+	seen := make(map[string]bool)
+	var zones []string
+	for _, networkInfo := range dd.networkInfoMap {
+		for _, subnet := range networkInfo.subnets {
+			if zone := reverseZone(subnet); zone != "" && !seen[zone] {
+				seen[zone] = true
+				zones = append(zones, zone)
+			}
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// ReverseZones returns the reverse zones derived from the subnets of the docker networks, e.g. to delegate them
+// to CoreDNS.
+func (dd *DockerDiscovery) ReverseZones() []string {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	return dd.reverseZones()
+}
+
+// indexAddresses adds the container to the reverse index of the addresses. The caller must hold the lock.
+func (dd *DockerDiscovery) indexAddresses(containerInfo *ContainerInfo) {
+	for _, address := range containerInfo.addresses() {
+		key := address.String()
+		dd.addressIndex[key] = append(dd.addressIndex[key], containerInfo)
+	}
+}
+
+// unindexAddresses removes the container from the reverse index of the addresses. The caller must hold the lock.
+func (dd *DockerDiscovery) unindexAddresses(containerInfo *ContainerInfo) {
+	for _, address := range containerInfo.addresses() {
+		removeOwner(dd.addressIndex, address.String(), containerInfo)
+	}
+}
+
+// ptrLabel set to false opts the container out of the PTR answers, e.g. for privacy, its names are still answered
+const ptrLabel = "coredns.dockerdiscovery.ptr"
+
+// ptrPriorityLabel sets the priority of the container in the PTR answers of an address shared with other containers,
+// the highest one is answered
+const ptrPriorityLabel = "coredns.dockerdiscovery.ptr.priority"
+
+// labelReverseOptOut reports whether the container opted out of the PTR answers with the ptr label
+func labelReverseOptOut(container *dockerapi.Container) bool {
+	value, ok := container.Config.Labels[ptrLabel]
+	if !ok {
+		return false
+	}
+	publish, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("[docker] Invalid %s label %q of container %s, publishing its PTR records", ptrLabel, value, container.ID[:12])
+		return false
+	}
+	return !publish
+}
+
+// labelPTRPriority returns the priority of the container in the PTR answers from the ptr.priority label, 0 for none
+func labelPTRPriority(container *dockerapi.Container) int {
+	value, ok := container.Config.Labels[ptrPriorityLabel]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("[docker] Ignoring the invalid %s label %q of container %s", ptrPriorityLabel, value, container.ID[:12])
+		return 0
+	}
+	return priority
+}
+
+// ptrOwner returns the container answered in the PTR records of the address among its owners: the highest
+// ptr.priority label, then the container started first, then the lowest container ID. The containers opted out
+// with the ptr label are left out, nil when all of them are.
+func ptrOwner(owners []*ContainerInfo) *ContainerInfo {
+	var answered *ContainerInfo
+	for _, containerInfo := range owners {
+		if containerInfo.ptrOptOut {
+			continue
+		}
+		if answered == nil || ptrPrecedes(containerInfo, answered) {
+			answered = containerInfo
+		}
+	}
+	return answered
+}
+
+// ptrPrecedes reports whether the container takes precedence over the other one in the PTR answers
+func ptrPrecedes(containerInfo, other *ContainerInfo) bool {
+	if containerInfo.ptrPriority != other.ptrPriority {
+		return containerInfo.ptrPriority > other.ptrPriority
+	}
+	if started, otherStarted := containerInfo.started(), other.started(); !started.Equal(otherStarted) {
+		return started.Before(otherStarted)
+	}
+	return containerInfo.container.ID < other.container.ID
+}
+
+// ptrRecords answers PTR queries for the addresses of the containers, with the domains of the container owning the
+// address, found in the reverse index, picked by ptrOwner when several containers share it. The caller must hold
+// the lock.
+func (dd *DockerDiscovery) ptrRecords(name string) []dns.RR {
+	address := net.ParseIP(dnsutil.ExtractAddressFromReverse(name))
+	if address == nil {
+		return nil
+	}
+	containerInfo := ptrOwner(dd.addressIndex[address.String()])
+	if containerInfo == nil {
+		return nil
+	}
+
+	var answers []dns.RR
+	for _, domain := range containerInfo.domains {
+		answers = append(answers, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: dd.ttl},
+			Ptr: dns.Fqdn(strings.ToLower(domain)),
+		})
+	}
+	return answers
+}
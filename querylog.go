@@ -0,0 +1,61 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// defaultQueryLogRate is the default limit of query log lines per second
+const defaultQueryLogRate = 100
+
+// queryLogger limits the query log to rate lines per second, the lines over the limit are dropped and counted.
+type queryLogger struct {
+	rate int
+
+	mu      sync.Mutex
+	window  time.Time // start of the current second
+	logged  int
+	dropped int
+}
+
+// allow reports whether a line can be logged now. The number of lines dropped during the previous second is
+// returned when a new second starts.
+func (logger *queryLogger) allow(now time.Time) (ok bool, dropped int) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	if now.Sub(logger.window) >= time.Second {
+		dropped = logger.dropped
+		logger.window, logger.logged, logger.dropped = now, 0, 0
+	}
+	if logger.logged >= logger.rate {
+		logger.dropped++
+		return false, dropped
+	}
+	logger.logged++
+	return true, dropped
+}
+
+// logQuery writes the query log line of an answered query: client address, name, type, rcode and the ID of the
+// container owning the name.
+func (dd *DockerDiscovery) logQuery(state request.Request, m *dns.Msg) {
+	ok, dropped := dd.queryLog.allow(time.Now())
+	if dropped > 0 {
+		log.Printf("[docker] query log rate of %d lines/s exceeded, %d lines dropped", dd.queryLog.rate, dropped)
+	}
+	if !ok {
+		return
+	}
+
+	containerID := "-"
+	dd.mu.RLock()
+	if containerInfo, _ := dd.containerInfoByDomain(state.Name()); containerInfo != nil {
+		containerID = containerInfo.container.ID[:12]
+	}
+	dd.mu.RUnlock()
+	log.Printf("[docker] query client=%s name=%s type=%s rcode=%s container=%s", state.IP(), state.Name(), state.Type(), dns.RcodeToString[m.Rcode], containerID)
+}
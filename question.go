@@ -0,0 +1,57 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// servedClass reports whether the plugin answers the class of the question: IN, and ANY answered as IN. The other
+// classes, e.g. CH for the chaos plugin, are passed to the next plugin.
+func servedClass(qclass uint16) bool {
+	return qclass == dns.ClassINET || qclass == dns.ClassANY
+}
+
+// anyRecords answers the ANY queries with the records of every type of the name: the probed types and those of the
+// record directives. The records of other names, e.g. the addresses of the target of an alias, are left out.
+func (dd *DockerDiscovery) anyRecords(qname string, client net.IP) []dns.RR {
+	types := append([]uint16{}, probedTypes...)
+	for _, rr := range dd.staticRecords {
+		if !containsType(types, rr.Header().Rrtype) {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+
+	var answers []dns.RR
+	for _, qtype := range types {
+		records, _ := dd.records(qname, qtype, client)
+		for _, rr := range records {
+			if strings.EqualFold(rr.Header().Name, qname) {
+				answers = append(answers, rr)
+			}
+		}
+	}
+	return answers
+}
+
+func containsType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// matchQuestionCase writes the records of the name with the case of the question, the lookups being case
+// insensitive: the resolvers randomizing the case of their queries (DNS 0x20) expect it back.
+func matchQuestionCase(records []dns.RR, qname string) []dns.RR {
+	for i, rr := range records {
+		if name := rr.Header().Name; name != qname && strings.EqualFold(name, qname) {
+			records[i] = dns.Copy(rr)
+			records[i].Header().Name = qname
+		}
+	}
+	return records
+}
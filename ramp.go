@@ -0,0 +1,92 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// rampLabel ramps up the share of the answers of its names a new container gets first, e.g. ramp=10m: its chance
+// of being the first address grows linearly with its uptime over the duration, for progressive rollouts (canary or
+// blue-green cutover) at the DNS level
+const rampLabel = "coredns.dockerdiscovery.ramp"
+
+// rampPick returns the random number in [0, 1) picking the container answered first, replaced by the tests
+var rampPick = rand.Float64
+
+// labelRamp returns the ramp duration of the container from the ramp label, 0 for none
+func labelRamp(container *dockerapi.Container) time.Duration {
+	value, ok := container.Config.Labels[rampLabel]
+	if !ok || value == "" {
+		return 0
+	}
+	ramp, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || ramp < 0 {
+		log.Printf("[docker] Ignoring the invalid ramp %q of container %s", value, container.ID[:12])
+		return 0
+	}
+	return ramp
+}
+
+// rampShare returns the weight of the container to be answered first: from 0 when it just started to 1 once its
+// ramp is over, 1 without ramp
+func (containerInfo *ContainerInfo) rampShare(now time.Time) float64 {
+	if containerInfo.ramp == 0 {
+		return 1
+	}
+	uptime := now.Sub(containerInfo.started())
+	switch {
+	case uptime >= containerInfo.ramp:
+		return 1
+	case uptime <= 0:
+		return 0
+	}
+	return float64(uptime) / float64(containerInfo.ramp)
+}
+
+// rampOrder moves first the container picked at random weighted by the ramp shares, when one of the containers is
+// ramping up, the others keeping their order. The containers are reordered in place.
+func rampOrder(owners []*ContainerInfo) []*ContainerInfo {
+	if len(owners) < 2 {
+		return owners
+	}
+	now := time.Now()
+	shares := make([]float64, len(owners))
+	total, ramping := 0.0, false
+	for i, containerInfo := range owners {
+		shares[i] = containerInfo.rampShare(now)
+		total += shares[i]
+		ramping = ramping || shares[i] < 1
+	}
+	if !ramping || total == 0 {
+		return owners
+	}
+
+	pick := rampPick() * total
+	for i, share := range shares {
+		if pick -= share; pick < 0 {
+			first := owners[i]
+			copy(owners[1:i+1], owners[:i])
+			owners[0] = first
+			break
+		}
+	}
+	return owners
+}
+
+// ramping reports whether a container of the name is ramping up, its answers are then ordered by rampOrder
+func (dd *DockerDiscovery) ramping(qname string) bool {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	now := time.Now()
+	for _, containerInfo := range dd.domainOwners(qname) {
+		if containerInfo.rampShare(now) < 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// rcodeLabel forces the response code of the names of a container, e.g. SERVFAIL during a maintenance
+const rcodeLabel = "coredns.dockerdiscovery.rcode"
+
+// parseForcedRcode returns the response code the names can be forced to answer: SERVFAIL, NXDOMAIN or REFUSED
+func parseForcedRcode(value string) (int, error) {
+	rcode, ok := dns.StringToRcode[strings.ToUpper(strings.TrimSpace(value))]
+	if !ok || (rcode != dns.RcodeServerFailure && rcode != dns.RcodeNameError && rcode != dns.RcodeRefused) {
+		return dns.RcodeSuccess, errors.New("invalid rcode: " + value)
+	}
+	return rcode, nil
+}
+
+// labelRcode returns the response code forced by the rcode label of the container, RcodeSuccess for none
+func labelRcode(container *dockerapi.Container) int {
+	value, ok := container.Config.Labels[rcodeLabel]
+	if !ok || value == "" {
+		return dns.RcodeSuccess
+	}
+	rcode, err := parseForcedRcode(value)
+	if err != nil {
+		log.Printf("[docker] Ignoring the %s label of container %s: %s", rcodeLabel, container.ID[:12], err)
+	}
+	return rcode
+}
+
+// SetRcode forces the response code of the name, SERVFAIL, NXDOMAIN or REFUSED, e.g. to take it out during a
+// maintenance without stopping its containers. An empty rcode answers the name again.
+func (dd *DockerDiscovery) SetRcode(name, rcode string) error {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return errors.New("invalid domain name")
+	}
+	code := dns.RcodeSuccess
+	if rcode != "" {
+		var err error
+		if code, err = parseForcedRcode(rcode); err != nil {
+			return err
+		}
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	if code == dns.RcodeSuccess {
+		delete(dd.rcodes, name)
+	} else {
+		dd.rcodes[name] = code
+	}
+	dd.bumpVersion()
+	return nil
+}
+
+// Rcodes returns a snapshot of the names (with trailing dot) whose response code is forced with SetRcode
+func (dd *DockerDiscovery) Rcodes() map[string]string {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	rcodes := make(map[string]string, len(dd.rcodes))
+	for name, rcode := range dd.rcodes {
+		rcodes[name] = dns.RcodeToString[rcode]
+	}
+	return rcodes
+}
+
+// forcedRcode returns the response code forced for the name, by SetRcode, or by the rcode label when every
+// container of the name has one (the lowest container ID first), so the replicas still answer while one is out.
+// RcodeSuccess when it's answered normally.
+func (dd *DockerDiscovery) forcedRcode(qname string) int {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	if rcode, ok := dd.rcodes[strings.ToLower(qname)]; ok {
+		return rcode
+	}
+	owners := dd.containersByDomain(qname)
+	for _, containerInfo := range owners {
+		if containerInfo.rcode == dns.RcodeSuccess {
+			return dns.RcodeSuccess
+		}
+	}
+	if len(owners) == 0 {
+		return dns.RcodeSuccess
+	}
+	return owners[0].rcode
+}
+
+// forceRcode answers the query with the forced response code, with the SOA record of the zone for NXDOMAIN
+func (dd *DockerDiscovery) forceRcode(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, rcode int) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Authoritative, m.RecursionAvailable, m.Compress = rcode == dns.RcodeNameError, true, dd.compress
+	if zone := plugin.Zones(dd.zones).Matches(state.Name()); rcode == dns.RcodeNameError && zone != "" {
+		m.Ns = []dns.RR{dd.negativeSOA(strings.ToLower(zone))}
+		dd.adjustTTLs(m.Ns)
+	}
+
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	queryCount.WithLabelValues(metrics.WithServer(ctx), "forced").Inc()
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("[docker] Error: %s", err.Error())
+	}
+	if dd.queryLog != nil {
+		dd.logQuery(state, m)
+	}
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,78 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// reconnectWindow is how long the records of a container disconnected from the network of its address are kept
+// for its reconnection, e.g. docker network disconnect then connect to change its address: the connect event swaps
+// the address at once, instead of the name being NXDOMAIN in between.
+var reconnectWindow = 2 * time.Second
+
+// containerDisconnected handles the network:disconnect events. A container left without address keeps its records
+// until it's connected again or the reconnect window is over, then they're swapped or removed. The containers still
+// having an address are updated right away.
+func (dd *DockerDiscovery) containerDisconnected(ctx context.Context, event, containerID string, eventTime int64) {
+	container, err := dd.inspectEventContainer(ctx, containerID, eventTime)
+	if err != nil {
+		dd.inspectFailed(event, containerID, err)
+		return
+	}
+	if dd.registered(containerID) && container.State.Running {
+		address, address6, err := dd.getContainerAddress(container)
+		if address, address6 = dd.filterFamily(address, address6); !isTransient(err) && address == nil && address6 == nil {
+			dd.awaitReconnect(containerID)
+			return
+		}
+	}
+	if err := dd.updateContainerInfo(container); err != nil {
+		log.Printf("[docker] Error adding A record for container %s: %s", container.ID[:12], err)
+		eventErrorCount.WithLabelValues(event).Inc()
+		countError(err)
+	}
+}
+
+// containerConnected handles the network:connect events, the records of a container awaiting its reconnection are
+// swapped to the new address
+func (dd *DockerDiscovery) containerConnected(ctx context.Context, event, containerID string, eventTime int64) {
+	dd.reconnectMu.Lock()
+	if timer, ok := dd.reconnects[containerID]; ok {
+		timer.Stop()
+		delete(dd.reconnects, containerID)
+		log.Printf("[docker] Container %s reconnected, swapping its address", containerID[:12])
+	}
+	dd.reconnectMu.Unlock()
+
+	dd.refreshContainer(ctx, event, containerID, eventTime)
+}
+
+// awaitReconnect keeps the records of the disconnected container for the reconnect window, after which the
+// container is inspected again: still without address, its records are removed.
+func (dd *DockerDiscovery) awaitReconnect(containerID string) {
+	dd.reconnectMu.Lock()
+	defer dd.reconnectMu.Unlock()
+	if timer, ok := dd.reconnects[containerID]; ok {
+		timer.Reset(reconnectWindow)
+		return
+	}
+	log.Printf("[docker] Keeping the records of container %s for %s, until reconnected", containerID[:12], reconnectWindow)
+	dd.reconnects[containerID] = time.AfterFunc(reconnectWindow, func() {
+		dd.reconnectMu.Lock()
+		delete(dd.reconnects, containerID)
+		dd.reconnectMu.Unlock()
+		if dd.ctx.Err() != nil {
+			return
+		}
+		container, err := dd.inspectContainerRetry(dd.ctx, containerID)
+		if err != nil {
+			dd.inspectFailed("network:disconnect", containerID, err)
+			return
+		}
+		if err := dd.updateContainerInfo(container); err != nil {
+			log.Printf("[docker] Error updating A record for container %s: %s", containerID[:12], err)
+			countError(err)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package dockerdiscovery
+
+import (
+	"log"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// composeIdentity returns what identifies a compose container across its recreations (e.g. by
+// `docker compose up` after an edit), empty for the containers not managed by compose.
+func composeIdentity(container *dockerapi.Container) string {
+	labels := container.Config.Labels
+	project, service := labels["com.docker.compose.project"], labels["com.docker.compose.service"]
+	if project == "" || service == "" {
+		return ""
+	}
+	return project + "/" + service + "/" + labels["com.docker.compose.container-number"]
+}
+
+// replaceRecreated adds to the change the removal of the entries (live and stale) of the previous containers
+// with the same compose identity, so a recreated container swaps the old records for its own instead of both
+// being answered for a while. The caller must hold the lock.
+func (dd *DockerDiscovery) replaceRecreated(change *containerChange, container *dockerapi.Container) {
+	identity := composeIdentity(container)
+	if identity == "" {
+		return
+	}
+	for id, containerInfo := range dd.containerInfoMap {
+		if id != container.ID && composeIdentity(containerInfo.container) == identity {
+			log.Printf("[docker] Container %s recreated as %s", id[:12], container.ID[:12])
+			change.remove(containerInfo)
+		}
+	}
+	for id, containerInfo := range dd.staleContainerInfoMap {
+		if id != container.ID && composeIdentity(containerInfo.container) == identity {
+			change.dropStale = append(change.dropStale, id)
+		}
+	}
+}
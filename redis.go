@@ -0,0 +1,263 @@
+package dockerdiscovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// redisBackend writes the A and AAAA records of the containers to redis, in the layout of the CoreDNS redis plugin:
+// a hash per zone (e.g. "docker.loc."), a field per name relative to the zone ("@" for the apex) holding its
+// records as JSON. The hashes of the zones belong to this instance, their fields which aren't names of the
+// containers are deleted. The domains outside of the zones are not written.
+type redisBackend struct {
+	dd       *DockerDiscovery
+	address  string
+	password string
+	written  map[string]map[string]string // fields known to be written, by zone and name
+	adopted  bool                         // whether the fields written before this run are loaded
+}
+
+// redisRecords are the records of a name in the redis plugin JSON format
+type redisRecords struct {
+	A    []redisAddress `json:"a,omitempty"`
+	AAAA []redisAddress `json:"aaaa,omitempty"`
+	SOA  *redisSOA      `json:"soa,omitempty"`
+}
+
+type redisAddress struct {
+	TTL uint32 `json:"ttl"`
+	IP  net.IP `json:"ip"`
+}
+
+type redisSOA struct {
+	TTL     uint32 `json:"ttl"`
+	MinTTL  uint32 `json:"minttl"`
+	Mbox    string `json:"mbox"`
+	Ns      string `json:"ns"`
+	Refresh uint32 `json:"refresh"`
+	Retry   uint32 `json:"retry"`
+	Expire  uint32 `json:"expire"`
+}
+
+func newRedisBackend(dd *DockerDiscovery, address, password string) *redisBackend {
+	return &redisBackend{dd: dd, address: address, password: password, written: make(map[string]map[string]string)}
+}
+
+func (backend *redisBackend) name() string {
+	return "redis"
+}
+
+func (backend *redisBackend) sync(ctx context.Context, containers []*ContainerInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	conn, err := dialRedis(ctx, backend.address, backend.password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !backend.adopted {
+		for _, zone := range backend.dd.zones {
+			reply, err := conn.do("HGETALL", zone)
+			if err != nil {
+				return err
+			}
+			fields, _ := reply.([]interface{})
+			written := make(map[string]string)
+			for i := 0; i+1 < len(fields); i += 2 {
+				name, _ := fields[i].(string)
+				value, _ := fields[i+1].(string)
+				written[name] = value
+			}
+			backend.written[zone] = written
+		}
+		backend.adopted = true
+	}
+
+	for zone, records := range backend.records(containers) {
+		written := backend.written[zone]
+		if written == nil {
+			written = make(map[string]string)
+			backend.written[zone] = written
+		}
+		for _, name := range sortedKeys(records) {
+			if previous, ok := written[name]; ok && previous == records[name] {
+				continue
+			}
+			if _, err := conn.do("HSET", zone, name, records[name]); err != nil {
+				return err
+			}
+			written[name] = records[name]
+		}
+		for _, name := range sortedKeys(written) {
+			if _, ok := records[name]; ok {
+				continue
+			}
+			if _, err := conn.do("HDEL", zone, name); err != nil {
+				return err
+			}
+			delete(written, name)
+		}
+	}
+	return nil
+}
+
+// reload drops the fields known to be written, the next sync loads them from redis again and writes the ones
+// missing or modified there.
+func (backend *redisBackend) reload() {
+	backend.written = make(map[string]map[string]string)
+	backend.adopted = false
+}
+
+// records returns the JSON records of the containers by zone and relative name, with the SOA record at the apex
+// of every zone, which the redis plugin requires to answer it.
+func (backend *redisBackend) records(containers []*ContainerInfo) map[string]map[string]string {
+	dd := backend.dd
+	names := make(map[string]map[string]*redisRecords)
+	for _, zone := range dd.zones {
+		soa := dd.negativeSOA(zone).(*dns.SOA)
+		names[zone] = map[string]*redisRecords{"@": {SOA: &redisSOA{TTL: dd.ttl, MinTTL: soa.Minttl, Mbox: soa.Mbox,
+			Ns: soa.Ns, Refresh: soa.Refresh, Retry: soa.Retry, Expire: soa.Expire}}}
+	}
+	for _, containerInfo := range containers {
+		for _, domain := range containerInfo.domains {
+			domain = dns.Fqdn(strings.ToLower(domain))
+			zone := plugin.Zones(dd.zones).Matches(domain)
+			if zone == "" {
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimSuffix(domain, zone), ".")
+			if name == "" {
+				name = "@"
+			}
+			records := names[zone][name]
+			if records == nil {
+				records = &redisRecords{}
+				names[zone][name] = records
+			}
+			if containerInfo.address != nil {
+				records.A = append(records.A, redisAddress{TTL: containerInfo.ttl, IP: containerInfo.address})
+			}
+			if containerInfo.address6 != nil {
+				records.AAAA = append(records.AAAA, redisAddress{TTL: containerInfo.ttl, IP: containerInfo.address6})
+			}
+		}
+	}
+
+	values := make(map[string]map[string]string, len(names))
+	for zone, records := range names {
+		values[zone] = make(map[string]string, len(records))
+		for name, record := range records {
+			value, _ := json.Marshal(record)
+			values[zone][name] = string(value)
+		}
+	}
+	return values
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redisConn is a minimal client of the redis protocol (RESP), enough for the hash commands of the backend
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialRedis connects to the redis server, authenticated with the password if any, until the context is done
+func dialRedis(ctx context.Context, address, password string) (*redisConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends the command and returns its reply: a string, an int64, nil or a []interface{} of them. The error
+// replies are returned as errors.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("invalid redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply: %q", line)
+	}
+}
@@ -0,0 +1,127 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handover is the state passed from the plugin instance being reloaded to its replacement
+type handover struct {
+	containerInfoMap ContainerInfoMap
+	networkInfoMap   NetworkInfoMap
+	shadowDomains    map[string]bool
+	lastEvent        int64 // time (unix nano) of the last docker event handled, the event cursor
+	version          uint64
+	zoneChanges      map[string]time.Time
+	importedNames    map[string][]net.IP
+}
+
+var (
+	handoversMu sync.Mutex
+	handovers   = make(map[string]*handover) // keyed by handoverKey
+)
+
+// handoverKey identifies the same plugin instance across reloads: one per server block and docker endpoint.
+func handoverKey(serverBlockKeys []string, dockerEndpoint string) string {
+	return strings.Join(serverBlockKeys, ",") + "|" + dockerEndpoint
+}
+
+// handOver saves the state of the instance for its replacement, it runs before the Corefile reload.
+func (dd *DockerDiscovery) handOver(key string) error {
+	dd.mu.RLock()
+	state := &handover{
+		containerInfoMap: make(ContainerInfoMap, len(dd.containerInfoMap)),
+		networkInfoMap:   make(NetworkInfoMap, len(dd.networkInfoMap)),
+		shadowDomains:    make(map[string]bool, len(dd.shadowDomains)),
+		lastEvent:        atomic.LoadInt64(&dd.lastEvent),
+		version:          dd.Version(),
+		zoneChanges:      make(map[string]time.Time, len(dd.zoneChanges)),
+		importedNames:    make(map[string][]net.IP, len(dd.importedNames)),
+	}
+	for id, containerInfo := range dd.containerInfoMap {
+		state.containerInfoMap[id] = containerInfo
+	}
+	for id, networkInfo := range dd.networkInfoMap {
+		state.networkInfoMap[id] = networkInfo
+	}
+	for domain := range dd.shadowDomains {
+		state.shadowDomains[domain] = true
+	}
+	for zone, changed := range dd.zoneChanges {
+		state.zoneChanges[zone] = changed
+	}
+	for name, addresses := range dd.importedNames {
+		state.importedNames[name] = addresses
+	}
+	dd.mu.RUnlock()
+
+	handoversMu.Lock()
+	handovers[key] = state
+	handoversMu.Unlock()
+	return nil
+}
+
+// dropHandover forgets the saved state when the reload failed and the instance keeps running.
+func dropHandover(key string) error {
+	handoversMu.Lock()
+	delete(handovers, key)
+	handoversMu.Unlock()
+	return nil
+}
+
+// takeOver adopts the state saved by the instance being replaced, if any. The adopted containers are answered
+// right away, so queries don't wait for the initial sync, which then only reconciles the state with docker.
+func (dd *DockerDiscovery) takeOver(key string) bool {
+	handoversMu.Lock()
+	state, ok := handovers[key]
+	delete(handovers, key)
+	handoversMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	dd.mu.Lock()
+	dd.containerInfoMap = state.containerInfoMap
+	dd.rebuildIndexes()
+	dd.updateRecordMetrics()
+	dd.networkInfoMap = state.networkInfoMap
+	dd.shadowDomains = state.shadowDomains
+	dd.lastEvent = state.lastEvent
+	dd.version = state.version
+	dd.zoneChanges = state.zoneChanges
+	dd.importedNames = state.importedNames
+	dd.mu.Unlock()
+	dd.markSynced()
+	log.Printf("[docker] Took over %d containers from the previous instance", len(state.containerInfoMap))
+	return true
+}
+
+// reconcile removes the containers which are not running anymore, e.g. adopted from the previous instance
+// but stopped during the reload. The exited containers still in their keep_exited window are kept until it ends.
+func (dd *DockerDiscovery) reconcile(running map[string]bool) {
+	var gone []string
+	dd.mu.RLock()
+	for id, containerInfo := range dd.containerInfoMap {
+		if running[id] {
+			continue
+		}
+		if !containerInfo.exited.IsZero() {
+			if keep := dd.keepExitedFor(containerInfo.exitCode) - time.Since(containerInfo.exited); keep > 0 {
+				dd.expireExited(containerInfo, keep)
+				continue
+			}
+		}
+		gone = append(gone, id)
+	}
+	dd.mu.RUnlock()
+
+	for _, id := range gone {
+		if err := dd.removeContainerInfo(id); err != nil {
+			log.Printf("[docker] Error deleting A record for container: %s: %s", id[:12], err)
+		}
+	}
+}
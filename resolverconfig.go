@@ -0,0 +1,146 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/discovery"
+)
+
+// resolversPath is the admin API path of the resolvers
+const resolversPath = "/resolvers"
+
+func resolverConfig(resolver ContainerDomainResolver) ResolverConfig {
+	config := ResolverConfig{Name: resolverName(resolver)}
+	switch resolver := resolver.(type) {
+	case *LabelResolver:
+		config.Labels = append([]string{}, resolver.hostLabels...)
+	case *SubDomainContainerNameResolver:
+		config.Domain = resolver.domain
+	case *SubDomainHostResolver:
+		config.Domain = resolver.domain
+	case *ComposeResolver:
+		config.Domain = resolver.domain
+	case *NetworkAliasesResolver:
+		config.Network = resolver.network
+		config.Domain = resolver.domain
+	case *RegistratorResolver:
+		config.Domain = resolver.domain
+	case *TemplateResolver:
+		config.Template = resolver.text
+	}
+	return config
+}
+
+// newResolver returns the resolver of the configuration, the domain defaulting to docker.loc (none for the aliases)
+// and the labels to coredns.dockerdiscovery.host as for the directives
+func newResolver(config ResolverConfig) (ContainerDomainResolver, error) {
+	domain := strings.TrimSuffix(config.Domain, ".")
+	if domain == "" {
+		domain = defaultDockerDomain
+	}
+	if !validDomain(domain, false) {
+		return nil, fmt.Errorf("invalid domain: '%s'", config.Domain)
+	}
+	switch config.Name {
+	case "label":
+		labels := config.Labels
+		if len(labels) == 0 {
+			labels = []string{"coredns.dockerdiscovery.host"}
+		}
+		return &LabelResolver{hostLabels: labels}, nil
+	case "name":
+		return &SubDomainContainerNameResolver{domain: domain}, nil
+	case "hostname":
+		return &SubDomainHostResolver{domain: domain}, nil
+	case "compose":
+		return &ComposeResolver{domain: domain}, nil
+	case "alias":
+		return &NetworkAliasesResolver{network: config.Network, domain: strings.TrimSuffix(config.Domain, ".")}, nil
+	case "registrator":
+		return &RegistratorResolver{domain: domain}, nil
+	case "template":
+		if config.Template == "" {
+			return nil, errors.New("missing template")
+		}
+		return newTemplateResolver(config.Template)
+	}
+	return nil, fmt.Errorf("unknown resolver: '%s'", config.Name)
+}
+
+// Resolvers returns the resolvers enabled, in order of precedence
+func (dd *DockerDiscovery) Resolvers() []ResolverConfig {
+	resolvers := dd.currentResolvers()
+	configs := make([]ResolverConfig, 0, len(resolvers))
+	for _, resolver := range resolvers {
+		configs = append(configs, resolverConfig(resolver))
+	}
+	return configs
+}
+
+// currentResolvers returns the resolvers enabled, the slice is replaced rather than modified by the changes
+func (dd *DockerDiscovery) currentResolvers() []ContainerDomainResolver {
+	dd.resolversMu.RLock()
+	defer dd.resolversMu.RUnlock()
+	return dd.resolvers
+}
+
+// SetResolver enables the resolver or changes its configuration, replacing the resolvers of the name in place
+// (the first one keeps its precedence) or coming last, then resolves the names of all the containers again.
+func (dd *DockerDiscovery) SetResolver(ctx context.Context, config ResolverConfig) error {
+	resolver, err := newResolver(config)
+	if err != nil {
+		return fmt.Errorf("%w: %s", discovery.ErrInvalidResolver, err)
+	}
+	dd.resolversMu.Lock()
+	var resolvers []ContainerDomainResolver
+	replaced := false
+	for _, current := range dd.resolvers {
+		if resolverName(current) != config.Name {
+			resolvers = append(resolvers, current)
+		} else if !replaced {
+			resolvers = append(resolvers, resolver)
+			replaced = true
+		}
+	}
+	if !replaced {
+		resolvers = append(resolvers, resolver)
+	}
+	dd.resolvers = resolvers
+	dd.resolversMu.Unlock()
+
+	log.Printf("[docker] Resolver %s set to %+v", config.Name, resolverConfig(resolver))
+	return dd.reresolve(ctx)
+}
+
+// RemoveResolver disables the resolvers of the name, then resolves the names of all the containers again
+func (dd *DockerDiscovery) RemoveResolver(ctx context.Context, name string) error {
+	dd.resolversMu.Lock()
+	var resolvers []ContainerDomainResolver
+	for _, current := range dd.resolvers {
+		if resolverName(current) != name {
+			resolvers = append(resolvers, current)
+		}
+	}
+	removed := len(resolvers) < len(dd.resolvers)
+	dd.resolvers = resolvers
+	dd.resolversMu.Unlock()
+
+	if !removed {
+		return fmt.Errorf("%w: %s", discovery.ErrNoResolver, name)
+	}
+	log.Printf("[docker] Resolver %s disabled", name)
+	return dd.reresolve(ctx)
+}
+
+// reresolve registers all the running containers again with the resolvers changed, including the ones which had
+// no name until then
+func (dd *DockerDiscovery) reresolve(ctx context.Context) error {
+	if err := dd.resync(ctx); err != nil {
+		return fmt.Errorf("resolving the containers again: %w", err)
+	}
+	return nil
+}
@@ -3,14 +3,38 @@ package dockerdiscovery
 import (
 	"fmt"
 	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// hostnameLabelRegexp matches a RFC 1123 hostname label (letters, digits and hyphens)
+var hostnameLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
 func normalizeContainerName(container *dockerapi.Container) string {
 	return strings.TrimLeft(container.Name, "/")
 }
 
+// validDomain checks a generated domain. The relaxed mode only requires a syntactically valid DNS name
+// (so underscores are allowed), the strict mode requires every label to be a valid hostname label.
+func validDomain(domain string, strict bool) bool {
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+		return false
+	}
+	if !strict {
+		return true
+	}
+	for _, label := range dns.SplitDomainName(domain) {
+		if !hostnameLabelRegexp.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
 // resolvers implements ContainerDomainResolver
 
 type SubDomainContainerNameResolver struct {
@@ -33,21 +57,63 @@ func (resolver SubDomainHostResolver) resolve(container *dockerapi.Container) ([
 	return domains, nil
 }
 
+// LabelResolver sets names based on the values of labels, each a comma separated list of names
 type LabelResolver struct {
-	hostLabel string
+	hostLabels []string
 }
 
 func (resolver LabelResolver) resolve(container *dockerapi.Container) ([]string, error) {
 	var domains []string
+	var firstErr error
 
-	for label, value := range container.Config.Labels {
-		if label == resolver.hostLabel {
-			domains = append(domains, value)
-			break
+	for _, label := range resolver.hostLabels {
+		value, ok := container.Config.Labels[label]
+		if !ok {
+			continue
+		}
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			domain, err := expandLabelTemplate(name, container)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			domains = append(domains, domain)
 		}
 	}
 
-	return domains, nil
+	return domains, firstErr
+}
+
+// labelPlaceholderRegexp matches the placeholders of the label templates, e.g. {name}
+var labelPlaceholderRegexp = regexp.MustCompile(`\{[a-z]+\}`)
+
+// expandLabelTemplate expands the placeholders of a label value from the container metadata, so a generic
+// compose template can define the naming, e.g. {service}.{project}.loc. The compose placeholders of a container
+// not managed by compose are an error.
+func expandLabelTemplate(value string, container *dockerapi.Container) (string, error) {
+	labels := container.Config.Labels
+	placeholders := map[string]string{
+		"{name}":     normalizeContainerName(container),
+		"{hostname}": container.Config.Hostname,
+		"{id}":       container.ID[:12],
+		"{project}":  labels["com.docker.compose.project"],
+		"{service}":  labels["com.docker.compose.service"],
+		"{number}":   labels["com.docker.compose.container-number"],
+	}
+	var err error
+	domain := labelPlaceholderRegexp.ReplaceAllStringFunc(value, func(placeholder string) string {
+		expanded, ok := placeholders[placeholder]
+		if !ok || expanded == "" {
+			err = fmt.Errorf("cannot expand %s in the label value %q of container %s", placeholder, value, container.ID[:12])
+		}
+		return expanded
+	})
+	return domain, err
 }
 
 // ComposeResolver sets names based on compose labels
@@ -71,23 +137,180 @@ func (resolver ComposeResolver) resolve(container *dockerapi.Container) ([]strin
 	return domains, nil
 }
 
+// NetworkAliasesResolver sets names based on the aliases of the container in a docker network (all of them when
+// empty), under the domain suffix when set, e.g. the alias web becomes web.docker.local
 type NetworkAliasesResolver struct {
 	network string
+	domain  string
 }
 
 func (resolver NetworkAliasesResolver) resolve(container *dockerapi.Container) ([]string, error) {
-	var domains []string
+	var aliases []string
 
 	if resolver.network != "" {
 		network, ok := container.NetworkSettings.Networks[resolver.network]
 		if ok {
-			domains = append(domains, network.Aliases...)
+			aliases = append(aliases, network.Aliases...)
 		}
 	} else {
 		for _, network := range container.NetworkSettings.Networks {
-			domains = append(domains, network.Aliases...)
+			aliases = append(aliases, network.Aliases...)
 		}
 	}
 
+	if resolver.domain == "" {
+		return aliases, nil
+	}
+	domains := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		domains = append(domains, fmt.Sprintf("%s.%s", alias, resolver.domain))
+	}
 	return domains, nil
 }
+
+// RegistratorResolver sets names from the Gliderlabs Registrator SERVICE_* environment variables
+type RegistratorResolver struct {
+	domain string
+}
+
+func (resolver RegistratorResolver) resolve(container *dockerapi.Container) ([]string, error) {
+	var domains []string
+
+	env := make(map[string]string)
+	for _, variable := range container.Config.Env {
+		if kv := strings.SplitN(variable, "=", 2); len(kv) == 2 && strings.HasPrefix(kv[0], "SERVICE_") {
+			env[kv[0]] = kv[1]
+		}
+	}
+	if env["SERVICE_IGNORE"] != "" {
+		return domains, nil
+	}
+
+	// SERVICE_NAME applies to all the ports, SERVICE_<port>_NAME to a single one
+	var names []string
+	for key, value := range env {
+		if value == "" {
+			continue
+		}
+		if key == "SERVICE_NAME" || (strings.HasSuffix(key, "_NAME") && strings.Count(key, "_") == 2) {
+			names = append(names, value)
+		}
+	}
+	sort.Strings(names)
+
+	var tags []string
+	for _, tag := range strings.Split(env["SERVICE_TAGS"], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		domains = append(domains, fmt.Sprintf("%s.%s", name, resolver.domain))
+		for _, tag := range tags {
+			domains = append(domains, fmt.Sprintf("%s.%s.%s", tag, name, resolver.domain))
+		}
+	}
+
+	return domains, nil
+}
+
+// registratorPort returns the port of the SERVICE_PORT variable of the container when the registrator resolver is
+// enabled, answered in its SRV records instead of the lowest exposed TCP port. Empty otherwise.
+func (dd *DockerDiscovery) registratorPort(container *dockerapi.Container) string {
+	enabled := false
+	for _, resolver := range dd.currentResolvers() {
+		if _, ok := resolver.(*RegistratorResolver); ok {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return ""
+	}
+	for _, variable := range container.Config.Env {
+		value := strings.TrimPrefix(variable, "SERVICE_PORT=")
+		if value == variable {
+			continue
+		}
+		if port, err := strconv.ParseUint(value, 10, 16); err != nil || port == 0 {
+			log.Printf("[docker] Ignoring the invalid SERVICE_PORT %q of container %s", value, container.ID[:12])
+			return ""
+		}
+		return value
+	}
+	return ""
+}
+
+// resolverNames are the names of the resolvers in the resolvers directive
+var resolverNames = []string{"label", "name", "hostname", "compose", "alias", "registrator", "template"}
+
+func isResolverName(name string) bool {
+	for _, resolverName := range resolverNames {
+		if name == resolverName {
+			return true
+		}
+	}
+	return false
+}
+
+func resolverName(resolver ContainerDomainResolver) string {
+	switch resolver.(type) {
+	case *LabelResolver:
+		return "label"
+	case *SubDomainContainerNameResolver:
+		return "name"
+	case *SubDomainHostResolver:
+		return "hostname"
+	case *ComposeResolver:
+		return "compose"
+	case *NetworkAliasesResolver:
+		return "alias"
+	case *RegistratorResolver:
+		return "registrator"
+	case *TemplateResolver:
+		return "template"
+	}
+	return ""
+}
+
+// defaultResolver returns the resolver enabled by the resolvers directive without its own directive, nil for the
+// template resolver which has no default template
+func defaultResolver(name string) ContainerDomainResolver {
+	switch name {
+	case "name":
+		return &SubDomainContainerNameResolver{domain: defaultDockerDomain}
+	case "hostname":
+		return &SubDomainHostResolver{domain: defaultDockerDomain}
+	case "compose":
+		return &ComposeResolver{domain: defaultDockerDomain}
+	case "alias":
+		return &NetworkAliasesResolver{}
+	case "registrator":
+		return &RegistratorResolver{domain: defaultDockerDomain}
+	}
+	return nil
+}
+
+// orderResolvers keeps only the resolvers named in order, sorted by it. Resolvers of the same name keep their
+// configuration order. The order is the precedence of the domains of a container.
+func orderResolvers(resolvers []ContainerDomainResolver, order []string) []ContainerDomainResolver {
+	var ordered []ContainerDomainResolver
+	for _, name := range order {
+		found := false
+		for _, resolver := range resolvers {
+			if resolverName(resolver) == name {
+				ordered = append(ordered, resolver)
+				found = true
+			}
+		}
+		if resolver := defaultResolver(name); !found && resolver != nil {
+			ordered = append(ordered, resolver)
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,81 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// restartPolicies are the restart policies of the restart_policy directive
+var restartPolicies = []string{"always", "unless-stopped", "on-failure", "no"}
+
+func isRestartPolicy(name string) bool {
+	for _, policy := range restartPolicies {
+		if name == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// restartPolicy is how the containers of a restart policy are answered, set by the restart_policy directive: the
+// stable ones (always) with a long TTL right away, the ephemeral ones (on-failure, no) with a short TTL once they
+// ran for a grace period, so the containers crashing right after their start are never answered.
+type restartPolicy struct {
+	ttl   uint32        // TTL of the answers and etcd record
+	grace time.Duration // how long the containers run before they are registered, 0 for right away
+}
+
+// restartPolicyName returns the restart policy of the container, "no" when it has none
+func restartPolicyName(container *dockerapi.Container) string {
+	if container.HostConfig == nil || container.HostConfig.RestartPolicy.Name == "" {
+		return "no"
+	}
+	return container.HostConfig.RestartPolicy.Name
+}
+
+// graceRemaining returns how long the running container still has to run before it's registered, by the grace
+// period of its restart policy, 0 when it can be
+func (dd *DockerDiscovery) graceRemaining(container *dockerapi.Container) time.Duration {
+	policy, ok := dd.restartPolicies[restartPolicyName(container)]
+	if !ok || policy.grace == 0 || !container.State.Running {
+		return 0
+	}
+	if remaining := policy.grace - time.Since(container.State.StartedAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// registerAfterGrace inspects the container again once its grace period is over, and registers it if it still
+// runs. A container restarted meanwhile waits for another grace period.
+func (dd *DockerDiscovery) registerAfterGrace(containerID string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		if dd.ctx.Err() != nil {
+			return
+		}
+		container, err := dd.inspectContainerRetry(dd.ctx, containerID)
+		if err != nil {
+			if !containerGone(err) {
+				log.Printf("[docker] Error inspecting container %s after its grace period: %s", containerID[:12], err)
+			}
+			return
+		}
+		if !container.State.Running {
+			return
+		}
+		if err := dd.updateContainerInfo(container); err != nil {
+			log.Printf("[docker] Error adding A record for container %s: %s", containerID[:12], err)
+			countError(err)
+		}
+	})
+}
+
+// registered reports whether the container has records
+func (dd *DockerDiscovery) registered(containerID string) bool {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	_, ok := dd.containerInfoMap[containerID]
+	return ok
+}
@@ -0,0 +1,139 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resyncDiff counts the records changed by a resync with docker
+type resyncDiff struct {
+	added, removed, changed int
+}
+
+// recordSet returns the addresses registered by domain, comparable before and after a resync
+func (dd *DockerDiscovery) recordSet() map[string]string {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	addresses := make(map[string][]string)
+	for _, containerInfo := range dd.containerInfoMap {
+		for _, domain := range containerInfo.domains {
+			domain = strings.ToLower(domain)
+			for _, address := range containerInfo.addresses() {
+				addresses[domain] = append(addresses[domain], address.String())
+			}
+		}
+	}
+	records := make(map[string]string, len(addresses))
+	for domain, ips := range addresses {
+		sort.Strings(ips)
+		records[domain] = strings.Join(ips, ",")
+	}
+	return records
+}
+
+// diffRecords compares the record sets before and after a resync
+func diffRecords(before, after map[string]string) resyncDiff {
+	var diff resyncDiff
+	for domain, addresses := range after {
+		if previous, ok := before[domain]; !ok {
+			diff.added++
+		} else if previous != addresses {
+			diff.changed++
+		}
+	}
+	for domain := range before {
+		if _, ok := after[domain]; !ok {
+			diff.removed++
+		}
+	}
+	return diff
+}
+
+// reportResync logs and exports the records changed by a resync, which are the docker events missed (e.g. while
+// disconnected). The initial sync is not reported, every record is new then.
+func (dd *DockerDiscovery) reportResync(before map[string]string) {
+	diff := diffRecords(before, dd.recordSet())
+	log.Printf("[docker] Resync: %d records added, %d removed, %d changed", diff.added, diff.removed, diff.changed)
+	resyncRecordCount.WithLabelValues("added").Add(float64(diff.added))
+	resyncRecordCount.WithLabelValues("removed").Add(float64(diff.removed))
+	resyncRecordCount.WithLabelValues("changed").Add(float64(diff.changed))
+}
+
+// isSynced reports whether the initial sync is done (or the containers were taken over from a reload)
+func (dd *DockerDiscovery) isSynced() bool {
+	select {
+	case <-dd.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// resync lists and inspects all the running containers, registering the ones whose events were missed and removing
+// the ones gone, then reports the records changed when it's not the initial sync.
+func (dd *DockerDiscovery) resync(ctx context.Context) error {
+	if dd.isSynced() && dd.injectedFaults().serveStale {
+		log.Println("[docker] Fault injection: skipping the resync")
+		return nil
+	}
+	var before map[string]string
+	if dd.isSynced() {
+		before = dd.recordSet()
+	}
+	containers, err := dd.listContainers(ctx)
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]bool, len(containers))
+	for _, apiContainer := range containers {
+		container, err := dd.inspectContainerRetry(ctx, apiContainer.ID)
+		if err != nil {
+			if !containerGone(err) {
+				running[apiContainer.ID] = true // the records are kept
+			}
+			log.Printf("[docker] Error inspecting container %s: %s", apiContainer.ID[:12], err)
+			continue
+		}
+		running[apiContainer.ID] = true
+		if err := dd.updateContainerInfo(container); err != nil {
+			log.Printf("[docker] Error adding A record for container %s: %s\n", container.ID[:12], err)
+			countError(err)
+		}
+	}
+	dd.reconcile(running)
+	if before != nil {
+		dd.reportResync(before)
+	}
+	dd.mu.Lock()
+	dd.markSyncDone()
+	dd.mu.Unlock()
+	return nil
+}
+
+// resyncPeriodically resyncs with docker every resync_interval while connected, until the final shutdown, and has
+// the backends compare their records with what they really hold, e.g. the etcd keys deleted by hand.
+func (dd *DockerDiscovery) resyncPeriodically() {
+	ticker := time.NewTicker(dd.resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dd.ctx.Done():
+			return
+		}
+		if !dd.isSynced() || !dd.Connection().Connected {
+			continue // resynced on connection
+		}
+		if err := dd.resync(dd.ctx); err != nil {
+			log.Printf("[docker] Error resyncing the containers: %s", err)
+			continue
+		}
+		dd.reloadBackends()
+		dd.writePrometheusTargets()
+	}
+}
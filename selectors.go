@@ -0,0 +1,208 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// AddressSelector picks the addresses answered for a container. The selectors are chained in the order of the
+// address_selectors directive: the first one returning an address, or an error, decides.
+type AddressSelector interface {
+	// selectAddress returns the IPv4 and IPv6 addresses of the container, both nil to leave the choice to the
+	// next selector. It's called without the lock.
+	selectAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP, error)
+}
+
+// defaultAddressSelectors is the chain without address_selectors directive
+var defaultAddressSelectors = []AddressSelector{&LabelNetworkSelector{}, &PreferredNetworksSelector{}, &HostModeSelector{}, &FallbackBridgeSelector{}}
+
+// LabelNetworkSelector picks the address in the network of the coredns.dockerdiscovery.network label
+type LabelNetworkSelector struct{}
+
+func (selector *LabelNetworkSelector) selectAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP, error) {
+	netName, ok := container.Config.Labels["coredns.dockerdiscovery.network"]
+	if !ok {
+		return nil, nil, nil
+	}
+	log.Printf("[docker] network name %s specified (%s)", netName, container.ID[:12])
+	network, ok := container.NetworkSettings.Networks[netName]
+	if !ok { // sometime while "network:disconnect" event fire
+		return nil, nil, fmt.Errorf("%w for the network %s", ErrNoNetwork, netName)
+	}
+	// ParseIP return nil when IPAddress equals "", e.g. in IPv6-only networks
+	address, address6 := net.ParseIP(network.IPAddress), dd.containerAddress6(container, network.GlobalIPv6Address)
+	if address == nil && address6 == nil {
+		// the label decides, the other networks are not answered
+		return nil, nil, fmt.Errorf("%w in the network %s", ErrNoAddress, netName)
+	}
+	return address, address6, nil
+}
+
+// PreferredNetworksSelector picks the address in the first network of the ipv4_networks directive the container is
+// connected to
+type PreferredNetworksSelector struct{}
+
+func (selector *PreferredNetworksSelector) selectAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP, error) {
+	for _, name := range dd.ipv4Networks {
+		if network, ok := container.NetworkSettings.Networks[name]; ok && network.IPAddress != "" {
+			return net.ParseIP(network.IPAddress), dd.containerAddress6(container, network.GlobalIPv6Address), nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// PublishedPortSelector picks the host address a port of the container is published on, for the containers only
+// reachable through their published ports (e.g. `-p 192.168.1.10:80:80`). The ports published on all the host
+// addresses are skipped, as they don't tell which one to answer.
+type PublishedPortSelector struct{}
+
+func (selector *PublishedPortSelector) selectAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP, error) {
+	var ports []string
+	for port := range container.NetworkSettings.Ports {
+		ports = append(ports, string(port))
+	}
+	sort.Strings(ports)
+
+	var address, address6 net.IP
+	for _, port := range ports {
+		for _, binding := range container.NetworkSettings.Ports[dockerapi.Port(port)] {
+			ip := net.ParseIP(binding.HostIP)
+			switch {
+			case ip == nil || ip.IsUnspecified():
+			case ip.To4() != nil && address == nil:
+				address = ip
+			case ip.To4() == nil && address6 == nil:
+				address6 = ip
+			}
+		}
+	}
+	return address, address6, nil
+}
+
+// HostModeSelector picks the address of the docker host for the containers of the host network (--net=host): the
+// addresses of the host_ip directive, otherwise the gateway of the default bridge, an address of the host every
+// container can reach. With podman, the rootless containers (slirp4netns or pasta) are reached on the host too,
+// through their published ports: the address of the host is detected without host_ip, the bridge being private.
+type HostModeSelector struct{}
+
+func (selector *HostModeSelector) selectAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP, error) {
+	rootless := dd.isPodman() && podmanRootlessModes[container.HostConfig.NetworkMode]
+	if container.HostConfig.NetworkMode != "host" && !rootless {
+		return nil, nil, nil
+	}
+	if len(dd.hostIPs) > 0 {
+		var address, address6 net.IP
+		for _, ip := range dd.hostIPs {
+			if ip.To4() != nil {
+				address = ip
+			} else {
+				address6 = ip
+			}
+		}
+		return address, address6, nil
+	}
+	if rootless {
+		address, err := detectHostIP()
+		return address, nil, err
+	}
+	bridge := dd.bridgeNetwork()
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	var address, address6 net.IP
+	for _, networkInfo := range dd.networkInfoMap {
+		if networkInfo.name != bridge {
+			continue
+		}
+		for _, gateway := range networkInfo.gateways {
+			if gateway.To4() != nil && address == nil {
+				address = gateway
+			} else if gateway.To4() == nil && address6 == nil {
+				address6 = gateway
+			}
+		}
+	}
+	return address, address6, nil
+}
+
+// detectHostIP returns the address of the interface of the default route, the one the host reaches other hosts
+// from. Dialing UDP sends no packet, it only selects the source address.
+func detectHostIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "192.0.2.1:53") // TEST-NET-1, never reached
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// FallbackBridgeSelector picks the address in the default bridge, or in the network of the network mode of the
+// container. With bridge_precedence user, the user-defined networks come before the default bridge. With podman,
+// the bridge network mode stands for the default network or the user-defined ones.
+type FallbackBridgeSelector struct{}
+
+func (selector *FallbackBridgeSelector) selectAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP, error) {
+	if dd.userNetworksFirst {
+		if address, address6 := userNetworkAddress(dd, container); address != nil || address6 != nil {
+			return address, address6, nil
+		}
+	}
+	if container.NetworkSettings.IPAddress != "" {
+		return net.ParseIP(container.NetworkSettings.IPAddress), dd.containerAddress6(container, container.NetworkSettings.GlobalIPv6Address), nil
+	}
+	networkMode := container.HostConfig.NetworkMode
+	network, ok := container.NetworkSettings.Networks[networkMode]
+	if !ok && dd.isPodman() && networkMode == "bridge" {
+		network, ok = podmanNetwork(container)
+	}
+	if !ok { // sometime while "network:disconnect" event fire
+		return nil, nil, fmt.Errorf("%w for the network %s", ErrNoNetwork, networkMode)
+	}
+	// ParseIP return nil when IPAddress equals "", e.g. in IPv6-only networks
+	return net.ParseIP(network.IPAddress), dd.containerAddress6(container, network.GlobalIPv6Address), nil
+}
+
+// builtinNetworks are the networks created by docker, the others are user-defined
+var builtinNetworks = map[string]bool{"bridge": true, "host": true, "none": true}
+
+// userNetworkAddress returns the addresses of the container in the user-defined network of its network mode,
+// otherwise in the first user-defined network by name it has an address in, nil if none.
+func userNetworkAddress(dd *DockerDiscovery, container *dockerapi.Container) (net.IP, net.IP) {
+	names := []string{container.HostConfig.NetworkMode}
+	var others []string
+	for name := range container.NetworkSettings.Networks {
+		others = append(others, name)
+	}
+	sort.Strings(others)
+	for _, name := range append(names, others...) {
+		network, ok := container.NetworkSettings.Networks[name]
+		if !ok || builtinNetworks[name] || name == dd.bridgeNetwork() {
+			continue
+		}
+		address, address6 := net.ParseIP(network.IPAddress), dd.containerAddress6(container, network.GlobalIPv6Address)
+		if address != nil || address6 != nil {
+			return address, address6
+		}
+	}
+	return nil, nil
+}
+
+// addressSelectorByName returns the address selector of the address_selectors directive
+func addressSelectorByName(name string) AddressSelector {
+	switch name {
+	case "label-network":
+		return &LabelNetworkSelector{}
+	case "preferred-networks":
+		return &PreferredNetworksSelector{}
+	case "published-port-host-ip":
+		return &PublishedPortSelector{}
+	case "host-mode":
+		return &HostModeSelector{}
+	case "fallback-bridge":
+		return &FallbackBridgeSelector{}
+	}
+	return nil
+}
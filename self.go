@@ -0,0 +1,54 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// cgroupContainerIDRegexp matches the container ID in the cgroup paths of cgroup v1, e.g. /docker/<ID> or
+// /system.slice/docker-<ID>.scope
+var cgroupContainerIDRegexp = regexp.MustCompile(`[/-]([0-9a-f]{64})(\.scope)?$`)
+
+// mountContainerIDRegexp matches the container ID in the mounts of the files docker writes for the container (e.g.
+// /etc/hostname), the only place it's found with cgroup v2 and a private cgroup namespace
+var mountContainerIDRegexp = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+// containerIDFromProc returns the ID of the container found in the /proc/self/cgroup or /proc/self/mountinfo data,
+// empty if none
+func containerIDFromProc(cgroup, mountinfo string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		if match := cgroupContainerIDRegexp.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			return match[1]
+		}
+	}
+	if match := mountContainerIDRegexp.FindStringSubmatch(mountinfo); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// detectSelf looks for the container CoreDNS runs in: its ID from /proc, otherwise the hostname, which docker sets
+// to the short container ID unless the container is given one
+func (dd *DockerDiscovery) detectSelf() {
+	cgroup, _ := os.ReadFile("/proc/self/cgroup")
+	mountinfo, _ := os.ReadFile("/proc/self/mountinfo")
+	dd.selfID = containerIDFromProc(string(cgroup), string(mountinfo))
+	if dd.selfID != "" {
+		log.Printf("[docker] Running in container %s", dd.selfID[:12])
+		return
+	}
+	dd.selfHostname, _ = os.Hostname()
+}
+
+// isSelf reports whether the container is the one CoreDNS runs in
+func (dd *DockerDiscovery) isSelf(container *dockerapi.Container) bool {
+	if dd.selfID != "" {
+		return container.ID == dd.selfID
+	}
+	return len(dd.selfHostname) == 12 && strings.HasPrefix(container.ID, dd.selfHostname) &&
+		container.Config.Hostname == dd.selfHostname
+}
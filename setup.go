@@ -1,16 +1,28 @@
 package dockerdiscovery
 
 import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blinkinglight/coredns-dockerdiscovery/backends"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/tls"
 
-	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
 
 	"github.com/coredns/caddy"
 )
 
 const defaultDockerEndpoint = "unix:///var/run/docker.sock"
 const defaultDockerDomain = "docker.local"
+const defaultSyncTimeout = 5 * time.Second
 
 func init() {
 	caddy.RegisterPlugin("docker", caddy.Plugin{
@@ -19,95 +31,1229 @@ func init() {
 	})
 }
 
+// createPlugin creates the plugin instance of the first docker directive of the controller
+func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
+	if !c.Next() {
+		return nil, c.ArgErr()
+	}
+	return parseDocker(c)
+}
+
+// createPlugins creates a plugin instance for every docker directive of the server block, each with its own
+// endpoint and event loop
+func createPlugins(c *caddy.Controller) ([]*DockerDiscovery, error) {
+	var plugins []*DockerDiscovery
+	for c.Next() {
+		dd, err := parseDocker(c)
+		if err != nil {
+			// caddy only shuts the returned instances down, the ones started stop here
+			for _, started := range append(plugins, dd) {
+				if started != nil {
+					started.close(false)
+					started.releaseDocker()
+				}
+			}
+			return nil, err
+		}
+		plugins = append(plugins, dd)
+	}
+	for _, dd := range plugins {
+		dd.peers = plugins
+	}
+	return plugins, nil
+}
+
 // TODO(kevinjqiu): add docker endpoint verification
-func createPlugin(c *caddy.Controller) (DockerDiscovery, error) {
+// parseDocker creates the plugin instance of the docker directive the controller is on, and starts it
+func parseDocker(c *caddy.Controller) (*DockerDiscovery, error) {
 	dd := NewDockerDiscovery(defaultDockerEndpoint)
-	labelResolver := &LabelResolver{hostLabel: "coredns.dockerdiscovery.host"}
-	dd.resolvers = append(dd.resolvers, labelResolver)
+	dd.zones = plugin.OriginsFromArgsOrServerBlock(nil, c.ServerBlockKeys)
+	p := &dockerParser{c: c, dd: dd, labelResolver: &LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}}}
+	dd.resolvers = append(dd.resolvers, p.labelResolver)
 
-	for c.Next() {
+	args := c.RemainingArgs()
+	if len(args) == 1 {
+		dd.dockerEndpoint = args[0]
+	}
+
+	if len(args) > 1 {
+		return dd, c.ArgErr()
+	}
+
+	for c.NextBlock() {
+		if err := p.parseProperty(c.Val()); err != nil {
+			return dd, err
+		}
+	}
+	if err := p.checkResolvers(); err != nil {
+		return dd, err
+	}
+	if err := p.checkLifecycle(len(args) == 1); err != nil {
+		return dd, err
+	}
+	if err := p.checkBackends(); err != nil {
+		return dd, err
+	}
+	for _, args := range p.composeFiles {
+		var placeholder net.IP
+		if len(args) == 2 {
+			placeholder = net.ParseIP(args[1])
+		}
+		if err := dd.loadComposeFile(args[0], placeholder); err != nil {
+			return dd, c.Errf("invalid compose_file '%s': %s", args[0], err)
+		}
+	}
+	if err := dd.enableFaultInjection(); err != nil {
+		return dd, c.Err(err.Error())
+	}
+	if dd.overridesFile != "" {
+		if err := dd.loadOverrides(); err != nil {
+			return dd, c.Errf("invalid overrides_file '%s': %s", dd.overridesFile, err)
+		}
+	}
+	if err := dd.acquireDocker(); err != nil {
+		return dd, err
+	}
+	if !dd.takeOver(handoverKey(c.ServerBlockKeys, dd.dockerEndpoint)) && dd.eventCursorFile != "" {
+		if err := dd.loadEventCursor(); err != nil {
+			return dd, c.Errf("invalid event_cursor_file '%s': %s", dd.eventCursorFile, err)
+		}
+	}
+	dd.spawn("watch", func() { dd.start() })
+	return dd, nil
+}
+
+// dockerParser is the state of the parsing of a docker block
+type dockerParser struct {
+	c              *caddy.Controller
+	dd             *DockerDiscovery
+	labelResolver  *LabelResolver
+	resolverOrder  []string
+	composeFiles   [][]string        // arguments of the compose_file directives, loaded once the resolvers are configured
+	recordBackends []func()          // creations of the record backends, once the ttl and the endpoint are known
+	files          map[string]string // directives writing the files, by path
+}
+
+// parseProperty parses a directive of the docker block with the parser of its subsystem
+func (p *dockerParser) parseProperty(property string) error {
+	parsers := []func(string) (bool, error){
+		p.parseResolverProperty, p.parseBackendProperty, p.parseAnswerProperty, p.parseLifecycleProperty,
+	}
+	for _, parse := range parsers {
+		if ok, err := parse(property); ok || err != nil {
+			return err
+		}
+	}
+	return p.c.Errf("unknown property: '%s'", property)
+}
+
+// parseResolverProperty parses the directives naming the containers: the resolvers, their order and the
+// normalization of the names. It reports whether the property is one of them.
+func (p *dockerParser) parseResolverProperty(property string) (bool, error) {
+	c, dd := p.c, p.dd
+	switch property {
+	case "domain":
+		var resolver = &SubDomainContainerNameResolver{
+			domain: defaultDockerDomain,
+		}
+		dd.resolvers = append(dd.resolvers, resolver)
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		resolver.domain = c.Val()
+	case "hostname_domain":
+		var resolver = &SubDomainHostResolver{
+			domain: defaultDockerDomain,
+		}
+		dd.resolvers = append(dd.resolvers, resolver)
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		resolver.domain = c.Val()
+	case "compose_domain":
+		var resolver = &ComposeResolver{
+			domain: defaultDockerDomain,
+		}
+		dd.resolvers = append(dd.resolvers, resolver)
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		resolver.domain = c.Val()
+	case "registrator_domain":
+		var resolver = &RegistratorResolver{
+			domain: defaultDockerDomain,
+		}
+		dd.resolvers = append(dd.resolvers, resolver)
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		resolver.domain = c.Val()
+	case "domain_template":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		resolver, err := newTemplateResolver(c.Val())
+		if err != nil {
+			return true, c.Errf("invalid domain_template: %s", err)
+		}
+		dd.resolvers = append(dd.resolvers, resolver)
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "network_aliases":
+		var resolver = &NetworkAliasesResolver{
+			network: "",
+		}
+		dd.resolvers = append(dd.resolvers, resolver)
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if resolver.network = c.Val(); resolver.network == "*" {
+			resolver.network = ""
+		}
+		if c.NextArg() {
+			resolver.domain = c.Val()
+		}
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "label":
 		args := c.RemainingArgs()
-		if len(args) == 1 {
-			dd.dockerEndpoint = args[0]
+		if len(args) == 0 {
+			return true, c.ArgErr()
+		}
+		p.labelResolver.hostLabels = args
+	case "compose_file":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return true, c.ArgErr()
+		}
+		if len(args) == 2 && net.ParseIP(args[1]) == nil {
+			return true, c.Errf("invalid compose_file address: '%s'", args[1])
+		}
+		p.composeFiles = append(p.composeFiles, args)
+	case "host_suffix":
+		args := c.RemainingArgs()
+		switch {
+		case len(args) > 1:
+			return true, c.ArgErr()
+		case len(args) == 0:
+			dd.hostSuffixFromInfo = true
+		case strings.Contains(args[0], ".") || !validDomain(args[0], true):
+			return true, c.Errf("invalid host_suffix label: '%s'", args[0])
+		default:
+			dd.hostSuffix = strings.ToLower(args[0])
+		}
+	case "host_suffix_merge":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.hostSuffixMerge = true
+	case "strict_names":
+		dd.strictNames = true
+		if c.NextArg() {
+			strict, err := strconv.ParseBool(c.Val())
+			if err != nil {
+				return true, c.Errf("invalid strict_names value: '%s'", c.Val())
+			}
+			dd.strictNames = strict
+		}
+	case "name_slashes":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		switch c.Val() {
+		case "leading":
+			dd.names.allSlashes = false
+		case "all":
+			dd.names.allSlashes = true
+		default:
+			return true, c.Errf("invalid name_slashes value: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "name_map":
+		args := c.RemainingArgs()
+		if len(args) != 2 || args[0] == "" {
+			return true, c.ArgErr()
+		}
+		dd.names.addMapping(args[0], args[1])
+	case "name_max_length":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		length, err := strconv.Atoi(c.Val())
+		if err != nil || length < 1 || length > 253 {
+			return true, c.Errf("invalid name_max_length: '%s'", c.Val())
+		}
+		dd.names.maxLength = length
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "resolvers":
+		p.resolverOrder = c.RemainingArgs()
+		if len(p.resolverOrder) == 0 {
+			return true, c.ArgErr()
+		}
+		seen := make(map[string]bool)
+		for _, name := range p.resolverOrder {
+			if !isResolverName(name) || seen[name] {
+				return true, c.Errf("unknown or repeated resolver: '%s'", name)
+			}
+			seen[name] = true
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseBackendProperty parses the directives publishing the records and the state of the discovery: etcd,
+// the record backends and the admin, status and debug listeners. It reports whether the property is one of them.
+func (p *dockerParser) parseBackendProperty(property string) (bool, error) {
+	c, dd := p.c, p.dd
+	switch property {
+	case "endpoint", "etcd_discovery", "etcd_tls", "etcd_credentials", "etcd_fallback", "etcd_prefix", "etcd_lease", "etcd_zone", "etcd_purge", "etcd_owner":
+		if err := parseEtcdProperty(c, dd, strings.TrimPrefix(property, "etcd_")); err != nil {
+			return true, err
+		}
+	case "etcd":
+		if endpoints := c.RemainingArgs(); len(endpoints) > 0 {
+			dd.endpoints = endpoints
+		}
+		if err := parseEtcdBlock(c, dd); err != nil {
+			return true, err
+		}
+	case "prometheus_sd":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if err := p.writesFile(property, c.Val()); err != nil {
+			return true, err
+		}
+		dd.prometheusSDFile = c.Val()
+	case "zone_file":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		backend, file := &recordBackend{dd: dd}, c.Val()
+		if err := p.writesFile(property, file); err != nil {
+			return true, err
+		}
+		dd.addBackend(backend)
+		p.recordBackends = append(p.recordBackends, func() { backend.backend = backends.NewZoneFile(file, dd.ttl) })
+	case "webhook":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.addBackend(&recordBackend{dd: dd, backend: backends.NewWebhook(c.Val(), &http.Client{Timeout: backendTimeout})})
+	case "hosts_file":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		for _, file := range args {
+			if err := p.writesFile(property, file); err != nil {
+				return true, err
+			}
+		}
+		backend := &recordBackend{dd: dd}
+		dd.addBackend(backend)
+		p.recordBackends = append(p.recordBackends, func() {
+			var snippet *backends.Snippet
+			if len(args) == 2 {
+				snippet = &backends.Snippet{Path: args[1], Zones: dd.zones, Source: dd.dockerEndpoint, TTL: dd.ttl}
+			}
+			backend.backend = backends.NewHostsFile(args[0], snippet)
+		})
+	case "consul":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return true, c.Errf("invalid consul URL: '%s'", args[0])
+		}
+		prefix := consulDefaultPrefix
+		if len(args) == 2 {
+			if prefix = strings.Trim(args[1], "/"); prefix == "" {
+				return true, c.Errf("invalid consul prefix: '%s'", args[1])
+			}
+		}
+		dd.addBackend(newConsulBackend(args[0], prefix))
+	case "redis":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(args[0]); err != nil {
+			return true, c.Errf("invalid redis address: '%s'", args[0])
+		}
+		password := ""
+		if len(args) == 2 {
+			password = args[1]
+		}
+		dd.addBackend(newRedisBackend(dd, args[0], password))
+	case "admin":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.adminAddress = c.Val()
+	case "status":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.statusAddress = c.Val()
+	case "debug_listen":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.debugAddress = c.Val()
+	case "overrides_file":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if err := p.writesFile(property, c.Val()); err != nil {
+			return true, err
+		}
+		dd.overridesFile = c.Val()
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseAnswerProperty parses the directives shaping the DNS answers: the addresses answered, the TTLs, the
+// static records and the zone records. It reports whether the property is one of them.
+func (p *dockerParser) parseAnswerProperty(property string) (bool, error) {
+	c, dd := p.c, p.dd
+	switch property {
+	case "dns64":
+		prefix := defaultDNS64Prefix
+		if c.NextArg() {
+			prefix = c.Val()
+		}
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil || !validDNS64Prefix(ipNet) {
+			return true, c.Errf("invalid dns64 prefix: '%s'", prefix)
+		}
+		dd.dns64Prefix = ipNet
+	case "ports_zone":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if _, ok := dns.IsDomainName(c.Val()); !ok {
+			return true, c.Errf("invalid ports_zone: '%s'", c.Val())
+		}
+		dd.portsZone = dns.Fqdn(strings.ToLower(c.Val()))
+	case "host_facts":
+		facts := c.RemainingArgs()
+		if len(facts) == 0 {
+			facts = hostFactNames
+		}
+		for _, fact := range facts {
+			if !isHostFact(fact) {
+				return true, c.Errf("unknown host fact: '%s'", fact)
+			}
+		}
+		dd.hostFacts = facts
+	case "txt_metadata":
+		patterns := c.RemainingArgs()
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return true, c.Errf("invalid txt_metadata pattern: '%s'", pattern)
+			}
+		}
+		dd.txtMetadata = true
+		dd.metadataLabels = append(dd.metadataLabels, patterns...)
+	case "round_robin":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.roundRobin = true
+	case "wildcards":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.wildcards = true
+	case "dns_sd":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.dnsSD = true
+	case "only_ipv4", "only_ipv6":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		family := 4
+		if c.Val() == "only_ipv6" {
+			family = 6
+		}
+		if dd.addressFamily != 0 && dd.addressFamily != family {
+			return true, c.Err("only_ipv4 and only_ipv6 are exclusive")
+		}
+		dd.addressFamily = family
+	case "query_budget":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		budget, err := time.ParseDuration(c.Val())
+		if err != nil || budget < queryBudgetMin {
+			return true, c.Errf("invalid query_budget: '%s'", c.Val())
+		}
+		dd.queryBudget = budget
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "ttl":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+		if err != nil {
+			return true, c.Errf("invalid ttl: '%s'", c.Val())
+		}
+		dd.ttl = uint32(ttl)
+	case "ttl_jitter":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(c.Val(), "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return true, c.Errf("invalid ttl_jitter percent: '%s'", c.Val())
+		}
+		dd.ttlJitter = percent
+	case "ttl_ramp":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		ramp, err := time.ParseDuration(args[0])
+		if err != nil || ramp <= 0 {
+			return true, c.Errf("invalid ttl_ramp duration: '%s'", args[0])
+		}
+		dd.ttlRamp = ramp
+		dd.ttlRampMin = defaultTTLRampMin
+		if len(args) == 2 {
+			ttl, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				return true, c.Errf("invalid ttl_ramp ttl: '%s'", args[1])
+			}
+			dd.ttlRampMin = uint32(ttl)
+		}
+	case "record":
+		args := c.RemainingArgs()
+		if len(args) < 3 {
+			return true, c.ArgErr()
+		}
+		for i, arg := range args {
+			if strings.ContainsAny(arg, " \t") {
+				args[i] = strconv.Quote(arg) // quoted strings of the rdata, e.g. of a TXT record
+			}
+		}
+		rr, err := dns.NewRR(strings.Join(args, " "))
+		if err != nil {
+			return true, c.Errf("invalid record '%s': %s", strings.Join(args, " "), err)
+		}
+		if rr.Header().Name == "." || !dns.IsFqdn(args[0]) {
+			return true, c.Errf("record name must be fully qualified: '%s'", args[0])
+		}
+		dd.staticRecords = append(dd.staticRecords, rr)
+	case "alias":
+		args := c.RemainingArgs()
+		if len(args) < 3 || args[len(args)-2] != "=>" {
+			return true, c.ArgErr()
+		}
+		target := dns.Fqdn(strings.ToLower(args[len(args)-1]))
+		for _, name := range append(args[:len(args)-2], target) {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return true, c.Errf("invalid alias name: '%s'", name)
+			}
+		}
+		for _, name := range args[:len(args)-2] {
+			dd.aliases[dns.Fqdn(strings.ToLower(name))] = target
+		}
+	case "network":
+		args := c.RemainingArgs()
+		if len(args) < 3 || args[len(args)-2] != "=>" {
+			return true, c.ArgErr()
+		}
+		zone := dns.Fqdn(strings.ToLower(args[len(args)-1]))
+		if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+			return true, c.Errf("invalid network zone: '%s'", args[len(args)-1])
+		}
+		for _, network := range args[:len(args)-2] {
+			dd.networkZones[network] = zone
+		}
+	case "log_queries":
+		rate := defaultQueryLogRate
+		if c.NextArg() {
+			var err error
+			if rate, err = strconv.Atoi(c.Val()); err != nil || rate <= 0 {
+				return true, c.Errf("invalid log_queries rate: '%s'", c.Val())
+			}
+		}
+		dd.queryLog = &queryLogger{rate: rate}
+	case "compress":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		compress, err := strconv.ParseBool(c.Val())
+		if err != nil {
+			return true, c.Errf("invalid compress value: '%s'", c.Val())
+		}
+		dd.compress = compress
+	case "max_udp_size":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		size, err := strconv.Atoi(c.Val())
+		if err != nil || size < dns.MinMsgSize || size > dns.MaxMsgSize {
+			return true, c.Errf("invalid max_udp_size value: '%s'", c.Val())
+		}
+		dd.maxUDPSize = size
+	case "host_ip":
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		if len(args) == 0 {
+			ip, err := detectHostIP()
+			if err != nil {
+				return true, c.Errf("cannot detect the host address: %s", err)
+			}
+			args = []string{ip.String()}
+		}
+		for _, arg := range args {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return true, c.Errf("invalid host_ip address: '%s'", arg)
+			}
+			dd.hostIPs = append(dd.hostIPs, ip)
+		}
+	case "address_selectors":
+		names := c.RemainingArgs()
+		if len(names) == 0 {
+			return true, c.ArgErr()
+		}
+		dd.addressSelectors = nil
+		seen := make(map[string]bool)
+		for _, name := range names {
+			selector := addressSelectorByName(name)
+			if selector == nil || seen[name] {
+				return true, c.Errf("unknown or repeated address selector: '%s'", name)
+			}
+			seen[name] = true
+			dd.addressSelectors = append(dd.addressSelectors, selector)
 		}
+	case "bridge_precedence":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		switch c.Val() {
+		case "default":
+			dd.userNetworksFirst = false
+		case "user":
+			dd.userNetworksFirst = true
+		default:
+			return true, c.Errf("invalid bridge_precedence: '%s', expected default or user", c.Val())
+		}
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "fallthrough":
+		dd.fall.SetZonesFromArgs(c.RemainingArgs())
+	case "soa":
+		args := c.RemainingArgs()
+		if len(args) != 2 && len(args) != 6 {
+			return true, c.ArgErr()
+		}
+		soa := &soaConfig{mname: dns.Fqdn(args[0]), rname: dns.Fqdn(strings.Replace(args[1], "@", ".", 1))}
+		timers := defaultSOATimers
+		for i, arg := range args[2:] {
+			timer, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return true, c.Errf("invalid soa timer: '%s'", arg)
+			}
+			timers[i] = uint32(timer)
+		}
+		soa.refresh, soa.retry, soa.expire, soa.minttl = timers[0], timers[1], timers[2], timers[3]
+		for _, name := range []string{soa.mname, soa.rname} {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return true, c.Errf("invalid soa name: '%s'", name)
+			}
+		}
+		dd.soa = soa
+	case "ns":
+		names := c.RemainingArgs()
+		if len(names) == 0 {
+			return true, c.ArgErr()
+		}
+		for _, name := range names {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return true, c.Errf("invalid ns name: '%s'", name)
+			}
+			dd.nameServers = append(dd.nameServers, dns.Fqdn(strings.ToLower(name)))
+		}
+	case "host_address":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return true, c.ArgErr()
+		}
+		address := net.ParseIP(args[1]).To4()
+		if address == nil {
+			return true, c.Errf("invalid host_address IPv4 address: '%s'", args[1])
+		}
+		if dd.hostAddresses == nil {
+			dd.hostAddresses = make(map[string]net.IP)
+		}
+		dd.hostAddresses[args[0]] = address
+	case "internal_clients":
+		cidrs := c.RemainingArgs()
+		if len(cidrs) == 0 {
+			return true, c.ArgErr()
+		}
+		for _, cidr := range cidrs {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return true, c.Errf("invalid internal_clients subnet: '%s'", cidr)
+			}
+			dd.internalClients = append(dd.internalClients, subnet)
+		}
+	case "annotate_answers":
+		cidrs := c.RemainingArgs()
+		if len(cidrs) == 0 {
+			return true, c.ArgErr()
+		}
+		for _, cidr := range cidrs {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return true, c.Errf("invalid annotate_answers subnet: '%s'", cidr)
+			}
+			dd.annotateClients = append(dd.annotateClients, subnet)
+		}
+	case "client_address":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return true, c.ArgErr()
+		}
+		address := net.ParseIP(args[len(args)-1]).To4()
+		if address == nil {
+			return true, c.Errf("invalid client_address IPv4 address: '%s'", args[len(args)-1])
+		}
+		for _, cidr := range args[:len(args)-1] {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return true, c.Errf("invalid client_address subnet: '%s'", cidr)
+			}
+			dd.clientAddresses = append(dd.clientAddresses, clientAddress{subnet: subnet, address: address})
+		}
+	case "ipv4_networks", "ipv6_networks":
+		directive := c.Val()
+		networks := c.RemainingArgs()
+		if len(networks) == 0 {
+			return true, c.ArgErr()
+		}
+		if directive == "ipv4_networks" {
+			dd.ipv4Networks = networks
+		} else {
+			dd.ipv6Networks = networks
+		}
+	case "internal_names":
+		dd.internalNames = c.RemainingArgs()
+		if len(dd.internalNames) == 0 {
+			dd.internalNames = defaultInternalNames
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
 
+// parseLifecycleProperty parses the directives of the connection to docker and of the lifecycle of the
+// containers: which ones are registered, when, and for how long. It reports whether the property is one of them.
+func (p *dockerParser) parseLifecycleProperty(property string) (bool, error) {
+	c, dd := p.c, p.dd
+	switch property {
+	case "docker_tls_cert", "docker_tls_key", "docker_tls_ca":
+		directive := c.Val()
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		switch directive {
+		case "docker_tls_cert":
+			dd.dockerTLSCert = c.Val()
+		case "docker_tls_key":
+			dd.dockerTLSKey = c.Val()
+		default:
+			dd.dockerTLSCA = c.Val()
+		}
+	case "resync_interval":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		interval, err := time.ParseDuration(c.Val())
+		if err != nil || interval <= 0 {
+			return true, c.Errf("invalid resync_interval duration: '%s'", c.Val())
+		}
+		dd.resyncInterval = interval
+	case "one_shot_lifetime":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		lifetime, err := time.ParseDuration(c.Val())
+		if err != nil || lifetime <= 0 {
+			return true, c.Errf("invalid one_shot_lifetime duration: '%s'", c.Val())
+		}
+		dd.oneShotLifetime = lifetime
+	case "restart_policy":
+		args := c.RemainingArgs()
+		if len(args) != 2 && len(args) != 3 {
+			return true, c.ArgErr()
+		}
+		if !isRestartPolicy(args[0]) {
+			return true, c.Errf("unknown restart policy: '%s'", args[0])
+		}
+		ttl, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return true, c.Errf("invalid restart_policy TTL: '%s'", args[1])
+		}
+		policy := restartPolicy{ttl: uint32(ttl)}
+		if len(args) == 3 {
+			if policy.grace, err = time.ParseDuration(args[2]); err != nil || policy.grace < 0 {
+				return true, c.Errf("invalid restart_policy grace period: '%s'", args[2])
+			}
+		}
+		if dd.restartPolicies == nil {
+			dd.restartPolicies = make(map[string]restartPolicy)
+		}
+		dd.restartPolicies[args[0]] = policy
+	case "swarm":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.swarm = true
+	case "approve_conflicts":
+		args := c.RemainingArgs()
 		if len(args) > 1 {
-			return dd, c.ArgErr()
+			return true, c.ArgErr()
+		}
+		if len(args) == 1 {
+			if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return true, c.Errf("invalid approve_conflicts webhook: '%s'", args[0])
+			}
+			dd.approvalWebhook = args[0]
+		}
+		dd.approveConflicts = true
+	case "max_records":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		max, err := strconv.Atoi(args[0])
+		if err != nil || max < 0 {
+			return true, c.Errf("invalid max_records value: '%s'", args[0])
+		}
+		dd.maxRecords = max
+		dd.limitPolicy = limitRefuse
+		if len(args) == 2 {
+			if args[1] != limitRefuse && args[1] != limitEvict {
+				return true, c.Errf("unknown max_records policy: '%s'", args[1])
+			}
+			dd.limitPolicy = args[1]
+		}
+	case "wait_for_sync":
+		dd.syncTimeout = defaultSyncTimeout
+		if c.NextArg() {
+			timeout, err := time.ParseDuration(c.Val())
+			if err != nil || timeout <= 0 {
+				return true, c.Errf("invalid wait_for_sync timeout: '%s'", c.Val())
+			}
+			dd.syncTimeout = timeout
+		}
+	case "lameduck":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		duration, err := time.ParseDuration(c.Val())
+		if err != nil || duration <= 0 {
+			return true, c.Errf("invalid lameduck duration: '%s'", c.Val())
+		}
+		dd.lameDuck = duration
+	case "serve_stale":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		duration, err := time.ParseDuration(args[0])
+		if err != nil || duration <= 0 {
+			return true, c.Errf("invalid serve_stale duration: '%s'", args[0])
+		}
+		dd.serveStale = duration
+		dd.staleTTL = defaultStaleTTL
+		if len(args) == 2 {
+			ttl, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				return true, c.Errf("invalid serve_stale ttl: '%s'", args[1])
+			}
+			dd.staleTTL = uint32(ttl)
+		}
+	case "keep_exited":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, c.ArgErr()
+		}
+		var durations []time.Duration
+		for _, arg := range args {
+			duration, err := time.ParseDuration(arg)
+			if err != nil || duration < 0 {
+				return true, c.Errf("invalid keep_exited duration: '%s'", arg)
+			}
+			durations = append(durations, duration)
+		}
+		dd.keepClean = durations[0]
+		if len(durations) == 2 {
+			dd.keepCrashed = durations[1]
+		}
+	case "max_concurrent_api":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		max, err := strconv.Atoi(c.Val())
+		if err != nil || max <= 0 {
+			return true, c.Errf("invalid max_concurrent_api value: '%s'", c.Val())
+		}
+		dd.apiLimiter = make(chan struct{}, max)
+	case "event_workers":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		workers, err := strconv.Atoi(c.Val())
+		if err != nil || workers <= 0 {
+			return true, c.Errf("invalid event_workers value: '%s'", c.Val())
+		}
+		dd.eventWorkers = workers
+	case "runtime":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		switch c.Val() {
+		case runtimeDocker, runtimePodman, runtimeAuto:
+			dd.runtime = c.Val()
+		default:
+			return true, c.Errf("invalid runtime: '%s'", c.Val())
+		}
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+	case "event_cursor_file":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if err := p.writesFile(property, c.Val()); err != nil {
+			return true, err
+		}
+		dd.eventCursorFile = c.Val()
+	case "only_images", "only_projects":
+		directive := c.Val()
+		patterns := c.RemainingArgs()
+		if len(patterns) == 0 {
+			return true, c.ArgErr()
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return true, c.Errf("invalid %s pattern: '%s'", directive, pattern)
+			}
+		}
+		if directive == "only_images" {
+			dd.onlyImages = append(dd.onlyImages, patterns...)
+		} else {
+			dd.onlyProjects = append(dd.onlyProjects, patterns...)
+		}
+	case "filter":
+		terms := c.RemainingArgs()
+		if len(terms) == 0 {
+			return true, c.ArgErr()
+		}
+		for _, term := range terms {
+			filter, err := parseContainerFilter(term)
+			if err != nil {
+				return true, c.Err(err.Error())
+			}
+			dd.filters = append(dd.filters, filter)
+		}
+	case "expose_by_default":
+		if !c.NextArg() {
+			return true, c.ArgErr()
 		}
+		expose, err := strconv.ParseBool(c.Val())
+		if err != nil {
+			return true, c.Errf("invalid expose_by_default value: '%s'", c.Val())
+		}
+		dd.hideByDefault = !expose
+	case "require_healthy":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.requireHealthy = true
+	case "hide_paused":
+		if c.NextArg() {
+			return true, c.ArgErr()
+		}
+		dd.hidePaused = true
+	case "self":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		if c.Val() != "register" && c.Val() != "exclude" {
+			return true, c.Errf("unknown self policy: '%s'", c.Val())
+		}
+		dd.selfPolicy = c.Val()
+		dd.detectSelf()
+	case "api_timeout":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		timeout, err := time.ParseDuration(c.Val())
+		if err != nil || timeout <= 0 {
+			return true, c.Errf("invalid api_timeout duration: '%s'", c.Val())
+		}
+		dd.apiTimeout = timeout
+	case "unhealthy_after":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		after, err := time.ParseDuration(c.Val())
+		if err != nil || after < 0 {
+			return true, c.Errf("invalid unhealthy_after duration: '%s'", c.Val())
+		}
+		dd.unhealthyAfter = after
+	default:
+		return false, nil
+	}
+	return true, nil
+}
 
-		for c.NextBlock() {
-			var value = c.Val()
-			switch value {
-			case "endpoint":
-				args := c.RemainingArgs()
-				if len(args) == 0 {
-					return dd, c.ArgErr()
-				}
-				dd.endpoints = args
-			case "domain":
-				var resolver = &SubDomainContainerNameResolver{
-					domain: defaultDockerDomain,
-				}
-				dd.resolvers = append(dd.resolvers, resolver)
-				if !c.NextArg() {
-					return dd, c.ArgErr()
-				}
-				resolver.domain = c.Val()
-			case "hostname_domain":
-				var resolver = &SubDomainHostResolver{
-					domain: defaultDockerDomain,
-				}
-				dd.resolvers = append(dd.resolvers, resolver)
-				if !c.NextArg() {
-					return dd, c.ArgErr()
-				}
-				resolver.domain = c.Val()
-			case "compose_domain":
-				var resolver = &ComposeResolver{
-					domain: defaultDockerDomain,
-				}
-				dd.resolvers = append(dd.resolvers, resolver)
-				if !c.NextArg() {
-					return dd, c.ArgErr()
-				}
-				resolver.domain = c.Val()
-			case "network_aliases":
-				var resolver = &NetworkAliasesResolver{
-					network: "",
-				}
-				dd.resolvers = append(dd.resolvers, resolver)
-				if !c.NextArg() {
-					return dd, c.ArgErr()
-				}
-				resolver.network = c.Val()
-			case "label":
-				if !c.NextArg() {
-					return dd, c.ArgErr()
-				}
-				labelResolver.hostLabel = c.Val()
-			default:
-				return dd, c.Errf("unknown property: '%s'", c.Val())
+// writesFile records the file written by the directive, each file being written by a single one
+func (p *dockerParser) writesFile(directive, file string) error {
+	if p.files == nil {
+		p.files = make(map[string]string)
+	}
+	if other, ok := p.files[filepath.Clean(file)]; ok {
+		return p.c.Errf("%s writes the file of %s: '%s'", directive, other, file)
+	}
+	p.files[filepath.Clean(file)] = directive
+	return nil
+}
+
+// checkResolvers orders the resolvers and checks the combinations of the resolver directives
+func (p *dockerParser) checkResolvers() error {
+	c, dd := p.c, p.dd
+	if p.resolverOrder != nil {
+		dd.resolvers = orderResolvers(dd.resolvers, p.resolverOrder)
+		// the template resolver has no default template, it would be dropped
+		for _, name := range p.resolverOrder {
+			if name == "template" && !hasResolver(dd.resolvers, name) {
+				return c.Err("the template resolver requires domain_template")
 			}
 		}
 	}
-	dockerClient, err := dockerapi.NewClient(dd.dockerEndpoint)
-	if err != nil {
-		return dd, err
+	if dd.hostSuffixMerge && dd.hostSuffix == "" && !dd.hostSuffixFromInfo {
+		return c.Err("host_suffix_merge requires host_suffix")
 	}
-	dd.dockerClient = dockerClient
-	go dd.start()
-	return dd, nil
+	return nil
+}
+
+// hasResolver reports whether a resolver of the name is enabled
+func hasResolver(resolvers []ContainerDomainResolver, name string) bool {
+	for _, resolver := range resolvers {
+		if resolverName(resolver) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLifecycle picks the endpoint of the runtime unless given, and checks the combinations of the lifecycle
+// directives
+func (p *dockerParser) checkLifecycle(endpoint bool) error {
+	c, dd := p.c, p.dd
+	if dd.runtime == runtimePodman {
+		dd.podman = 1
+		if !endpoint {
+			dd.dockerEndpoint = podmanEndpoint()
+		}
+	}
+	if (dd.dockerTLSCert == "") != (dd.dockerTLSKey == "") {
+		return c.Err("docker_tls_cert and docker_tls_key go together")
+	}
+	return nil
+}
+
+// checkBackends checks the combinations of the etcd directives, then creates the backends once the endpoint and
+// the ttl are known
+func (p *dockerParser) checkBackends() error {
+	c, dd := p.c, p.dd
+	if len(dd.etcdZones) > 0 && dd.etcdPrefix == "" {
+		dd.etcdPrefix = etcdDefaultZonePrefix
+	}
+	if dd.etcdEnabled() {
+		dd.addBackend(&etcdBackend{dd: dd, written: make(map[string]string)})
+	} else if dd.etcdPrefix != "" || len(dd.etcdZones) > 0 || dd.etcdLease || dd.etcdTLS != nil || dd.etcdUsername != "" || dd.etcdFallback || dd.etcdPurge || dd.etcdOwner != "" {
+		return c.Err("the etcd options require endpoint or etcd_discovery")
+	}
+	for _, create := range p.recordBackends {
+		create()
+	}
+	return nil
+}
+
+// parseEtcdProperty parses the etcd property: the endpoints, or an etcd_ directive without its prefix, as a directive
+// of the docker block or a line of its etcd block.
+func parseEtcdProperty(c *caddy.Controller, dd *DockerDiscovery, property string) error {
+	switch property {
+	case "endpoint":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		dd.endpoints = args
+	case "discovery":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		if args[0] != "srv" {
+			return c.Errf("unknown etcd_discovery method: '%s'", args[0])
+		}
+		dd.etcdDiscovery = args[1]
+	case "tls":
+		args := c.RemainingArgs()
+		if len(args) > 3 {
+			return c.ArgErr()
+		}
+		tlsConfig, err := tls.NewTLSConfigFromArgs(args...)
+		if err != nil {
+			return c.Errf("invalid etcd_tls: %s", err)
+		}
+		dd.etcdTLS = tlsConfig
+	case "credentials":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		dd.etcdUsername, dd.etcdPassword = args[0], args[1]
+	case "fallback":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		dd.etcdFallback = true
+	case "purge":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		dd.etcdPurge = true
+	case "prefix":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dd.etcdPrefix = c.Val()
+	case "owner":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		dd.etcdOwner = args[0]
+	case "lease":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		if len(args) == 1 {
+			ttl, err := time.ParseDuration(args[0])
+			if err != nil || ttl < etcdMinLeaseTTL*time.Second {
+				return c.Errf("invalid etcd_lease TTL: '%s'", args[0])
+			}
+			dd.etcdLeaseTTL = ttl
+		}
+		dd.etcdLease = true
+	case "zone":
+		zones := c.RemainingArgs()
+		if len(zones) == 0 {
+			return c.ArgErr()
+		}
+		for _, zone := range zones {
+			if _, ok := dns.IsDomainName(zone); !ok {
+				return c.Errf("invalid etcd_zone: '%s'", zone)
+			}
+			dd.etcdZones = append(dd.etcdZones, strings.ToLower(dns.Fqdn(zone)))
+		}
+	default:
+		return c.Errf("unknown etcd property '%s'", property)
+	}
+	return nil
+}
+
+// parseEtcdBlock parses the etcd block the controller may be on, its lines being etcd properties. The closing
+// brace is consumed here, the dispenser doesn't nest the blocks.
+func parseEtcdBlock(c *caddy.Controller, dd *DockerDiscovery) error {
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := parseEtcdProperty(c, dd, c.Val()); err != nil {
+			return err
+		}
+	}
+	return c.EOFErr()
 }
 
 func setup(c *caddy.Controller) error {
-	dd, err := createPlugin(c)
+	plugins, err := createPlugins(c)
 	if err != nil {
 		return err
 	}
 
+	for _, dd := range plugins {
+		dd := dd
+		c.OnFinalShutdown(dd.drain)
+		c.OnFinalShutdown(dd.revokeEtcdLease)
+		c.OnFinalShutdown(dd.shutdown)
+		c.OnShutdown(dd.shutdownReplaced)
+		c.OnShutdown(dd.releaseDocker)
+		key := handoverKey(c.ServerBlockKeys, dd.dockerEndpoint)
+		c.OnRestart(dd.replacing)
+		c.OnRestart(func() error { return dd.handOver(key) })
+		c.OnRestartFailed(dd.replaceFailed)
+		c.OnRestartFailed(func() error { return dropHandover(key) })
+		c.OnStartup(dd.startAdmin)
+		c.OnRestart(dd.stopAdmin)
+		c.OnRestartFailed(dd.startAdmin)
+		c.OnFinalShutdown(dd.stopAdmin)
+		c.OnStartup(dd.startStatus)
+		c.OnRestart(dd.stopStatus)
+		c.OnRestartFailed(dd.startStatus)
+		c.OnFinalShutdown(dd.stopStatus)
+		c.OnStartup(dd.startDebug)
+		c.OnRestart(dd.stopDebug)
+		c.OnRestartFailed(dd.startDebug)
+		c.OnFinalShutdown(dd.stopDebug)
+	}
+
+	// the instances of the docker hosts are chained, the names unknown to one are passed to the next one
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		dd.Next = next
-		return dd
+		for i := len(plugins) - 1; i >= 0; i-- {
+			plugins[i].Next = next
+			next = plugins[i]
+		}
+		return next
 	})
 	return nil
 }
@@ -1,12 +1,21 @@
 package dockerdiscovery
 
 import (
+	"context"
+	"encoding/pem"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -127,7 +136,7 @@ func TestMultipleNetworksDockerDiscovery(t *testing.T) {
 }
 
 // simple check
-func ipOk(t *testing.T, dd DockerDiscovery, domain string, address net.IP) *ContainerInfo {
+func ipOk(t *testing.T, dd *DockerDiscovery, domain string, address net.IP) *ContainerInfo {
 
 	containerInfo, e := dd.containerInfoByDomain(domain)
 	assert.Nil(t, e)
@@ -140,7 +149,7 @@ func ipOk(t *testing.T, dd DockerDiscovery, domain string, address net.IP) *Cont
 }
 
 // simple check
-func ipNotOk(t *testing.T, dd DockerDiscovery, domain string) {
+func ipNotOk(t *testing.T, dd *DockerDiscovery, domain string) {
 
 	containerInfo, e := dd.containerInfoByDomain(domain)
 	assert.Nil(t, e)
@@ -179,3 +188,861 @@ func genContainerDefn(nsAddress string, netMode string, netAddress string) *dock
 
 	return container
 }
+
+func TestMultipleZonesDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53", "lab.home.arpa.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	address := net.ParseIP("192.11.0.1")
+	container := genContainerDefn("", "bridge", address.String())
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	_ = ipOk(t, dd, "evil_ptolemy.docker.loc.", address)
+	_ = ipOk(t, dd, "evil_ptolemy.lab.home.arpa.", address)
+	// names outside of the server block zones are registered as is
+	_ = ipOk(t, dd, "label-host.loc.", address)
+	ipNotOk(t, dd, "label-host.loc.lab.home.arpa.")
+}
+
+func TestStrictNamesDockerDiscovery(t *testing.T) {
+	address := net.ParseIP("192.11.0.1")
+	for _, strict := range []bool{false, true} {
+		c := caddy.NewTestController("dns", fmt.Sprintf(`docker unix:///home/user/docker.sock {
+	domain docker.loc
+	strict_names %t
+}`, strict))
+		dd, err := createPlugin(c)
+		assert.Nil(t, err)
+		assert.Equal(t, strict, dd.strictNames)
+
+		container := genContainerDefn("", "bridge", address.String())
+		assert.Nil(t, dd.updateContainerInfo(container))
+
+		_ = ipOk(t, dd, "label-host.loc.", address)
+		if strict {
+			ipNotOk(t, dd, "evil_ptolemy.docker.loc.")
+		} else {
+			_ = ipOk(t, dd, "evil_ptolemy.docker.loc.", address)
+		}
+	}
+
+	assert.False(t, validDomain("-web.docker.loc", true))
+	assert.False(t, validDomain("web..docker.loc", false))
+	assert.True(t, validDomain("_web.docker.loc", false))
+}
+
+func TestNameRulesDockerDiscovery(t *testing.T) {
+	address := net.ParseIP("192.11.0.1")
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	strict_names
+	name_map _. -
+	name_max_length 9
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "bridge", address.String())
+	assert.Nil(t, dd.updateContainerInfo(container))
+	_ = ipOk(t, dd, "evil-ptol.docker.loc.", address)
+	ipNotOk(t, dd, "evil_ptolemy.docker.loc.")
+	assert.Equal(t, "/docker/docker/evil-ptol", dd.etcdKey(container))
+	assert.Equal(t, "evil-ptol", dd.Containers()[0].Name)
+	container.Config.Labels["prometheus.scrape"], container.Config.Labels["prometheus.port"] = "true", "9090"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "evil-ptol", dd.prometheusTargetGroups()[0].Labels["container"])
+
+	// the hyphens left at the end of a truncated name are dropped, the later mappings win
+	rules := nameRules{maxLength: 5}
+	rules.addMapping("_", "-")
+	rules.addMapping("_", "")
+	assert.Equal(t, "evilp", rules.normalize("/evil_ptolemy"))
+	rules = nameRules{allSlashes: true, maxLength: 5}
+	rules.addMapping(".", "-")
+	assert.Equal(t, "webdb", rules.normalize("/web/db"))
+	assert.Equal(t, "abc", rules.normalize("/abc.-def"))
+
+	for _, config := range []string{
+		"docker {\nname_slashes none\n}",
+		"docker {\nname_map _\n}",
+		"docker {\nname_max_length 0\n}",
+		"docker {\nname_max_length 254\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestMaxRecordsDockerDiscovery(t *testing.T) {
+	for _, policy := range []string{limitRefuse, limitEvict} {
+		c := caddy.NewTestController("dns", fmt.Sprintf(`docker unix:///home/user/docker.sock {
+	max_records 2 %s
+}`, policy))
+		dd, err := createPlugin(c)
+		assert.Nil(t, err)
+
+		first := genContainerDefn("", "bridge", "192.11.0.1")
+		first.Config.Labels["coredns.dockerdiscovery.host"] = "first.loc"
+		second := genContainerDefn("", "bridge", "192.11.0.2")
+		second.ID = "0ad1e6d2b0c5e3a0f4a3f4d1e98a24c64cb1b0fe4d0bd42b0a2c74e1e40dbf9a"
+		second.Config.Labels["coredns.dockerdiscovery.host"] = "second.loc"
+		second.Config.Labels["com.docker.compose.container-number"] = "2"
+		third := genContainerDefn("", "bridge", "192.11.0.3")
+		third.ID = "9c0a1bd2f3cf1f5c24ec44f2b3dd7ed5a7a2e29f5d67b2cb6e8dbfa1d44aa1c3"
+		third.Config.Labels["coredns.dockerdiscovery.host"] = "third.loc"
+		third.Config.Labels["com.docker.compose.container-number"] = "3"
+
+		assert.Nil(t, dd.updateContainerInfo(first))
+		assert.Nil(t, dd.updateContainerInfo(second))
+		err = dd.updateContainerInfo(third)
+		if policy == limitRefuse {
+			assert.NotNil(t, err)
+			_ = ipOk(t, dd, "first.loc.", net.ParseIP("192.11.0.1"))
+			ipNotOk(t, dd, "third.loc.")
+		} else {
+			assert.Nil(t, err)
+			ipNotOk(t, dd, "first.loc.")
+			_ = ipOk(t, dd, "third.loc.", net.ParseIP("192.11.0.3"))
+		}
+		_ = ipOk(t, dd, "second.loc.", net.ParseIP("192.11.0.2"))
+		assert.Equal(t, 2, dd.recordCount())
+	}
+}
+
+func TestRegistratorDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	registrator_domain service.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	address := net.ParseIP("192.11.0.1")
+	container := genContainerDefn("", "bridge", address.String())
+	container.Config.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin",
+		"SERVICE_NAME=web",
+		"SERVICE_443_NAME=web-tls",
+		"SERVICE_TAGS=prod, eu",
+		"SERVICE_PORT=8443",
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	_ = ipOk(t, dd, "web.service.loc.", address)
+	_ = ipOk(t, dd, "web-tls.service.loc.", address)
+	_ = ipOk(t, dd, "prod.web.service.loc.", address)
+	_ = ipOk(t, dd, "eu.web-tls.service.loc.", address)
+	// SERVICE_PORT is the port of the SRV records
+	if answers, _ := dd.records("web.service.loc.", dns.TypeSRV, nil); assert.Len(t, answers, 1) {
+		assert.Equal(t, uint16(8443), answers[0].(*dns.SRV).Port)
+	}
+
+	container.Config.Env = append(container.Config.Env, "SERVICE_IGNORE=true")
+	assert.Nil(t, dd.updateContainerInfo(container))
+	ipNotOk(t, dd, "web.service.loc.")
+}
+
+func TestDomainTemplateDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain_template "{{.Name}}.{{index .Config.Labels \"env\" | default \"prod\"}}.docker.loc, {{.Config.Hostname | lower}}.{{index .Config.Labels \"team\"}}.loc"
+	resolvers template
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, []ResolverConfig{{Name: "template", Template: `{{.Name}}.{{index .Config.Labels "env" | default "prod"}}.docker.loc, {{.Config.Hostname | lower}}.{{index .Config.Labels "team"}}.loc`}}, dd.Resolvers())
+
+	address := net.ParseIP("192.11.0.1")
+	container := genContainerDefn("", "bridge", address.String())
+	container.Name = "/" + container.Name
+	container.Config.Hostname = "NGINX"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// the missing label falls back, the name left with an empty label is skipped
+	containerInfo := ipOk(t, dd, "evil_ptolemy.prod.docker.loc.", address)
+	assert.Equal(t, []string{"evil_ptolemy.prod.docker.loc"}, containerInfo.domains)
+
+	container.Config.Labels["env"] = "staging"
+	container.Config.Labels["team"] = "web"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	_ = ipOk(t, dd, "evil_ptolemy.staging.docker.loc.", address)
+	_ = ipOk(t, dd, "nginx.web.loc.", address)
+
+	// the template failing on the container registers no name
+	resolver, err := newTemplateResolver("{{.State.Health.Log.Missing}}")
+	assert.Nil(t, err)
+	domains, err := resolver.resolve(container)
+	assert.NotNil(t, err)
+	assert.Empty(t, domains)
+
+	for _, config := range []string{"domain_template", `domain_template "{{.Name"`, "domain_template a b"} {
+		_, err = createPlugin(caddy.NewTestController("dns", "docker {\n"+config+"\n}"))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestResolversDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	hostname_domain home.example.org
+	resolvers hostname name
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	address := net.ParseIP("192.11.0.1")
+	container := genContainerDefn("", "bridge", address.String())
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// the label resolver is not selected, the domains follow the order of the directive
+	ipNotOk(t, dd, "label-host.loc.")
+	containerInfo := ipOk(t, dd, "nginx.home.example.org.", address)
+	assert.Equal(t, []string{"nginx.home.example.org", container.Name + ".docker.loc"}, containerInfo.domains)
+
+	// selected resolvers without their own directive use the default domain
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	resolvers compose
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(container))
+	_ = ipOk(t, dd, "cservice.cproject."+defaultDockerDomain+".", address)
+
+	for _, config := range []string{"resolvers", "resolvers label unknown", "resolvers label label"} {
+		_, err = createPlugin(caddy.NewTestController("dns", "docker {\n"+config+"\n}"))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestOverlappingResolversDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	hostname_domain loc
+	network_aliases bridge
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	// label, hostname and alias resolvers all produce label-host.loc
+	address := net.ParseIP("192.11.0.1")
+	container := genContainerDefn("", "bridge", address.String())
+	container.Config.Hostname = "label-host"
+	container.NetworkSettings.Networks["bridge"] = dockerapi.ContainerNetwork{
+		Aliases:   []string{"Label-Host.loc", "myproject.loc"},
+		IPAddress: address.String(),
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	containerInfo := ipOk(t, dd, "label-host.loc.", address)
+	assert.Equal(t, []string{"label-host.loc", "myproject.loc"}, containerInfo.domains)
+	assert.Equal(t, 2, dd.recordCount())
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 1)
+}
+
+func TestNetworkAliasesDomainDockerDiscovery(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	network_aliases * docker.local
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &NetworkAliasesResolver{domain: "docker.local"}, dd.resolvers[1])
+
+	address := net.ParseIP("192.11.0.1")
+	container := genContainerDefn("", "my_project_network_name", address.String())
+	container.NetworkSettings.Networks["my_project_network_name"] = dockerapi.ContainerNetwork{
+		Aliases:   []string{"web"},
+		IPAddress: address.String(),
+	}
+	assert.Nil(t, dd.updateContainerInfo(container))
+	_ = ipOk(t, dd, "web.docker.local.", address)
+	ipNotOk(t, dd, "web.")
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nnetwork_aliases bridge docker.local extra\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestRecreatedComposeContainerDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	compose_domain compose.loc
+	serve_stale 1m
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	old := genContainerDefn("", "bridge", "192.11.0.1")
+	assert.Nil(t, dd.updateContainerInfo(old))
+
+	// recreated with a new label while the old container is still running
+	recreated := genContainerDefn("", "bridge", "192.11.0.2")
+	recreated.ID = "0b1d6e4c2e1f5a4d8f6e3c9b7a5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d"
+	recreated.Config.Labels["coredns.dockerdiscovery.host"] = "new-host.loc"
+	assert.Nil(t, dd.updateContainerInfo(recreated))
+
+	ipNotOk(t, dd, "label-host.loc.")
+	_ = ipOk(t, dd, "new-host.loc.", net.ParseIP("192.11.0.2"))
+	_ = ipOk(t, dd, "cservice.cproject.compose.loc.", net.ParseIP("192.11.0.2"))
+	assert.Len(t, dd.Containers(), 1)
+	assert.Nil(t, dd.Lookup("label-host.loc", dns.TypeA))
+
+	// another replica of the service is not a recreation
+	replica := genContainerDefn("", "bridge", "192.11.0.3")
+	replica.ID = "1c2e7f5d3f2a6b5e9a7f4d0c8b6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e"
+	replica.Config.Labels = map[string]string{
+		"com.docker.compose.project":          "cproject",
+		"com.docker.compose.service":          "cservice",
+		"com.docker.compose.container-number": "2",
+	}
+	assert.Nil(t, dd.updateContainerInfo(replica))
+	assert.Len(t, dd.Containers(), 2)
+}
+
+func TestStaticRecordsDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	record docker.loc. CAA 0 issue "letsencrypt.org"
+	record docker.loc. TXT "v=spf1 -all"
+	record _dmarc.docker.loc. 300 TXT "v=DMARC1; p=reject"
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	caa := dd.Lookup("docker.loc", dns.TypeCAA)
+	assert.Len(t, caa, 1)
+	assert.Equal(t, "letsencrypt.org", caa[0].(*dns.CAA).Value)
+	txt := dd.Lookup("docker.loc", dns.TypeTXT)
+	assert.Len(t, txt, 1)
+	assert.Equal(t, []string{"v=spf1 -all"}, txt[0].(*dns.TXT).Txt)
+	txt = dd.Lookup("_DMARC.docker.loc", dns.TypeTXT)
+	assert.Len(t, txt, 1)
+	assert.Equal(t, uint32(300), txt[0].Header().Ttl)
+
+	for _, config := range []string{"record docker.loc. TXT", "record docker.loc TXT x", "record docker.loc. CAA invalid"} {
+		_, err = createPlugin(caddy.NewTestController("dns", "docker {\n"+config+"\n}"))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestWhitelistDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	only_images nginx:* myorg/*
+	only_projects prod-*
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.Config.Labels["com.docker.compose.project"] = "prod-web"
+	for image, allowed := range map[string]bool{"nginx": true, "nginx:1.21": true, "myorg/app@sha256:4f2c": true, "redis:6": false, "other/myorg/app": false} {
+		container.Config.Image = image
+		assert.Nil(t, dd.updateContainerInfo(container))
+		assert.Equal(t, allowed, len(dd.Lookup("label-host.loc", dns.TypeA)) == 1, image)
+	}
+
+	container.Config.Image = "nginx"
+	container.Config.Labels["com.docker.compose.project"] = "dev-web"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nonly_images [nginx\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestLabelTemplate(t *testing.T) {
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	resolver := LabelResolver{hostLabels: []string{"coredns.dockerdiscovery.host"}}
+
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "{service}.{project}.{name}.loc"
+	domains, err := resolver.resolve(container)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cservice.cproject.evil_ptolemy.loc"}, domains)
+
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "{hostname}-{number}.loc"
+	_, err = resolver.resolve(container)
+	assert.NotNil(t, err)
+
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "{unknown}.loc"
+	_, err = resolver.resolve(container)
+	assert.NotNil(t, err)
+}
+
+func TestLabelListDockerDiscovery(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	label coredns.dockerdiscovery.host traefik.host
+}`))
+	assert.Nil(t, err)
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "app.loc, api.loc,"
+	container.Config.Labels["traefik.host"] = "{name}.lab.loc,{number}.loc"
+	assert.Nil(t, dd.updateContainerInfo(container))
+
+	// the name which can't be expanded is skipped
+	for _, name := range []string{"app.loc.", "api.loc.", "evil_ptolemy.lab.loc."} {
+		assert.NotNil(t, query(t, dd, name, dns.TypeA, ""), name)
+	}
+	assert.Nil(t, query(t, dd, "label-host.loc.", dns.TypeA, ""))
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nlabel\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestApexRecordsDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	soa ns1.docker.loc hostmaster@example.com 3600 600 604800 60
+	ns ns1.docker.loc NS2.example.com.
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	soa := dd.Lookup("Docker.loc", dns.TypeSOA)
+	assert.Len(t, soa, 1)
+	assert.Equal(t, "ns1.docker.loc.", soa[0].(*dns.SOA).Ns)
+	assert.Equal(t, "hostmaster.example.com.", soa[0].(*dns.SOA).Mbox)
+	assert.Equal(t, uint32(604800), soa[0].(*dns.SOA).Expire)
+	assert.Equal(t, uint32(dd.Version()), soa[0].(*dns.SOA).Serial)
+
+	ns := dd.Lookup("docker.loc", dns.TypeNS)
+	assert.Len(t, ns, 2)
+	assert.Equal(t, "ns2.example.com.", ns[1].(*dns.NS).Ns)
+	assert.Len(t, dd.Lookup("sub.docker.loc", dns.TypeSOA), 0)
+
+	for _, config := range []string{"soa ns1.docker.loc", "soa ns1.docker.loc hostmaster 1 2 3 x", "ns"} {
+		_, err = createPlugin(caddy.NewTestController("dns", "docker {\n"+config+"\n}"))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestEtcdOptionsDockerDiscovery(t *testing.T) {
+	// without endpoint the records are served from memory only
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker`))
+	assert.Nil(t, err)
+	assert.False(t, dd.etcdEnabled())
+	assert.Empty(t, dd.Backends())
+
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	endpoint https://etcd1:2379 https://etcd2:2379
+	etcd_tls
+	etcd_credentials coredns s3cret
+}`))
+	assert.Nil(t, err)
+	assert.True(t, dd.etcdEnabled())
+	assert.NotNil(t, dd.etcdTLS)
+	assert.Equal(t, "coredns", dd.etcdUsername)
+	assert.Equal(t, "s3cret", dd.etcdPassword)
+	if assert.Len(t, dd.Backends(), 1) {
+		assert.Equal(t, "etcd", dd.Backends()[0].Name)
+	}
+
+	for _, config := range []string{
+		"docker {\netcd_credentials coredns\n}",
+		"docker {\nendpoint http://etcd:2379\netcd_tls cert.pem key.pem ca.pem extra\n}",
+		"docker {\netcd_credentials coredns s3cret\n}",
+		"docker {\netcd_prefix /skydns\n}",
+		"docker {\netcd_owner docker-host-1\n}",
+		"docker {\nendpoint http://etcd:2379\netcd_owner\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestEtcdBlockDockerDiscovery(t *testing.T) {
+	flat, err := createPlugin(caddy.NewTestController("dns", `docker {
+	endpoint https://etcd1:2379 https://etcd2:2379
+	etcd_credentials coredns s3cret
+	etcd_prefix /skydns/{zone}
+	etcd_zone docker.loc
+	etcd_lease 30s
+	etcd_fallback
+	etcd_purge
+	etcd_owner docker-host-1
+	ttl 60
+}`))
+	assert.Nil(t, err)
+
+	// the same options grouped in the etcd block, the directives after it still parsed
+	block, err := createPlugin(caddy.NewTestController("dns", `docker {
+	etcd https://etcd1:2379 https://etcd2:2379 {
+		credentials coredns s3cret
+		prefix /skydns/{zone}
+		zone docker.loc
+		lease 30s
+		fallback
+		purge
+		owner docker-host-1
+	}
+	ttl 60
+}`))
+	assert.Nil(t, err)
+	for _, dd := range []*DockerDiscovery{flat, block} {
+		assert.Equal(t, []string{"https://etcd1:2379", "https://etcd2:2379"}, dd.endpoints)
+		assert.Equal(t, "coredns", dd.etcdUsername)
+		assert.Equal(t, "/skydns/{zone}", dd.etcdPrefix)
+		assert.Equal(t, []string{"docker.loc."}, dd.etcdZones)
+		assert.Equal(t, 30*time.Second, dd.etcdLeaseTTL)
+		assert.True(t, dd.etcdFallback)
+		assert.True(t, dd.etcdPurge)
+		assert.Equal(t, "docker-host-1", dd.etcdOwner)
+		assert.Equal(t, uint32(60), dd.ttl)
+	}
+
+	// the endpoints in the block, or without block
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	etcd {
+		endpoint http://etcd:2379
+	}
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://etcd:2379"}, dd.endpoints)
+	dd, err = createPlugin(caddy.NewTestController("dns", `docker {
+	etcd http://etcd:2379
+}`))
+	assert.Nil(t, err)
+	assert.True(t, dd.etcdEnabled())
+
+	for _, config := range []string{
+		"docker {\netcd http://etcd:2379 {\nunknown\n}\n}",
+		"docker {\netcd http://etcd:2379 {\ncredentials coredns\n}\n}",
+		"docker {\netcd {\nprefix /skydns\n}\n}",
+		"docker {\netcd http://etcd:2379 {\nfallback\n",
+		"docker {\netcd_purge\n}",
+		"docker {\netcd http://etcd:2379 {\npurge now\n}\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestDockerTLSDockerDiscovery(t *testing.T) {
+	daemon := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	}))
+	defer daemon.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: daemon.Certificate().Raw}), 0644))
+
+	dd, err := createPlugin(caddy.NewTestController("dns", fmt.Sprintf(`docker tcp://127.0.0.3:2376 {
+	docker_tls_ca %s
+}`, ca)))
+	assert.Nil(t, err)
+	assert.Equal(t, ca, dd.dockerTLSCA)
+
+	// the certificate of the daemon is verified with the CA. The plugin is not started, the event stream of the
+	// fake daemon would race with the docker client
+	dd = NewDockerDiscovery("tcp://" + strings.TrimPrefix(daemon.URL, "https://"))
+	dd.dockerTLSCA = ca
+	dd.dockerClient, err = dd.newDockerClient()
+	assert.Nil(t, err)
+	networks, err := dd.listNetworks(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, networks)
+
+	for _, config := range []string{
+		"docker tcp://127.0.0.2:2376 {\ndocker_tls_cert cert.pem\n}",
+		"docker tcp://127.0.0.2:2376 {\ndocker_tls_ca\n}",
+		"docker tcp://127.0.0.2:2376 {\ndocker_tls_ca missing-ca.pem\n}",
+		"docker tcp://127.0.0.2:2376 {\ndocker_tls_cert missing-cert.pem\ndocker_tls_key missing-key.pem\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestMultipleEndpointsDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///var/run/host1.sock {
+	host_suffix host1
+}
+docker tcp://host2:2375 {
+	host_suffix
+}`)
+	c.ServerBlockKeys = []string{"docker.loc.:53"}
+	plugins, err := createPlugins(c)
+	assert.Nil(t, err)
+	if assert.Len(t, plugins, 2) {
+		assert.Equal(t, "unix:///var/run/host1.sock", plugins[0].dockerEndpoint)
+		assert.Equal(t, "host1", plugins[0].hostSuffix)
+		assert.Equal(t, "tcp://host2:2375", plugins[1].dockerEndpoint)
+		assert.True(t, plugins[1].hostSuffixFromInfo)
+	}
+
+	dd := plugins[0]
+	assert.Equal(t, []string{"nginx.host1.docker.loc", "nginx.host1.docker.local", "single"},
+		dd.suffixHost([]string{"nginx.docker.loc", "nginx.docker.local", "single"}))
+	plugins[1].mu.Lock()
+	plugins[1].hostInfo = &dockerapi.DockerInfo{Name: "Host2.lab.example"}
+	plugins[1].mu.Unlock()
+	assert.Equal(t, []string{"web.host2.docker.loc"}, plugins[1].suffixHost([]string{"web.docker.loc"}))
+
+	// the instances started before a directive failing to parse stop watching their docker host
+	c = caddy.NewTestController("dns", `docker unix:///var/run/host3.sock
+docker tcp://host4:2375 {
+	host_suffix host_1
+}`)
+	_, err = createPlugins(c)
+	assert.NotNil(t, err)
+	sharedDockersMu.Lock()
+	assert.NotContains(t, sharedDockers, "unix:///var/run/host3.sock")
+	sharedDockersMu.Unlock()
+
+	for _, config := range []string{
+		"docker {\nhost_suffix_merge\n}",
+		"docker {\nhost_suffix host1 host2\n}",
+		"docker {\nhost_suffix host1.lab\n}",
+		"docker {\nhost_suffix host_1\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestExposeDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	expose_by_default false
+	filter label=com.docker.compose.project=prod-* !name=*-debug
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "my_project_network_name", "172.20.0.2")
+	container.Config.Labels["com.docker.compose.project"] = "prod-web"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+
+	// opted in
+	container.Config.Labels[enableLabel] = "true"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 1)
+
+	// the filters apply to the containers opted in too
+	container.Name = "/web-debug"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+	container.Name = "/evil_ptolemy"
+	container.Config.Labels["com.docker.compose.project"] = "dev-web"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+
+	// opted out
+	dd, err = createPlugin(caddy.NewTestController("dns", "docker"))
+	assert.Nil(t, err)
+	container.Config.Labels[enableLabel] = "false"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+
+	for _, config := range []string{
+		"docker {\nexpose_by_default maybe\n}",
+		"docker {\nfilter\n}",
+		"docker {\nfilter image=nginx\n}",
+		"docker {\nfilter name=[web\n}",
+		"docker {\nfilter label=\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestSelfDockerDiscovery(t *testing.T) {
+	id := "fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7"
+	assert.Equal(t, id, containerIDFromProc("12:pids:/docker/"+id+"\n0::/", ""))
+	assert.Equal(t, id, containerIDFromProc("1:name=systemd:/system.slice/docker-"+id+".scope\n", ""))
+	assert.Equal(t, id, containerIDFromProc("0::/\n", "612 600 0:52 /docker/containers/"+id+"/hostname /etc/hostname rw\n"))
+	assert.Empty(t, containerIDFromProc("0::/user.slice\n", "22 1 8:1 / / rw\n"))
+
+	dd, err := createPlugin(caddy.NewTestController("dns", `docker {
+	expose_by_default false
+	self register
+}`))
+	assert.Nil(t, err)
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	dd.selfID = container.ID
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 1)
+
+	dd.selfPolicy = "exclude"
+	container.Config.Labels[enableLabel] = "true"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Len(t, dd.Lookup("label-host.loc", dns.TypeA), 0)
+
+	// without ID, the hostname set by docker
+	dd.selfID, dd.selfHostname = "", id[:12]
+	container.Config.Hostname = id[:12]
+	assert.True(t, dd.isSelf(container))
+	container.Config.Hostname = "web"
+	assert.False(t, dd.isSelf(container))
+
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\nself ignore\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestComposeFileDockerDiscovery(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "My.Shop")
+	assert.Nil(t, os.Mkdir(dir, 0o755))
+	file := filepath.Join(dir, "compose.yaml")
+	assert.Nil(t, os.WriteFile(file, []byte(`services:
+  web:
+    image: nginx
+    labels:
+      coredns.dockerdiscovery.host: www.shop.loc
+  db:
+    image: postgres
+    container_name: shop-db
+    labels:
+      - coredns.dockerdiscovery.host=db.shop.loc
+`), 0o644))
+
+	c := caddy.NewTestController("dns", `docker {
+	compose_file `+file+` 10.0.0.1
+	compose_domain compose.loc
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	// the project is named after the directory
+	for _, name := range []string{"www.shop.loc", "web.myshop.compose.loc", "myshop-web-1.docker.loc", "db.shop.loc", "shop-db.docker.loc"} {
+		answers := dd.Lookup(name, dns.TypeA)
+		if assert.Len(t, answers, 1, name) {
+			assert.Equal(t, "10.0.0.1", answers[0].(*dns.A).A.String())
+			assert.Equal(t, uint32(composePlaceholderTTL), answers[0].Header().Ttl)
+		}
+	}
+
+	// the started containers are answered instead
+	container := genContainerDefn("", "bridge", "172.17.0.2")
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "www.shop.loc"
+	assert.Nil(t, dd.updateContainerInfo(container))
+	assert.Equal(t, "172.17.0.2", dd.Lookup("www.shop.loc", dns.TypeA)[0].(*dns.A).A.String())
+
+	for _, config := range []string{
+		"docker {\ncompose_file " + filepath.Join(dir, "missing.yaml") + "\n}",
+		"docker {\ncompose_file " + file + " host\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+// parseTest is the directives of a docker block and the error of their parsing, empty when they are valid
+type parseTest struct {
+	config string
+	err    string
+}
+
+func testParse(t *testing.T, tests []parseTest) {
+	for _, test := range tests {
+		dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n"+test.config+"\n}"))
+		if test.err == "" {
+			if assert.Nil(t, err, test.config) {
+				dd.close(false)
+				dd.releaseDocker()
+			}
+		} else if assert.NotNil(t, err, test.config) {
+			assert.Contains(t, err.Error(), test.err, test.config)
+		}
+	}
+}
+
+func TestParseResolverProperties(t *testing.T) {
+	testParse(t, []parseTest{
+		{"domain docker.loc\nhostname_domain host.loc\nresolvers name label", ""},
+		{"domain_template {{.Name}}.loc\nresolvers template", ""},
+		{"domain", "Wrong argument count"},
+		{"registrator_domain", "Wrong argument count"},
+		{"domain_template {{.Name", "invalid domain_template"},
+		{"network_aliases my_net docker.loc extra", "Wrong argument count"},
+		{"label", "Wrong argument count"},
+		{"resolvers", "Wrong argument count"},
+		{"resolvers label label", "unknown or repeated resolver: 'label'"},
+		{"resolvers label consul", "unknown or repeated resolver: 'consul'"},
+		{"resolvers label template", "the template resolver requires domain_template"},
+		{"name_slashes some", "invalid name_slashes value"},
+		{"name_map web", "Wrong argument count"},
+		{"name_max_length 254", "invalid name_max_length"},
+		{"strict_names maybe", "invalid strict_names value"},
+		{"host_suffix host_1", "invalid host_suffix label"},
+		{"host_suffix_merge", "host_suffix_merge requires host_suffix"},
+		{"compose_file docker-compose.yml nowhere", "invalid compose_file address"},
+	})
+}
+
+func TestParseBackendProperties(t *testing.T) {
+	dir := t.TempDir()
+	testParse(t, []parseTest{
+		{"zone_file " + dir + "/docker.zone\nhosts_file " + dir + "/hosts " + dir + "/hosts.conf", ""},
+		{"etcd http://etcd:2379 {\nprefix /skydns/{zone}\nlease 30s\n}", ""},
+		{"etcd_prefix /skydns", "the etcd options require endpoint or etcd_discovery"},
+		{"etcd_discovery dns example.com", "unknown etcd_discovery method"},
+		{"endpoint http://etcd:2379\netcd_lease 1s", "invalid etcd_lease TTL"},
+		{"endpoint http://etcd:2379\netcd_zone bad..zone", "invalid etcd_zone"},
+		{"etcd http://etcd:2379 {\nunknown\n}", "unknown etcd property"},
+		{"consul ftp://consul:8500", "invalid consul URL"},
+		{"consul http://consul:8500 /", "invalid consul prefix"},
+		{"redis redis", "invalid redis address"},
+		{"webhook", "Wrong argument count"},
+		{"hosts_file", "Wrong argument count"},
+		{"zone_file " + dir + "/docker.zone\nhosts_file " + dir + "/docker.zone", "hosts_file writes the file of zone_file"},
+		{"prometheus_sd " + dir + "/targets.json\noverrides_file " + dir + "/targets.json", "overrides_file writes the file of prometheus_sd"},
+	})
+}
+
+func TestParseAnswerProperties(t *testing.T) {
+	testParse(t, []parseTest{
+		{"ttl 60\nttl_jitter 10%\nttl_ramp 1m 5\nrecord www.loc. 60 IN A 10.0.0.1\nalias web.loc => www.loc", ""},
+		{"dns64 10.0.0.0/8", "invalid dns64 prefix"},
+		{"ports_zone bad..zone", "invalid ports_zone"},
+		{"host_facts cpu", "unknown host fact"},
+		{"txt_metadata [", "invalid txt_metadata pattern"},
+		{"ttl -1", "invalid ttl"},
+		{"ttl_jitter 101%", "invalid ttl_jitter percent"},
+		{"ttl_ramp 0s", "invalid ttl_ramp duration"},
+		{"ttl_ramp 1m -1", "invalid ttl_ramp ttl"},
+		{"record www.loc 60 IN A 10.0.0.1", "record name must be fully qualified"},
+		{"record www.loc. 60 IN A nowhere", "invalid record"},
+		{"alias web.loc www.loc", "Wrong argument count"},
+		{"network bridge => .", "invalid network zone"},
+		{"log_queries 0", "invalid log_queries rate"},
+		{"compress maybe", "invalid compress value"},
+		{"max_udp_size 100", "invalid max_udp_size value"},
+		{"soa ns.loc. admin.loc. 1 2 3 x", "invalid soa timer"},
+		{"ns bad..name", "invalid ns name"},
+		{"host_address bridge ::1", "invalid host_address IPv4 address"},
+		{"internal_clients 10.0.0.0", "invalid internal_clients subnet"},
+		{"annotate_answers 10.0.0.0", "invalid annotate_answers subnet"},
+		{"client_address 10.0.0.0/8 ::1", "invalid client_address IPv4 address"},
+		{"query_budget 1us", "invalid query_budget"},
+		{"only_ipv4\nonly_ipv6", "only_ipv4 and only_ipv6 are exclusive"},
+		{"address_selectors published unknown", "unknown or repeated address selector"},
+		{"bridge_precedence first", "invalid bridge_precedence"},
+		{"host_ip 10.0.0.1 10.0.0.2 10.0.0.3", "Wrong argument count"},
+		{"host_ip nowhere", "invalid host_ip address"},
+		{"ipv4_networks", "Wrong argument count"},
+	})
+}
+
+func TestParseLifecycleProperties(t *testing.T) {
+	dir := t.TempDir()
+	testParse(t, []parseTest{
+		{"resync_interval 1m\nkeep_exited 1m 1h\nrestart_policy always 30 5s\nmax_records 10 evict", ""},
+		{"docker_tls_cert cert.pem", "docker_tls_cert and docker_tls_key go together"},
+		{"resync_interval 0s", "invalid resync_interval duration"},
+		{"one_shot_lifetime 0s", "invalid one_shot_lifetime duration"},
+		{"restart_policy sometimes 60", "unknown restart policy"},
+		{"restart_policy always -1", "invalid restart_policy TTL"},
+		{"restart_policy always 60 -1s", "invalid restart_policy grace period"},
+		{"swarm yes", "Wrong argument count"},
+		{"approve_conflicts ftp://approver", "invalid approve_conflicts webhook"},
+		{"max_records -1", "invalid max_records value"},
+		{"max_records 10 drop", "unknown max_records policy"},
+		{"wait_for_sync 0s", "invalid wait_for_sync timeout"},
+		{"lameduck 0s", "invalid lameduck duration"},
+		{"serve_stale 1m -1", "invalid serve_stale ttl"},
+		{"keep_exited 1m 1h 1d", "Wrong argument count"},
+		{"max_concurrent_api 0", "invalid max_concurrent_api value"},
+		{"event_workers 0", "invalid event_workers value"},
+		{"runtime lxc", "invalid runtime"},
+		{"event_cursor_file " + dir + "/cursor\noverrides_file " + dir + "/cursor", "overrides_file writes the file of event_cursor_file"},
+		{"only_images [", "invalid only_images pattern"},
+		{"expose_by_default maybe", "invalid expose_by_default value"},
+		{"self maybe", "unknown self policy"},
+		{"api_timeout 0s", "invalid api_timeout duration"},
+		{"unhealthy_after -1s", "invalid unhealthy_after duration"},
+	})
+}
@@ -0,0 +1,137 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// eventInspectionWindow is how long the inspection of the container of an event is shared with the other
+// instances watching the same endpoint, which handle the same event
+const eventInspectionWindow = 10 * time.Second
+
+// sharedDocker is the docker client of an endpoint shared by the plugin instances of the server blocks watching
+// it: the client has a single event stream, whatever the number of listeners, and the containers of an event are
+// inspected once for all the instances.
+type sharedDocker struct {
+	endpoint string
+	client   *dockerapi.Client
+	refs     int // instances using the client, guarded by sharedDockersMu
+
+	mu          sync.Mutex
+	inspections map[string]*eventInspection // by container ID and event time
+}
+
+// eventInspection is the inspection of the container of an event, in progress until done is closed
+type eventInspection struct {
+	done      chan struct{}
+	container *dockerapi.Container
+	err       error
+}
+
+var (
+	sharedDockersMu sync.Mutex
+	sharedDockers   = make(map[string]*sharedDocker) // by endpoint
+)
+
+// acquireDocker returns the docker client of the endpoint, created by the first instance watching it
+func (dd *DockerDiscovery) acquireDocker() error {
+	sharedDockersMu.Lock()
+	defer sharedDockersMu.Unlock()
+	shared, ok := sharedDockers[dd.dockerEndpoint]
+	if !ok {
+		client, err := dd.newDockerClient()
+		if err != nil {
+			return err
+		}
+		// the api_timeout of the first instance applies to the shared client
+		dd.setAPITimeout(client)
+		shared = &sharedDocker{endpoint: dd.dockerEndpoint, client: client, inspections: make(map[string]*eventInspection)}
+		sharedDockers[dd.dockerEndpoint] = shared
+	} else {
+		log.Printf("[docker] Sharing the connection to %s with another server block", dd.dockerEndpoint)
+	}
+	shared.refs++
+	dd.shared = shared
+	dd.dockerClient = shared.client
+	return nil
+}
+
+// newDockerClient connects to the endpoint, with the certificates of the docker_tls_* directives if any. The files
+// are read here rather than by the docker client, which ignores the missing ones, e.g. skipping the verification
+// of the daemon for a CA file path mistyped.
+func (dd *DockerDiscovery) newDockerClient() (*dockerapi.Client, error) {
+	if dd.dockerTLSCert == "" && dd.dockerTLSCA == "" {
+		return dockerapi.NewClient(dd.dockerEndpoint)
+	}
+	var pems [3][]byte
+	for i, file := range []string{dd.dockerTLSCert, dd.dockerTLSKey, dd.dockerTLSCA} {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pems[i] = data
+	}
+	if dd.dockerTLSCA == "" {
+		log.Printf("[docker] No docker_tls_ca, the certificate of %s is not verified", dd.dockerEndpoint)
+	}
+	return dockerapi.NewTLSClientFromBytes(dd.dockerEndpoint, pems[0], pems[1], pems[2])
+}
+
+// releaseDocker drops the reference of the instance to the shared docker client, it runs on the shutdown and
+// after a reload, once the new instances hold their own reference.
+func (dd *DockerDiscovery) releaseDocker() error {
+	if dd.shared == nil {
+		return nil
+	}
+	sharedDockersMu.Lock()
+	defer sharedDockersMu.Unlock()
+	dd.shared.refs--
+	if dd.shared.refs == 0 {
+		delete(sharedDockers, dd.shared.endpoint)
+	}
+	dd.shared = nil
+	return nil
+}
+
+// inspectEventContainer inspects the container of an event. The instances sharing the docker client get the
+// result of a single inspection for the same event.
+func (dd *DockerDiscovery) inspectEventContainer(ctx context.Context, id string, eventTime int64) (*dockerapi.Container, error) {
+	if dd.shared == nil || dd.dockerClient != dd.shared.client {
+		return dd.inspectContainerRetry(ctx, id)
+	}
+	shared := dd.shared
+	key := id + "@" + strconv.FormatInt(eventTime, 10)
+
+	shared.mu.Lock()
+	inspection, ok := shared.inspections[key]
+	if !ok {
+		inspection = &eventInspection{done: make(chan struct{})}
+		shared.inspections[key] = inspection
+	}
+	shared.mu.Unlock()
+
+	if !ok {
+		inspection.container, inspection.err = dd.inspectContainerRetry(ctx, id)
+		close(inspection.done)
+		time.AfterFunc(eventInspectionWindow, func() {
+			shared.mu.Lock()
+			delete(shared.inspections, key)
+			shared.mu.Unlock()
+		})
+	}
+	select {
+	case <-inspection.done:
+		return inspection.container, inspection.err
+	case <-ctx.Done():
+		return nil, &transientError{ctx.Err()}
+	}
+}
@@ -0,0 +1,127 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// shutdownTimeout bounds how long the shutdown waits for the goroutines of the instance to return, e.g. a docker
+// call without context bounded by the api_timeout only
+var shutdownTimeout = 5 * time.Second
+
+// spawn runs the function in a goroutine of the instance, waited for by the shutdown, labelled with the stage of
+// the discovery for the profiles
+func (dd *DockerDiscovery) spawn(stage string, f func()) {
+	dd.running.Add(1)
+	go func() {
+		defer dd.running.Done()
+		pprof.Do(context.Background(), dd.stageLabels(stage), func(context.Context) { f() })
+	}()
+}
+
+// replacing marks the instance as replaced by the Corefile reload starting, e.g. on SIGUSR1
+func (dd *DockerDiscovery) replacing() error {
+	atomic.StoreInt32(&dd.replaced, 1)
+	return nil
+}
+
+// replaceFailed unmarks the instance when the reload failed, it keeps running
+func (dd *DockerDiscovery) replaceFailed() error {
+	atomic.StoreInt32(&dd.replaced, 0)
+	return nil
+}
+
+// shutdownReplaced shuts the instance replaced by a reload down once its replacement started, so the reloads don't
+// leave event loops and connections behind. Its records are left to the replacement, which took its state over.
+func (dd *DockerDiscovery) shutdownReplaced() error {
+	if atomic.LoadInt32(&dd.replaced) == 1 {
+		dd.close(false)
+	}
+	return nil
+}
+
+// shutdown shuts the instance down on the final shutdown, deleting its etcd records with etcd_purge
+func (dd *DockerDiscovery) shutdown() error {
+	dd.close(dd.etcdPurge)
+	return nil
+}
+
+// close cancels the docker and etcd calls in progress, which stops the watch loop (removing its docker event
+// listener), the backends and the other loops, waits for them and the events being handled, then closes the etcd
+// client. The timers pending are stopped, the others check the context when they fire.
+func (dd *DockerDiscovery) close(purge bool) {
+	dd.shutdownOnce.Do(func() {
+		dd.stop()
+
+		dd.reconnectMu.Lock()
+		for id, timer := range dd.reconnects {
+			timer.Stop()
+			delete(dd.reconnects, id)
+		}
+		dd.reconnectMu.Unlock()
+		dd.teardownMu.Lock()
+		for project, pending := range dd.teardowns {
+			pending.timer.Stop()
+			delete(dd.teardowns, project)
+		}
+		dd.teardownMu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			dd.running.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(shutdownTimeout):
+			log.Printf("[docker] Shutdown: goroutines still running after %s", shutdownTimeout)
+		}
+
+		dd.mu.Lock()
+		client := dd.etcd
+		dd.etcd = nil
+		dd.mu.Unlock()
+		if client == nil {
+			return
+		}
+		if purge {
+			dd.purgeEtcd(client)
+		}
+		if err := client.Close(); err != nil {
+			log.Printf("[docker] Error closing the etcd client: %s", err)
+		}
+	})
+}
+
+// purgeEtcd deletes the etcd records written by the instance, once its backends stopped. Only the records carrying
+// the owner of the instance are deleted, and only while they are the ones written: the records of the other docker
+// hosts sharing the prefix are kept.
+func (dd *DockerDiscovery) purgeEtcd(client *etcdcv3.Client) {
+	owner := dd.etcdOwnerName()
+	for _, queue := range dd.backends {
+		backend, ok := queue.backend.(*etcdBackend)
+		if !ok {
+			continue
+		}
+		for key, value := range backend.written {
+			if etcdRecordOwner(value) != owner {
+				delete(backend.written, key)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+			_, err := client.Txn(ctx).Then(etcdDelete(key, value)).Commit()
+			cancel()
+			if err != nil {
+				log.Printf("[docker] Error deleting the etcd record %s: %s", key, err)
+				continue
+			}
+			delete(backend.written, key)
+		}
+		log.Printf("[docker] Deleted the etcd records of the instance, %d left", len(backend.written))
+	}
+}
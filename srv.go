@@ -0,0 +1,136 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// srvRecords answers SRV queries for a container domain with one record per container owning it, e.g. per member
+// of a group, weighted by their weight label. The priority is the start order of the container's compose service
+// given by depends_on: the services others depend on (e.g. a primary database its replicas depend on) come first
+// and are preferred by the clients. The clients answered the host address (see host_address) get the host port the
+// port is published on instead, the containers whose port isn't published being left out. The caller must hold the
+// lock.
+func (dd *DockerDiscovery) srvRecords(qname string, client net.IP) (answers, extras []dns.RR) {
+	for _, containerInfo := range dd.containersByDomain(qname) {
+		exposed := firstExposedPort(containerInfo)
+		port, _ := strconv.ParseUint(exposed, 10, 16)
+		target := dns.Fqdn(srvTarget(containerInfo))
+		glue := containerGlue(target, containerInfo)
+		if hostAddress := dd.hostAddressFor(containerInfo, client); hostAddress != nil && containerInfo.address != nil {
+			if port = uint64(publishedPort(containerInfo, exposed)); port == 0 {
+				continue
+			}
+			glue = a(strings.ToLower(target), []net.IP{hostAddress})
+		}
+		answers = append(answers, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: strings.ToLower(qname), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: dd.containerTTL(containerInfo)},
+			Priority: uint16(dd.startOrder(containerInfo, nil)),
+			Weight:   srvWeight(containerInfo),
+			Port:     uint16(port),
+			Target:   target,
+		})
+		extras = append(extras, glue...)
+	}
+	return answers, extras
+}
+
+// publishedPort returns the lowest host port the TCP port of the container is published on, 0 if it isn't
+func publishedPort(containerInfo *ContainerInfo, port string) uint16 {
+	var published uint16
+	for _, binding := range containerInfo.container.NetworkSettings.Ports[dockerapi.Port(port+"/tcp")] {
+		hostPort, err := strconv.ParseUint(binding.HostPort, 10, 16)
+		if err == nil && hostPort > 0 && (published == 0 || uint16(hostPort) < published) {
+			published = uint16(hostPort)
+		}
+	}
+	return published
+}
+
+// weightLabel sets the SRV weight of a container, e.g. to share the load of a group proportionally
+const weightLabel = "coredns.dockerdiscovery.weight"
+
+// defaultSRVWeight is the SRV weight of the containers without weight label
+const defaultSRVWeight = 10
+
+// srvWeight returns the SRV weight of the container, from the weight label
+func srvWeight(containerInfo *ContainerInfo) uint16 {
+	value, ok := containerInfo.container.Config.Labels[weightLabel]
+	if !ok {
+		return defaultSRVWeight
+	}
+	weight, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+	if err != nil {
+		log.Printf("[docker] Invalid weight %q of container %s, using %d", value, containerInfo.container.ID[:12], defaultSRVWeight)
+		return defaultSRVWeight
+	}
+	return uint16(weight)
+}
+
+// srvTarget returns the own name of the container, the target of its SRV records: group names are answered with
+// all the members.
+func srvTarget(containerInfo *ContainerInfo) string {
+	for _, domain := range containerInfo.domains {
+		if !containsDomain(containerInfo.groups, domain) {
+			return domain
+		}
+	}
+	return containerInfo.domains[0]
+}
+
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// composeDependsOn returns the services the compose service of the container depends on, from the
+// com.docker.compose.depends_on label (`service:condition:restart,...`) set by recent compose versions.
+func composeDependsOn(containerInfo *ContainerInfo) []string {
+	var services []string
+	for _, dependency := range strings.Split(containerInfo.container.Config.Labels["com.docker.compose.depends_on"], ",") {
+		if service := strings.TrimSpace(strings.SplitN(dependency, ":", 2)[0]); service != "" {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// startOrder returns the depth of the container's compose service in the depends_on graph of its project:
+// 0 for the services without dependencies, one more than the deepest dependency otherwise. The services of the
+// project are known from the registered containers. The caller must hold the lock.
+func (dd *DockerDiscovery) startOrder(containerInfo *ContainerInfo, visiting map[string]bool) int {
+	labels := containerInfo.container.Config.Labels
+	project, service := labels["com.docker.compose.project"], labels["com.docker.compose.service"]
+	if project == "" || service == "" || visiting[service] {
+		return 0 // not a compose container, or a dependency cycle
+	}
+	if visiting == nil {
+		visiting = make(map[string]bool)
+	}
+	visiting[service] = true
+	defer delete(visiting, service)
+
+	order := 0
+	for _, dependency := range composeDependsOn(containerInfo) {
+		for _, other := range dd.containerInfoMap {
+			otherLabels := other.container.Config.Labels
+			if otherLabels["com.docker.compose.project"] != project || otherLabels["com.docker.compose.service"] != dependency {
+				continue
+			}
+			if depth := dd.startOrder(other, visiting) + 1; depth > order {
+				order = depth
+			}
+			break
+		}
+	}
+	return order
+}
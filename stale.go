@@ -0,0 +1,47 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"time"
+)
+
+// defaultStaleTTL is the TTL of stale answers recommended by RFC 8767
+const defaultStaleTTL = 30
+
+// keepStale keeps the entry of a removed container to answer with its last known address for the
+// serve_stale window, the caller must hold the lock.
+func (dd *DockerDiscovery) keepStale(containerInfo *ContainerInfo) {
+	if dd.serveStale == 0 {
+		return
+	}
+	containerInfo.removed = time.Now()
+	dd.staleContainerInfoMap[containerInfo.container.ID] = containerInfo
+	dd.pruneStale()
+}
+
+// pruneStale forgets the stale entries older than the serve_stale window, the caller must hold the lock.
+func (dd *DockerDiscovery) pruneStale() {
+	for id, containerInfo := range dd.staleContainerInfoMap {
+		if time.Since(containerInfo.removed) > dd.serveStale {
+			delete(dd.staleContainerInfoMap, id)
+		}
+	}
+}
+
+// staleContainerInfoByDomain returns the most recently removed container owning the domain within the
+// serve_stale window, the caller must hold the lock.
+func (dd *DockerDiscovery) staleContainerInfoByDomain(requestName string) *ContainerInfo {
+	var stale *ContainerInfo
+	for _, containerInfo := range dd.staleContainerInfoMap {
+		if time.Since(containerInfo.removed) > dd.serveStale || !containerInfo.hasDomain(requestName) {
+			continue
+		}
+		if stale == nil || containerInfo.removed.After(stale.removed) {
+			stale = containerInfo
+		}
+	}
+	if stale != nil {
+		log.Printf("[docker] Serving stale ip %v for host %s", stale.address, requestName)
+	}
+	return stale
+}
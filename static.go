@@ -0,0 +1,19 @@
+package dockerdiscovery
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// staticRecordsFor returns the static records of the record directives matching the name and type,
+// e.g. the CAA and TXT (SPF, DMARC) records completing a zone delegated publicly.
+func (dd *DockerDiscovery) staticRecordsFor(name string, qtype uint16) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range dd.staticRecords {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			answers = append(answers, dns.Copy(rr))
+		}
+	}
+	return answers
+}
@@ -0,0 +1,122 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Status returns the summary of the discovery: records count, last sync with docker, freshness of the zones, backend
+// health and etcd endpoint health.
+func (dd *DockerDiscovery) Status() Status {
+	status := Status{
+		Endpoint:   dd.dockerEndpoint,
+		Connected:  dd.Connection().Connected,
+		Containers: len(dd.Containers()),
+		Records:    len(dd.recordSet()),
+		Zones:      dd.ZoneStatuses(),
+		Backends:   dd.Backends(),
+		Etcd:       dd.EtcdEndpoints(),
+	}
+	dd.mu.RLock()
+	if !dd.lastSync.IsZero() {
+		lastSync, age := dd.lastSync, time.Since(dd.lastSync).Seconds()
+		status.LastSync, status.SyncAge = &lastSync, &age
+	}
+	dd.mu.RUnlock()
+	return status
+}
+
+// statusHandler serves the read-only status page on GET /status, in plain text, or in JSON for the clients
+// accepting it, and the health check on GET /health.
+func (dd *DockerDiscovery) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := dd.Status()
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		connected := "disconnected"
+		if status.Connected {
+			connected = "connected"
+		}
+		fmt.Fprintf(w, "docker: %s, %s\n", status.Endpoint, connected)
+		fmt.Fprintf(w, "containers: %d\n", status.Containers)
+		fmt.Fprintf(w, "records: %d\n", status.Records)
+		if status.LastSync != nil {
+			fmt.Fprintf(w, "last sync: %s (%s ago)\n", status.LastSync.Format(time.RFC3339), time.Since(*status.LastSync).Round(time.Second))
+		} else {
+			fmt.Fprintln(w, "last sync: never")
+		}
+		for _, zone := range status.Zones {
+			fmt.Fprintf(w, "zone %s: last change %s (%s ago)\n", zone.Zone, zone.LastChange.Format(time.RFC3339), time.Since(zone.LastChange).Round(time.Second))
+		}
+		for _, backend := range status.Backends {
+			health := "healthy"
+			if !backend.Healthy {
+				health = "failing: " + backend.LastError
+			}
+			fmt.Fprintf(w, "backend %s: %s, %d changes pending\n", backend.Name, health, backend.Pending)
+		}
+		for _, endpoint := range status.Etcd {
+			health := "healthy"
+			if !endpoint.Healthy {
+				health = "failing: " + endpoint.LastError
+			}
+			if !endpoint.InUse {
+				health += ", rotated out"
+			}
+			fmt.Fprintf(w, "etcd %s: %s\n", endpoint.Endpoint, health)
+		}
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := dd.unhealthy(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+	return mux
+}
+
+// startStatus starts listening for the status page, if enabled.
+func (dd *DockerDiscovery) startStatus() error {
+	if dd.statusAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", dd.statusAddress)
+	if err != nil {
+		return err
+	}
+	dd.statusServer = &http.Server{Handler: dd.statusHandler()}
+	go dd.statusServer.Serve(listener)
+	log.Printf("[docker] Status page listening on %s", listener.Addr())
+	return nil
+}
+
+// stopStatus stops the status page, on reload it's closed before the new instance listens on the same address.
+func (dd *DockerDiscovery) stopStatus() error {
+	if dd.statusServer == nil {
+		return nil
+	}
+	err := dd.statusServer.Shutdown(context.Background())
+	dd.statusServer = nil
+	return err
+}
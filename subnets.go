@@ -0,0 +1,67 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// subnetsPrefix is the name answered with the subnets of the docker networks hosting containers, at the apex of
+// each zone, e.g. _subnets.docker.loc
+const subnetsPrefix = "_subnets."
+
+// subnets returns the subnets of the docker networks one of the discovered containers has an address in, sorted by
+// network name. The caller must hold the lock.
+func (dd *DockerDiscovery) subnets() []NetworkSubnets {
+	var networks []NetworkSubnets
+	for _, networkInfo := range dd.networkInfoMap {
+		if !dd.hostsContainers(networkInfo) {
+			continue
+		}
+		network := NetworkSubnets{Network: networkInfo.name}
+		for _, subnet := range networkInfo.subnets {
+			network.Subnets = append(network.Subnets, subnet.String())
+		}
+		networks = append(networks, network)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Network < networks[j].Network })
+	return networks
+}
+
+// hostsContainers reports whether one of the discovered containers has an address in the network, from the
+// address index. The caller must hold the lock.
+func (dd *DockerDiscovery) hostsContainers(networkInfo *NetworkInfo) bool {
+	for address := range dd.addressIndex {
+		if networkInfo.contains(net.ParseIP(address)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subnets returns the subnets of the docker networks hosting discovered containers, e.g. for firewall automation
+func (dd *DockerDiscovery) Subnets() []NetworkSubnets {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	return dd.subnets()
+}
+
+// subnetRecords answers TXT queries for _subnets.<zone> with one record per subnet of the networks hosting
+// discovered containers: network=<name> subnet=<CIDR>. The caller must hold the lock.
+func (dd *DockerDiscovery) subnetRecords(name string, qtype uint16) []dns.RR {
+	if qtype != dns.TypeTXT || !dd.isApex(strings.TrimPrefix(name, subnetsPrefix)) {
+		return nil
+	}
+	var answers []dns.RR
+	for _, network := range dd.subnets() {
+		for _, subnet := range network.Subnets {
+			answers = append(answers, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dd.ttl},
+				Txt: []string{"network=" + network.Network, "subnet=" + subnet},
+			})
+		}
+	}
+	return answers
+}
@@ -0,0 +1,177 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// swarmRefreshInterval is how often the swarm services and tasks are listed again, the tasks moving between
+// the other nodes emit no event on this one
+const swarmRefreshInterval = 10 * time.Second
+
+// swarmTasksPrefix is the prefix of the names answered with the addresses of the running tasks of a service,
+// like the embedded DNS of the swarm networks
+const swarmTasksPrefix = "tasks."
+
+// listSwarm lists the services and the running tasks of the swarm, the node must be a manager
+func (dd *DockerDiscovery) listSwarm(ctx context.Context) ([]swarm.Service, []swarm.Task, error) {
+	release := dd.acquireAPI()
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, dd.apiTimeout)
+	defer cancel()
+	services, err := dd.dockerClient.ListServices(dockerapi.ListServicesOptions{Context: ctx})
+	if err != nil {
+		return nil, nil, err
+	}
+	tasks, err := dd.dockerClient.ListTasks(dockerapi.ListTasksOptions{
+		Filters: map[string][]string{"desired-state": {"running"}},
+		Context: ctx,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return services, tasks, nil
+}
+
+// swarmNames returns the addresses of the swarm names by lower case FQDN: <service>.<zone> with the virtual IPs
+// of the service, tasks.<service>.<zone> with the addresses of its running tasks, under each zone.
+func swarmNames(services []swarm.Service, tasks []swarm.Task, zones []string) map[string][]net.IP {
+	taskAddresses := make(map[string][]net.IP)
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		for _, attachment := range task.NetworksAttachments {
+			if attachment.Network.Spec.Ingress {
+				continue // the routing mesh, not reachable by the clients
+			}
+			taskAddresses[task.ServiceID] = append(taskAddresses[task.ServiceID], cidrAddresses(attachment.Addresses)...)
+		}
+	}
+
+	names := make(map[string][]net.IP)
+	for _, service := range services {
+		var vips []string
+		for _, vip := range service.Endpoint.VirtualIPs {
+			vips = append(vips, vip.Addr)
+		}
+		addresses := sortedAddresses(taskAddresses[service.ID])
+		for _, zone := range zones {
+			name := strings.ToLower(service.Spec.Name) + "." + zone
+			if len(vips) > 0 {
+				names[name] = cidrAddresses(vips)
+			} else {
+				names[name] = addresses // dnsrr endpoint mode, no virtual IP
+			}
+			names[swarmTasksPrefix+name] = addresses
+		}
+	}
+	return names
+}
+
+// cidrAddresses returns the addresses of the CIDR notations of the swarm API, e.g. 10.0.1.5/24
+func cidrAddresses(cidrs []string) []net.IP {
+	var addresses []net.IP
+	for _, cidr := range cidrs {
+		if address, _, err := net.ParseCIDR(cidr); err == nil {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func sortedAddresses(addresses []net.IP) []net.IP {
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].String() < addresses[j].String() })
+	return addresses
+}
+
+// refreshSwarm lists the swarm services and tasks again and replaces the swarm names
+func (dd *DockerDiscovery) refreshSwarm(ctx context.Context) error {
+	services, tasks, err := dd.listSwarm(ctx)
+	if err != nil {
+		return err
+	}
+	names := swarmNames(services, tasks, dd.serviceZones())
+
+	dd.mu.Lock()
+	dd.swarmNames = names
+	dd.mu.Unlock()
+	log.Printf("[docker] Loaded %d swarm services, %d tasks", len(services), len(tasks))
+	return nil
+}
+
+// watchSwarm refreshes the swarm names periodically, until the final shutdown
+func (dd *DockerDiscovery) watchSwarm() {
+	ticker := time.NewTicker(swarmRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dd.ctx.Done():
+			return
+		}
+		if err := dd.refreshSwarm(dd.ctx); err != nil {
+			log.Printf("[docker] Error loading the swarm services: %s", err)
+		}
+	}
+}
+
+// swarmEvent refreshes the swarm names after the events changing them: the changes of the services, and the start
+// and stop of the tasks running on this node.
+func (dd *DockerDiscovery) swarmEvent(ctx context.Context, event string, attributes map[string]string) {
+	if !dd.swarm {
+		return
+	}
+	switch event {
+	case "service:create", "service:update", "service:remove":
+	case "container:start", "container:die":
+		if attributes["com.docker.swarm.service.id"] == "" {
+			return
+		}
+	default:
+		return
+	}
+	if err := dd.refreshSwarm(ctx); err != nil {
+		log.Printf("[docker] Event error %s: error loading the swarm services: %s", event, err)
+	}
+}
+
+// swarmRecords answers the A and AAAA queries of the swarm names. The caller must hold the lock.
+func (dd *DockerDiscovery) swarmRecords(name string, qtype uint16) []dns.RR {
+	addresses, ok := dd.swarmNames[name]
+	if !ok {
+		return nil
+	}
+	var ipv4, ipv6 []net.IP
+	for _, address := range addresses {
+		if address.To4() != nil {
+			ipv4 = append(ipv4, address)
+		} else {
+			ipv6 = append(ipv6, address)
+		}
+	}
+
+	var answers []dns.RR
+	switch qtype {
+	case dns.TypeA:
+		answers = a(name, ipv4)
+	case dns.TypeAAAA:
+		answers = aaaa(name, ipv6)
+	}
+	for _, rr := range answers {
+		rr.Header().Ttl = dd.ttl
+	}
+	if dd.roundRobin {
+		rand.Shuffle(len(answers), func(i, j int) { answers[i], answers[j] = answers[j], answers[i] })
+	}
+	return answers
+}
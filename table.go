@@ -0,0 +1,165 @@
+package dockerdiscovery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// importedTTL is the TTL of the imported names, short as they are answered until the containers start here
+const importedTTL = 30
+
+// ExportTable returns the record table: the addresses of the names of the containers and of the imported names
+// not owned by a container yet, the overrides and the forced response codes. The names have a trailing dot.
+func (dd *DockerDiscovery) ExportTable() RecordTable {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	table := RecordTable{
+		Version:   dd.Version(),
+		Records:   make(map[string][]string),
+		Overrides: make(map[string]string, len(dd.overrides)),
+		Rcodes:    make(map[string]string, len(dd.rcodes)),
+	}
+	for name, addresses := range dd.importedNames {
+		for _, address := range addresses {
+			table.Records[name] = append(table.Records[name], address.String())
+		}
+	}
+	for _, containerInfo := range dd.containerInfoMap {
+		for _, domain := range containerInfo.domains {
+			name := strings.ToLower(dns.Fqdn(domain))
+			for _, address := range containerInfo.addresses() {
+				table.Records[name] = append(table.Records[name], address.String())
+			}
+		}
+	}
+	for name, addresses := range table.Records {
+		sort.Strings(addresses)
+		unique := addresses[:0]
+		for i, address := range addresses {
+			if i == 0 || address != addresses[i-1] {
+				unique = append(unique, address)
+			}
+		}
+		table.Records[name] = unique
+	}
+	for name, address := range dd.overrides {
+		table.Overrides[name] = address.String()
+	}
+	for name, rcode := range dd.rcodes {
+		table.Rcodes[name] = dns.RcodeToString[rcode]
+	}
+	return table
+}
+
+// ImportTable imports the record table, merged into the current one or replacing it. The container names are
+// answered with their imported addresses until containers of this docker host own them, the overrides and response
+// codes are set like SetOverride and SetRcode. The containers discovered here are never changed, docker stays the
+// source of truth. The table is checked first, nothing is imported when a name, address or code is invalid.
+func (dd *DockerDiscovery) ImportTable(table RecordTable, replace bool) error {
+	for _, name := range tableNames(table) {
+		if _, ok := dns.IsDomainName(name); !ok || name == "" {
+			return errors.New("invalid domain name: " + name)
+		}
+	}
+	records := make(map[string][]net.IP, len(table.Records))
+	for name, values := range table.Records {
+		for _, value := range values {
+			address := net.ParseIP(value)
+			if address == nil {
+				return fmt.Errorf("invalid address of %s: %s", name, value)
+			}
+			records[name] = append(records[name], address)
+		}
+	}
+	overrides := make(map[string]net.IP, len(table.Overrides))
+	for name, value := range table.Overrides {
+		if overrides[name] = net.ParseIP(value); overrides[name] == nil {
+			return fmt.Errorf("invalid address of %s: %s", name, value)
+		}
+	}
+	rcodes := make(map[string]int, len(table.Rcodes))
+	for name, value := range table.Rcodes {
+		rcode, err := parseForcedRcode(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		rcodes[name] = rcode
+	}
+
+	dd.overridesMu.Lock()
+	defer dd.overridesMu.Unlock()
+	dd.mu.Lock()
+	if replace {
+		dd.importedNames = make(map[string][]net.IP)
+		dd.overrides = make(map[string]net.IP)
+		dd.rcodes = make(map[string]int)
+	}
+	imported := 0
+	for name, addresses := range records {
+		name = strings.ToLower(dns.Fqdn(name))
+		if len(dd.containersByDomain(name)) > 0 {
+			continue // owned by a container here
+		}
+		dd.importedNames[name] = addresses
+		imported++
+	}
+	for name, address := range overrides {
+		dd.overrides[strings.ToLower(dns.Fqdn(name))] = address
+	}
+	for name, rcode := range rcodes {
+		dd.rcodes[strings.ToLower(dns.Fqdn(name))] = rcode
+	}
+	dd.bumpVersion()
+	dd.mu.Unlock()
+	log.Printf("[docker] Imported %d names, %d overrides and %d rcodes (replace: %t)", imported, len(overrides), len(rcodes), replace)
+	return dd.saveOverrides()
+}
+
+// tableNames returns the names of the records, overrides and response codes of the table
+func tableNames(table RecordTable) []string {
+	var names []string
+	for name := range table.Records {
+		names = append(names, name)
+	}
+	for name := range table.Overrides {
+		names = append(names, name)
+	}
+	for name := range table.Rcodes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// importedRecords answers the A and AAAA queries of the imported names with their addresses. The caller must hold
+// the lock.
+func (dd *DockerDiscovery) importedRecords(name string, qtype uint16) []dns.RR {
+	var answers []dns.RR
+	for _, address := range dd.importedNames[name] {
+		if qtype == dns.TypeA && address.To4() != nil {
+			answers = append(answers, a(name, []net.IP{address})...)
+		} else if qtype == dns.TypeAAAA && address.To4() == nil {
+			answers = append(answers, aaaa(name, []net.IP{address})...)
+		}
+	}
+	for _, rr := range answers {
+		rr.Header().Ttl = importedTTL
+	}
+	return answers
+}
+
+// dropImported forgets the imported names the containers added own, they are answered with the containers now.
+// The caller must hold the lock.
+func (dd *DockerDiscovery) dropImported(change *containerChange) {
+	for _, containerInfo := range change.added {
+		for _, domain := range containerInfo.domains {
+			delete(dd.importedNames, strings.ToLower(dns.Fqdn(domain)))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// teardownWindow is how long the die events of a compose project are collected, from the last one, before the
+// records of the exited containers are removed together, e.g. during `docker compose down`
+const teardownWindow = 500 * time.Millisecond
+
+// teardownMaxDelay bounds how long a steady flow of die events of a project delays the removal of its records
+const teardownMaxDelay = 5 * time.Second
+
+// teardown collects the die events of a compose project
+type teardown struct {
+	exits   []projectExit
+	started time.Time
+	timer   *time.Timer
+}
+
+// projectExit is the die event of a container of a compose project
+type projectExit struct {
+	containerInfo *ContainerInfo // the entry of the container when it died
+	exitCode      int
+}
+
+// containerDied handles the die event of a container. The exits of the compose containers are collected by
+// project until teardownWindow passes without another die event of the project, then applied as one change, so
+// tearing a project down updates the record table and the backends once instead of once per container.
+func (dd *DockerDiscovery) containerDied(containerID string, attributes map[string]string) error {
+	project := attributes["com.docker.compose.project"]
+	if project == "" {
+		return dd.containerExited(containerID, attributes)
+	}
+	logExit(containerID, attributes)
+
+	dd.mu.RLock()
+	containerInfo, ok := dd.containerInfoMap[containerID]
+	dd.mu.RUnlock()
+	if !ok {
+		log.Printf("[docker] No entry associated with the container %s", containerID[:12])
+		return nil
+	}
+
+	dd.teardownMu.Lock()
+	defer dd.teardownMu.Unlock()
+	pending, ok := dd.teardowns[project]
+	if !ok {
+		pending = &teardown{started: time.Now()}
+		pending.timer = time.AfterFunc(teardownWindow, func() { dd.tearDown(project) })
+		dd.teardowns[project] = pending
+	} else if time.Since(pending.started) < teardownMaxDelay {
+		pending.timer.Reset(teardownWindow)
+	}
+	pending.exits = append(pending.exits, projectExit{containerInfo: containerInfo, exitCode: exitCode(attributes)})
+	return nil
+}
+
+// teardownPending reports whether the exit of the container is collected for the teardown of its project
+func (dd *DockerDiscovery) teardownPending(project, containerID string) bool {
+	dd.teardownMu.Lock()
+	defer dd.teardownMu.Unlock()
+	if pending, ok := dd.teardowns[project]; ok {
+		for _, exit := range pending.exits {
+			if exit.containerInfo.container.ID == containerID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tearDown applies the exits collected for the compose project. The containers restarted since their die event
+// keep their new entry.
+func (dd *DockerDiscovery) tearDown(project string) {
+	dd.teardownMu.Lock()
+	pending := dd.teardowns[project]
+	delete(dd.teardowns, project)
+	dd.teardownMu.Unlock()
+	if pending == nil {
+		return // applied already, the timer was reset as it fired
+	}
+
+	dd.mu.Lock()
+	change := &containerChange{keepStale: true}
+	var kept []*ContainerInfo
+	for _, exit := range pending.exits {
+		if dd.containerInfoMap[exit.containerInfo.container.ID] != exit.containerInfo {
+			continue // restarted or already removed
+		}
+		if exited := dd.exit(change, exit.containerInfo, exit.exitCode); exited != nil {
+			kept = append(kept, exited)
+		}
+	}
+	if len(change.removed) > 1 {
+		change.summary = fmt.Sprintf("Compose project %s torn down, updating the entries of %d containers at once", project, len(change.removed))
+		teardownCount.WithLabelValues(project).Inc()
+	}
+	dd.applyChange(change)
+	for _, exited := range kept {
+		dd.expireExited(exited, dd.keepExitedFor(exited.exitCode))
+	}
+	dd.mu.Unlock()
+
+	if len(change.removed) > 0 {
+		dd.writePrometheusTargets()
+	}
+}
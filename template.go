@@ -0,0 +1,65 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// templateFuncs are the functions of the domain templates besides the text/template ones
+var templateFuncs = template.FuncMap{
+	// default returns the value, or the fallback when it's empty, e.g. {{index .Config.Labels "env" | default "prod"}}
+	"default": func(fallback string, value interface{}) string {
+		if s := fmt.Sprint(value); value != nil && s != "" {
+			return s
+		}
+		return fallback
+	},
+	"lower":   strings.ToLower,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+// TemplateResolver sets names by evaluating a Go template over the inspected container, e.g.
+// {{.Name}}.{{index .Config.Labels "env"}}.docker.local, a comma separated list of names. The name of the container
+// is without the leading slash, and the missing labels are empty.
+type TemplateResolver struct {
+	text     string
+	template *template.Template
+}
+
+func newTemplateResolver(text string) (*TemplateResolver, error) {
+	tmpl, err := template.New("domain").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateResolver{text: text, template: tmpl}, nil
+}
+
+func (resolver TemplateResolver) resolve(container *dockerapi.Container) ([]string, error) {
+	var domains []string
+
+	data := *container
+	data.Name = normalizeContainerName(container)
+	var value strings.Builder
+	if err := resolver.template.Execute(&value, &data); err != nil {
+		return domains, fmt.Errorf("cannot evaluate the domain template of container %s: %s", container.ID[:12], err)
+	}
+
+	// a missing field leaves an empty label, the name is skipped rather than registered partially
+	var firstErr error
+	for _, name := range strings.Split(value.String(), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, ".") || strings.Contains(strings.TrimSuffix(name, "."), "..") {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("empty label in the name %q of the domain template of container %s", name, container.ID[:12])
+			}
+			continue
+		}
+		domains = append(domains, name)
+	}
+	return domains, firstErr
+}
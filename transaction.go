@@ -0,0 +1,96 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+)
+
+// containerChange is a diff of the container entries. Every update of the entries is computed as a change
+// first, then applied at once by applyChange. The backends publish the resulting record table on their own.
+type containerChange struct {
+	removed   []*ContainerInfo // the previous entry of an updated container included
+	added     []*ContainerInfo
+	dropStale []string // IDs of the stale entries to forget
+	keepStale bool     // keep the removed entries for serve_stale
+	summary   string   // logged instead of a line per entry, e.g. for the teardown of a compose project
+}
+
+func (change *containerChange) remove(containerInfo *ContainerInfo) {
+	if !change.removes(containerInfo.container.ID) {
+		change.removed = append(change.removed, containerInfo)
+	}
+}
+
+func (change *containerChange) removes(containerID string) bool {
+	for _, containerInfo := range change.removed {
+		if containerInfo.container.ID == containerID {
+			return true
+		}
+	}
+	return false
+}
+
+func (change *containerChange) adds(containerID string) bool {
+	for _, containerInfo := range change.added {
+		if containerInfo.container.ID == containerID {
+			return true
+		}
+	}
+	return false
+}
+
+// removedRecords returns the number of domains of the removed entries
+func (change *containerChange) removedRecords() int {
+	count := 0
+	for _, containerInfo := range change.removed {
+		count += len(containerInfo.domains)
+	}
+	return count
+}
+
+// applyChange applies the change to the entries and wakes the backends up. The memory is the source of
+// truth: the answers never wait for the backends, which catch up in the background. The caller must hold the lock.
+func (dd *DockerDiscovery) applyChange(change *containerChange) {
+	defer stageRegion(context.Background(), "store").End()
+	for _, containerInfo := range change.added {
+		containerInfo.etcdRecord = dd.etcdRecord(containerInfo)
+	}
+
+	dd.dropImported(change)
+	for _, id := range change.dropStale {
+		delete(dd.staleContainerInfoMap, id)
+	}
+	if change.summary != "" {
+		log.Printf("[docker] %s", change.summary)
+	}
+	for _, containerInfo := range change.removed {
+		if change.summary == "" && !change.adds(containerInfo.container.ID) {
+			log.Printf("[docker] Deleting entry %s (%s)", normalizeContainerName(containerInfo.container), containerInfo.container.ID[:12])
+		}
+		delete(dd.containerInfoMap, containerInfo.container.ID)
+		dd.unindexDomains(containerInfo)
+		dd.unindexAddresses(containerInfo)
+		if change.keepStale && !change.adds(containerInfo.container.ID) {
+			dd.keepStale(containerInfo)
+		}
+	}
+	for _, containerInfo := range change.added {
+		if change.summary == "" && !change.removes(containerInfo.container.ID) {
+			log.Printf("[docker] Add entry of container %s (%s). IP: %v", normalizeContainerName(containerInfo.container), containerInfo.container.ID[:12], containerInfo.addresses())
+		}
+		dd.containerInfoMap[containerInfo.container.ID] = containerInfo
+		dd.indexDomains(containerInfo)
+		dd.indexAddresses(containerInfo)
+	}
+	if len(change.removed) > 0 || len(change.added) > 0 {
+		dd.markZoneChanges(change)
+		dd.updateRecordMetrics()
+		dd.bumpVersion()
+	}
+}
+
+// updateRecordMetrics exports the number of containers and names registered. The caller must hold the lock.
+func (dd *DockerDiscovery) updateRecordMetrics() {
+	containerCount.WithLabelValues(dd.dockerEndpoint).Set(float64(len(dd.containerInfoMap)))
+	domainCount.WithLabelValues(dd.dockerEndpoint).Set(float64(len(dd.domainIndex)))
+}
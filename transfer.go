@@ -0,0 +1,93 @@
+package dockerdiscovery
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// zoneSerial returns the serial of the zones: the sum of the record table versions of the docker hosts of the
+// server block, so it increases with every change of any of them
+func (dd *DockerDiscovery) zoneSerial() uint32 {
+	peers := dd.peers
+	if len(peers) == 0 {
+		peers = []*DockerDiscovery{dd}
+	}
+	var serial uint64
+	for _, peer := range peers {
+		serial += peer.Version()
+	}
+	return uint32(serial)
+}
+
+// Transfer implements the transfer.Transferer interface, so the transfer plugin serves the AXFR and IXFR requests
+// of the server block zones to the secondary servers: the SOA record, the NS records, the record directives and the
+// A and AAAA records of the containers of every docker host, then the SOA record again. IXFR requests of a serial
+// at least the current one get the SOA record alone, the older ones the full zone.
+func (dd *DockerDiscovery) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if !dd.isApex(zone) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+	soa := dd.negativeSOA(zone)
+	soa.Header().Ttl = dd.ttl
+
+	ch := make(chan []dns.RR, 2)
+	if serial != 0 && serial >= soa.(*dns.SOA).Serial {
+		ch <- []dns.RR{soa}
+		close(ch)
+		return ch, nil
+	}
+	records := append([]dns.RR{soa}, dd.apexRecords(zone, dns.TypeNS)...)
+	records = append(records, dd.zoneRecordsOf(zone)...)
+	go func() {
+		ch <- records
+		ch <- []dns.RR{soa}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// zoneRecordsOf returns the records of the zone other than its SOA and NS records, sorted and without duplicates:
+// the record directives and the addresses of the containers of every docker host
+func (dd *DockerDiscovery) zoneRecordsOf(zone string) []dns.RR {
+	inZone := func(name string) bool { return plugin.Name(zone).Matches(strings.ToLower(name)) }
+	var records []dns.RR
+	for _, rr := range dd.staticRecords {
+		if inZone(rr.Header().Name) {
+			records = append(records, rr)
+		}
+	}
+	peers := dd.peers
+	if len(peers) == 0 {
+		peers = []*DockerDiscovery{dd}
+	}
+	for _, peer := range peers {
+		peer.mu.RLock()
+		for _, containerInfo := range peer.containerInfoMap {
+			for _, domain := range containerInfo.domains {
+				fqdn := dns.Fqdn(strings.ToLower(domain))
+				if !inZone(fqdn) {
+					continue
+				}
+				for _, rr := range containerGlue(fqdn, containerInfo) {
+					rr.Header().Ttl = containerInfo.ttl
+					records = append(records, rr)
+				}
+			}
+		}
+		peer.mu.RUnlock()
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].String() < records[j].String() })
+	unique := records[:0]
+	for i, rr := range records {
+		if i == 0 || !dns.IsDuplicate(rr, records[i-1]) {
+			unique = append(unique, rr)
+		}
+	}
+	return unique
+}
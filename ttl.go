@@ -0,0 +1,93 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// adjustTTLs applies the lame duck and jitter policies to the TTLs of the records sent to a client. The records of
+// an RR set get the same jitter, so they keep sharing their TTL.
+func (dd *DockerDiscovery) adjustTTLs(records []dns.RR) {
+	jittered := make(map[rrsetKey]uint32)
+	for _, rr := range records {
+		if atomic.LoadInt32(&dd.draining) == 1 {
+			// clients must not cache records of a server going away
+			rr.Header().Ttl = 0
+			continue
+		}
+		key := rrsetOf(rr)
+		ttl, ok := jittered[key]
+		if !ok {
+			ttl = jitter(rr.Header().Ttl, dd.ttlJitter)
+			jittered[key] = ttl
+		}
+		rr.Header().Ttl = ttl
+	}
+}
+
+// jitter spreads the TTL randomly by ±percent, so that clients which cached the records at the same time
+// don't expire them all at the same instant.
+func jitter(ttl uint32, percent int) uint32 {
+	delta := int64(ttl) * int64(percent) / 100
+	if delta == 0 {
+		return ttl
+	}
+	return uint32(int64(ttl) - delta + rand.Int63n(2*delta+1))
+}
+
+// ttlLabel sets the TTL of the answers and etcd record of a container, instead of the ttl directive
+const ttlLabel = "coredns.dockerdiscovery.ttl"
+
+// labelTTL returns the TTL of the container, from the ttl label, otherwise from the restart_policy directive of its
+// restart policy
+func (dd *DockerDiscovery) labelTTL(container *dockerapi.Container) uint32 {
+	value, ok := container.Config.Labels[ttlLabel]
+	if !ok {
+		if policy, ok := dd.restartPolicies[restartPolicyName(container)]; ok {
+			return policy.ttl
+		}
+		return dd.ttl
+	}
+	ttl, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		log.Printf("[docker] Invalid TTL %q of container %s, using %d", value, container.ID[:12], dd.ttl)
+		return dd.ttl
+	}
+	return uint32(ttl)
+}
+
+// defaultTTLRampMin is the TTL of the containers which just started, with ttl_ramp
+const defaultTTLRampMin = 5
+
+// containerTTL returns the TTL of the container answers. With ttl_ramp it grows linearly with the uptime of the
+// container, from the ramp minimum to the full TTL, so the clients re-query the containers churning during a
+// deploy sooner, while the stable ones keep the cache efficiency of the full TTL.
+func (dd *DockerDiscovery) containerTTL(containerInfo *ContainerInfo) uint32 {
+	ttl := containerInfo.ttl
+	if dd.ttlRamp == 0 || ttl <= dd.ttlRampMin {
+		return ttl
+	}
+	uptime := time.Since(containerInfo.started())
+	if uptime >= dd.ttlRamp {
+		return ttl
+	}
+	if uptime < 0 {
+		uptime = 0
+	}
+	return dd.ttlRampMin + uint32(int64(ttl-dd.ttlRampMin)*int64(uptime)/int64(dd.ttlRamp))
+}
+
+// started returns when the container started, when it was registered if docker doesn't tell
+func (containerInfo *ContainerInfo) started() time.Time {
+	if state := containerInfo.container.State; !state.StartedAt.IsZero() {
+		return state.StartedAt
+	}
+	return containerInfo.added
+}
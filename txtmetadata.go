@@ -0,0 +1,44 @@
+package dockerdiscovery
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// maxTXTString is the length limit of a character string of a TXT record
+const maxTXTString = 255
+
+// metadataRecords answers the TXT queries of the container names with the metadata of the containers, one record
+// per container: its short ID, image, compose project and service, and the labels of the txt_metadata allow-list
+// as key=value strings, longer strings cut. The caller must hold the lock.
+func (dd *DockerDiscovery) metadataRecords(name string, owners []*ContainerInfo) []dns.RR {
+	var answers []dns.RR
+	for _, containerInfo := range owners {
+		container := containerInfo.container
+		txt := []string{"id=" + container.ID[:12], "image=" + container.Config.Image}
+		for _, key := range []string{"project", "service"} {
+			if value := container.Config.Labels["com.docker.compose."+key]; value != "" {
+				txt = append(txt, key+"="+value)
+			}
+		}
+		var labels []string
+		for label, value := range container.Config.Labels {
+			if matchAny(dd.metadataLabels, label) {
+				labels = append(labels, label+"="+value)
+			}
+		}
+		sort.Strings(labels)
+		txt = append(txt, labels...)
+		for i, s := range txt {
+			if len(s) > maxTXTString {
+				txt[i] = s[:maxTXTString]
+			}
+		}
+		answers = append(answers, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dd.containerTTL(containerInfo)},
+			Txt: txt,
+		})
+	}
+	return answers
+}
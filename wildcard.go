@@ -0,0 +1,56 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// wildcardLabel gives a container wildcard names, comma separated, e.g. *.app.loc, so any subdomain resolves to it,
+// as needed by the reverse proxies of virtual hosts. "true" gives it the wildcard of each of its domains.
+const wildcardLabel = "coredns.dockerdiscovery.wildcard"
+
+// wildcardDomains returns the wildcard names of the container (lower case, with trailing dot): those of the wildcard
+// label, or the wildcard of each of its domains with the wildcards directive unless the label is "false"
+func (dd *DockerDiscovery) wildcardDomains(container *dockerapi.Container, domains []string) []string {
+	value := strings.TrimSpace(container.Config.Labels[wildcardLabel])
+	var patterns []string
+	switch {
+	case strings.EqualFold(value, "false"), value == "" && !dd.wildcards:
+		return nil
+	case value == "", strings.EqualFold(value, "true"):
+		for _, domain := range domains {
+			patterns = append(patterns, "*."+domain)
+		}
+	default:
+		patterns = strings.Split(value, ",")
+	}
+
+	var wildcards []string
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+		if pattern == "" {
+			continue
+		}
+		if !strings.HasPrefix(pattern, "*.") || !validDomain(strings.TrimPrefix(pattern, "*."), dd.strictNames) {
+			log.Printf("[docker] Ignoring invalid wildcard %q of container %s", pattern, container.ID[:12])
+			continue
+		}
+		wildcards = append(wildcards, pattern+".")
+	}
+	return uniqueDomains(wildcards)
+}
+
+// wildcardOwners returns the containers of the closest wildcard name covering the name, e.g. *.app.loc. for
+// a.b.app.loc., nil when none does. The caller must hold the lock.
+func (dd *DockerDiscovery) wildcardOwners(name string) []*ContainerInfo {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := 1; i < len(labels); i++ {
+		if owners := dd.domainIndex["*."+strings.Join(labels[i:], ".")+"."]; len(owners) > 0 {
+			return owners
+		}
+	}
+	return nil
+}
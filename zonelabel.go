@@ -0,0 +1,52 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// zoneLabel chooses the server block zone the domains of a container land in, e.g. staging.loc, so one instance
+// feeds the zones of several environments
+const zoneLabel = "coredns.dockerdiscovery.zone"
+
+// labelZone returns the server block zone of the zone label of the container (lower case, with trailing dot),
+// empty without label or when the label names no zone of the server block
+func (dd *DockerDiscovery) labelZone(container *dockerapi.Container) string {
+	value := strings.TrimSpace(container.Config.Labels[zoneLabel])
+	if value == "" {
+		return ""
+	}
+	zone := dns.Fqdn(strings.ToLower(value))
+	for _, z := range dd.zones {
+		if z != "." && strings.ToLower(z) == zone {
+			return zone
+		}
+	}
+	log.Printf("[docker] Ignoring the zone %q of container %s, not a zone of the server block", value, container.ID[:12])
+	return ""
+}
+
+// zoneDomains places the domains of the container in the server block zones: the domains found in one of the zones
+// are moved to the zone of the zone label, or registered under all the zones without label. The domains outside
+// of the zones are kept as they are.
+func (dd *DockerDiscovery) zoneDomains(container *dockerapi.Container, domains []string) []string {
+	target := dd.labelZone(container)
+	if target == "" {
+		return dd.expandZones(domains)
+	}
+	var routed []string
+	for _, domain := range domains {
+		fqdn := dns.Fqdn(strings.ToLower(domain))
+		zone := plugin.Zones(dd.zones).Matches(fqdn)
+		if zone == "" || zone == "." {
+			routed = append(routed, domain)
+			continue
+		}
+		routed = append(routed, strings.TrimSuffix(strings.TrimSuffix(fqdn, zone)+target, "."))
+	}
+	return routed
+}
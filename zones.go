@@ -0,0 +1,127 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// probedTypes are the types the negative answers look for records of, to tell an existing name (NODATA) from a
+// missing one (NXDOMAIN)
+var probedTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeTXT, dns.TypePTR, dns.TypeSOA, dns.TypeNS}
+
+// unanswered handles the query the plugin has no records for: passed to the next plugin when outside of the zones
+// of the server block or in the root zone (a server block without zones, e.g. followed by forward), or when a docker
+// host follows in the chain, and for the names without records listed by fallthrough; otherwise answered with an
+// authoritative NXDOMAIN, or NODATA for the existing names (e.g. the types not answered, HINFO or MX of a container),
+// and the SOA record of the zone, like the hosts and etcd plugins.
+func (dd *DockerDiscovery) unanswered(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request) (int, error) {
+	qname := state.Name()
+	zone := plugin.Zones(dd.zones).Matches(qname)
+	if _, chained := dd.Next.(*DockerDiscovery); chained || zone == "" || zone == "." {
+		return dd.passToNext(ctx, w, r)
+	}
+	client := net.ParseIP(state.IP())
+	if dd.fall.Through(qname) && !dd.hasRecords(qname, client) {
+		return dd.passToNext(ctx, w, r)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, dd.compress
+	result := "nodata"
+	if !dd.nameExists(qname, client) {
+		m.Rcode = dns.RcodeNameError
+		result = "nxdomain"
+	}
+	m.Ns = []dns.RR{dd.negativeSOA(strings.ToLower(zone))}
+	dd.adjustTTLs(m.Ns)
+
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	queryCount.WithLabelValues(metrics.WithServer(ctx), result).Inc()
+	if err := w.WriteMsg(m); err != nil {
+		log.Printf("[docker] Error: %s", err.Error())
+	}
+	if dd.queryLog != nil {
+		dd.logQuery(state, m)
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// nameExists reports whether a docker host of the chain has records of any type for the name, or names below it
+// (an empty non-terminal, e.g. docker.loc for app.docker.loc).
+func (dd *DockerDiscovery) nameExists(qname string, client net.IP) bool {
+	peers := dd.peers
+	if len(peers) == 0 {
+		peers = []*DockerDiscovery{dd}
+	}
+	for _, peer := range peers {
+		if peer.hasNamesBelow(qname) || peer.hasRecords(qname, client) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRecords reports whether the docker host has records of one of the probed types for the name
+func (dd *DockerDiscovery) hasRecords(qname string, client net.IP) bool {
+	for _, qtype := range probedTypes {
+		if answers, _ := dd.records(qname, qtype, client); len(answers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNamesBelow reports whether containers are registered under the name
+func (dd *DockerDiscovery) hasNamesBelow(qname string) bool {
+	suffix := "." + strings.ToLower(dns.Fqdn(qname))
+	if suffix == ".." {
+		return true
+	}
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+	for domain := range dd.domainIndex {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	for name := range dd.swarmNames {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// negativeSOA returns the SOA record of the zone for the authority section of the negative answers, as set by the
+// soa directive or synthesized like the other CoreDNS plugins, with the minimum TTL as TTL (RFC 2308)
+func (dd *DockerDiscovery) negativeSOA(zone string) dns.RR {
+	soa := dd.soa
+	if soa == nil {
+		soa = &soaConfig{mname: dnsutil.Join("ns.dns", zone), rname: dnsutil.Join("hostmaster", zone)}
+		soa.refresh, soa.retry, soa.expire, soa.minttl = defaultSOATimers[0], defaultSOATimers[1], defaultSOATimers[2], defaultSOATimers[3]
+	}
+	ttl := soa.minttl
+	if dd.ttl < ttl {
+		ttl = dd.ttl
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      soa.mname,
+		Mbox:    soa.rname,
+		Serial:  dd.zoneSerial(),
+		Refresh: soa.refresh,
+		Retry:   soa.retry,
+		Expire:  soa.expire,
+		Minttl:  soa.minttl,
+	}
+}